@@ -0,0 +1,269 @@
+// Package audit writes an append-only, hash-chained log of file and peer
+// operations. Each entry is one JSON line whose hash covers the previous
+// entry's hash, so editing, removing or reordering entries breaks the chain
+// and is caught by Verify.
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Outcomes recorded with each event.
+const (
+	OutcomeOK     = "ok"
+	OutcomeDenied = "denied"
+	OutcomeError  = "error"
+)
+
+// Event describes one audited operation.
+type Event struct {
+	Type     string // e.g. "register", "file_request", "store_file"
+	PeerID   string // remote peer the operation was performed for, if any
+	Remote   string // remote network address, if any
+	Filename string
+	Bytes    int64
+	Outcome  string // defaults to OutcomeError if Err is set, OutcomeOK otherwise
+	Detail   string // context; defaults to Err's text
+	Err      error
+}
+
+// Entry is an Event as written to the log.
+type Entry struct {
+	Seq      uint64    `json:"seq"`
+	Time     time.Time `json:"time"`
+	Node     string    `json:"node,omitempty"`
+	Type     string    `json:"type"`
+	PeerID   string    `json:"peer_id,omitempty"`
+	Remote   string    `json:"remote,omitempty"`
+	Filename string    `json:"filename,omitempty"`
+	Bytes    int64     `json:"bytes,omitempty"`
+	Outcome  string    `json:"outcome"`
+	Detail   string    `json:"detail,omitempty"`
+	PrevHash string    `json:"prev_hash"`
+	Hash     string    `json:"hash"`
+}
+
+// Logger appends entries to an audit log file.
+type Logger struct {
+	mutex    sync.Mutex
+	file     *os.File
+	node     string
+	seq      uint64
+	lastHash string
+}
+
+// Open opens (or creates) the audit log at path and continues its chain.
+// node identifies the process writing the log and is stored in every entry.
+func Open(path, node string) (*Logger, error) {
+	last, err := lastEntry(path)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	l := &Logger{file: file, node: node}
+	if last != nil {
+		l.seq = last.Seq
+		l.lastHash = last.Hash
+	}
+	return l, nil
+}
+
+// Record appends an event to the log.
+func (l *Logger) Record(ev Event) error {
+	if ev.Err != nil {
+		if ev.Outcome == "" {
+			ev.Outcome = OutcomeError
+		}
+		if ev.Detail == "" {
+			ev.Detail = ev.Err.Error()
+		}
+	}
+	if ev.Outcome == "" {
+		ev.Outcome = OutcomeOK
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	entry := Entry{
+		Seq:      l.seq + 1,
+		Time:     time.Now().UTC(),
+		Node:     l.node,
+		Type:     ev.Type,
+		PeerID:   ev.PeerID,
+		Remote:   ev.Remote,
+		Filename: ev.Filename,
+		Bytes:    ev.Bytes,
+		Outcome:  ev.Outcome,
+		Detail:   ev.Detail,
+		PrevHash: l.lastHash,
+	}
+	hash, err := entryHash(entry)
+	if err != nil {
+		return err
+	}
+	entry.Hash = hash
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit entry: %w", err)
+	}
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write audit entry: %w", err)
+	}
+	l.seq = entry.Seq
+	l.lastHash = entry.Hash
+	return nil
+}
+
+// Close closes the log file.
+func (l *Logger) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.file.Close()
+}
+
+// entryHash returns SHA-256 over the entry encoded with an empty Hash field.
+// PrevHash is part of the encoding, which is what links the chain.
+func entryHash(entry Entry) (string, error) {
+	entry.Hash = ""
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode audit entry: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// ChainError reports the first entry at which an audit log fails verification.
+type ChainError struct {
+	Line   int
+	Reason string
+}
+
+func (e *ChainError) Error() string {
+	return fmt.Sprintf("audit log broken at line %d: %s", e.Line, e.Reason)
+}
+
+// Verify checks every entry of the audit log at path: each must hash to its
+// recorded hash, point at the previous entry's hash and carry the next
+// sequence number. It returns the number of valid entries; on failure the
+// error is a *ChainError naming the first bad line.
+func Verify(path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	defer file.Close()
+
+	count := 0
+	prevHash := ""
+	err = scanEntries(file, func(line int, entry Entry, parseErr error) error {
+		if parseErr != nil {
+			return &ChainError{Line: line, Reason: parseErr.Error()}
+		}
+		if entry.Seq != uint64(count)+1 {
+			return &ChainError{Line: line, Reason: fmt.Sprintf("sequence %d, expected %d", entry.Seq, count+1)}
+		}
+		if entry.PrevHash != prevHash {
+			return &ChainError{Line: line, Reason: "previous hash does not match the preceding entry"}
+		}
+		hash, err := entryHash(entry)
+		if err != nil {
+			return &ChainError{Line: line, Reason: err.Error()}
+		}
+		if hash != entry.Hash {
+			return &ChainError{Line: line, Reason: "entry hash does not match its contents"}
+		}
+		prevHash = entry.Hash
+		count++
+		return nil
+	})
+	return count, err
+}
+
+// lastEntry returns the final entry of an existing log, or nil if there is none.
+func lastEntry(path string) (*Entry, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	defer file.Close()
+
+	var last *Entry
+	err = scanEntries(file, func(line int, entry Entry, parseErr error) error {
+		if parseErr != nil {
+			return fmt.Errorf("audit log line %d: %w", line, parseErr)
+		}
+		last = &entry
+		return nil
+	})
+	return last, err
+}
+
+// scanEntries calls fn for every non-empty line of an audit log.
+func scanEntries(r io.Reader, fn func(line int, entry Entry, parseErr error) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+		var entry Entry
+		err := json.Unmarshal(data, &entry)
+		if err := fn(line, entry, err); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// defaultLogger receives events passed to the package-level Record.
+var (
+	defaultMutex  sync.RWMutex
+	defaultLogger *Logger
+)
+
+// Init opens the audit log at path and makes it the destination of Record.
+func Init(path, node string) error {
+	l, err := Open(path, node)
+	if err != nil {
+		return err
+	}
+	defaultMutex.Lock()
+	defaultLogger = l
+	defaultMutex.Unlock()
+	return nil
+}
+
+// Record appends an event to the log opened by Init. Without Init it does nothing,
+// so library code can record events unconditionally.
+func Record(ev Event) {
+	defaultMutex.RLock()
+	l := defaultLogger
+	defaultMutex.RUnlock()
+	if l == nil {
+		return
+	}
+	if err := l.Record(ev); err != nil {
+		log.Printf("[WARN] Audit log write failed: %v", err)
+	}
+}
@@ -0,0 +1,118 @@
+package audit
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeLog(t *testing.T, path string, events ...Event) {
+	t.Helper()
+	l, err := Open(path, "node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	for _, ev := range events {
+		if err := l.Record(ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRecordAndVerify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	writeLog(t, path,
+		Event{Type: "register", PeerID: "alice"},
+		Event{Type: "file_request", Filename: "a.txt", Bytes: 10},
+	)
+	// Reopening continues the chain.
+	writeLog(t, path, Event{Type: "store_file", Err: errors.New("disk full")})
+
+	n, err := Verify(path)
+	if err != nil || n != 3 {
+		t.Fatalf("Verify = %d, %v; want 3 entries", n, err)
+	}
+
+	var entries []Entry
+	file, _ := os.Open(path)
+	defer file.Close()
+	scanEntries(file, func(line int, entry Entry, parseErr error) error {
+		entries = append(entries, entry)
+		return parseErr
+	})
+	if got := entries[2]; got.Outcome != OutcomeError || got.Detail != "disk full" || got.Seq != 3 || got.PrevHash != entries[1].Hash {
+		t.Errorf("third entry = %+v", got)
+	}
+	if entries[0].Outcome != OutcomeOK || entries[0].Node != "node" {
+		t.Errorf("first entry = %+v", entries[0])
+	}
+}
+
+func TestVerifyDetectsTampering(t *testing.T) {
+	tests := []struct {
+		name     string
+		tamper   func(lines [][]byte) [][]byte
+		wantLine int
+	}{
+		{"edited entry", func(lines [][]byte) [][]byte {
+			lines[1] = bytes.Replace(lines[1], []byte(`"bytes":10`), []byte(`"bytes":11`), 1)
+			return lines
+		}, 2},
+		{"removed entry", func(lines [][]byte) [][]byte {
+			return append(lines[:1], lines[2:]...)
+		}, 2},
+		{"reordered entries", func(lines [][]byte) [][]byte {
+			lines[1], lines[2] = lines[2], lines[1]
+			return lines
+		}, 2},
+		{"garbage line", func(lines [][]byte) [][]byte {
+			return append(lines, []byte("{not json"))
+		}, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "audit.log")
+			writeLog(t, path,
+				Event{Type: "register"},
+				Event{Type: "file_request", Bytes: 10},
+				Event{Type: "heartbeat"},
+			)
+			data, _ := os.ReadFile(path)
+			lines := bytes.Split(bytes.TrimSpace(data), []byte("\n"))
+			os.WriteFile(path, append(bytes.Join(tt.tamper(lines), []byte("\n")), '\n'), 0644)
+
+			_, err := Verify(path)
+			var chainErr *ChainError
+			if !errors.As(err, &chainErr) {
+				t.Fatalf("Verify = %v, want a ChainError", err)
+			}
+			if chainErr.Line != tt.wantLine {
+				t.Errorf("broken at line %d, want %d", chainErr.Line, tt.wantLine)
+			}
+		})
+	}
+}
+
+// Two processes appending to one file keep separate chains that interleave,
+// which is why every node defaults to its own log.
+func TestSharedLogBreaksChain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	a, err := Open(path, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := Open(path, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	a.Record(Event{Type: "register"})
+	b.Record(Event{Type: "register"})
+	if _, err := Verify(path); err == nil {
+		t.Fatal("Verify accepted interleaved chains")
+	}
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net"
@@ -11,13 +13,20 @@ import (
 	"sync"
 	"syscall"
 	"time"
+
+	"FDS/audit"
+	"FDS/crypto"
 )
 
 // PeerInfo stores details of each peer.
+// LastSeen is the time of the peer's last registration or heartbeat.
+// SeenAgo is only set in get_peers replies: how long before the reply
+// LastSeen was, which peers can trust whatever their clocks say.
 type PeerInfo struct {
-	ID       string
-	Addr     string
-	LastSeen time.Time
+	ID       string        `json:"id"`
+	Addr     string        `json:"addr"`
+	LastSeen time.Time     `json:"last_seen"`
+	SeenAgo  time.Duration `json:"seen_ago"`
 }
 
 // BootstrapServer manages peer registrations.
@@ -26,6 +35,7 @@ type BootstrapServer struct {
 	mutex    sync.RWMutex
 	listener net.Listener
 	done     chan struct{}
+	tls      *crypto.TLSIdentity // nil for plaintext TCP
 }
 
 func NewBootstrapServer() *BootstrapServer {
@@ -41,6 +51,9 @@ func (bs *BootstrapServer) Start(port string) error {
 	if err != nil {
 		return fmt.Errorf("failed to start bootstrap server: %w", err)
 	}
+	if bs.tls != nil {
+		bs.listener = tls.NewListener(bs.listener, bs.tls.ServerConfig())
+	}
 
 	go bs.handleSignals()
 	go bs.cleanupInactivePeers()
@@ -81,31 +94,63 @@ func (bs *BootstrapServer) handleConnection(conn net.Conn) {
 		return
 	}
 
-	bs.mutex.Lock()
-	defer bs.mutex.Unlock()
+	// Over mutual TLS a peer may only act under the ID its certificate was issued to.
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if certID := crypto.PeerIDFromConnState(tlsConn.ConnectionState()); certID != msg.ID {
+			log.Printf("Rejected %s from %s: certificate is for %q", msg.Type, msg.ID, certID)
+			audit.Record(audit.Event{
+				Type:    msg.Type,
+				PeerID:  msg.ID,
+				Remote:  conn.RemoteAddr().String(),
+				Outcome: audit.OutcomeDenied,
+				Detail:  fmt.Sprintf("certificate is for %q", certID),
+			})
+			encoder.Encode(map[string]string{"status": "error", "error": "peer ID does not match certificate"})
+			return
+		}
+	}
+
+	// The mutex only guards the peer table; replies and the audit log are written without it.
+	event := audit.Event{Type: msg.Type, PeerID: msg.ID, Remote: conn.RemoteAddr().String()}
+	defer func() { audit.Record(event) }()
 
 	switch msg.Type {
 	case "register":
+		bs.mutex.Lock()
 		bs.peers[msg.ID] = PeerInfo{ID: msg.ID, Addr: msg.Addr, LastSeen: time.Now()}
+		bs.mutex.Unlock()
 		log.Printf("Registered peer: %s (%s)", msg.ID, msg.Addr)
+		event.Detail = msg.Addr
 		encoder.Encode(map[string]string{"status": "ok"})
 
 	case "get_peers":
 		var peers []PeerInfo
+		bs.mutex.RLock()
+		now := time.Now()
 		for _, peer := range bs.peers {
 			if peer.ID != msg.ID {
+				peer.SeenAgo = now.Sub(peer.LastSeen)
 				peers = append(peers, peer)
 			}
 		}
+		bs.mutex.RUnlock()
+		event.Detail = fmt.Sprintf("%d peers", len(peers))
 		encoder.Encode(peers)
 
 	case "heartbeat":
-		if peer, exists := bs.peers[msg.ID]; exists {
+		bs.mutex.Lock()
+		peer, exists := bs.peers[msg.ID]
+		if exists {
 			peer.LastSeen = time.Now()
 			bs.peers[msg.ID] = peer
 		}
+		bs.mutex.Unlock()
+		if !exists {
+			event.Err = errors.New("unknown peer")
+		}
 
 	default:
+		event.Err = errors.New("unknown request")
 		encoder.Encode(map[string]string{"status": "error", "error": "unknown request"})
 	}
 }
@@ -137,8 +182,30 @@ func (bs *BootstrapServer) cleanupInactivePeers() {
 }
 
 func main() {
+	port := flag.String("port", "9999", "Port to listen on")
+	certFile := flag.String("tls-cert", "", "Certificate for mutual TLS (enables TLS)")
+	keyFile := flag.String("tls-key", "", "Private key for the TLS certificate")
+	trustDir := flag.String("trust-dir", "", "Directory of trusted peer or CA certificates")
+	auditLog := flag.String("audit-log", "audit-bootstrap.log", "Hash-chained audit log of peer operations")
+	flag.Parse()
+
+	if err := audit.Init(*auditLog, "bootstrap"); err != nil {
+		log.Fatal(err)
+	}
+
 	server := NewBootstrapServer()
-	if err := server.Start("9999"); err != nil {
+	if *certFile != "" {
+		if *keyFile == "" || *trustDir == "" {
+			log.Fatal("-tls-cert requires -tls-key and -trust-dir")
+		}
+		identity, err := crypto.LoadTLSIdentity(*certFile, *keyFile, *trustDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		server.tls = identity
+		log.Printf("Mutual TLS enabled as %s", identity.PeerID)
+	}
+	if err := server.Start(*port); err != nil {
 		log.Fatal(err)
 	}
 }
\ No newline at end of file
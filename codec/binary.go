@@ -0,0 +1,190 @@
+package codec
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// A binary frame is a fixed 7-byte header followed by optional metadata and the payload:
+//
+//	+------+-----------+-------------+--------------------+---------+
+//	| type | meta len  | payload len | metadata           | payload |
+//	| u8   | u16 (BE)  | u32 (BE)    | JSON (other fields)| raw     |
+//	+------+-----------+-------------+--------------------+---------+
+//
+// The payload carries Message.Content unencoded, so a file chunk costs seven
+// bytes of overhead instead of a base64-encoded JSON object.
+const headerSize = 7
+
+// MaxPayloadSize bounds the payload of a single frame so a corrupt or hostile
+// header cannot make the reader allocate arbitrary amounts of memory.
+const MaxPayloadSize = 16 << 20
+
+const bufferSize = 64 * 1024
+
+// frameTypes assigns each message type its on-wire type byte. Zero is reserved.
+var frameTypes = map[string]byte{
+	"message":         1,
+	"request_file":    2,
+	"send_file_chunk": 3,
+	"end_of_file":     4,
+	"error":           5,
+	"file_info":       6,
+	"stat_file":       7,
+	"list_files":      8,
+	"file_list":       9,
+	"search":          10,
+	"get_chunk":       11,
+	"chunk_data":      12,
+	"get_manifest":    13,
+	"manifest":        14,
+	"put_chunk":       15,
+	"chunk_stored":    16,
+	"put_file":        17,
+	"put_ready":       18,
+	"file_stored":     19,
+	"watch_folder":    20,
+	"file_changed":    21,
+	"list_versions":   22,
+	"version_list":    23,
+	"request_dir":     24,
+	"dir_entry":       25,
+	"end_of_dir":      26,
+	"file_list_part":  27,
+}
+
+var messageTypes = func() map[byte]string {
+	m := make(map[byte]string, len(frameTypes))
+	for name, code := range frameTypes {
+		m[code] = name
+	}
+	return m
+}()
+
+// ErrFrameTooLarge is returned when a frame's payload exceeds MaxPayloadSize.
+var ErrFrameTooLarge = errors.New("frame payload too large")
+
+type binaryCodec struct {
+	reader *bufio.Reader
+	writer *bufio.Writer
+	header [headerSize]byte
+}
+
+// NewBinaryCodec returns a codec that exchanges length-prefixed binary frames.
+func NewBinaryCodec(r io.Reader, w io.Writer) Codec {
+	return &binaryCodec{
+		reader: bufio.NewReaderSize(r, bufferSize),
+		writer: bufio.NewWriterSize(w, bufferSize),
+	}
+}
+
+func (c *binaryCodec) WriteMessage(msg Message) error {
+	frame, err := encodeHeader(msg)
+	if err != nil {
+		return err
+	}
+	if _, err := c.writer.Write(frame); err != nil {
+		return err
+	}
+	_, err = c.writer.Write(msg.Content)
+	return err
+}
+
+func (c *binaryCodec) ReadMessage() (Message, error) {
+	if _, err := io.ReadFull(c.reader, c.header[:]); err != nil {
+		return Message{}, err
+	}
+	msg, metaLen, payloadLen, err := decodeHeader(c.header[:])
+	if err != nil {
+		return Message{}, err
+	}
+
+	body := make([]byte, metaLen+payloadLen)
+	if _, err := io.ReadFull(c.reader, body); err != nil {
+		return Message{}, unexpectedEOF(err)
+	}
+	if err := decodeMetadata(&msg, body[:metaLen]); err != nil {
+		return Message{}, err
+	}
+	if payloadLen > 0 {
+		msg.Content = body[metaLen:]
+	}
+	return msg, nil
+}
+
+func (c *binaryCodec) Flush() error {
+	return c.writer.Flush()
+}
+
+// encodeHeader returns the frame header and metadata for msg; the payload is written separately.
+func encodeHeader(msg Message) ([]byte, error) {
+	code, ok := frameTypes[msg.Type]
+	if !ok {
+		return nil, fmt.Errorf("no frame type for message type %q", msg.Type)
+	}
+	if len(msg.Content) > MaxPayloadSize {
+		return nil, ErrFrameTooLarge
+	}
+
+	// Everything except the type and the payload travels as JSON metadata.
+	// Most chunk frames have none, so the "{}" of an empty message is dropped.
+	rest := msg
+	rest.Type = ""
+	rest.Content = nil
+	meta, err := json.Marshal(rest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode frame metadata: %w", err)
+	}
+	if string(meta) == "{}" {
+		meta = nil
+	}
+	if len(meta) > 0xFFFF {
+		return nil, fmt.Errorf("frame metadata too large: %d bytes", len(meta))
+	}
+
+	frame := make([]byte, headerSize+len(meta))
+	frame[0] = code
+	binary.BigEndian.PutUint16(frame[1:3], uint16(len(meta)))
+	binary.BigEndian.PutUint32(frame[3:7], uint32(len(msg.Content)))
+	copy(frame[headerSize:], meta)
+	return frame, nil
+}
+
+// decodeHeader parses a frame header, returning the typed message shell and the lengths that follow.
+func decodeHeader(header []byte) (Message, int, int, error) {
+	name, ok := messageTypes[header[0]]
+	if !ok {
+		return Message{}, 0, 0, fmt.Errorf("unknown frame type %d", header[0])
+	}
+	metaLen := int(binary.BigEndian.Uint16(header[1:3]))
+	payloadLen := binary.BigEndian.Uint32(header[3:7])
+	if payloadLen > MaxPayloadSize {
+		return Message{}, 0, 0, ErrFrameTooLarge
+	}
+	return Message{Type: name}, metaLen, int(payloadLen), nil
+}
+
+func decodeMetadata(msg *Message, meta []byte) error {
+	if len(meta) == 0 {
+		return nil
+	}
+	typ := msg.Type
+	if err := json.Unmarshal(meta, msg); err != nil {
+		return fmt.Errorf("failed to decode frame metadata: %w", err)
+	}
+	// The type byte is authoritative; metadata must not smuggle in another type or a payload.
+	msg.Type = typ
+	msg.Content = nil
+	return nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
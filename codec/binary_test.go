@@ -0,0 +1,245 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"reflect"
+	"sort"
+	"testing"
+	"unicode/utf8"
+)
+
+// frameTypeNames lists the message types in type byte order, so fuzz inputs can pick one by index.
+var frameTypeNames = func() []string {
+	names := make([]string, 0, len(frameTypes))
+	for name := range frameTypes {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return frameTypes[names[i]] < frameTypes[names[j]] })
+	return names
+}()
+
+func roundTrip(t *testing.T, msgs ...Message) []Message {
+	t.Helper()
+	var buf bytes.Buffer
+	c := NewBinaryCodec(&buf, &buf)
+	for _, msg := range msgs {
+		if err := c.WriteMessage(msg); err != nil {
+			t.Fatalf("WriteMessage(%+v): %v", msg, err)
+		}
+	}
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	var got []Message
+	for range msgs {
+		msg, err := c.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %v", err)
+		}
+		got = append(got, msg)
+	}
+	if _, err := c.ReadMessage(); err != io.EOF {
+		t.Fatalf("ReadMessage after last frame: got %v, want io.EOF", err)
+	}
+	return got
+}
+
+func TestBinaryRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  Message
+	}{
+		{"chunk without metadata", Message{Type: "send_file_chunk", Content: []byte("data")}},
+		{"chunk with hash", Message{Type: "send_file_chunk", Content: []byte{0, 1, 2, 0xff}, Hash: "abc"}},
+		{"empty request", Message{Type: "list_files"}},
+		{"every field", Message{Type: "file_info", Filename: "docs/a.txt", Hash: "h", Size: 1 << 40, ModTime: -5, Offset: 7, Length: 9, Code: "not_found", Mode: 0750}},
+		{"error with text", Message{Type: "error", Filename: "x", Content: []byte("File not found"), Code: "not_found"}},
+		{"largest payload", Message{Type: "chunk_data", Content: make([]byte, MaxPayloadSize)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := roundTrip(t, tt.msg)
+			if !reflect.DeepEqual(got[0], tt.msg) {
+				t.Errorf("got %+v, want %+v", got[0], tt.msg)
+			}
+		})
+	}
+}
+
+func TestBinaryRoundTripAllTypes(t *testing.T) {
+	var msgs []Message
+	for _, name := range frameTypeNames {
+		msgs = append(msgs, Message{Type: name, Filename: name})
+	}
+	got := roundTrip(t, msgs...)
+	if !reflect.DeepEqual(got, msgs) {
+		t.Errorf("got %+v, want %+v", got, msgs)
+	}
+}
+
+func TestWriteMessageRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  Message
+	}{
+		{"unknown type", Message{Type: "no_such_type"}},
+		{"empty type", Message{}},
+		{"payload too large", Message{Type: "chunk_data", Content: make([]byte, MaxPayloadSize+1)}},
+		{"metadata too large", Message{Type: "message", Filename: string(bytes.Repeat([]byte("a"), 0x10000))}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			c := NewBinaryCodec(&buf, &buf)
+			if err := c.WriteMessage(tt.msg); err == nil {
+				t.Fatal("WriteMessage succeeded")
+			}
+			c.Flush()
+			if buf.Len() != 0 {
+				t.Errorf("a rejected message wrote %d bytes", buf.Len())
+			}
+		})
+	}
+}
+
+func frame(code byte, meta string, payload []byte) []byte {
+	header := make([]byte, headerSize)
+	header[0] = code
+	binary.BigEndian.PutUint16(header[1:3], uint16(len(meta)))
+	binary.BigEndian.PutUint32(header[3:7], uint32(len(payload)))
+	return append(append(header, meta...), payload...)
+}
+
+func TestReadMessage(t *testing.T) {
+	oversized := make([]byte, headerSize)
+	oversized[0] = frameTypes["chunk_data"]
+	binary.BigEndian.PutUint32(oversized[3:7], MaxPayloadSize+1)
+
+	tests := []struct {
+		name    string
+		input   []byte
+		want    Message
+		wantErr error // nil with wantFail means any error
+		fail    bool
+	}{
+		{name: "metadata cannot change type or content",
+			input: frame(frameTypes["get_chunk"], `{"type":"put_chunk","content":"AAAA","hash":"h"}`, nil),
+			want:  Message{Type: "get_chunk", Hash: "h"}},
+		{name: "payload wins over metadata content",
+			input: frame(frameTypes["chunk_data"], `{"content":"AAAA"}`, []byte("xy")),
+			want:  Message{Type: "chunk_data", Content: []byte("xy")}},
+		{name: "unknown type", input: frame(0, "", nil), fail: true},
+		{name: "unassigned type", input: frame(255, "", nil), fail: true},
+		{name: "oversized payload", input: oversized, wantErr: ErrFrameTooLarge, fail: true},
+		{name: "bad metadata", input: frame(frameTypes["message"], "{", nil), fail: true},
+		{name: "truncated header", input: []byte{1, 0}, wantErr: io.ErrUnexpectedEOF, fail: true},
+		{name: "truncated body", input: frame(frameTypes["chunk_data"], "", []byte("abc"))[:headerSize+1], wantErr: io.ErrUnexpectedEOF, fail: true},
+		{name: "no frame", input: nil, wantErr: io.EOF, fail: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewBinaryCodec(bytes.NewReader(tt.input), io.Discard)
+			got, err := c.ReadMessage()
+			if tt.fail {
+				if err == nil {
+					t.Fatalf("got %+v, want an error", got)
+				}
+				if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got error %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// FuzzReadFrame feeds arbitrary bytes to the binary reader. It must never
+// panic, and every frame it accepts must survive being written and read again.
+func FuzzReadFrame(f *testing.F) {
+	f.Add(frame(frameTypes["send_file_chunk"], "", []byte("chunk")))
+	f.Add(frame(frameTypes["file_info"], `{"filename":"a","size":3,"mode":420}`, nil))
+	f.Add(append(frame(frameTypes["end_of_file"], `{"hash":"x"}`, nil), frame(frameTypes["error"], `{"code":"c"}`, []byte("t"))...))
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		c := NewBinaryCodec(bytes.NewReader(data), io.Discard)
+		for {
+			msg, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			if len(msg.Content) > MaxPayloadSize {
+				t.Fatalf("accepted a %d byte payload", len(msg.Content))
+			}
+			if _, ok := frameTypes[msg.Type]; !ok {
+				t.Fatalf("accepted unknown type %q", msg.Type)
+			}
+			var buf bytes.Buffer
+			again := NewBinaryCodec(&buf, &buf)
+			if err := again.WriteMessage(msg); err != nil {
+				// Metadata that only fits because it was escaped differently on the way in.
+				continue
+			}
+			again.Flush()
+			reread, err := again.ReadMessage()
+			if err != nil {
+				t.Fatalf("re-reading %+v: %v", msg, err)
+			}
+			if !reflect.DeepEqual(reread, msg) {
+				t.Fatalf("re-read %+v, want %+v", reread, msg)
+			}
+		}
+	})
+}
+
+// FuzzBinaryRoundTrip checks that any message with a known type reads back as written.
+func FuzzBinaryRoundTrip(f *testing.F) {
+	f.Add(uint8(2), "file.txt", []byte("content"), "hash", int64(10), int64(1), int64(2), int64(3), "", uint32(0644))
+	f.Add(uint8(0), "", []byte{}, "", int64(0), int64(0), int64(0), int64(0), "", uint32(0))
+	f.Add(uint8(4), "a/b\x00c", []byte{0}, "\"}", int64(-1), int64(-1), int64(-1), int64(-1), "not_found", uint32(0xffffffff))
+	f.Fuzz(func(t *testing.T, typ uint8, filename string, content []byte, hash string, size, modTime, offset, length int64, code string, mode uint32) {
+		if !utf8.ValidString(filename) || !utf8.ValidString(hash) || !utf8.ValidString(code) {
+			// JSON metadata replaces invalid UTF-8; names on the wire are always valid.
+			t.Skip()
+		}
+		if len(content) == 0 {
+			content = nil
+		}
+		msg := Message{
+			Type:     frameTypeNames[int(typ)%len(frameTypeNames)],
+			Filename: filename,
+			Content:  content,
+			Hash:     hash,
+			Size:     size,
+			ModTime:  modTime,
+			Offset:   offset,
+			Length:   length,
+			Code:     code,
+			Mode:     mode,
+		}
+		var buf bytes.Buffer
+		c := NewBinaryCodec(&buf, &buf)
+		if err := c.WriteMessage(msg); err != nil {
+			if len(filename)+len(hash)+len(code) > 0xFFFF/2 {
+				t.Skip()
+			}
+			t.Fatalf("WriteMessage(%+v): %v", msg, err)
+		}
+		c.Flush()
+		got, err := c.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %v", err)
+		}
+		if !reflect.DeepEqual(got, msg) {
+			t.Fatalf("got %+v, want %+v", got, msg)
+		}
+	})
+}
@@ -0,0 +1,64 @@
+// Package codec implements the wire formats spoken between peers: the original
+// newline-delimited JSON messages and the length-prefixed binary frames that
+// replace them once both sides agree on it during the version handshake.
+package codec
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+)
+
+// Message struct for handling different request types.
+type Message struct {
+	Type     string `json:"type,omitempty"`
+	Filename string `json:"filename,omitempty"`
+	Content  []byte `json:"content,omitempty"`
+	Hash     string `json:"hash,omitempty"`     // hex SHA-256 of Content, or of the served range on "end_of_file"
+	Size     int64  `json:"size,omitempty"`     // total file size
+	ModTime  int64  `json:"mod_time,omitempty"` // file modification time, Unix nanoseconds
+	Offset   int64  `json:"offset,omitempty"`   // first byte of the requested or served range
+	Length   int64  `json:"length,omitempty"`   // bytes in the range; zero on a request means "to end of file"
+	Code     string `json:"code,omitempty"`     // machine-readable reason on "error"
+	Mode     uint32 `json:"mode,omitempty"`     // permission bits of a file or directory in a directory transfer
+}
+
+// Codec reads and writes messages on a connection.
+// Writes are buffered; call Flush before waiting for the remote side to answer.
+type Codec interface {
+	ReadMessage() (Message, error)
+	WriteMessage(msg Message) error
+	Flush() error
+}
+
+// jsonCodec speaks the original protocol: one JSON object per message,
+// with Content base64-encoded by encoding/json.
+type jsonCodec struct {
+	decoder *json.Decoder
+	encoder *json.Encoder
+	writer  *bufio.Writer
+}
+
+// NewJSONCodec returns a codec for peers that only understand JSON messages.
+func NewJSONCodec(r io.Reader, w io.Writer) Codec {
+	writer := bufio.NewWriterSize(w, bufferSize)
+	return &jsonCodec{
+		decoder: json.NewDecoder(r),
+		encoder: json.NewEncoder(writer),
+		writer:  writer,
+	}
+}
+
+func (c *jsonCodec) ReadMessage() (Message, error) {
+	var msg Message
+	err := c.decoder.Decode(&msg)
+	return msg, err
+}
+
+func (c *jsonCodec) WriteMessage(msg Message) error {
+	return c.encoder.Encode(msg)
+}
+
+func (c *jsonCodec) Flush() error {
+	return c.writer.Flush()
+}
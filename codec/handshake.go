@@ -0,0 +1,115 @@
+package codec
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Protocol versions. Version 1 is the original JSON protocol; it has no
+// handshake, so a peer that never says hello is assumed to speak it.
+const (
+	VersionJSON   = 1
+	VersionBinary = 2
+
+	// ProtocolVersion is the newest version this build speaks.
+	ProtocolVersion = VersionBinary
+)
+
+// ErrLegacyPeer is returned by ClientHandshake when the remote peer closed the
+// connection instead of answering hello, which is what JSON-only peers do with
+// message types they don't know. The caller should redial and use NewJSONCodec.
+var ErrLegacyPeer = errors.New("peer does not support the protocol handshake")
+
+// hello is exchanged as a plain JSON object before any framed traffic.
+type hello struct {
+	Type    string `json:"type"`
+	Version int    `json:"version"`
+}
+
+// ClientHandshake offers the binary protocol on a fresh connection and returns
+// the codec both sides agreed on.
+func ClientHandshake(rw io.ReadWriter) (Codec, error) {
+	if err := writeHello(rw, ProtocolVersion); err != nil {
+		return nil, fmt.Errorf("failed to send hello: %w", err)
+	}
+
+	decoder := json.NewDecoder(rw)
+	var reply hello
+	if err := decoder.Decode(&reply); err != nil {
+		if err == io.EOF {
+			return nil, ErrLegacyPeer
+		}
+		return nil, fmt.Errorf("failed to read hello reply: %w", err)
+	}
+	if reply.Type != "hello" {
+		return nil, fmt.Errorf("unexpected handshake reply %q", reply.Type)
+	}
+
+	// Anything the JSON decoder read past the reply belongs to the next frame.
+	r := io.MultiReader(decoder.Buffered(), rw)
+	if reply.Version >= VersionBinary {
+		return NewBinaryCodec(r, rw), nil
+	}
+	return NewJSONCodec(r, rw), nil
+}
+
+// ServerHandshake reads the first message on an accepted connection. If it is a
+// hello, the version is negotiated and the first real request is read with the
+// agreed codec; otherwise the peer is a legacy JSON client and its request is
+// returned as is.
+func ServerHandshake(rw io.ReadWriter) (Codec, Message, error) {
+	br := bufio.NewReader(rw)
+	decoder := json.NewDecoder(br)
+
+	var raw json.RawMessage
+	if err := decoder.Decode(&raw); err != nil {
+		return nil, Message{}, err
+	}
+	r := io.MultiReader(decoder.Buffered(), br)
+
+	var offer hello
+	if err := json.Unmarshal(raw, &offer); err != nil || offer.Type != "hello" {
+		var request Message
+		if err := json.Unmarshal(raw, &request); err != nil {
+			return nil, Message{}, err
+		}
+		return NewJSONCodec(r, rw), request, nil
+	}
+
+	version := offer.Version
+	if version > ProtocolVersion {
+		version = ProtocolVersion
+	}
+	if version < VersionJSON {
+		version = VersionJSON
+	}
+	if err := writeHello(rw, version); err != nil {
+		return nil, Message{}, fmt.Errorf("failed to send hello reply: %w", err)
+	}
+
+	var c Codec
+	if version >= VersionBinary {
+		c = NewBinaryCodec(r, rw)
+	} else {
+		c = NewJSONCodec(r, rw)
+	}
+	request, err := c.ReadMessage()
+	if err != nil {
+		return nil, Message{}, err
+	}
+	return c, request, nil
+}
+
+// writeHello sends a hello without the trailing newline json.Encoder would add,
+// so the first byte after it is already the start of the first frame.
+func writeHello(w io.Writer, version int) error {
+	data, err := json.Marshal(hello{Type: "hello", Version: version})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
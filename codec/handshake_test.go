@@ -0,0 +1,185 @@
+package codec
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// handshakePair runs ServerHandshake on one end of a pipe while client drives the other.
+func handshakePair(t *testing.T, client func(conn net.Conn)) (Codec, Message, error) {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	t.Cleanup(func() {
+		clientConn.Close()
+		serverConn.Close()
+	})
+	serverConn.SetDeadline(time.Now().Add(5 * time.Second))
+	clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+	go client(clientConn)
+	return ServerHandshake(serverConn)
+}
+
+func TestHandshakeNegotiatesBinary(t *testing.T) {
+	request := Message{Type: "request_file", Filename: "docs/a.txt", Offset: 4}
+	reply := Message{Type: "file_info", Filename: "docs/a.txt", Size: 9}
+	clientDone := make(chan error, 1)
+
+	c, got, err := handshakePair(t, func(conn net.Conn) {
+		clientDone <- func() error {
+			cc, err := ClientHandshake(conn)
+			if err != nil {
+				return err
+			}
+			if _, ok := cc.(*binaryCodec); !ok {
+				return errors.New("client did not pick the binary codec")
+			}
+			if err := cc.WriteMessage(request); err != nil {
+				return err
+			}
+			if err := cc.Flush(); err != nil {
+				return err
+			}
+			msg, err := cc.ReadMessage()
+			if err != nil {
+				return err
+			}
+			if !reflect.DeepEqual(msg, reply) {
+				return errors.New("client got the wrong reply")
+			}
+			return nil
+		}()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.(*binaryCodec); !ok {
+		t.Errorf("server picked %T, want the binary codec", c)
+	}
+	if !reflect.DeepEqual(got, request) {
+		t.Errorf("server got %+v, want %+v", got, request)
+	}
+	c.WriteMessage(reply)
+	c.Flush()
+	if err := <-clientDone; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandshakeVersions(t *testing.T) {
+	tests := []struct {
+		name        string
+		offer       int
+		wantVersion int
+		wantBinary  bool
+	}{
+		{"current", ProtocolVersion, ProtocolVersion, true},
+		{"newer client", ProtocolVersion + 5, ProtocolVersion, true},
+		{"json client", VersionJSON, VersionJSON, false},
+		{"bogus version", -3, VersionJSON, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			answered := make(chan hello, 1)
+			c, got, err := handshakePair(t, func(conn net.Conn) {
+				writeHello(conn, tt.offer)
+				var reply hello
+				decoder := json.NewDecoder(conn)
+				decoder.Decode(&reply)
+				answered <- reply
+				request := Message{Type: "list_files"}
+				if tt.wantBinary {
+					w := NewBinaryCodec(conn, conn)
+					w.WriteMessage(request)
+					w.Flush()
+				} else {
+					json.NewEncoder(conn).Encode(request)
+				}
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reply := <-answered; reply.Type != "hello" || reply.Version != tt.wantVersion {
+				t.Errorf("server answered %+v, want version %d", reply, tt.wantVersion)
+			}
+			if _, isBinary := c.(*binaryCodec); isBinary != tt.wantBinary {
+				t.Errorf("server picked %T", c)
+			}
+			if got.Type != "list_files" {
+				t.Errorf("server got %+v", got)
+			}
+		})
+	}
+}
+
+func TestHandshakeLegacyClient(t *testing.T) {
+	request := Message{Type: "request_file", Filename: "a.txt"}
+	c, got, err := handshakePair(t, func(conn net.Conn) {
+		json.NewEncoder(conn).Encode(request)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.(*jsonCodec); !ok {
+		t.Errorf("server picked %T, want the JSON codec", c)
+	}
+	if !reflect.DeepEqual(got, request) {
+		t.Errorf("got %+v, want %+v", got, request)
+	}
+}
+
+func TestClientHandshakeLegacyPeer(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go func() {
+		// A JSON-only peer drops connections whose first message it does not know.
+		json.NewDecoder(serverConn).Decode(new(Message))
+		serverConn.Close()
+	}()
+	if _, err := ClientHandshake(clientConn); !errors.Is(err, ErrLegacyPeer) {
+		t.Fatalf("got %v, want ErrLegacyPeer", err)
+	}
+}
+
+// FuzzServerHandshake sends arbitrary bytes as the opening of a connection.
+// The handshake must neither panic nor hang, and a binary codec it returns
+// must go on reading frames from the rest of the input.
+func FuzzServerHandshake(f *testing.F) {
+	f.Add([]byte(`{"type":"hello","version":2}` + string(frame(frameTypes["list_files"], "", nil))))
+	f.Add([]byte(`{"type":"hello","version":1}{"type":"request_file","filename":"a"}`))
+	f.Add([]byte(`{"type":"request_file","filename":"a","offset":3}`))
+	f.Add([]byte(`{"type":"hello","version":99}` + "\xff\xff"))
+	f.Add([]byte(`[1,2`))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		clientConn, serverConn := net.Pipe()
+		defer serverConn.Close()
+		serverConn.SetDeadline(time.Now().Add(5 * time.Second))
+		go io.Copy(io.Discard, clientConn)
+		go func() {
+			clientConn.Write(data)
+			clientConn.Close()
+		}()
+
+		c, _, err := ServerHandshake(serverConn)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				t.Fatal("handshake hung")
+			}
+			return
+		}
+		for {
+			if _, err := c.ReadMessage(); err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					t.Fatal("reading after the handshake hung")
+				}
+				return
+			}
+		}
+	})
+}
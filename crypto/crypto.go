@@ -0,0 +1,141 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// A sealed chunk is laid out as
+//
+//	magic "FDSE" | version u8 | wrapped key length u16 (BE) | wrapped key | nonce | AES-GCM ciphertext
+//
+// The 256-bit data key is random per chunk and wrapped with RSA-OAEP (SHA-256)
+// for the recipient, so only the holder of the matching private key can read it.
+var sealMagic = []byte("FDSE")
+
+const sealVersion = 1
+
+const dataKeySize = 32
+
+// ErrNotSealed is returned by Open for data that was not produced by Seal.
+var ErrNotSealed = errors.New("data is not an encrypted chunk")
+
+// ErrWrongKey is returned by Open when the data key was not wrapped for the
+// given private key, as opposed to a chunk whose contents fail authentication.
+var ErrWrongKey = errors.New("chunk is sealed for another key")
+
+// IsSealed reports whether data starts with the sealed chunk header.
+func IsSealed(data []byte) bool {
+	return len(data) > len(sealMagic) && bytes.Equal(data[:len(sealMagic)], sealMagic)
+}
+
+// CheckSealed reports whether data is laid out like a sealed chunk: a known
+// version, a complete wrapped key and room for a nonce and an authentication
+// tag. Only Open with the right key can tell whether the contents are genuine.
+func CheckSealed(data []byte) error {
+	if !IsSealed(data) {
+		return ErrNotSealed
+	}
+	rest := data[len(sealMagic):]
+	if len(rest) < 3 {
+		return errors.New("truncated encrypted chunk")
+	}
+	if rest[0] != sealVersion {
+		return fmt.Errorf("unsupported encrypted chunk version %d", rest[0])
+	}
+	keyLen := int(binary.BigEndian.Uint16(rest[1:3]))
+	// A GCM nonce is 12 bytes and its tag 16.
+	if keyLen == 0 || len(rest[3:]) < keyLen+12+16 {
+		return errors.New("truncated encrypted chunk")
+	}
+	return nil
+}
+
+// Seal encrypts plaintext for recipient with a fresh AES-GCM data key.
+// additionalData is authenticated but not encrypted; the same value must be
+// passed to Open, which binds the ciphertext to, for example, its chunk hash.
+func Seal(recipient *rsa.PublicKey, plaintext, additionalData []byte) ([]byte, error) {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, fmt.Errorf("failed to generate data key: %w", err)
+	}
+	wrappedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, recipient, dataKey, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap data key: %w", err)
+	}
+
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	header := len(sealMagic) + 1 + 2
+	out := make([]byte, header, header+len(wrappedKey)+len(nonce)+len(plaintext)+gcm.Overhead())
+	copy(out, sealMagic)
+	out[len(sealMagic)] = sealVersion
+	binary.BigEndian.PutUint16(out[len(sealMagic)+1:], uint16(len(wrappedKey)))
+	out = append(out, wrappedKey...)
+	out = append(out, nonce...)
+	return gcm.Seal(out, nonce, plaintext, additionalData), nil
+}
+
+// Open decrypts data produced by Seal using the recipient's private key.
+func Open(private *rsa.PrivateKey, sealed, additionalData []byte) ([]byte, error) {
+	if !IsSealed(sealed) {
+		return nil, ErrNotSealed
+	}
+	rest := sealed[len(sealMagic):]
+	if len(rest) < 3 {
+		return nil, errors.New("truncated encrypted chunk")
+	}
+	if rest[0] != sealVersion {
+		return nil, fmt.Errorf("unsupported encrypted chunk version %d", rest[0])
+	}
+	keyLen := int(binary.BigEndian.Uint16(rest[1:3]))
+	rest = rest[3:]
+	if len(rest) < keyLen {
+		return nil, errors.New("truncated encrypted chunk")
+	}
+
+	dataKey, err := rsa.DecryptOAEP(sha256.New(), nil, private, rest[:keyLen], nil)
+	if err != nil {
+		return nil, ErrWrongKey
+	}
+	rest = rest[keyLen:]
+
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) < gcm.NonceSize() {
+		return nil, errors.New("truncated encrypted chunk")
+	}
+	plaintext, err := gcm.Open(nil, rest[:gcm.NonceSize()], rest[gcm.NonceSize():], additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt chunk: %w", err)
+	}
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %w", err)
+	}
+	return gcm, nil
+}
@@ -0,0 +1,146 @@
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+var (
+	testKeysOnce sync.Once
+	testKeys     [2]*KeyPair
+)
+
+// keyPairs returns two key pairs shared by the tests, since generating RSA keys is slow.
+func keyPairs(t *testing.T) (*KeyPair, *KeyPair) {
+	t.Helper()
+	testKeysOnce.Do(func() {
+		for i := range testKeys {
+			kp, err := GenerateKeyPair(KeyBits)
+			if err != nil {
+				t.Fatal(err)
+			}
+			testKeys[i] = kp
+		}
+	})
+	if testKeys[1] == nil {
+		t.Fatal("key generation failed")
+	}
+	return testKeys[0], testKeys[1]
+}
+
+func TestSealOpen(t *testing.T) {
+	kp, other := keyPairs(t)
+	plaintext := []byte("chunk contents")
+	sealed, err := Seal(kp.Public, plaintext, []byte("hash"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsSealed(sealed) || bytes.Contains(sealed, plaintext) {
+		t.Fatal("Seal did not produce a sealed chunk")
+	}
+
+	flipped := append([]byte(nil), sealed...)
+	flipped[len(flipped)-1] ^= 1
+
+	tests := []struct {
+		name    string
+		key     *KeyPair
+		sealed  []byte
+		ad      string
+		wantErr error // nil with fail means any error
+		fail    bool
+	}{
+		{name: "matching key and data", key: kp, sealed: sealed, ad: "hash"},
+		{name: "other additional data", key: kp, sealed: sealed, ad: "other", fail: true},
+		{name: "tampered ciphertext", key: kp, sealed: flipped, ad: "hash", fail: true},
+		{name: "other key", key: other, sealed: sealed, ad: "hash", wantErr: ErrWrongKey, fail: true},
+		{name: "plaintext", key: kp, sealed: plaintext, ad: "hash", wantErr: ErrNotSealed, fail: true},
+		{name: "header only", key: kp, sealed: sealed[:5], ad: "hash", fail: true},
+		{name: "truncated key", key: kp, sealed: sealed[:20], ad: "hash", fail: true},
+		{name: "truncated nonce", key: kp, sealed: sealed[:len(sealed)-len(plaintext)-20], ad: "hash", fail: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Open(tt.key.Private, tt.sealed, []byte(tt.ad))
+			if !tt.fail {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, plaintext) {
+					t.Errorf("got %q, want %q", got, plaintext)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("Open succeeded")
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("got %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && errors.Is(err, ErrWrongKey) {
+				t.Errorf("got %v for a chunk sealed for this key", err)
+			}
+		})
+	}
+}
+
+func TestSealIsRandomized(t *testing.T) {
+	kp, _ := keyPairs(t)
+	a, _ := Seal(kp.Public, []byte("same"), nil)
+	b, _ := Seal(kp.Public, []byte("same"), nil)
+	if bytes.Equal(a, b) {
+		t.Error("sealing the same plaintext twice gave the same output")
+	}
+}
+
+func TestKeyPairFiles(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "keys", "alice")
+	kp, err := LoadOrGenerateKeyPair(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := LoadOrGenerateKeyPair(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !kp.Private.Equal(again.Private) {
+		t.Error("a second load generated a new key instead of reading the saved one")
+	}
+	public, err := LoadPublicKey(filepath.Join(dir, publicKeyFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !public.Equal(kp.Public) {
+		t.Error("public.pem does not hold the public key")
+	}
+}
+
+func TestCheckSealed(t *testing.T) {
+	kp, _ := keyPairs(t)
+	sealed, err := Seal(kp.Public, []byte("x"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	badVersion := append([]byte(nil), sealed...)
+	badVersion[4] = 9
+	tests := []struct {
+		name   string
+		data   []byte
+		wantOK bool
+	}{
+		{"sealed", sealed, true},
+		{"plaintext", []byte("plain"), false},
+		{"magic only", []byte("FDSE garbage"), false},
+		{"unknown version", badVersion, false},
+		{"truncated key", sealed[:100], false},
+		{"no tag", sealed[:len(sealed)-17], false},
+	}
+	for _, tt := range tests {
+		if err := CheckSealed(tt.data); (err == nil) != tt.wantOK {
+			t.Errorf("%s: CheckSealed = %v", tt.name, err)
+		}
+	}
+}
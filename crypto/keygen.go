@@ -0,0 +1,159 @@
+// Package crypto implements the node's key management and the hybrid
+// RSA + AES-GCM encryption used for chunks at rest.
+package crypto
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// KeyBits is the RSA modulus size used for newly generated keys.
+const KeyBits = 2048
+
+const (
+	privateKeyFile = "private.pem"
+	publicKeyFile  = "public.pem"
+)
+
+// KeyPair holds a peer's RSA keys.
+type KeyPair struct {
+	Private *rsa.PrivateKey
+	Public  *rsa.PublicKey
+}
+
+// KeyDir returns the directory holding a peer's key pair, keys/<peer>.
+func KeyDir(peerID string) string {
+	return filepath.Join("keys", peerID)
+}
+
+// GenerateKeyPair creates a new RSA key pair of the given size.
+func GenerateKeyPair(bits int) (*KeyPair, error) {
+	private, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate RSA key: %w", err)
+	}
+	return &KeyPair{Private: private, Public: &private.PublicKey}, nil
+}
+
+// SaveKeyPair writes private.pem (readable only by the owner) and public.pem into dir.
+func SaveKeyPair(dir string, kp *KeyPair) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create key directory: %w", err)
+	}
+
+	privateDER, err := x509.MarshalPKCS8PrivateKey(kp.Private)
+	if err != nil {
+		return fmt.Errorf("failed to encode private key: %w", err)
+	}
+	privatePEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER})
+	if err := os.WriteFile(filepath.Join(dir, privateKeyFile), privatePEM, 0600); err != nil {
+		return fmt.Errorf("failed to write private key: %w", err)
+	}
+
+	publicDER, err := x509.MarshalPKIXPublicKey(kp.Public)
+	if err != nil {
+		return fmt.Errorf("failed to encode public key: %w", err)
+	}
+	publicPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER})
+	if err := os.WriteFile(filepath.Join(dir, publicKeyFile), publicPEM, 0644); err != nil {
+		return fmt.Errorf("failed to write public key: %w", err)
+	}
+	return nil
+}
+
+// LoadKeyPair reads the key pair stored in dir. Keys generated with
+// "openssl genrsa" (PKCS#1 or PKCS#8) are accepted.
+func LoadKeyPair(dir string) (*KeyPair, error) {
+	private, err := LoadPrivateKey(filepath.Join(dir, privateKeyFile))
+	if err != nil {
+		return nil, err
+	}
+	return &KeyPair{Private: private, Public: &private.PublicKey}, nil
+}
+
+// LoadOrGenerateKeyPair loads the key pair in dir, generating and saving a new
+// one if the directory has none yet.
+func LoadOrGenerateKeyPair(dir string) (*KeyPair, error) {
+	kp, err := LoadKeyPair(dir)
+	if err == nil {
+		return kp, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	kp, err = GenerateKeyPair(KeyBits)
+	if err != nil {
+		return nil, err
+	}
+	if err := SaveKeyPair(dir, kp); err != nil {
+		return nil, err
+	}
+	return kp, nil
+}
+
+// LoadPrivateKey reads a PEM-encoded RSA private key.
+func LoadPrivateKey(path string) (*rsa.PrivateKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse private key %s: %w", path, err)
+		}
+		private, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("private key %s is not an RSA key", path)
+		}
+		return private, nil
+	default:
+		return nil, fmt.Errorf("unexpected PEM block %q in %s", block.Type, path)
+	}
+}
+
+// LoadPublicKey reads a PEM-encoded RSA public key, such as another peer's public.pem.
+func LoadPublicKey(path string) (*rsa.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	case "PUBLIC KEY":
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse public key %s: %w", path, err)
+		}
+		public, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("public key %s is not an RSA key", path)
+		}
+		return public, nil
+	default:
+		return nil, fmt.Errorf("unexpected PEM block %q in %s", block.Type, path)
+	}
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key %s: %w", path, err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", path)
+	}
+	return block, nil
+}
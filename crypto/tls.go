@@ -0,0 +1,237 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// TLSIdentity is a node's certificate together with the certificates it trusts.
+// A peer's ID is the Common Name of its certificate, so a node can only claim
+// the ID its trusted certificate was issued for.
+type TLSIdentity struct {
+	PeerID      string
+	Certificate tls.Certificate
+	Trusted     *x509.CertPool      // CA certificates peer certificates may be issued by
+	Pinned      []*x509.Certificate // peer certificates trusted exactly as they are
+}
+
+// LoadTLSIdentity loads a PEM certificate and key and every certificate in
+// trustDir (*.pem or *.crt), which may hold CA certificates or the self-signed
+// certificates of individual peers. Only certificates that are CAs and not
+// meant for TLS clients or servers themselves can issue peer certificates;
+// every other certificate is pinned, so it identifies exactly one peer and
+// nothing it signs is trusted.
+func LoadTLSIdentity(certFile, keyFile, trustDir string) (*TLSIdentity, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate: %w", err)
+	}
+	if leaf.Subject.CommonName == "" {
+		return nil, fmt.Errorf("certificate %s has no Common Name to use as peer ID", certFile)
+	}
+
+	trusted := x509.NewCertPool()
+	var pinned []*x509.Certificate
+	entries, err := os.ReadDir(trustDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read trust store: %w", err)
+	}
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if entry.IsDir() || (ext != ".pem" && ext != ".crt") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(trustDir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read trusted certificate: %w", err)
+		}
+		certs, err := parseCertificates(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", entry.Name(), err)
+		}
+		for _, c := range certs {
+			if isIssuer(c) {
+				trusted.AddCert(c)
+			} else {
+				pinned = append(pinned, c)
+			}
+		}
+	}
+
+	return &TLSIdentity{
+		PeerID:      leaf.Subject.CommonName,
+		Certificate: cert,
+		Trusted:     trusted,
+		Pinned:      pinned,
+	}, nil
+}
+
+// parseCertificates returns every certificate in PEM data.
+func parseCertificates(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		c, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, c)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no certificates found")
+	}
+	return certs, nil
+}
+
+// isIssuer reports whether a trusted certificate may vouch for others: it must
+// be a CA allowed to sign certificates, and not a peer's own certificate, which
+// carries the client or server auth usage. Self-signed peer certificates made
+// by older versions of GenerateSelfSignedCertificate were marked as CAs too.
+func isIssuer(c *x509.Certificate) bool {
+	if !c.BasicConstraintsValid || !c.IsCA || c.KeyUsage&x509.KeyUsageCertSign == 0 {
+		return false
+	}
+	for _, usage := range c.ExtKeyUsage {
+		if usage == x509.ExtKeyUsageClientAuth || usage == x509.ExtKeyUsageServerAuth {
+			return false
+		}
+	}
+	return true
+}
+
+// GenerateSelfSignedCertificate issues a certificate for peerID signed by its
+// own key pair and writes it to certFile. Other nodes trust it by copying the
+// file into their trust store. It is not a CA certificate, so it cannot be used
+// to issue certificates for other peer IDs.
+func GenerateSelfSignedCertificate(peerID string, kp *KeyPair, certFile string) error {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return fmt.Errorf("failed to generate serial number: %w", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: peerID},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(5, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  false,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, kp.Public, kp.Private)
+	if err != nil {
+		return fmt.Errorf("failed to create certificate: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(certFile), 0700); err != nil {
+		return fmt.Errorf("failed to create certificate directory: %w", err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := os.WriteFile(certFile, certPEM, 0644); err != nil {
+		return fmt.Errorf("failed to write certificate: %w", err)
+	}
+	return nil
+}
+
+// ServerConfig returns a TLS config that requires clients to present a trusted certificate.
+func (id *TLSIdentity) ServerConfig() *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{id.Certificate},
+		ClientAuth:   tls.RequireAnyClientCert,
+		MinVersion:   tls.VersionTLS12,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			_, err := id.verify(cs.PeerCertificates)
+			return err
+		},
+	}
+}
+
+// ClientConfig returns a TLS config that presents this identity and accepts
+// the server only if its certificate is trusted and, when expectedPeerID is
+// not empty, was issued to that peer ID.
+func (id *TLSIdentity) ClientConfig(expectedPeerID string) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{id.Certificate},
+		MinVersion:   tls.VersionTLS12,
+		// Peers are addressed by IP and identified by their certificate's
+		// Common Name, so hostname verification is replaced by verify below.
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			peerID, err := id.verify(cs.PeerCertificates)
+			if err != nil {
+				return err
+			}
+			if expectedPeerID != "" && peerID != expectedPeerID {
+				return fmt.Errorf("peer presented certificate for %q, expected %q", peerID, expectedPeerID)
+			}
+			return nil
+		},
+	}
+}
+
+// verify checks a presented certificate chain against the trust store and
+// returns the peer ID it was issued to. The peer's certificate must either be
+// pinned or chain up to a trusted CA.
+func (id *TLSIdentity) verify(chain []*x509.Certificate) (string, error) {
+	if len(chain) == 0 {
+		return "", errors.New("peer presented no certificate")
+	}
+	leaf := chain[0]
+	for _, pinned := range id.Pinned {
+		if leaf.Equal(pinned) {
+			if now := time.Now(); now.Before(leaf.NotBefore) || now.After(leaf.NotAfter) {
+				return "", errors.New("untrusted peer certificate: expired or not yet valid")
+			}
+			return PeerIDFromCertificate(leaf), nil
+		}
+	}
+	if leaf.IsCA {
+		return "", errors.New("untrusted peer certificate: a CA certificate cannot identify a peer")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         id.Trusted,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return "", fmt.Errorf("untrusted peer certificate: %w", err)
+	}
+	return PeerIDFromCertificate(leaf), nil
+}
+
+// PeerIDFromCertificate returns the peer ID a certificate was issued to.
+func PeerIDFromCertificate(cert *x509.Certificate) string {
+	return cert.Subject.CommonName
+}
+
+// PeerIDFromConnState returns the verified peer ID of the remote side of a TLS
+// connection, or "" if it presented no certificate.
+func PeerIDFromConnState(cs tls.ConnectionState) string {
+	if len(cs.PeerCertificates) == 0 {
+		return ""
+	}
+	return PeerIDFromCertificate(cs.PeerCertificates[0])
+}
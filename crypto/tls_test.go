@@ -0,0 +1,209 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// certSpec describes a certificate for issue.
+type certSpec struct {
+	cn       string
+	ca       bool
+	peerAuth bool // carries the client and server auth usages of a peer certificate
+	expired  bool
+}
+
+// issue creates a certificate for key, signed by parent and parentKey, or self-signed if parent is nil.
+func issue(t *testing.T, spec certSpec, key *KeyPair, parent *x509.Certificate, parentKey *KeyPair) *x509.Certificate {
+	t.Helper()
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: spec.cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		BasicConstraintsValid: true,
+		IsCA:                  spec.ca,
+	}
+	if spec.ca {
+		template.KeyUsage |= x509.KeyUsageCertSign
+	}
+	if spec.peerAuth {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	}
+	if spec.expired {
+		template.NotBefore, template.NotAfter = time.Now().Add(-2*time.Hour), time.Now().Add(-time.Hour)
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public, parentKey.Private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func writeCert(t *testing.T, path string, cert *x509.Certificate) {
+	t.Helper()
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyPeerCertificates(t *testing.T) {
+	peerKey, caKey := keyPairs(t)
+	dir := t.TempDir()
+	trustDir := filepath.Join(dir, "trust")
+	os.MkdirAll(trustDir, 0700)
+
+	// bob's certificate comes from GenerateSelfSignedCertificate; mallory's is
+	// an older self-signed peer certificate that was marked as a CA.
+	bobCertFile := filepath.Join(dir, "bob.pem")
+	if err := GenerateSelfSignedCertificate("bob", peerKey, bobCertFile); err != nil {
+		t.Fatal(err)
+	}
+	bobData, _ := os.ReadFile(bobCertFile)
+	bobCerts, _ := parseCertificates(bobData)
+	bob := bobCerts[0]
+	if bob.IsCA || bob.KeyUsage&x509.KeyUsageCertSign != 0 {
+		t.Fatal("GenerateSelfSignedCertificate made a CA certificate")
+	}
+	mallory := issue(t, certSpec{cn: "mallory", ca: true, peerAuth: true}, peerKey, nil, nil)
+	ca := issue(t, certSpec{cn: "Test CA", ca: true}, caKey, nil, nil)
+	untrustedCA := issue(t, certSpec{cn: "Other CA", ca: true}, peerKey, nil, nil)
+	expired := issue(t, certSpec{cn: "old", peerAuth: true, expired: true}, peerKey, nil, nil)
+	writeCert(t, filepath.Join(trustDir, "bob.pem"), bob)
+	writeCert(t, filepath.Join(trustDir, "mallory.pem"), mallory)
+	writeCert(t, filepath.Join(trustDir, "ca.crt"), ca)
+	writeCert(t, filepath.Join(trustDir, "old.pem"), expired)
+	os.WriteFile(filepath.Join(trustDir, "notes.txt"), []byte("ignored"), 0644)
+
+	keyDir := filepath.Join(dir, "keys")
+	if err := SaveKeyPair(keyDir, peerKey); err != nil {
+		t.Fatal(err)
+	}
+	identity, err := LoadTLSIdentity(bobCertFile, filepath.Join(keyDir, privateKeyFile), trustDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.PeerID != "bob" {
+		t.Fatalf("PeerID = %q, want bob", identity.PeerID)
+	}
+	if len(identity.Pinned) != 3 {
+		t.Fatalf("pinned %d certificates, want bob's, mallory's and the expired one", len(identity.Pinned))
+	}
+
+	tests := []struct {
+		name   string
+		chain  []*x509.Certificate
+		wantID string // "" if the chain must be rejected
+	}{
+		{"pinned self-signed peer", []*x509.Certificate{bob}, "bob"},
+		{"pinned older CA-style peer", []*x509.Certificate{mallory}, "mallory"},
+		{"issued by a trusted CA", []*x509.Certificate{issue(t, certSpec{cn: "dave", peerAuth: true}, peerKey, ca, caKey)}, "dave"},
+		{"issued by a trusted CA via an intermediate", func() []*x509.Certificate {
+			intermediate := issue(t, certSpec{cn: "Intermediate", ca: true}, caKey, ca, caKey)
+			return []*x509.Certificate{issue(t, certSpec{cn: "erin", peerAuth: true}, peerKey, intermediate, caKey), intermediate}
+		}(), "erin"},
+		{"claiming another ID with a pinned peer's key", []*x509.Certificate{issue(t, certSpec{cn: "alice", peerAuth: true}, peerKey, mallory, peerKey)}, ""},
+		{"chained through a pinned peer certificate", []*x509.Certificate{issue(t, certSpec{cn: "alice", peerAuth: true}, peerKey, mallory, peerKey), mallory}, ""},
+		{"self-signed but not pinned", []*x509.Certificate{issue(t, certSpec{cn: "bob", peerAuth: true}, caKey, nil, nil)}, ""},
+		{"issued by an untrusted CA", []*x509.Certificate{issue(t, certSpec{cn: "frank", peerAuth: true}, caKey, untrustedCA, peerKey)}, ""},
+		{"the CA certificate itself", []*x509.Certificate{ca}, ""},
+		{"expired pinned certificate", []*x509.Certificate{expired}, ""},
+		{"no certificate", nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := identity.verify(tt.chain)
+			if tt.wantID == "" {
+				if err == nil {
+					t.Fatalf("accepted as %q", id)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id != tt.wantID {
+				t.Errorf("verified as %q, want %q", id, tt.wantID)
+			}
+		})
+	}
+}
+
+func TestMutualTLSHandshake(t *testing.T) {
+	peerKey, caKey := keyPairs(t)
+	dir := t.TempDir()
+	trustDir := filepath.Join(dir, "trust")
+	os.MkdirAll(trustDir, 0700)
+	for _, peer := range []struct {
+		id  string
+		key *KeyPair
+	}{{"alice", peerKey}, {"bob", caKey}} {
+		keyDir := filepath.Join(dir, peer.id)
+		SaveKeyPair(keyDir, peer.key)
+		certFile := filepath.Join(keyDir, "cert.pem")
+		if err := GenerateSelfSignedCertificate(peer.id, peer.key, certFile); err != nil {
+			t.Fatal(err)
+		}
+		data, _ := os.ReadFile(certFile)
+		os.WriteFile(filepath.Join(trustDir, peer.id+".pem"), data, 0644)
+	}
+	load := func(id string) *TLSIdentity {
+		identity, err := LoadTLSIdentity(filepath.Join(dir, id, "cert.pem"), filepath.Join(dir, id, privateKeyFile), trustDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return identity
+	}
+	alice, bob := load("alice"), load("bob")
+
+	handshake := func(expected string) (string, error) {
+		clientConn, serverConn := net.Pipe()
+		defer clientConn.Close()
+		defer serverConn.Close()
+		server := tls.Server(serverConn, bob.ServerConfig())
+		serverErr := make(chan error, 1)
+		go func() { serverErr <- server.Handshake() }()
+		client := tls.Client(clientConn, alice.ClientConfig(expected))
+		err := client.Handshake()
+		if err != nil {
+			clientConn.Close()
+			<-serverErr
+			return "", err
+		}
+		if err := <-serverErr; err != nil {
+			return "", err
+		}
+		return PeerIDFromConnState(server.ConnectionState()), nil
+	}
+
+	id, err := handshake("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "alice" {
+		t.Errorf("server saw client %q, want alice", id)
+	}
+	if _, err := handshake("carol"); err == nil || !strings.Contains(err.Error(), "expected \"carol\"") {
+		t.Errorf("dialing bob as carol: got %v", err)
+	}
+}
@@ -0,0 +1,228 @@
+// Package erasure implements systematic Reed-Solomon coding over GF(2^8).
+// k data shards are extended with m parity shards so that any k of the k+m
+// shards are enough to recover all of them.
+package erasure
+
+import (
+	"errors"
+	"fmt"
+)
+
+// MaxShards is the most data plus parity shards a Coder supports.
+const MaxShards = 256
+
+var (
+	// ErrTooFewShards is returned by Reconstruct when fewer than k shards are present.
+	ErrTooFewShards = errors.New("too few shards to reconstruct")
+	// ErrShardSize is returned when the present shards are not all the same length.
+	ErrShardSize = errors.New("shards differ in size")
+)
+
+// Coder encodes and reconstructs stripes of k data and m parity shards.
+type Coder struct {
+	k, m   int
+	matrix [][]byte // (k+m) x k; the top k rows are the identity
+}
+
+// New returns a Coder for k data shards and m parity shards.
+func New(k, m int) (*Coder, error) {
+	if k <= 0 || m < 0 || k+m > MaxShards {
+		return nil, fmt.Errorf("invalid erasure scheme %d+%d", k, m)
+	}
+	// Any k rows of a Vandermonde matrix are independent. Multiplying by the
+	// inverse of its top square keeps that property and makes the code
+	// systematic: data shards are stored unchanged.
+	vandermonde := make([][]byte, k+m)
+	for r := range vandermonde {
+		vandermonde[r] = make([]byte, k)
+		for c := range vandermonde[r] {
+			vandermonde[r][c] = gfPow(byte(r), c)
+		}
+	}
+	top, err := invert(vandermonde[:k])
+	if err != nil {
+		return nil, err
+	}
+	return &Coder{k: k, m: m, matrix: multiply(vandermonde, top)}, nil
+}
+
+// DataShards returns k.
+func (c *Coder) DataShards() int { return c.k }
+
+// ParityShards returns m.
+func (c *Coder) ParityShards() int { return c.m }
+
+// Encode computes the parity shards of a stripe. shards holds k data shards of
+// equal length followed by m parity shards, which are allocated if nil.
+func (c *Coder) Encode(shards [][]byte) error {
+	if len(shards) != c.k+c.m {
+		return fmt.Errorf("got %d shards, want %d", len(shards), c.k+c.m)
+	}
+	size := len(shards[0])
+	for _, shard := range shards[:c.k] {
+		if len(shard) != size {
+			return ErrShardSize
+		}
+	}
+	for i := c.k; i < c.k+c.m; i++ {
+		shards[i] = c.combine(c.matrix[i], shards[:c.k], size)
+	}
+	return nil
+}
+
+// Reconstruct fills in the missing (nil) shards of a stripe from any k present ones.
+func (c *Coder) Reconstruct(shards [][]byte) error {
+	if len(shards) != c.k+c.m {
+		return fmt.Errorf("got %d shards, want %d", len(shards), c.k+c.m)
+	}
+	size := -1
+	var rows [][]byte
+	var present [][]byte
+	complete := true
+	for i, shard := range shards {
+		if shard == nil {
+			complete = complete && i >= c.k
+			continue
+		}
+		if size == -1 {
+			size = len(shard)
+		} else if len(shard) != size {
+			return ErrShardSize
+		}
+		if len(rows) < c.k {
+			rows = append(rows, c.matrix[i])
+			present = append(present, shard)
+		}
+	}
+	if len(rows) < c.k {
+		return ErrTooFewShards
+	}
+
+	if !complete {
+		decode, err := invert(rows)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < c.k; i++ {
+			if shards[i] == nil {
+				shards[i] = c.combine(decode[i], present, size)
+			}
+		}
+	}
+	for i := c.k; i < c.k+c.m; i++ {
+		if shards[i] == nil {
+			shards[i] = c.combine(c.matrix[i], shards[:c.k], size)
+		}
+	}
+	return nil
+}
+
+// combine returns the linear combination of shards with the given coefficients.
+func (c *Coder) combine(coefficients []byte, shards [][]byte, size int) []byte {
+	out := make([]byte, size)
+	for j, coefficient := range coefficients {
+		if coefficient == 0 {
+			continue
+		}
+		row := mulTable[coefficient][:]
+		for b, v := range shards[j] {
+			out[b] ^= row[v]
+		}
+	}
+	return out
+}
+
+// GF(2^8) with the polynomial x^8 + x^4 + x^3 + x^2 + 1 (0x11d) and generator 2.
+var (
+	expTable [510]byte
+	logTable [256]int
+	mulTable [256][256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		expTable[i] = byte(x)
+		expTable[i+255] = byte(x)
+		logTable[x] = i
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			mulTable[a][b] = expTable[logTable[a]+logTable[b]]
+		}
+	}
+}
+
+func gfInverse(a byte) byte {
+	return expTable[255-logTable[a]]
+}
+
+func gfPow(a byte, n int) byte {
+	if n == 0 {
+		return 1
+	}
+	if a == 0 {
+		return 0
+	}
+	return expTable[(logTable[a]*n)%255]
+}
+
+// multiply returns a x b.
+func multiply(a, b [][]byte) [][]byte {
+	out := make([][]byte, len(a))
+	for r := range a {
+		out[r] = make([]byte, len(b[0]))
+		for c := range out[r] {
+			var v byte
+			for i := range b {
+				v ^= mulTable[a[r][i]][b[i][c]]
+			}
+			out[r][c] = v
+		}
+	}
+	return out
+}
+
+// invert returns the inverse of a square matrix by Gauss-Jordan elimination.
+func invert(matrix [][]byte) ([][]byte, error) {
+	n := len(matrix)
+	work := make([][]byte, n)
+	for r := range matrix {
+		work[r] = make([]byte, 2*n)
+		copy(work[r], matrix[r])
+		work[r][n+r] = 1
+	}
+	for col := 0; col < n; col++ {
+		pivot := col
+		for pivot < n && work[pivot][col] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, errors.New("matrix is singular")
+		}
+		work[col], work[pivot] = work[pivot], work[col]
+
+		scale := gfInverse(work[col][col])
+		for c := range work[col] {
+			work[col][c] = mulTable[scale][work[col][c]]
+		}
+		for r := 0; r < n; r++ {
+			if r == col || work[r][col] == 0 {
+				continue
+			}
+			factor := work[r][col]
+			for c := range work[r] {
+				work[r][c] ^= mulTable[factor][work[col][c]]
+			}
+		}
+	}
+	inverse := make([][]byte, n)
+	for r := range work {
+		inverse[r] = work[r][n:]
+	}
+	return inverse, nil
+}
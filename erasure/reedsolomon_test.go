@@ -0,0 +1,161 @@
+package erasure
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/bits"
+	"math/rand"
+	"testing"
+)
+
+// stripe returns k random data shards of size bytes followed by m empty parity shards.
+func stripe(k, m, size int, seed int64) [][]byte {
+	rng := rand.New(rand.NewSource(seed))
+	shards := make([][]byte, k+m)
+	for i := range shards[:k] {
+		shards[i] = make([]byte, size)
+		rng.Read(shards[i])
+	}
+	return shards
+}
+
+func TestReconstructEveryLoss(t *testing.T) {
+	schemes := []struct{ k, m int }{{1, 1}, {2, 1}, {3, 2}, {4, 2}, {5, 3}, {10, 4}}
+	for _, s := range schemes {
+		t.Run(fmt.Sprintf("%d+%d", s.k, s.m), func(t *testing.T) {
+			coder, err := New(s.k, s.m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			shards := stripe(s.k, s.m, 100, int64(s.k*10+s.m))
+			if err := coder.Encode(shards); err != nil {
+				t.Fatal(err)
+			}
+
+			// Every set of lost shards is a bit mask over the k+m shards.
+			n := s.k + s.m
+			for lost := 0; lost < 1<<n; lost++ {
+				count := bits.OnesCount(uint(lost))
+				if count > s.m+1 {
+					continue
+				}
+				damaged := make([][]byte, n)
+				for i := range shards {
+					if lost&(1<<i) == 0 {
+						damaged[i] = append([]byte(nil), shards[i]...)
+					}
+				}
+				err := coder.Reconstruct(damaged)
+				if count > s.m {
+					if !errors.Is(err, ErrTooFewShards) {
+						t.Fatalf("losing shards %b: got %v, want ErrTooFewShards", lost, err)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("losing shards %b: %v", lost, err)
+				}
+				for i := range shards {
+					if !bytes.Equal(damaged[i], shards[i]) {
+						t.Fatalf("losing shards %b: shard %d reconstructed wrong", lost, i)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestShardSizeMismatch(t *testing.T) {
+	coder, err := New(3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := stripe(3, 2, 64, 1)
+	if err := coder.Encode(encoded); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		run  func(shards [][]byte) error
+		edit func(shards [][]byte)
+	}{
+		{"encode with a short data shard", coder.Encode, func(shards [][]byte) {
+			shards[1] = shards[1][:10]
+			shards[3], shards[4] = nil, nil
+		}},
+		{"reconstruct with a short data shard", coder.Reconstruct, func(shards [][]byte) {
+			shards[0] = nil
+			shards[2] = shards[2][:63]
+		}},
+		{"reconstruct with a long parity shard", coder.Reconstruct, func(shards [][]byte) {
+			shards[1] = nil
+			shards[4] = append(shards[4], 0)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shards := make([][]byte, len(encoded))
+			for i := range encoded {
+				shards[i] = append([]byte(nil), encoded[i]...)
+			}
+			tt.edit(shards)
+			if err := tt.run(shards); !errors.Is(err, ErrShardSize) {
+				t.Errorf("got %v, want ErrShardSize", err)
+			}
+		})
+	}
+}
+
+func TestNewRejectsSchemes(t *testing.T) {
+	for _, s := range []struct{ k, m int }{{0, 1}, {-1, 2}, {2, -1}, {200, 57}} {
+		if _, err := New(s.k, s.m); err == nil {
+			t.Errorf("New(%d, %d) accepted", s.k, s.m)
+		}
+	}
+	if _, err := New(200, 56); err != nil {
+		t.Errorf("New(200, 56) = %v", err)
+	}
+}
+
+func TestInvert(t *testing.T) {
+	tests := []struct {
+		name     string
+		matrix   [][]byte
+		singular bool
+	}{
+		{"identity", [][]byte{{1, 0}, {0, 1}}, false},
+		{"needs a row swap", [][]byte{{0, 3}, {5, 7}}, false},
+		{"vandermonde", [][]byte{{1, 1, 1}, {1, 2, 4}, {1, 3, 5}}, false},
+		{"zero column", [][]byte{{0, 1}, {0, 2}}, true},
+		{"repeated row", [][]byte{{1, 2, 3}, {4, 5, 6}, {1, 2, 3}}, true},
+		// The third row is the sum (XOR) of the first two.
+		{"dependent rows", [][]byte{{1, 2, 3}, {4, 5, 6}, {5, 7, 5}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inverse, err := invert(tt.matrix)
+			if tt.singular {
+				if err == nil {
+					t.Fatal("inverted a singular matrix")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for r, row := range multiply(tt.matrix, inverse) {
+				for c, v := range row {
+					want := byte(0)
+					if r == c {
+						want = 1
+					}
+					if v != want {
+						t.Fatalf("matrix x inverse has %d at %d,%d, want the identity", v, r, c)
+					}
+				}
+			}
+		})
+	}
+}
@@ -1,15 +1,25 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/signal"
+	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
+	"text/tabwriter"
 	"time"
 
+	"FDS/audit"
+	"FDS/crypto"
 	"FDS/p2p"
 )
 
@@ -17,16 +27,236 @@ func main() {
 	peerID := flag.String("id", "", "Unique peer ID")
 	bootstrapAddr := flag.String("bootstrap", "", "Bootstrap server address (host:port)")
 	fileRequest := flag.String("file", "", "Filename to request from peers")
-	targetPeer := flag.String("target", "", "Target peer ID to request file from")
+	dirRequest := flag.String("dir", "", "Directory to download recursively from the -target peer's shared folder (\".\" for all of it) and exit")
+	targetPeer := flag.String("target", "", "Target peer ID to request file from (default: download from every peer that has it)")
+	searchPattern := flag.String("search", "", "Search all peers for files matching a glob or substring and exit")
+	listFiles := flag.Bool("list", false, "List the files shared by the -target peer and exit")
+	jsonOutput := flag.Bool("json", false, "Print -list and -search output as JSON instead of a table")
+	rootHash := flag.String("hash", "", "Fetch a file by the root hash of its manifest from any peer that has its chunks")
+	storePath := flag.String("store", "", "Add a local file to the chunk store and print its root hash")
+	uploadPath := flag.String("upload", "", "Split a local file into chunks, push them to peers and exit (requires -tls-cert: peers only keep chunks pushed by an authenticated peer)")
+	retrieveName := flag.String("retrieve", "", "Reassemble a file uploaded with -upload from the peers holding its chunks and exit (requires -tls-cert)")
+	putPath := flag.String("put", "", "Upload a local file into the shared folder of the -target peer and exit")
+	acceptUploads := flag.Bool("accept-uploads", false, "Accept files other peers -put into the shared folder (requires -acl; limited to its writers)")
+	maxUpload := flag.Int64("max-upload", p2p.DefaultMaxUpload, "Largest file accepted with -accept-uploads, in bytes")
+	uploadQuota := flag.Int64("upload-quota", 0, "Most bytes the shared folder may hold after an accepted upload (0 means no limit)")
+	replicas := flag.Int("replicas", p2p.DefaultReplicas, "Peers each chunk is placed on by -upload and kept on by repair (both require -tls-cert)")
+	heldQuota := flag.Int64("held-quota", p2p.DefaultHeldQuota, "Most bytes of chunks each peer may -upload to this node (0 means no limit)")
+	erasureScheme := flag.String("erasure", "", "Store -store and -upload files with Reed-Solomon erasure coding, as data+parity shards (e.g. 4+2)")
+	chunker := flag.String("chunker", p2p.DefaultChunker.Algorithm, "How -store and -upload split files: fastcdc (content-defined) or fixed")
+	chunkMin := flag.Int("chunk-min", p2p.DefaultChunker.Min, "Smallest fastcdc chunk in bytes")
+	chunkAvg := flag.Int("chunk-avg", p2p.DefaultChunker.Avg, "Average fastcdc chunk in bytes")
+	chunkMax := flag.Int("chunk-max", p2p.DefaultChunker.Max, "Largest fastcdc chunk in bytes")
+	chunkSize := flag.Int("chunk-size", p2p.DefaultFixedChunker.Max, "Chunk size of -chunker fixed in bytes")
+	repairStatus := flag.Bool("repair-status", false, "Run a repair pass over the files uploaded with -upload, print its outcome and exit (requires -tls-cert)")
+	repairInterval := flag.Duration("repair-interval", time.Minute, "How often chunks uploaded by this node are re-replicated to -replicas live peers (requires -tls-cert; 0 disables)")
+	scrubInterval := flag.Duration("scrub-interval", time.Hour, "How often every stored chunk is re-verified, with corrupt ones quarantined and re-fetched (0 disables)")
+	syncPeers := flag.String("sync", "", "Comma-separated IDs of peers to keep the shared folder in sync with while running")
+	syncInterval := flag.Duration("sync-interval", 30*time.Second, "How often the shared folder is synced with the -sync peers")
+	watchFolder := flag.Bool("watch", false, "Watch the shared folder and log files added, modified, removed and renamed")
+	watchPoll := flag.Duration("watch-poll", 0, "Poll the shared folder at this interval instead of using inotify (0 uses inotify where available)")
+	announceChanges := flag.Bool("announce-changes", false, "Watch the shared folder and announce changes to peers that subscribe with -watch-peer")
+	watchPeer := flag.String("watch-peer", "", "Subscribe to the changes in this peer's shared folder and log them while running")
+	workers := flag.Int("workers", 4, "Parallel range requests when downloading from several peers")
+	certFile := flag.String("tls-cert", "", "Certificate for mutual TLS (enables TLS; a self-signed one is created if missing)")
+	keyFile := flag.String("tls-key", "", "Private key for the TLS certificate (default: keys/<id>/private.pem)")
+	trustDir := flag.String("trust-dir", "", "Directory of trusted peer or CA certificates")
+	aclFile := flag.String("acl", "", "JSON access policy for shared files and -store files, which share one namespace (default: everything public, so any peer can fetch -store files decrypted)")
+	auditLog := flag.String("audit-log", "", "Hash-chained audit log of file operations (default: audit-<id>.log)")
+	deleteName := flag.String("delete", "", "Delete a stored file's manifest and exit (run -gc to reclaim its chunks)")
+	runGC := flag.Bool("gc", false, "Remove chunks no stored file references and exit")
+	gcDryRun := flag.Bool("gc-dry-run", false, "List what -gc would remove without removing anything")
+	gcGrace := flag.Duration("gc-grace", p2p.DefaultGCGracePeriod, "Keep unreferenced chunks younger than this during -gc")
+	storeBackend := flag.String("store-backend", p2p.BackendFS, "Where chunks are kept: fs (a file per chunk), bolt (a single database file) or memory")
+	storeDir := flag.String("store-path", "chunks", "Directory (fs) or database file (bolt) of the chunk store")
+	history := flag.Bool("history", false, "Keep every version of the shared folder's files in the chunk store")
+	versionsOf := flag.String("versions", "", "List the versions of a shared file (of the -target peer's, if set) and exit")
+	versionNumber := flag.Int("version", 0, "Version for -restore, or of -file to fetch from -target")
+	restoreName := flag.String("restore", "", "Restore a shared file to -version and exit")
+	pruneVersions := flag.Bool("prune-versions", false, "Remove versions beyond -keep-versions or older than -version-max-age and exit (run -gc to reclaim their chunks)")
+	keepVersions := flag.Int("keep-versions", 0, "Versions -prune-versions keeps per file (0 keeps all)")
+	versionMaxAge := flag.Duration("version-max-age", 0, "Age beyond which -prune-versions removes versions (0 keeps all)")
+	verifyAudit := flag.String("verify-audit", "", "Verify the hash chain of an audit log and exit")
 	flag.Parse()
 
+	if *verifyAudit != "" {
+		n, err := audit.Verify(*verifyAudit)
+		if err != nil {
+			log.Fatalf("[ERROR] %v (%d entries valid before it)", err, n)
+		}
+		log.Printf("[INFO] Audit log %s intact: %d entries", *verifyAudit, n)
+		return
+	}
+
 	if *peerID == "" {
 		log.Fatalln("Please provide a peer ID using -id")
 	}
+
+	// Each node keeps its own chain; nodes sharing a working directory must not interleave entries.
+	if *auditLog == "" {
+		*auditLog = "audit-" + *peerID + ".log"
+	}
+	if err := audit.Init(*auditLog, *peerID); err != nil {
+		log.Fatalf("[ERROR] Failed to open audit log: %v", err)
+	}
+
+	// Local chunk store maintenance needs no network or keys
+	if *deleteName != "" || *runGC || *gcDryRun {
+		store, err := p2p.OpenStore(*storeBackend, *storeDir, nil)
+		if err != nil {
+			log.Fatalf("[ERROR] %v", err)
+		}
+		defer store.Close()
+		if *deleteName != "" {
+			if err := store.DeleteFile(*deleteName); err != nil {
+				log.Fatalf("[ERROR] %v", err)
+			}
+		}
+		if *runGC || *gcDryRun {
+			report, err := store.CollectGarbage(p2p.GCOptions{DryRun: *gcDryRun, GracePeriod: *gcGrace})
+			if err != nil {
+				log.Fatalf("[ERROR] %v", err)
+			}
+			if *gcDryRun {
+				for _, name := range report.Removed {
+					fmt.Println(name)
+				}
+			}
+		}
+		return
+	}
+
+	// Local version history commands need keys but no network
+	if (*versionsOf != "" && *targetPeer == "") || *restoreName != "" || *pruneVersions {
+		keys, err := crypto.LoadOrGenerateKeyPair(crypto.KeyDir(*peerID))
+		if err != nil {
+			log.Fatalf("[ERROR] Failed to load keys: %v", err)
+		}
+		store, err := p2p.OpenStore(*storeBackend, *storeDir, keys)
+		if err != nil {
+			log.Fatalf("[ERROR] %v", err)
+		}
+		defer store.Close()
+		folder := &p2p.SharedFolder{FolderPath: p2p.DefaultSharedFolder, History: store}
+
+		switch {
+		case *versionsOf != "":
+			versions, err := folder.Versions(*versionsOf)
+			if err != nil {
+				log.Fatalf("[ERROR] %v", err)
+			}
+			printVersions(versions, *jsonOutput)
+		case *restoreName != "":
+			if *versionNumber <= 0 {
+				log.Fatalln("Please provide the version to restore using -version")
+			}
+			if _, err := folder.RestoreVersion(*restoreName, *versionNumber); err != nil {
+				log.Fatalf("[ERROR] %v", err)
+			}
+		case *pruneVersions:
+			pruned, err := store.PruneVersions(p2p.PruneOptions{Keep: *keepVersions, MaxAge: *versionMaxAge})
+			if err != nil {
+				log.Fatalf("[ERROR] %v", err)
+			}
+			log.Printf("[INFO] Pruned %d versions", pruned)
+		}
+		return
+	}
+
 	if *bootstrapAddr == "" {
 		log.Fatalln("Please provide a bootstrap server address using -bootstrap")
 	}
 
+	// Chunks at rest are encrypted for this peer's key pair in keys/<id>/
+	keys, err := crypto.LoadOrGenerateKeyPair(crypto.KeyDir(*peerID))
+	if err != nil {
+		log.Fatalf("[ERROR] Failed to load keys: %v", err)
+	}
+	store, err := p2p.OpenStore(*storeBackend, *storeDir, keys)
+	if err != nil {
+		log.Fatalf("[ERROR] Failed to open chunk store: %v", err)
+	}
+	defer store.Close()
+	p2p.UseStore(store)
+	p2p.UseHeldQuota(*heldQuota)
+
+	if *certFile != "" {
+		if *trustDir == "" {
+			log.Fatalln("Please provide a trust store directory using -trust-dir")
+		}
+		if *keyFile == "" {
+			*keyFile = filepath.Join(crypto.KeyDir(*peerID), "private.pem")
+		}
+		if _, err := os.Stat(*certFile); os.IsNotExist(err) {
+			if err := crypto.GenerateSelfSignedCertificate(*peerID, keys, *certFile); err != nil {
+				log.Fatalf("[ERROR] Failed to create certificate: %v", err)
+			}
+			log.Printf("[INFO] Created self-signed certificate %s; add it to other nodes' trust stores", *certFile)
+		}
+		identity, err := crypto.LoadTLSIdentity(*certFile, *keyFile, *trustDir)
+		if err != nil {
+			log.Fatalf("[ERROR] Failed to load TLS identity: %v", err)
+		}
+		if identity.PeerID != *peerID {
+			log.Fatalf("[ERROR] Certificate %s was issued to %q, not %q", *certFile, identity.PeerID, *peerID)
+		}
+		p2p.UseTLS(identity)
+		log.Printf("[INFO] Mutual TLS enabled")
+	} else if *uploadPath != "" || *retrieveName != "" || *repairStatus || flagSet("repair-interval") && *repairInterval > 0 {
+		// Peers keep pushed chunks under the verified ID of their owner and refuse anonymous pushes
+		log.Fatalln("[ERROR] -upload, -retrieve and repair push or fetch chunks kept per peer, which requires mutual TLS; set -tls-cert and -trust-dir")
+	}
+
+	storeOpts, err := parseErasure(*erasureScheme)
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+	storeOpts.Chunker = &p2p.ChunkerConfig{Algorithm: *chunker, Min: *chunkMin, Avg: *chunkAvg, Max: *chunkMax}
+	if *chunker == p2p.ChunkerFixed {
+		storeOpts.Chunker = &p2p.ChunkerConfig{Algorithm: p2p.ChunkerFixed, Max: *chunkSize}
+	}
+	if err := storeOpts.Chunker.Validate(); err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+
+	if *storePath != "" {
+		f, err := os.Open(*storePath)
+		if err != nil {
+			log.Fatalf("[ERROR] Failed to read %s: %v", *storePath, err)
+		}
+		name := filepath.Base(*storePath)
+		err = store.StoreReaderWith(name, f, storeOpts)
+		f.Close()
+		if err != nil {
+			log.Fatalf("[ERROR] Failed to store %s: %v", name, err)
+		}
+		root, err := store.ResolveName(name)
+		if err != nil {
+			log.Fatalf("[ERROR] %v", err)
+		}
+		log.Printf("[INFO] Stored %s with root hash %s", name, root)
+	}
+
+	if *aclFile != "" {
+		policy, err := p2p.LoadAccessPolicy(*aclFile)
+		if err != nil {
+			log.Fatalf("[ERROR] %v", err)
+		}
+		p2p.UseAccessPolicy(policy)
+	}
+	if *acceptUploads {
+		if *aclFile == "" {
+			log.Fatalf("[ERROR] -accept-uploads requires an -acl policy naming the peers that may write")
+		}
+		p2p.UseUploads(p2p.UploadOptions{MaxFileSize: *maxUpload, Quota: *uploadQuota})
+	}
+
+	folder := p2p.NewSharedFolder(p2p.DefaultSharedFolder)
+	if *history {
+		folder.History = store
+	}
+	p2p.UseSharedFolder(folder)
+
 	ip := p2p.GetLocalIP()
 	listener, portStr, err := p2p.CreateTCPListener(ip, "0") // Auto-assign port
 	if err != nil {
@@ -86,6 +316,56 @@ func main() {
 		}
 	}()
 	
+	currentPeers := func() []p2p.BootstrapPeerInfo {
+		listMutex.Lock()
+		defer listMutex.Unlock()
+		peers := make([]p2p.BootstrapPeerInfo, 0, len(peerList))
+		for _, p := range peerList {
+			peers = append(peers, p)
+		}
+		return peers
+	}
+
+	// Keep chunks this node uploaded at their replication factor as peers go offline
+	repairer := p2p.NewRepairer(store, p2p.RepairOptions{Replicas: *replicas, Interval: *repairInterval}, currentPeers)
+	if *repairInterval > 0 && !*repairStatus && *certFile != "" {
+		go repairer.Run(quit)
+	}
+
+	// Catch chunks that rot on disk before they are needed
+	if *scrubInterval > 0 {
+		scrubber := p2p.NewScrubber(store, p2p.ScrubOptions{Interval: *scrubInterval}, currentPeers)
+		go scrubber.Run(quit)
+	}
+
+	// Keep the shared folder in sync with the -sync peers
+	if *syncPeers != "" && *syncInterval > 0 {
+		syncer := p2p.NewSyncer(folder, p2p.SyncOptions{Peers: strings.Split(*syncPeers, ","), Interval: *syncInterval}, currentPeers)
+		go syncer.Run(quit)
+	}
+
+	// Report changes to the shared folder as they happen
+	if *watchFolder || *announceChanges || *history {
+		watcher := p2p.NewFolderWatcher(folder, p2p.WatchOptions{PollInterval: *watchPoll, Poll: *watchPoll > 0})
+		if *history {
+			// Version files written into the folder directly, not just through uploads and sync
+			events, _ := watcher.Subscribe()
+			go folder.TrackVersions(events)
+		}
+		if *watchFolder {
+			events, _ := watcher.Subscribe()
+			go func() {
+				for event := range events {
+					logFileEvent("", event)
+				}
+			}()
+		}
+		if *announceChanges {
+			p2p.UseWatcher(watcher)
+		}
+		go watcher.Run(quit)
+	}
+
 	// Wait for a few seconds to allow the peer list to update
 	log.Printf("[INFO] Waiting for peers to register...")
 	time.Sleep(10 * time.Second)
@@ -95,34 +375,270 @@ func main() {
 		log.Printf("[INFO] Requesting file '%s' from peer %s via bootstrap...", *fileRequest, *targetPeer)
 
 		listMutex.Lock()
-		target, exists := peerList[*targetPeer]
+		target, err := lookupPeer(peerList, *targetPeer)
 		listMutex.Unlock()
+		if err != nil {
+			log.Fatalf("[ERROR] %v", err)
+		}
 
-		if !exists {
-			log.Fatalf("[ERROR] Peer %s not found in the bootstrap peer list", *targetPeer)
+		if *versionNumber > 0 {
+			destPath := "received_" + path.Base(*fileRequest)
+			if err := fetchVersion(store, target, *fileRequest, *versionNumber, destPath); err != nil {
+				log.Fatalf("[ERROR] Fetching version %d of %s failed: %v", *versionNumber, *fileRequest, err)
+			}
+			log.Printf("[INFO] Version %d of '%s' saved as '%s'", *versionNumber, *fileRequest, destPath)
+			close(quit)
+			close(stopHeartbeat)
+			return
 		}
 
-		// Extract IP and port from target.Addr
-		peerIP, peerPort := parsePeerAddress(target.Addr)
-		if peerIP == "" || peerPort == "" {
-			log.Fatalf("[ERROR] Invalid peer address format: %s", target.Addr)
+		// Stream the file straight to disk; it only appears under its final name once complete,
+		// and an interrupted transfer resumes from its .partial file when the command is rerun.
+		destPath := "received_" + path.Base(*fileRequest)
+		written, err := p2p.DownloadFile(target, *fileRequest, destPath)
+		if err != nil {
+			log.Fatalf("[ERROR] File request failed: %v", err)
 		}
+		log.Printf("[INFO] File '%s' received and saved as '%s' (%d bytes)", *fileRequest, destPath, written)
+	} else if *fileRequest != "" {
+		log.Printf("[INFO] Requesting file '%s' from all peers that have it...", *fileRequest)
+
+		listMutex.Lock()
+		peers := knownPeers(peerList)
+		listMutex.Unlock()
 
-		// Here RequestFile is called with a value of type p2p.Peer, constructed using the target's data.
-		fileData, err := p2p.RequestFile(p2p.Peer{
-			ID:   target.ID,
-			IP:   peerIP,
-			Port: peerPort,
-		}, *fileRequest)
+		destPath := "received_" + path.Base(*fileRequest)
+		written, err := p2p.SwarmDownload(peers, *fileRequest, destPath, p2p.SwarmOptions{Workers: *workers})
 		if err != nil {
 			log.Fatalf("[ERROR] File request failed: %v", err)
 		}
+		log.Printf("[INFO] File '%s' received and saved as '%s' (%d bytes)", *fileRequest, destPath, written)
+	}
+
+	// Download a directory tree of a peer's shared folder and exit
+	if *dirRequest != "" {
+		if *targetPeer == "" {
+			log.Fatalln("-dir requires -target, the peer to download the directory from")
+		}
+		listMutex.Lock()
+		target, err := lookupPeer(peerList, *targetPeer)
+		listMutex.Unlock()
+		if err != nil {
+			log.Fatalf("[ERROR] %v", err)
+		}
+		destPath := "received_" + path.Base(*dirRequest)
+		if path.Clean(*dirRequest) == "." {
+			destPath = "received_" + *targetPeer
+		}
+		result, err := p2p.DownloadDir(target, *dirRequest, destPath)
+		if err != nil {
+			log.Fatalf("[ERROR] Directory request failed: %v", err)
+		}
+		log.Printf("[INFO] Directory '%s' received and saved as '%s' (%d files in %d subdirectories, %d bytes)",
+			*dirRequest, destPath, result.Files, result.Dirs, result.Bytes)
+		for _, name := range result.Skipped {
+			log.Printf("[WARN] Not received: %s", name)
+		}
+
+		close(quit)
+		close(stopHeartbeat)
+		return
+	}
+
+	// Fetch content-addressed chunks by manifest hash
+	if *rootHash != "" {
+		log.Printf("[INFO] Fetching manifest %s from all peers...", *rootHash)
+
+		listMutex.Lock()
+		peers := knownPeers(peerList)
+		listMutex.Unlock()
+
+		destPath := "received_" + *rootHash
+		meta, err := store.DownloadByHash(peers, *rootHash, destPath)
+		if err != nil {
+			log.Fatalf("[ERROR] Fetch by hash failed: %v", err)
+		}
+		log.Printf("[INFO] File '%s' (%d chunks) received and saved as '%s'", meta.Filename, len(meta.ChunkHashes), destPath)
+	}
+
+	// Distribute a file's chunks across peers and exit
+	if *uploadPath != "" {
+		f, err := os.Open(*uploadPath)
+		if err != nil {
+			log.Fatalf("[ERROR] Failed to read %s: %v", *uploadPath, err)
+		}
+		listMutex.Lock()
+		peers := knownPeers(peerList)
+		listMutex.Unlock()
+
+		name := filepath.Base(*uploadPath)
+		root, err := store.DistributeReader(peers, name, f, *replicas, storeOpts)
+		f.Close()
+		if err != nil {
+			log.Fatalf("[ERROR] Upload failed: %v", err)
+		}
+		log.Printf("[INFO] Uploaded %s with root hash %s", name, root)
+
+		close(quit)
+		close(stopHeartbeat)
+		return
+	}
+
+	// Reassemble a distributed file and exit
+	if *retrieveName != "" {
+		listMutex.Lock()
+		peers := knownPeers(peerList)
+		listMutex.Unlock()
+
+		destPath := "received_" + *retrieveName
+		var written int64
+		err := saveAs(destPath, func(w io.Writer) (err error) {
+			written, err = store.RetrieveFromPeersTo(peers, *retrieveName, w)
+			return err
+		})
+		if err != nil {
+			log.Fatalf("[ERROR] Retrieval failed: %v", err)
+		}
+		log.Printf("[INFO] File '%s' reassembled and saved as '%s' (%d bytes)", *retrieveName, destPath, written)
+
+		close(quit)
+		close(stopHeartbeat)
+		return
+	}
+
+	// Run a repair pass, report it and exit
+	if *repairStatus {
+		status := repairer.RepairOnce()
+		if *jsonOutput {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			encoder.Encode(status)
+		} else {
+			fmt.Printf("%d files, %d chunks: %d under-replicated, %d copies made, %d still short (%s)\n",
+				status.Files, status.Chunks, status.UnderReplicated, status.Copied, status.Failed,
+				status.Finished.Sub(status.Started).Round(time.Millisecond))
+		}
+
+		close(quit)
+		close(stopHeartbeat)
+		return
+	}
+
+	// List the versions of a peer's shared file and exit
+	if *versionsOf != "" {
+		listMutex.Lock()
+		target, err := lookupPeer(peerList, *targetPeer)
+		listMutex.Unlock()
+		if err != nil {
+			log.Fatalf("[ERROR] %v", err)
+		}
+		versions, err := p2p.ListVersions(target, *versionsOf)
+		if err != nil {
+			log.Fatalf("[ERROR] Listing versions of %s on %s failed: %v", *versionsOf, *targetPeer, err)
+		}
+		printVersions(versions, *jsonOutput)
+
+		close(quit)
+		close(stopHeartbeat)
+		return
+	}
+
+	// List a peer's shared files and exit
+	if *listFiles {
+		if *targetPeer == "" {
+			log.Fatalln("Please provide the peer to list using -target")
+		}
+		listMutex.Lock()
+		target, err := lookupPeer(peerList, *targetPeer)
+		listMutex.Unlock()
+		if err != nil {
+			log.Fatalf("[ERROR] %v", err)
+		}
+
+		files, err := p2p.ListRemoteFiles(target)
+		if err != nil {
+			log.Fatalf("[ERROR] Listing files of %s failed: %v", *targetPeer, err)
+		}
+		if *jsonOutput {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			encoder.Encode(files)
+		} else {
+			printFileTable(files)
+		}
+
+		close(quit)
+		close(stopHeartbeat)
+		return
+	}
+
+	// Upload a file to a peer's shared folder and exit
+	if *putPath != "" {
+		if *targetPeer == "" {
+			log.Fatalln("Please provide the peer to upload to using -target")
+		}
+		listMutex.Lock()
+		target, err := lookupPeer(peerList, *targetPeer)
+		listMutex.Unlock()
+		if err != nil {
+			log.Fatalf("[ERROR] %v", err)
+		}
+
+		name := filepath.Base(*putPath)
+		sent, err := p2p.PutFile(target, *putPath, name)
+		if err != nil {
+			var rejected *p2p.PeerError
+			if errors.As(err, &rejected) {
+				log.Fatalf("[ERROR] %s rejected %s: %s (%s)", *targetPeer, name, rejected.Message, rejected.Code)
+			}
+			log.Fatalf("[ERROR] Upload of %s to %s failed: %v", name, *targetPeer, err)
+		}
+		log.Printf("[INFO] Uploaded %s to %s (%d bytes)", name, *targetPeer, sent)
+
+		close(quit)
+		close(stopHeartbeat)
+		return
+	}
+
+	// Search every known peer and exit
+	if *searchPattern != "" {
+		listMutex.Lock()
+		peers := knownPeers(peerList)
+		listMutex.Unlock()
+
+		results := p2p.SearchPeers(peers, *searchPattern)
+		if *jsonOutput {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			encoder.Encode(results)
+		} else {
+			printSearchTable(results)
+		}
+
+		close(quit)
+		close(stopHeartbeat)
+		return
+	}
 
-		// Save received file
-		if err := os.WriteFile("received_"+*fileRequest, fileData, 0644); err != nil {
-			log.Fatalf("[ERROR] Failed to save received file: %v", err)
+	// Follow the changes in another peer's shared folder until shutdown
+	if *watchPeer != "" {
+		listMutex.Lock()
+		target, err := lookupPeer(peerList, *watchPeer)
+		listMutex.Unlock()
+		if err != nil {
+			log.Fatalf("[ERROR] %v", err)
 		}
-		log.Printf("[INFO] File '%s' received and saved as 'received_%s'", *fileRequest, *fileRequest)
+		files, events, err := p2p.WatchPeer(target, quit)
+		if err != nil {
+			log.Fatalf("[ERROR] Failed to watch %s: %v", *watchPeer, err)
+		}
+		log.Printf("[INFO] Watching %s, which shares %d files", *watchPeer, len(files))
+		go func() {
+			for event := range events {
+				logFileEvent(*watchPeer, event)
+			}
+			log.Printf("[WARN] Stopped receiving changes from %s", *watchPeer)
+		}()
 	}
 
 	// Graceful shutdown on SIGINT/SIGTERM
@@ -135,6 +651,146 @@ func main() {
 	close(stopHeartbeat)
 }
 
+// parseErasure parses an erasure coding scheme given as "data+parity".
+func parseErasure(scheme string) (p2p.StoreOptions, error) {
+	var opts p2p.StoreOptions
+	if scheme == "" {
+		return opts, nil
+	}
+	data, parity, found := strings.Cut(scheme, "+")
+	dataShards, dataErr := strconv.Atoi(data)
+	parityShards, parityErr := strconv.Atoi(parity)
+	if !found || dataErr != nil || parityErr != nil || dataShards <= 0 || parityShards < 1 {
+		return opts, fmt.Errorf("invalid erasure scheme %q, expected data+parity with at least one parity shard, such as 4+2", scheme)
+	}
+	opts.DataShards, opts.ParityShards = dataShards, parityShards
+	return opts, nil
+}
+
+// flagSet reports whether the named flag was given on the command line.
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// lookupPeer finds a peer by ID in the bootstrap peer list.
+func lookupPeer(peerList map[string]p2p.BootstrapPeerInfo, id string) (p2p.Peer, error) {
+	target, exists := peerList[id]
+	if !exists {
+		return p2p.Peer{}, fmt.Errorf("peer %s not found in the bootstrap peer list", id)
+	}
+
+	// Extract IP and port from target.Addr
+	peerIP, peerPort := parsePeerAddress(target.Addr)
+	if peerIP == "" || peerPort == "" {
+		return p2p.Peer{}, fmt.Errorf("invalid peer address format: %s", target.Addr)
+	}
+	return p2p.Peer{ID: target.ID, IP: peerIP, Port: peerPort}, nil
+}
+
+// knownPeers converts the bootstrap peer list into peers that can be contacted.
+func knownPeers(peerList map[string]p2p.BootstrapPeerInfo) []p2p.Peer {
+	var peers []p2p.Peer
+	for _, p := range peerList {
+		peerIP, peerPort := parsePeerAddress(p.Addr)
+		if peerIP == "" || peerPort == "" {
+			continue
+		}
+		peers = append(peers, p2p.Peer{ID: p.ID, IP: peerIP, Port: peerPort})
+	}
+	return peers
+}
+
+// logFileEvent logs a change to the local shared folder, or to a peer's if peerID is set.
+func logFileEvent(peerID string, event p2p.FileEvent) {
+	where := "shared folder"
+	if peerID != "" {
+		where = peerID
+	}
+	if event.Type == p2p.FileRenamed {
+		log.Printf("[INFO] %s: %s renamed to %s", where, event.OldName, event.Name)
+		return
+	}
+	log.Printf("[INFO] %s: %s %s (%d bytes)", where, event.Name, event.Type, event.Size)
+}
+
+// printSearchTable writes search results as an aligned table.
+func printSearchTable(results []p2p.SearchResult) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PEER\tNAME\tSIZE\tSHA-256")
+	for _, r := range results {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", r.PeerID, r.Name, r.Size, r.Hash)
+	}
+	w.Flush()
+}
+
+// printFileTable writes a remote file listing as an aligned table.
+func printFileTable(files []p2p.RemoteFileInfo) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSIZE\tMODIFIED\tSHA-256")
+	for _, f := range files {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", f.Name, f.Size, f.ModTime.Format(time.RFC3339), f.Hash)
+	}
+	w.Flush()
+}
+
+// printVersions writes the versions of a file as JSON or an aligned table.
+func printVersions(versions []p2p.FileVersion, asJSON bool) {
+	if asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(versions)
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tSIZE\tMODIFIED\tRECORDED\tSHA-256")
+	for _, v := range versions {
+		if v.Removed {
+			fmt.Fprintf(w, "%d\t-\t-\t%s\tremoved\n", v.Version, v.Created.Format(time.RFC3339))
+			continue
+		}
+		fmt.Fprintf(w, "%d\t%d\t%s\t%s\t%s\n", v.Version, v.Size, v.ModTime.Format(time.RFC3339), v.Created.Format(time.RFC3339), v.Hash)
+	}
+	w.Flush()
+}
+
+// fetchVersion saves version of filename from peer's history at destPath. It
+// stages the version with saveAs rather than in destPath+".partial", which
+// belongs to a resumable -get of the current file.
+func fetchVersion(store *p2p.Store, peer p2p.Peer, filename string, version int, destPath string) error {
+	return saveAs(destPath, func(w io.Writer) error {
+		_, err := store.FetchVersion(peer, filename, version, w)
+		return err
+	})
+}
+
+// saveAs writes a file at destPath with write, into a temporary file next to
+// it that only replaces destPath once write succeeds, so a failed write
+// leaves nothing behind.
+func saveAs(destPath string, write func(w io.Writer) error) error {
+	file, err := os.CreateTemp(filepath.Dir(destPath), "."+filepath.Base(destPath)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	err = write(file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(file.Name(), 0644)
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), destPath)
+}
+
 // parsePeerAddress extracts IP and Port from the peer's Addr field
 func parsePeerAddress(addr string) (string, string) {
 	parts := strings.Split(addr, ":")
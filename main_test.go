@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestParseErasure(t *testing.T) {
+	tests := []struct {
+		scheme       string
+		data, parity int
+		wantErr      bool
+	}{
+		{"", 0, 0, false},
+		{"4+2", 4, 2, false},
+		{"1+1", 1, 1, false},
+		{"4+0", 0, 0, true},
+		{"0+2", 0, 0, true},
+		{"4-2", 0, 0, true},
+		{"four", 0, 0, true},
+		{"4+2x", 0, 0, true},
+		{"4+2+1", 0, 0, true},
+		{"4+", 0, 0, true},
+		{" 4+2", 0, 0, true},
+		{"+2", 0, 0, true},
+	}
+	for _, tt := range tests {
+		opts, err := parseErasure(tt.scheme)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseErasure(%q) = %v, want error %v", tt.scheme, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && (opts.DataShards != tt.data || opts.ParityShards != tt.parity) {
+			t.Errorf("parseErasure(%q) = %d+%d", tt.scheme, opts.DataShards, opts.ParityShards)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package p2p
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Machine-readable codes carried in the Code field of "error" messages.
+const (
+	CodeNotFound        = "not_found"
+	CodeInvalidPath     = "invalid_path"
+	CodeAccessDenied    = "access_denied"
+	CodeUnauthenticated = "unauthenticated"
+	CodeInvalidRange    = "invalid_range"
+	CodeUnreadable      = "unreadable"
+	CodeTooLarge        = "too_large"
+	CodeIntegrity       = "integrity"
+	CodeStoreFailed     = "store_failed"
+	CodeQuotaExceeded   = "quota_exceeded"
+)
+
+// PeerError is an "error" message received from a peer.
+// Code is empty for peers that predate error codes.
+type PeerError struct {
+	Code    string
+	Message string
+}
+
+func (e *PeerError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("peer responded with error: %s", e.Message)
+	}
+	return fmt.Sprintf("peer responded with error: %s (%s)", e.Message, e.Code)
+}
+
+// Visibility values for FileRule.
+const (
+	Public  = "public"
+	Private = "private"
+)
+
+// FileRule controls who may fetch a shared file. Private files are only
+// served to the listed peers, identified by their TLS certificates. Writers
+// lists the peers that may upload the file with put_file.
+type FileRule struct {
+	Visibility   string   `json:"visibility"`
+	AllowedPeers []string `json:"allowed_peers,omitempty"`
+	Writers      []string `json:"writers,omitempty"`
+}
+
+// AccessPolicy maps shared file and directory names, or path.Match patterns
+// such as "*.pdf", to rules. An entry containing a slash, other than a
+// trailing one, is matched against the whole path from the shared folder
+// ("docs/report.pdf", "private/*"); any other entry is matched against each
+// name in the path at any depth ("*.pdf", "notes.txt", "build"). An entry
+// that matches a directory covers everything under it; a trailing slash
+// ("private/") makes an entry match directories only. The nearest match
+// wins: the file's own, else that of the closest directory containing it.
+// At each level an exact entry beats a pattern, a whole-path entry beats a
+// per-name one, and patterns are tried in sorted order. Files matching no
+// entry get Default, which is public unless set otherwise.
+//
+//	{
+//	  "default": {"visibility": "public"},
+//	  "files": {
+//	    "private/": {"visibility": "private", "allowed_peers": ["alice"]},
+//	    "*.pdf": {"visibility": "private", "allowed_peers": ["alice", "bob"]},
+//	    "notes.txt": {"visibility": "public", "writers": ["alice"]}
+//	  }
+//	}
+type AccessPolicy struct {
+	Default FileRule            `json:"default"`
+	Files   map[string]FileRule `json:"files"`
+}
+
+// accessPolicy is consulted before serving files; nil serves every file.
+var accessPolicy *AccessPolicy
+
+// UseAccessPolicy makes the TCP server check policy before serving files.
+func UseAccessPolicy(policy *AccessPolicy) {
+	accessPolicy = policy
+}
+
+// LoadAccessPolicy reads an access policy from a JSON file.
+func LoadAccessPolicy(policyPath string) (*AccessPolicy, error) {
+	data, err := os.ReadFile(policyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read access policy: %w", err)
+	}
+	var policy AccessPolicy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return nil, fmt.Errorf("failed to parse access policy: %w", err)
+	}
+	return &policy, nil
+}
+
+// rule returns the rule governing filename, a directory if isDir is set: the
+// entry matching it, else the entry matching the nearest directory containing
+// it, else the default.
+func (p *AccessPolicy) rule(filename string, isDir bool) FileRule {
+	name := filepath.ToSlash(filepath.Clean(filepath.FromSlash(filename)))
+	keys := sortedKeys(p.Files)
+	for level := name; level != "." && level != "/"; level, isDir = path.Dir(level), true {
+		if key, ok := p.match(keys, level, isDir); ok {
+			return p.Files[key]
+		}
+	}
+	return p.Default
+}
+
+// match returns the first of keys matching the file or directory name, in
+// the order described by AccessPolicy.
+func (p *AccessPolicy) match(keys []string, name string, isDir bool) (string, bool) {
+	exact := []string{name}
+	if isDir {
+		exact = []string{name + "/", name}
+	}
+	for _, key := range exact {
+		if _, ok := p.Files[key]; ok {
+			return key, true
+		}
+	}
+	base := path.Base(name)
+	for _, wholePath := range []bool{true, false} {
+		for _, key := range keys {
+			pattern, dirOnly := strings.CutSuffix(key, "/")
+			if (dirOnly && !isDir) || strings.Contains(pattern, "/") != wholePath {
+				continue
+			}
+			target := name
+			if !wholePath {
+				target = base
+			}
+			if matched, _ := path.Match(pattern, target); matched {
+				return key, true
+			}
+		}
+	}
+	return "", false
+}
+
+// Check decides whether peerID may fetch filename. peerID is the verified
+// certificate ID, or "" on connections without TLS, which can only see public files.
+func (p *AccessPolicy) Check(filename, peerID string) *PeerError {
+	if p == nil {
+		return nil
+	}
+	return checkRule(p.rule(filename, false), peerID)
+}
+
+// CheckDir decides whether peerID may see the directory dir, such as in a
+// directory transfer. Files in it are checked on their own.
+func (p *AccessPolicy) CheckDir(dir, peerID string) *PeerError {
+	if p == nil {
+		return nil
+	}
+	return checkRule(p.rule(dir, true), peerID)
+}
+
+func checkRule(rule FileRule, peerID string) *PeerError {
+	if rule.Visibility != Private {
+		return nil
+	}
+	if peerID == "" {
+		return &PeerError{Code: CodeUnauthenticated, Message: "File requires an authenticated peer"}
+	}
+	for _, allowed := range rule.AllowedPeers {
+		if allowed == peerID {
+			return nil
+		}
+	}
+	return &PeerError{Code: CodeAccessDenied, Message: "Access denied"}
+}
+
+// CheckWrite decides whether peerID may upload filename: only authenticated
+// peers listed in the file's Writers may. Without a policy no peer may.
+func (p *AccessPolicy) CheckWrite(filename, peerID string) *PeerError {
+	if p == nil {
+		return &PeerError{Code: CodeAccessDenied, Message: "Uploads require an access policy naming writers"}
+	}
+	if peerID == "" {
+		return &PeerError{Code: CodeUnauthenticated, Message: "Uploads require an authenticated peer"}
+	}
+	for _, writer := range p.rule(filename, false).Writers {
+		if writer == peerID {
+			return nil
+		}
+	}
+	return &PeerError{Code: CodeAccessDenied, Message: "Access denied"}
+}
+
+func sortedKeys(m map[string]FileRule) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,62 @@
+package p2p
+
+import "testing"
+
+func TestAccessPolicyRule(t *testing.T) {
+	alice := FileRule{Visibility: Private, AllowedPeers: []string{"alice"}}
+	public := FileRule{Visibility: Public}
+	policy := &AccessPolicy{
+		Default: public,
+		Files: map[string]FileRule{
+			"private/":           alice,
+			"private/readme.txt": public,
+			"*.pdf":              alice,
+			"docs/*.pdf":         public,
+			"build":              alice,
+			"notes/":             alice,
+		},
+	}
+
+	tests := []struct {
+		name  string
+		isDir bool
+		want  FileRule
+	}{
+		{"report.pdf", false, alice},
+		{"papers/2024/report.pdf", false, alice},
+		{"docs/report.pdf", false, public},
+		{"docs/old/report.pdf", false, alice},
+		{"private", true, alice},
+		{"private/x.txt", false, alice},
+		{"private/x/y.txt", false, alice},
+		{"private/readme.txt", false, public},
+		{"./private//x.txt", false, alice},
+		{"src/build", true, alice},
+		{"src/build/out.txt", false, alice},
+		{"notes", false, public}, // a directory-only entry does not match a file
+		{"notes/todo.txt", false, alice},
+		{"readme.txt", false, public},
+		{"docs", true, public},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := policy.rule(tt.name, tt.isDir)
+			if got.Visibility != tt.want.Visibility || len(got.AllowedPeers) != len(tt.want.AllowedPeers) {
+				t.Errorf("rule(%q, %v) = %+v, want %+v", tt.name, tt.isDir, got, tt.want)
+			}
+		})
+	}
+
+	if err := policy.Check("private/x/y.txt", "alice"); err != nil {
+		t.Errorf("Check denied alice: %v", err)
+	}
+	if err := policy.Check("private/x/y.txt", "bob"); err == nil || err.Code != CodeAccessDenied {
+		t.Errorf("Check let bob in: %v", err)
+	}
+	if err := policy.CheckDir("private", "bob"); err == nil {
+		t.Error("CheckDir let bob see private")
+	}
+	if err := (*AccessPolicy)(nil).CheckDir("private", ""); err != nil {
+		t.Errorf("nil policy denied a directory: %v", err)
+	}
+}
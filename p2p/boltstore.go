@@ -0,0 +1,138 @@
+package p2p
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// BoltChunkStore keeps values in one bucket of an embedded bbolt database.
+// Each value is prefixed with its modification time, as Unix nanoseconds.
+type BoltChunkStore struct {
+	db     *bolt.DB
+	bucket []byte
+}
+
+// OpenBoltDB opens (or creates) a bbolt database file for BoltChunkStores.
+func OpenBoltDB(path string) (*bolt.DB, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open chunk database %s: %w", path, err)
+	}
+	return db, nil
+}
+
+// NewBoltChunkStore returns a store backed by the named bucket of db, creating the bucket if needed.
+func NewBoltChunkStore(db *bolt.DB, bucket string) (*BoltChunkStore, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create bucket %s: %w", bucket, err)
+	}
+	return &BoltChunkStore{db: db, bucket: []byte(bucket)}, nil
+}
+
+func encodeBoltValue(data []byte, modTime time.Time) []byte {
+	value := make([]byte, 8+len(data))
+	binary.BigEndian.PutUint64(value, uint64(modTime.UnixNano()))
+	copy(value[8:], data)
+	return value
+}
+
+func decodeBoltValue(value []byte) ([]byte, time.Time, error) {
+	if len(value) < 8 {
+		return nil, time.Time{}, errors.New("corrupt chunk database value")
+	}
+	return value[8:], time.Unix(0, int64(binary.BigEndian.Uint64(value))), nil
+}
+
+// Put stores data under key.
+func (s *BoltChunkStore) Put(key string, data []byte) error {
+	if err := validKey(key); err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(s.bucket).Put([]byte(key), encodeBoltValue(data, time.Now()))
+	})
+}
+
+// Get returns the value stored under key.
+func (s *BoltChunkStore) Get(key string) ([]byte, error) {
+	var data []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(s.bucket).Get([]byte(key))
+		if value == nil {
+			return fmt.Errorf("%s: %w", key, ErrChunkNotFound)
+		}
+		stored, _, err := decodeBoltValue(value)
+		// Values are only valid inside the transaction.
+		data = append([]byte(nil), stored...)
+		return err
+	})
+	return data, err
+}
+
+// Has reports whether key is stored.
+func (s *BoltChunkStore) Has(key string) (bool, error) {
+	found := false
+	err := s.db.View(func(tx *bolt.Tx) error {
+		found = tx.Bucket(s.bucket).Get([]byte(key)) != nil
+		return nil
+	})
+	return found, err
+}
+
+// Delete removes key.
+func (s *BoltChunkStore) Delete(key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(s.bucket).Delete([]byte(key))
+	})
+}
+
+// List returns every stored key in sorted order.
+func (s *BoltChunkStore) List() ([]string, error) {
+	var keys []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(s.bucket).ForEach(func(k, _ []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+	})
+	return keys, err
+}
+
+// Stat returns the size and modification time of key.
+func (s *BoltChunkStore) Stat(key string) (ChunkInfo, error) {
+	var info ChunkInfo
+	err := s.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(s.bucket).Get([]byte(key))
+		if value == nil {
+			return fmt.Errorf("%s: %w", key, ErrChunkNotFound)
+		}
+		data, modTime, err := decodeBoltValue(value)
+		info = ChunkInfo{Size: int64(len(data)), ModTime: modTime}
+		return err
+	})
+	return info, err
+}
+
+// Touch sets the modification time of key to now.
+func (s *BoltChunkStore) Touch(key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(s.bucket)
+		value := bucket.Get([]byte(key))
+		if value == nil {
+			return fmt.Errorf("%s: %w", key, ErrChunkNotFound)
+		}
+		data, _, err := decodeBoltValue(value)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(key), encodeBoltValue(data, time.Now()))
+	})
+}
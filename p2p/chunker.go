@@ -0,0 +1,184 @@
+package p2p
+
+import (
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// Chunker algorithms recorded in manifests.
+const (
+	ChunkerFixed   = "fixed"
+	ChunkerFastCDC = "fastcdc"
+)
+
+// maxChunkLimit bounds the largest chunk any chunker configuration may produce.
+const maxChunkLimit = 1 << 20
+
+// ChunkerConfig describes how a file's data was split into chunks. Fixed
+// chunking cuts every Max bytes. FastCDC cuts where a rolling hash of the
+// content matches, so boundaries move with the data: inserting bytes only
+// changes the chunks around the insertion, and the rest still deduplicate.
+// Its chunks are between Min and Max bytes and Avg bytes on average.
+type ChunkerConfig struct {
+	Algorithm string `json:"algorithm"`
+	Min       int    `json:"min,omitempty"`
+	Avg       int    `json:"avg,omitempty"`
+	Max       int    `json:"max"`
+}
+
+// DefaultChunker is used for files stored without an explicit chunker.
+var DefaultChunker = ChunkerConfig{Algorithm: ChunkerFastCDC, Min: 2048, Avg: 8192, Max: 65536}
+
+// DefaultFixedChunker cuts the 4096-byte chunks files were stored in before
+// content-defined chunking.
+var DefaultFixedChunker = ChunkerConfig{Algorithm: ChunkerFixed, Max: chunkSize}
+
+// Validate reports whether the configuration can be used to split files.
+func (c ChunkerConfig) Validate() error {
+	switch c.Algorithm {
+	case ChunkerFixed:
+		if c.Max <= 0 || c.Max > maxChunkLimit {
+			return fmt.Errorf("fixed chunk size must be between 1 and %d bytes", maxChunkLimit)
+		}
+	case ChunkerFastCDC:
+		if c.Min < 64 || c.Min >= c.Avg || c.Avg >= c.Max || c.Max > maxChunkLimit {
+			return fmt.Errorf("fastcdc sizes must satisfy 64 <= min < avg < max <= %d, got %d/%d/%d", maxChunkLimit, c.Min, c.Avg, c.Max)
+		}
+	default:
+		return fmt.Errorf("unknown chunker %q", c.Algorithm)
+	}
+	return nil
+}
+
+// Split cuts data into chunks and returns them with their SHA-256 hashes.
+func (c ChunkerConfig) Split(data []byte) ([][]byte, []string) {
+	if c.Algorithm == ChunkerFixed {
+		return chunkData(data, c.Max)
+	}
+
+	// Normalized chunking: a stricter mask before the average size and a
+	// looser one after it keep chunk sizes clustered around Avg.
+	avgBits := bits.Len(uint(c.Avg)) - 1
+	maskSmall := topBits(avgBits + 1)
+	maskLarge := topBits(avgBits - 1)
+
+	var chunks [][]byte
+	var hashes []string
+	for len(data) > 0 {
+		n := cutPoint(data, c.Min, c.Avg, c.Max, maskSmall, maskLarge)
+		chunks = append(chunks, data[:n])
+		hashes = append(hashes, hashChunk(data[:n]))
+		data = data[n:]
+	}
+	return chunks, hashes
+}
+
+// chunkReader cuts chunks from a stream at the same boundaries Split finds in
+// the whole data, holding no more than two maximum-size chunks in memory.
+type chunkReader struct {
+	config     ChunkerConfig
+	r          io.Reader
+	buf        []byte
+	start, end int
+	eof        bool
+}
+
+// newChunkReader returns a chunkReader that splits r with the configuration c.
+func (c ChunkerConfig) newChunkReader(r io.Reader) *chunkReader {
+	return &chunkReader{config: c, r: r, buf: make([]byte, 2*c.Max)}
+}
+
+// Next returns the next chunk, or io.EOF after the last one. The chunk is only
+// valid until the following call.
+func (cr *chunkReader) Next() ([]byte, error) {
+	// A cut is decided within the first Max bytes, so with that many buffered
+	// (or the rest of the stream) the boundary is the one Split would find.
+	if cr.end-cr.start < cr.config.Max && !cr.eof {
+		cr.end = copy(cr.buf, cr.buf[cr.start:cr.end])
+		cr.start = 0
+		for cr.end < len(cr.buf) && !cr.eof {
+			n, err := cr.r.Read(cr.buf[cr.end:])
+			cr.end += n
+			if err == io.EOF {
+				cr.eof = true
+			} else if err != nil {
+				return nil, err
+			}
+		}
+	}
+	data := cr.buf[cr.start:cr.end]
+	if len(data) == 0 {
+		return nil, io.EOF
+	}
+
+	c := cr.config
+	n := len(data)
+	if c.Algorithm == ChunkerFixed {
+		if n > c.Max {
+			n = c.Max
+		}
+	} else {
+		avgBits := bits.Len(uint(c.Avg)) - 1
+		n = cutPoint(data, c.Min, c.Avg, c.Max, topBits(avgBits+1), topBits(avgBits-1))
+	}
+	cr.start += n
+	return data[:n], nil
+}
+
+// cutPoint returns the length of the next FastCDC chunk at the start of data.
+func cutPoint(data []byte, min, avg, max int, maskSmall, maskLarge uint64) int {
+	n := len(data)
+	if n <= min {
+		return n
+	}
+	if n > max {
+		n = max
+	}
+	normal := avg
+	if normal > n {
+		normal = n
+	}
+
+	var fp uint64
+	i := min
+	for ; i < normal; i++ {
+		fp = fp<<1 + gearTable[data[i]]
+		if fp&maskSmall == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = fp<<1 + gearTable[data[i]]
+		if fp&maskLarge == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// topBits returns a mask of the n most significant bits. The gear hash shifts
+// left, so its top bits depend on the most recent bytes.
+func topBits(n int) uint64 {
+	if n <= 0 {
+		return 0
+	}
+	return ^uint64(0) << (64 - n)
+}
+
+// gearTable maps each byte to a random 64-bit value for the rolling hash. It
+// is generated from a fixed seed and must never change: chunk boundaries, and
+// so deduplication against existing chunks, depend on it.
+var gearTable [256]uint64
+
+func init() {
+	// splitmix64
+	state := uint64(0x46445343444331) // "FDSCDC1"
+	for i := range gearTable {
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		gearTable[i] = z ^ z>>31
+	}
+}
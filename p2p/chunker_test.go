@@ -0,0 +1,146 @@
+package p2p
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"slices"
+	"testing"
+	"testing/iotest"
+)
+
+func randomData(n int, seed int64) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func TestChunkerValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  ChunkerConfig
+		wantErr bool
+	}{
+		{"default", DefaultChunker, false},
+		{"default fixed", DefaultFixedChunker, false},
+		{"fixed without size", ChunkerConfig{Algorithm: ChunkerFixed}, true},
+		{"fixed too large", ChunkerConfig{Algorithm: ChunkerFixed, Max: maxChunkLimit + 1}, true},
+		{"fastcdc min too small", ChunkerConfig{Algorithm: ChunkerFastCDC, Min: 32, Avg: 128, Max: 256}, true},
+		{"fastcdc avg not above min", ChunkerConfig{Algorithm: ChunkerFastCDC, Min: 128, Avg: 128, Max: 256}, true},
+		{"fastcdc max too large", ChunkerConfig{Algorithm: ChunkerFastCDC, Min: 64, Avg: 128, Max: maxChunkLimit + 1}, true},
+		{"unknown", ChunkerConfig{Algorithm: "rabin", Max: 4096}, true},
+	}
+	for _, tt := range tests {
+		if err := tt.config.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: Validate = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+	if DefaultFixedChunker.Max != 4096 {
+		t.Errorf("fixed chunks default to %d bytes, want the original 4096", DefaultFixedChunker.Max)
+	}
+}
+
+func TestSplitBoundaries(t *testing.T) {
+	small := ChunkerConfig{Algorithm: ChunkerFastCDC, Min: 256, Avg: 1024, Max: 4096}
+	tests := []struct {
+		name   string
+		config ChunkerConfig
+		size   int
+	}{
+		{"fastcdc", small, 100000},
+		{"fastcdc shorter than min", small, 100},
+		{"fastcdc empty", small, 0},
+		{"default fastcdc", DefaultChunker, 300000},
+		{"fixed", DefaultFixedChunker, 10000},
+		{"fixed exact multiple", DefaultFixedChunker, 3 * 4096},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := randomData(tt.size, 1)
+			chunks, hashes := tt.config.Split(data)
+			if !bytes.Equal(bytes.Join(chunks, nil), data) {
+				t.Fatal("chunks do not add up to the data")
+			}
+			for i, chunk := range chunks {
+				last := i == len(chunks)-1
+				if len(chunk) > tt.config.Max || len(chunk) == 0 {
+					t.Errorf("chunk %d is %d bytes", i, len(chunk))
+				}
+				if !last && len(chunk) < tt.config.Min {
+					t.Errorf("chunk %d is %d bytes, below the %d minimum", i, len(chunk), tt.config.Min)
+				}
+				if tt.config.Algorithm == ChunkerFixed && !last && len(chunk) != tt.config.Max {
+					t.Errorf("fixed chunk %d is %d bytes", i, len(chunk))
+				}
+				if hashes[i] != hashChunk(chunk) {
+					t.Errorf("hash %d does not match its chunk", i)
+				}
+			}
+		})
+	}
+}
+
+// An insertion only changes the chunks around it, so most still deduplicate.
+func TestFastCDCInsertionLocality(t *testing.T) {
+	config := ChunkerConfig{Algorithm: ChunkerFastCDC, Min: 256, Avg: 1024, Max: 4096}
+	data := randomData(200000, 2)
+	edited := append(append(append([]byte(nil), data[:100000]...), "inserted"...), data[100000:]...)
+	_, before := config.Split(data)
+	_, after := config.Split(edited)
+	shared := 0
+	for _, hash := range after {
+		if slices.Contains(before, hash) {
+			shared++
+		}
+	}
+	if shared < len(before)-3 {
+		t.Errorf("only %d of %d chunks survived an 8-byte insertion", shared, len(before))
+	}
+}
+
+func TestChunkReaderMatchesSplit(t *testing.T) {
+	configs := []ChunkerConfig{
+		{Algorithm: ChunkerFastCDC, Min: 64, Avg: 256, Max: 1024},
+		DefaultChunker,
+		DefaultFixedChunker,
+		{Algorithm: ChunkerFixed, Max: 1000},
+	}
+	for _, config := range configs {
+		for _, size := range []int{0, 1, 1023, 1024, 1025, 70000, 300000} {
+			data := randomData(size, int64(size))
+			_, want := config.Split(data)
+			for _, reader := range []struct {
+				name string
+				r    io.Reader
+			}{
+				{"whole", bytes.NewReader(data)},
+				{"one byte at a time", iotest.OneByteReader(bytes.NewReader(data))},
+			} {
+				var got []string
+				chunks := config.newChunkReader(reader.r)
+				for {
+					chunk, err := chunks.Next()
+					if err == io.EOF {
+						break
+					}
+					if err != nil {
+						t.Fatal(err)
+					}
+					got = append(got, hashChunk(chunk))
+				}
+				if !slices.Equal(got, want) {
+					t.Errorf("%s %d/%d, %d bytes read %s: %d chunks differ from Split's %d",
+						config.Algorithm, config.Avg, config.Max, size, reader.name, len(got), len(want))
+				}
+			}
+		}
+	}
+}
+
+func TestChunkReaderError(t *testing.T) {
+	broken := io.MultiReader(bytes.NewReader(randomData(100, 3)), iotest.ErrReader(io.ErrUnexpectedEOF))
+	chunks := DefaultFixedChunker.newChunkReader(broken)
+	if _, err := chunks.Next(); err != io.ErrUnexpectedEOF {
+		t.Errorf("Next = %v, want the reader's error", err)
+	}
+}
@@ -0,0 +1,295 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrChunkNotFound is returned by ChunkStore.Get for a key that is not stored.
+var ErrChunkNotFound = errors.New("not found in chunk store")
+
+// ChunkStore is a flat key-value store for chunks and the metadata that
+// describes them. Keys are chunk hashes, "<root>.manifest" for manifests and
+// "<filename>.meta" for name records; they never contain path separators.
+type ChunkStore interface {
+	Put(key string, data []byte) error
+	Get(key string) ([]byte, error)
+	Has(key string) (bool, error)
+	Delete(key string) error
+	List() ([]string, error)
+}
+
+// ChunkInfo describes a stored value.
+type ChunkInfo struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// TimedChunkStore is a ChunkStore that tracks when each key was last written.
+// Garbage collection needs this for its grace period, and refreshes the time
+// of chunks that a new file reuses with Touch.
+type TimedChunkStore interface {
+	ChunkStore
+	Stat(key string) (ChunkInfo, error)
+	Touch(key string) error
+}
+
+// validKey rejects keys that a filesystem store could not safely map to a file name.
+func validKey(key string) error {
+	if key == "" || key == "." || key == ".." || strings.ContainsAny(key, "/\\\x00") {
+		return fmt.Errorf("invalid chunk store key %q", key)
+	}
+	return nil
+}
+
+// tmpSuffix ends the names of the files FileChunkStore.Put writes before
+// renaming them into place. No key ends with it.
+const tmpSuffix = ".tmp"
+
+// FileChunkStore keeps each key in a file of the same name under Root.
+type FileChunkStore struct {
+	Root string
+}
+
+// NewFileChunkStore returns a store rooted at the given directory, which is
+// created on the first Put.
+func NewFileChunkStore(root string) *FileChunkStore {
+	return &FileChunkStore{Root: root}
+}
+
+func (s *FileChunkStore) path(key string) (string, error) {
+	if err := validKey(key); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.Root, key), nil
+}
+
+// Put writes data under key, replacing any previous value. The data is
+// written to a temporary file of its own first, so readers never see a
+// partial value and concurrent Puts of one key each publish a whole one.
+func (s *FileChunkStore) Put(key string, data []byte) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.Root, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", s.Root, err)
+	}
+	tmp, err := os.CreateTemp(s.Root, key+".*"+tmpSuffix)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", key, err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", key, err)
+	}
+	return nil
+}
+
+// Get returns the value stored under key.
+func (s *FileChunkStore) Get(key string) ([]byte, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%s: %w", key, ErrChunkNotFound)
+	}
+	return data, err
+}
+
+// Has reports whether key is stored.
+func (s *FileChunkStore) Has(key string) (bool, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return false, err
+	}
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil && info.Mode().IsRegular(), err
+}
+
+// Delete removes key. Deleting a key that is not stored is not an error.
+func (s *FileChunkStore) Delete(key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// List returns every stored key in sorted order. Subdirectories, such as
+// another store rooted inside this one, and the temporary files of Puts in
+// progress are not part of it.
+func (s *FileChunkStore) List() ([]string, error) {
+	return s.files(false)
+}
+
+// leftovers returns the names of the temporary files of Puts in progress or
+// interrupted, such as by a crash, for garbage collection to remove once they
+// are past its grace period. Stat and Delete accept them like keys.
+func (s *FileChunkStore) leftovers() ([]string, error) {
+	return s.files(true)
+}
+
+// files returns the names of the regular files under Root that are
+// temporary files, or keys if temporary is false.
+func (s *FileChunkStore) files(temporary bool) ([]string, error) {
+	entries, err := os.ReadDir(s.Root)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", s.Root, err)
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && strings.HasSuffix(entry.Name(), tmpSuffix) == temporary {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+// Stat returns the size and modification time of the file holding key.
+func (s *FileChunkStore) Stat(key string) (ChunkInfo, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return ChunkInfo{}, err
+	}
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return ChunkInfo{}, fmt.Errorf("%s: %w", key, ErrChunkNotFound)
+	}
+	if err != nil {
+		return ChunkInfo{}, err
+	}
+	return ChunkInfo{Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+// Touch sets the modification time of key to now.
+func (s *FileChunkStore) Touch(key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	err = os.Chtimes(path, now, now)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%s: %w", key, ErrChunkNotFound)
+	}
+	return err
+}
+
+// MemoryChunkStore keeps values in memory. It is meant for tests and for
+// nodes that only relay chunks for others.
+type MemoryChunkStore struct {
+	mutex  sync.RWMutex
+	values map[string]memoryValue
+}
+
+type memoryValue struct {
+	data    []byte
+	modTime time.Time
+}
+
+// NewMemoryChunkStore returns an empty in-memory store.
+func NewMemoryChunkStore() *MemoryChunkStore {
+	return &MemoryChunkStore{values: make(map[string]memoryValue)}
+}
+
+// Put stores a copy of data under key.
+func (s *MemoryChunkStore) Put(key string, data []byte) error {
+	if err := validKey(key); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.values[key] = memoryValue{data: append([]byte(nil), data...), modTime: time.Now()}
+	return nil
+}
+
+// Get returns a copy of the value stored under key.
+func (s *MemoryChunkStore) Get(key string) ([]byte, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	value, ok := s.values[key]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", key, ErrChunkNotFound)
+	}
+	return append([]byte(nil), value.data...), nil
+}
+
+// Has reports whether key is stored.
+func (s *MemoryChunkStore) Has(key string) (bool, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	_, ok := s.values[key]
+	return ok, nil
+}
+
+// Delete removes key.
+func (s *MemoryChunkStore) Delete(key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.values, key)
+	return nil
+}
+
+// List returns every stored key in sorted order.
+func (s *MemoryChunkStore) List() ([]string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	keys := make([]string, 0, len(s.values))
+	for key := range s.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Stat returns the size and time of the last Put or Touch of key.
+func (s *MemoryChunkStore) Stat(key string) (ChunkInfo, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	value, ok := s.values[key]
+	if !ok {
+		return ChunkInfo{}, fmt.Errorf("%s: %w", key, ErrChunkNotFound)
+	}
+	return ChunkInfo{Size: int64(len(value.data)), ModTime: value.modTime}, nil
+}
+
+// Touch sets the modification time of key to now.
+func (s *MemoryChunkStore) Touch(key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	value, ok := s.values[key]
+	if !ok {
+		return fmt.Errorf("%s: %w", key, ErrChunkNotFound)
+	}
+	value.modTime = time.Now()
+	s.values[key] = value
+	return nil
+}
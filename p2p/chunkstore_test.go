@@ -0,0 +1,85 @@
+package p2p
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Concurrent Puts of one key, as when scrub or repair race StoreFile, each
+// publish a whole value, and their temporary files never show up as keys.
+func TestFileChunkStoreConcurrentPut(t *testing.T) {
+	store := NewFileChunkStore(t.TempDir())
+	var wg sync.WaitGroup
+	errs := make(chan error, 40)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(fill byte) {
+			defer wg.Done()
+			errs <- store.Put("key.meta", bytes.Repeat([]byte{fill}, 1<<16))
+			if keys, _ := store.List(); len(keys) > 0 && !slices.Equal(keys, []string{"key.meta"}) {
+				errs <- fmt.Errorf("listed %v", keys)
+			}
+		}(byte(i))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	data, err := store.Get("key.meta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 1<<16 || !bytes.Equal(data, bytes.Repeat(data[:1], len(data))) {
+		t.Errorf("got %d bytes of mixed values", len(data))
+	}
+	entries, _ := os.ReadDir(store.Root)
+	if len(entries) != 1 {
+		t.Errorf("%d files left in the store, want only the key", len(entries))
+	}
+}
+
+// Temporary files left by an interrupted Put are collected once past the grace period.
+func TestCollectGarbageRemovesLeftovers(t *testing.T) {
+	store := testStore(t)
+	files := NewFileChunkStore(t.TempDir())
+	store.chunks = files
+	if err := store.StoreFile("kept", []byte("kept contents")); err != nil {
+		t.Fatal(err)
+	}
+	old := filepath.Join(files.Root, "abc.manifest.123.tmp")
+	young := filepath.Join(files.Root, "def.manifest.456.tmp")
+	os.WriteFile(old, []byte("partial"), 0644)
+	os.WriteFile(young, []byte("partial"), 0644)
+	past := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(old, past, past)
+
+	keys, _ := files.List()
+	for _, key := range keys {
+		if filepath.Ext(key) == tmpSuffix {
+			t.Errorf("List returned %s", key)
+		}
+	}
+	report, err := store.CollectGarbage(GCOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(report.Removed, []string{filepath.Base(old)}) || report.Young != 1 {
+		t.Errorf("removed %v with %d young, want only %s", report.Removed, report.Young, filepath.Base(old))
+	}
+	if _, err := os.Stat(young); err != nil {
+		t.Errorf("young temporary file: %v", err)
+	}
+	if _, err := store.RetrieveFile("kept"); err != nil {
+		t.Errorf("kept is damaged: %v", err)
+	}
+}
@@ -2,16 +2,24 @@ package p2p
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
+	"sync"
 	"time"
+
+	"FDS/codec"
 )
 
 // CreateTCPListener sets up a TCP listener with proper error handling.
+// With UseTLS in effect, accepted connections require a trusted client certificate.
 func CreateTCPListener(ip, port string) (net.Listener, string, error) {
 	addr := net.JoinHostPort(ip, port)
 	listener, err := net.Listen("tcp", addr)
@@ -19,12 +27,53 @@ func CreateTCPListener(ip, port string) (net.Listener, string, error) {
 		return nil, "", fmt.Errorf("tcp listen failed on %s: %v", addr, err)
 	}
 	actualPort := listener.Addr().(*net.TCPAddr).Port
+	if tlsIdentity != nil {
+		listener = tls.NewListener(listener, tlsIdentity.ServerConfig())
+	}
 	return listener, fmt.Sprintf("%d", actualPort), nil
 }
 
+// transferIdleTimeout is how long a file transfer may go without receiving
+// anything from the serving peer before it is considered stalled.
+const transferIdleTimeout = 30 * time.Second
+
+// legacyPeers remembers addresses that answered the hello with a closed
+// connection, so later dials go straight to the JSON protocol.
+var legacyPeers sync.Map
+
+// dialPeer connects to a peer and negotiates the wire protocol, falling back
+// to plain JSON for peers that predate the binary codec.
+func dialPeer(peer Peer) (net.Conn, codec.Codec, error) {
+	addr := peer.Address()
+	if _, legacy := legacyPeers.Load(addr); !legacy {
+		conn, err := dialTCP(addr, peer.ID)
+		if err != nil {
+			return nil, nil, err
+		}
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		c, err := codec.ClientHandshake(conn)
+		if err == nil {
+			conn.SetDeadline(time.Time{})
+			return conn, c, nil
+		}
+		conn.Close()
+		if !errors.Is(err, codec.ErrLegacyPeer) {
+			return nil, nil, err
+		}
+		log.Printf("[DEBUG] Peer %s does not support the binary protocol, using JSON", addr)
+		legacyPeers.Store(addr, struct{}{})
+	}
+
+	conn, err := dialTCP(addr, peer.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, codec.NewJSONCodec(conn, conn), nil
+}
+
 // SendMessage allows a peer to send a message via TCP.
 func SendMessage(peer Peer, message string) error {
-	conn, err := net.DialTimeout("tcp", peer.Address(), 10*time.Second)
+	conn, c, err := dialPeer(peer)
 	if err != nil {
 		return fmt.Errorf("could not connect to peer %s: %w", peer.Address(), err)
 	}
@@ -35,68 +84,289 @@ func SendMessage(peer Peer, message string) error {
 		Content: []byte(message),
 	}
 
-	encoder := json.NewEncoder(conn)
-	if err := encoder.Encode(msg); err != nil {
+	if err := c.WriteMessage(msg); err != nil {
+		return fmt.Errorf("failed to send message: %w", err)
+	}
+	if err := c.Flush(); err != nil {
 		return fmt.Errorf("failed to send message: %w", err)
 	}
 	return nil
 }
 
 // RequestFile sends a file request and receives the file in chunks.
+// It buffers the whole file in memory; use RequestFileTo or DownloadFile for large files.
 func RequestFile(peer Peer, filename string) ([]byte, error) {
-	conn, err := net.DialTimeout("tcp", peer.Address(), 10*time.Second)
-	if err != nil {
-		return nil, fmt.Errorf("[ERROR] Failed to connect to peer %s: %w", peer.Address(), err)
+	var buf bytes.Buffer
+	if _, err := RequestFileTo(peer, filename, &buf); err != nil {
+		return nil, err
 	}
-	defer conn.Close()
+	return buf.Bytes(), nil
+}
+
+// IntegrityError reports a transferred chunk or file whose SHA-256 did not match
+// the digest sent by the serving peer. Chunk is -1 for the digest of the whole transfer.
+type IntegrityError struct {
+	Filename string
+	Chunk    int
+	Expected string
+	Actual   string
+}
+
+func (e *IntegrityError) Error() string {
+	if e.Chunk < 0 {
+		return fmt.Sprintf("integrity check failed for %s: file digest %s, expected %s", e.Filename, e.Actual, e.Expected)
+	}
+	return fmt.Sprintf("integrity check failed for %s: chunk %d digest %s, expected %s", e.Filename, e.Chunk, e.Actual, e.Expected)
+}
+
+// ErrUnverified is returned for a transfer the serving peer sent without the
+// digests needed to verify it, as peers that predate integrity checks do.
+var ErrUnverified = errors.New("peer sent no digest to verify the transfer against")
 
-	// Send file request as JSON
+// RequestFileTo sends a file request and streams the received chunks into w.
+// It returns the number of bytes written. The transfer only succeeds once the
+// peer has sent "end_of_file"; a connection closed earlier is reported as an error.
+// Each chunk is checked against its SHA-256 before it is written, and the whole
+// file against the digest in "end_of_file"; mismatches return an *IntegrityError,
+// and a chunk or "end_of_file" without a digest returns ErrUnverified.
+func RequestFileTo(peer Peer, filename string, w io.Writer) (int64, error) {
 	request := Message{
 		Type:     "request_file",
 		Filename: filename,
 	}
-	encoder := json.NewEncoder(conn)
+	return requestFile(peer, request, w, nil, 0)
+}
+
+// RequestFileRange is like RequestFileTo but only transfers length bytes starting
+// at offset. A length of zero requests everything up to the end of the file.
+func RequestFileRange(peer Peer, filename string, offset, length int64, w io.Writer) (int64, error) {
+	request := Message{
+		Type:     "request_file",
+		Filename: filename,
+		Offset:   offset,
+		Length:   length,
+	}
+	return requestFile(peer, request, w, func(info Message) error {
+		if info.Offset != offset {
+			return fmt.Errorf("[ERROR] Peer %s does not support byte-range requests", peer.ID)
+		}
+		return nil
+	}, 0)
+}
+
+// requestFile sends a request_file message and streams the response into w.
+// onInfo, if set, is called with the "file_info" message before the first chunk
+// is written. Peers that predate range requests send no file_info; onInfo then
+// receives one describing a full transfer from offset 0.
+// If the peer sends nothing for idle (transferIdleTimeout when zero), the
+// transfer is abandoned as stalled.
+func requestFile(peer Peer, request Message, w io.Writer, onInfo func(info Message) error, idle time.Duration) (int64, error) {
+	filename := request.Filename
+	conn, c, err := dialPeer(peer)
+	if err != nil {
+		return 0, fmt.Errorf("[ERROR] Failed to connect to peer %s: %w", peer.Address(), err)
+	}
+	defer conn.Close()
 
 	log.Printf("[DEBUG] Sending file request: %s to %s", filename, peer.Address())
 
-	if err := encoder.Encode(request); err != nil {
-		return nil, fmt.Errorf("[ERROR] Failed to send file request: %w", err)
+	if err := c.WriteMessage(request); err == nil {
+		err = c.Flush()
+	}
+	if err != nil {
+		return 0, fmt.Errorf("[ERROR] Failed to send file request: %w", err)
 	}
 
 	// Read file chunks
-	var receivedData []byte
-	decoder := json.NewDecoder(conn)
+	var written int64
+	rangeHash := sha256.New()
+	started := false
+	start := func(info Message) error {
+		started = true
+		if onInfo == nil {
+			return nil
+		}
+		return onInfo(info)
+	}
 
-	for {
-		var response Message
-		if err := decoder.Decode(&response); err != nil {
+	if idle <= 0 {
+		idle = transferIdleTimeout
+	}
+	for chunk := 0; ; {
+		conn.SetReadDeadline(time.Now().Add(idle))
+		response, err := c.ReadMessage()
+		if err != nil {
 			if err == io.EOF {
-				break
+				return written, fmt.Errorf("[ERROR] Connection closed before end of file (%d bytes received)", written)
 			}
-			return nil, fmt.Errorf("[ERROR] Error receiving file chunk: %w", err)
+			return written, fmt.Errorf("[ERROR] Error receiving file chunk: %w", err)
 		}
 
-		log.Printf("[DEBUG] Received message type: %s", response.Type)
-
-		if response.Type == "error" {
-			return nil, fmt.Errorf("[ERROR] Peer responded with error: %s", string(response.Content))
+		if !started && response.Type != "error" {
+			info := response
+			if response.Type != "file_info" {
+				info = Message{Type: "file_info", Filename: filename}
+			}
+			if err := start(info); err != nil {
+				return written, err
+			}
 		}
 
-		if response.Type == "send_file_chunk" {
-			log.Printf("[DEBUG] Received file chunk: %d bytes", len(response.Content))
-			receivedData = append(receivedData, response.Content...)
-		}
+		switch response.Type {
+		case "error":
+			return written, fmt.Errorf("[ERROR] %w", &PeerError{Code: response.Code, Message: string(response.Content)})
 
-		if response.Type == "end_of_file" {
-			log.Println("[DEBUG] File transfer complete!")
-			break
+		case "send_file_chunk":
+			if response.Hash == "" {
+				return written, fmt.Errorf("[ERROR] Rejected file chunk %d of %s: %w", chunk, filename, ErrUnverified)
+			}
+			if actual := hashChunk(response.Content); actual != response.Hash {
+				return written, fmt.Errorf("[ERROR] Rejected file chunk: %w", &IntegrityError{
+					Filename: filename,
+					Chunk:    chunk,
+					Expected: response.Hash,
+					Actual:   actual,
+				})
+			}
+			chunk++
+			rangeHash.Write(response.Content)
+			n, err := w.Write(response.Content)
+			written += int64(n)
+			if err != nil {
+				return written, fmt.Errorf("[ERROR] Failed to write file chunk: %w", err)
+			}
+
+		case "end_of_file":
+			if response.Hash == "" {
+				return written, fmt.Errorf("[ERROR] Rejected file %s: %w", filename, ErrUnverified)
+			}
+			if response.Length != written {
+				return written, fmt.Errorf("[ERROR] Truncated transfer of %s: received %d of %d bytes", filename, written, response.Length)
+			}
+			if actual := fmt.Sprintf("%x", rangeHash.Sum(nil)); actual != response.Hash {
+				return written, fmt.Errorf("[ERROR] Rejected file: %w", &IntegrityError{
+					Filename: filename,
+					Chunk:    -1,
+					Expected: response.Hash,
+					Actual:   actual,
+				})
+			}
+			log.Printf("[DEBUG] File transfer complete: %d bytes", written)
+			return written, nil
 		}
 	}
+}
+
+// RemoteFileInfo describes a file in a peer's shared folder.
+type RemoteFileInfo struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	Hash    string    `json:"hash"`
+}
+
+// StatFile asks a peer whether it shares filename and returns its size,
+// modification time and digest together with its chunk manifest.
+func StatFile(peer Peer, filename string) (RemoteFileInfo, MetaData, error) {
+	conn, c, err := dialPeer(peer)
+	if err != nil {
+		return RemoteFileInfo{}, MetaData{}, fmt.Errorf("could not connect to peer %s: %w", peer.Address(), err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(transferIdleTimeout))
+
+	request := Message{
+		Type:     "stat_file",
+		Filename: filename,
+	}
+	if err := c.WriteMessage(request); err == nil {
+		err = c.Flush()
+	}
+	if err != nil {
+		return RemoteFileInfo{}, MetaData{}, fmt.Errorf("failed to send stat request: %w", err)
+	}
+
+	response, err := c.ReadMessage()
+	if err != nil {
+		return RemoteFileInfo{}, MetaData{}, fmt.Errorf("failed to read stat response: %w", err)
+	}
+	if response.Type == "error" {
+		return RemoteFileInfo{}, MetaData{}, &PeerError{Code: response.Code, Message: string(response.Content)}
+	}
+	if response.Type != "file_info" {
+		return RemoteFileInfo{}, MetaData{}, fmt.Errorf("unexpected response type %q", response.Type)
+	}
 
-	// Confirm final data length before saving
-	log.Printf("[DEBUG] Total received file size: %d bytes", len(receivedData))
+	var manifest MetaData
+	if err := json.Unmarshal(response.Content, &manifest); err != nil {
+		return RemoteFileInfo{}, MetaData{}, fmt.Errorf("failed to decode manifest: %w", err)
+	}
+	info := RemoteFileInfo{
+		Name:    response.Filename,
+		Size:    response.Size,
+		ModTime: time.Unix(0, response.ModTime),
+		Hash:    response.Hash,
+	}
+	return info, manifest, nil
+}
+
+// fileListBatch is the most entries a file list request accepts per message;
+// it asks the peer to stream the list while it hashes its files.
+const fileListBatch = 256
+
+// ListRemoteFiles asks a peer for the files in its shared folder that it is
+// willing to serve to us.
+func ListRemoteFiles(peer Peer) ([]RemoteFileInfo, error) {
+	return queryFileList(peer, Message{Type: "list_files"})
+}
+
+// queryFileList sends a request answered with a file list and decodes the result.
+func queryFileList(peer Peer, request Message) ([]RemoteFileInfo, error) {
+	conn, c, err := dialPeer(peer)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to peer %s: %w", peer.Address(), err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(transferIdleTimeout))
+
+	request.Length = fileListBatch
+	if err := c.WriteMessage(request); err == nil {
+		err = c.Flush()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to send list request: %w", err)
+	}
+	return readFileList(conn, c)
+}
+
+// readFileList reads a file list, streamed in "file_list_part" messages or
+// whole, as sendFileList sends it. The idle deadline applies to each message,
+// so a peer still hashing a large folder is waited for as long as it keeps
+// sending.
+func readFileList(conn net.Conn, c codec.Codec) ([]RemoteFileInfo, error) {
+	files := []RemoteFileInfo{}
+	for {
+		conn.SetReadDeadline(time.Now().Add(transferIdleTimeout))
+		response, err := c.ReadMessage()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read file list: %w", err)
+		}
+		if response.Type == "error" {
+			return nil, &PeerError{Code: response.Code, Message: string(response.Content)}
+		}
+		if response.Type != "file_list" && response.Type != "file_list_part" {
+			return nil, fmt.Errorf("unexpected response type %q", response.Type)
+		}
 
-	return receivedData, nil
+		var part []RemoteFileInfo
+		if err := json.Unmarshal(response.Content, &part); err != nil {
+			return nil, fmt.Errorf("failed to decode file list: %w", err)
+		}
+		files = append(files, part...)
+		if response.Type == "file_list" {
+			return files, nil
+		}
+	}
 }
 
 // SaveFile writes received data to disk.
@@ -0,0 +1,170 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"FDS/codec"
+)
+
+// servePeer starts a listener that answers each connection's first request
+// with handle, and returns a Peer to dial it.
+func servePeer(t *testing.T, handle func(conn net.Conn, c codec.Codec, request Message)) Peer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				c, request, err := codec.ServerHandshake(conn)
+				if err != nil {
+					return
+				}
+				handle(conn, c, request)
+				c.Flush()
+			}()
+		}
+	}()
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	return Peer{ID: "peer", IP: host, Port: port}
+}
+
+// serveFolder serves dir with the real connection handler, with no access
+// policy unless the test sets one.
+func serveFolder(t *testing.T, dir string) Peer {
+	t.Helper()
+	folder, policy := servedFolder, accessPolicy
+	t.Cleanup(func() { servedFolder, accessPolicy = folder, policy })
+	servedFolder, accessPolicy = &SharedFolder{FolderPath: dir}, nil
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go handleConnection(conn, nil)
+		}
+	}()
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	return Peer{ID: "peer", IP: host, Port: port}
+}
+
+func digest(data []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(data))
+}
+
+func TestRequestFileToVerifies(t *testing.T) {
+	chunks := [][]byte{[]byte("hello "), []byte("world")}
+	whole := bytes.Join(chunks, nil)
+
+	tests := []struct {
+		name      string
+		chunkHash func(i int, chunk []byte) string
+		endHash   string
+		endLength int64
+		wantErr   func(error) bool
+	}{
+		{name: "verified",
+			chunkHash: func(i int, chunk []byte) string { return hashChunk(chunk) },
+			endHash:   digest(whole), endLength: int64(len(whole))},
+		{name: "chunk without digest",
+			chunkHash: func(i int, chunk []byte) string { return "" },
+			endHash:   digest(whole), endLength: int64(len(whole)),
+			wantErr: func(err error) bool { return errors.Is(err, ErrUnverified) }},
+		{name: "end of file without digest",
+			chunkHash: func(i int, chunk []byte) string { return hashChunk(chunk) },
+			endLength: int64(len(whole)),
+			wantErr:   func(err error) bool { return errors.Is(err, ErrUnverified) }},
+		{name: "corrupt chunk",
+			chunkHash: func(i int, chunk []byte) string { return hashChunk([]byte("other")) },
+			endHash:   digest(whole), endLength: int64(len(whole)),
+			wantErr: func(err error) bool {
+				var integrityErr *IntegrityError
+				return errors.As(err, &integrityErr) && integrityErr.Chunk == 0
+			}},
+		{name: "wrong file digest",
+			chunkHash: func(i int, chunk []byte) string { return hashChunk(chunk) },
+			endHash:   digest([]byte("other")), endLength: int64(len(whole)),
+			wantErr: func(err error) bool {
+				var integrityErr *IntegrityError
+				return errors.As(err, &integrityErr) && integrityErr.Chunk == -1
+			}},
+		{name: "truncated",
+			chunkHash: func(i int, chunk []byte) string { return hashChunk(chunk) },
+			endHash:   digest(whole), endLength: int64(len(whole)) + 1,
+			wantErr: func(err error) bool { return err != nil }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			peer := servePeer(t, func(conn net.Conn, c codec.Codec, request Message) {
+				c.WriteMessage(Message{Type: "file_info", Filename: request.Filename, Size: int64(len(whole)), Length: int64(len(whole))})
+				for i, chunk := range chunks {
+					c.WriteMessage(Message{Type: "send_file_chunk", Content: chunk, Hash: tt.chunkHash(i, chunk)})
+				}
+				c.WriteMessage(Message{Type: "end_of_file", Filename: request.Filename, Hash: tt.endHash, Length: tt.endLength})
+			})
+			var buf bytes.Buffer
+			_, err := RequestFileTo(peer, "a.txt", &buf)
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(buf.Bytes(), whole) {
+					t.Errorf("got %q, want %q", buf.Bytes(), whole)
+				}
+				return
+			}
+			if !tt.wantErr(err) {
+				t.Fatalf("unexpected error %v", err)
+			}
+		})
+	}
+}
+
+func TestRequestFileToPeerError(t *testing.T) {
+	peer := servePeer(t, func(conn net.Conn, c codec.Codec, request Message) {
+		sendError(c, request.Filename, CodeNotFound, "File not found")
+	})
+	_, err := RequestFileTo(peer, "missing.txt", new(bytes.Buffer))
+	var peerErr *PeerError
+	if !errors.As(err, &peerErr) || peerErr.Code != CodeNotFound {
+		t.Fatalf("got %v, want a not_found PeerError", err)
+	}
+}
+
+func TestRequestFileToServedFile(t *testing.T) {
+	dir := t.TempDir()
+	data := bytes.Repeat([]byte("0123456789"), chunkSize/3)
+	folder := &SharedFolder{FolderPath: dir}
+	if err := folder.AddFile("docs/data.bin", data); err != nil {
+		t.Fatal(err)
+	}
+	peer := serveFolder(t, dir)
+
+	var buf bytes.Buffer
+	written, err := RequestFileTo(peer, "docs/data.bin", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written != int64(len(data)) || !bytes.Equal(buf.Bytes(), data) {
+		t.Errorf("received %d bytes, want %d", written, len(data))
+	}
+}
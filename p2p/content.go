@@ -0,0 +1,231 @@
+package p2p
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"FDS/codec"
+	"FDS/crypto"
+)
+
+// sendChunk answers get_chunk from the local chunk store. Chunks of this
+// node's own files are decrypted and sent only if the request names, in
+// Filename, the root hash of a manifest that references the chunk and whose
+// file the access policy lets peerID fetch. Chunks peerID pushed to this node
+// are sent as stored, for it to decrypt.
+func sendChunk(c codec.Codec, request Message, peerID string) {
+	hash := request.Hash
+	if !isHash(hash) {
+		sendError(c, hash, CodeNotFound, "Chunk not found")
+		return
+	}
+	chunk, err := localStore.chunks.Get(hash)
+	if err == nil {
+		if denied := chunkAccess(request.Filename, hash, peerID); denied != nil {
+			log.Printf("[WARN] Denied chunk %s to peer %q: %s", hash, peerID, denied.Code)
+			sendError(c, hash, denied.Code, denied.Message)
+			return
+		}
+		if chunk, err = localStore.openChunk(hash, chunk); err != nil {
+			log.Printf("[ERROR] %v", err)
+			sendError(c, hash, CodeUnreadable, "Chunk not readable")
+			return
+		}
+	} else if chunk, err = localStore.readHeldChunk(peerID, hash); err != nil {
+		sendError(c, hash, CodeNotFound, "Chunk not found")
+		return
+	}
+	if err := c.WriteMessage(Message{Type: "chunk_data", Hash: hash, Content: chunk}); err == nil {
+		c.Flush()
+	}
+}
+
+// chunkAccess decides whether peerID may have one of this node's own chunks,
+// as part of the file whose manifest has the given root hash.
+func chunkAccess(root, hash, peerID string) *PeerError {
+	if root == "" {
+		return &PeerError{Code: CodeAccessDenied, Message: "Chunk requests must name a manifest"}
+	}
+	meta, err := localStore.loadManifest(root)
+	if err != nil {
+		return &PeerError{Code: CodeNotFound, Message: "Manifest not found"}
+	}
+	if !meta.references(hash) {
+		return &PeerError{Code: CodeAccessDenied, Message: "Chunk is not part of the manifest"}
+	}
+	return checkShared(meta.Filename, peerID)
+}
+
+// sendManifest answers get_manifest with the encoded manifest for a root hash,
+// subject to the access policy for the file it names.
+func sendManifest(c codec.Codec, root, peerID string) {
+	data, err := localStore.readManifestBytes(root)
+	if err != nil {
+		sendError(c, root, CodeNotFound, "Manifest not found")
+		return
+	}
+	var meta MetaData
+	if err := json.Unmarshal(data, &meta); err != nil {
+		sendError(c, root, CodeUnreadable, "Manifest not readable")
+		return
+	}
+	if denied := checkShared(meta.Filename, peerID); denied != nil {
+		sendError(c, root, denied.Code, denied.Message)
+		return
+	}
+	if err := c.WriteMessage(Message{Type: "manifest", Hash: root, Content: data}); err == nil {
+		c.Flush()
+	}
+}
+
+// fetchObject sends a get_chunk or get_manifest request and returns the payload
+// of the expected response type.
+func fetchObject(peer Peer, request Message, responseType string) ([]byte, error) {
+	conn, c, err := dialPeer(peer)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to peer %s: %w", peer.Address(), err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(transferIdleTimeout))
+
+	if err := c.WriteMessage(request); err == nil {
+		err = c.Flush()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to send %s request: %w", request.Type, err)
+	}
+	response, err := c.ReadMessage()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s response: %w", request.Type, err)
+	}
+	if response.Type == "error" {
+		return nil, &PeerError{Code: response.Code, Message: string(response.Content)}
+	}
+	if response.Type != responseType || response.Hash != request.Hash {
+		return nil, fmt.Errorf("unexpected response %q for %s", response.Type, request.Type)
+	}
+	return response.Content, nil
+}
+
+// FetchChunk retrieves a chunk by hash from a peer and verifies it. A chunk the
+// peer holds encrypted for this node is decrypted with the store's key pair.
+// root is the manifest the chunk is wanted for, which a peer serving chunks
+// of its own files checks access against; it may be empty for chunks this
+// node pushed to the peer.
+func (s *Store) FetchChunk(peer Peer, root, hash string) ([]byte, error) {
+	chunk, err := fetchObject(peer, Message{Type: "get_chunk", Hash: hash, Filename: root}, "chunk_data")
+	if err != nil {
+		return nil, err
+	}
+	if crypto.IsSealed(chunk) {
+		if chunk, err = s.openChunk(hash, chunk); err != nil {
+			return nil, err
+		}
+	}
+	if actual := hashChunk(chunk); actual != hash {
+		return nil, &IntegrityError{Filename: hash, Chunk: -1, Expected: hash, Actual: actual}
+	}
+	return chunk, nil
+}
+
+// FetchManifest retrieves the manifest with the given root hash from a peer
+// and verifies that it hashes to root. The parts of a manifest of manifests
+// are fetched from the same peer, verified the same way, and joined.
+func FetchManifest(peer Peer, root string) (MetaData, error) {
+	meta, err := fetchManifestPart(peer, root)
+	if err != nil {
+		return MetaData{}, err
+	}
+	return joinParts(meta, func(part string) (MetaData, error) {
+		return fetchManifestPart(peer, part)
+	})
+}
+
+// fetchManifestPart retrieves and verifies one manifest as the peer stores it.
+func fetchManifestPart(peer Peer, root string) (MetaData, error) {
+	data, err := fetchObject(peer, Message{Type: "get_manifest", Hash: root}, "manifest")
+	if err != nil {
+		return MetaData{}, err
+	}
+	if actual := hashChunk(data); actual != root {
+		return MetaData{}, &IntegrityError{Filename: root + ".manifest", Chunk: -1, Expected: root, Actual: actual}
+	}
+	var meta MetaData
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return MetaData{}, fmt.Errorf("failed to decode manifest %s: %w", root, err)
+	}
+	return meta, nil
+}
+
+// FetchByHash retrieves the file whose manifest has the given root hash,
+// taking the manifest and each chunk from whichever peer has it and verifying
+// every piece, and writes the file to w.
+func (s *Store) FetchByHash(peers []Peer, root string, w io.Writer) (MetaData, error) {
+	if len(peers) == 0 {
+		return MetaData{}, errors.New("no peers to fetch from")
+	}
+
+	var meta MetaData
+	var err error
+	next := 0
+	for i, peer := range peers {
+		if meta, err = FetchManifest(peer, root); err == nil {
+			next = i
+			break
+		}
+		log.Printf("[DEBUG] Manifest %s not available from %s: %v", root, peer.ID, err)
+	}
+	if err != nil {
+		return MetaData{}, fmt.Errorf("no peer could provide manifest %s: %w", root, err)
+	}
+
+	// Start each request at the peer that served the last one; it most likely has the rest.
+	_, err = assembleTo(w, meta, func(hash string) ([]byte, error) {
+		var chunk []byte
+		var err error
+		for attempt := 0; attempt < len(peers); attempt++ {
+			peer := peers[(next+attempt)%len(peers)]
+			if chunk, err = s.FetchChunk(peer, root, hash); err == nil {
+				next = (next + attempt) % len(peers)
+				return chunk, nil
+			}
+			log.Printf("[DEBUG] Chunk %s of %s not available from %s: %v", hash, root, peer.ID, err)
+		}
+		return nil, fmt.Errorf("no peer could provide chunk %s: %w", hash, err)
+	})
+	return meta, err
+}
+
+// DownloadByHash fetches a content-addressed file into destPath, writing it
+// under a temporary name first so a failed fetch leaves nothing behind. The
+// temporary file is unique, so it never touches the ".partial" file of a
+// resumable download of the same name.
+func (s *Store) DownloadByHash(peers []Peer, root, destPath string) (MetaData, error) {
+	file, err := os.CreateTemp(filepath.Dir(destPath), "."+filepath.Base(destPath)+".*.tmp")
+	if err != nil {
+		return MetaData{}, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	tmpPath := file.Name()
+	defer os.Remove(tmpPath)
+
+	meta, err := s.FetchByHash(peers, root, file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return meta, err
+	}
+	if err := os.Chmod(tmpPath, 0644); err != nil {
+		return meta, fmt.Errorf("failed to set permissions: %w", err)
+	}
+	if err := os.Rename(tmpPath, destPath); err != nil {
+		return meta, fmt.Errorf("failed to move file into place: %w", err)
+	}
+	return meta, nil
+}
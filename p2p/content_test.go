@@ -0,0 +1,131 @@
+package p2p
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"FDS/crypto"
+)
+
+var (
+	testKeysOnce sync.Once
+	testKeys     *crypto.KeyPair
+)
+
+// testStore returns a memory store with a key pair shared by the tests, and
+// makes it the store the TCP server serves until the test ends.
+func testStore(t *testing.T) *Store {
+	t.Helper()
+	testKeysOnce.Do(func() {
+		testKeys, _ = crypto.GenerateKeyPair(1024)
+	})
+	if testKeys == nil {
+		t.Fatal("key generation failed")
+	}
+	store := NewStore(NewMemoryChunkStore(), NewMemoryChunkStore(), testKeys)
+	previous := localStore
+	t.Cleanup(func() { localStore = previous })
+	localStore = store
+	return store
+}
+
+func TestSendChunkChecksManifest(t *testing.T) {
+	store := testStore(t)
+	peer := serveFolder(t, t.TempDir())
+	data := bytes.Repeat([]byte("content "), 1000)
+	if err := store.StoreFile("public.bin", data); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.StoreFile("secret.bin", []byte("secret contents")); err != nil {
+		t.Fatal(err)
+	}
+	publicRoot, _ := store.ResolveName("public.bin")
+	secretRoot, _ := store.ResolveName("secret.bin")
+	public, _ := store.loadManifest(publicRoot)
+	secret, _ := store.loadManifest(secretRoot)
+	held := []byte("sealed for someone else")
+	heldHash := hashChunk(held)
+	store.held.Put(heldHash, held)
+	accessPolicy = &AccessPolicy{Files: map[string]FileRule{"secret.bin": {Visibility: Private}}}
+
+	tests := []struct {
+		name     string
+		root     string
+		hash     string
+		want     []byte
+		wantCode string
+	}{
+		{"chunk of a public file", publicRoot, public.ChunkHashes[0], nil, ""},
+		{"chunk of a private file", secretRoot, secret.ChunkHashes[0], nil, CodeUnauthenticated},
+		{"private chunk through a public manifest", publicRoot, secret.ChunkHashes[0], nil, CodeAccessDenied},
+		{"no manifest", "", public.ChunkHashes[0], nil, CodeAccessDenied},
+		{"unknown manifest", hashChunk([]byte("none")), public.ChunkHashes[0], nil, CodeNotFound},
+		{"held chunk", "", heldHash, held, ""},
+		{"missing chunk", publicRoot, hashChunk([]byte("none")), nil, CodeNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := fetchObject(peer, Message{Type: "get_chunk", Hash: tt.hash, Filename: tt.root}, "chunk_data")
+			if tt.wantCode != "" {
+				var peerErr *PeerError
+				if !errors.As(err, &peerErr) || peerErr.Code != tt.wantCode {
+					t.Fatalf("got %v, want a %s error", err, tt.wantCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.want != nil && !bytes.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if tt.want == nil && hashChunk(got) != tt.hash {
+				t.Error("chunk was not sent decrypted")
+			}
+		})
+	}
+
+	var buf bytes.Buffer
+	if _, err := store.FetchByHash([]Peer{peer}, publicRoot, &buf); err != nil || !bytes.Equal(buf.Bytes(), data) {
+		t.Errorf("FetchByHash = %v, want the public file", err)
+	}
+}
+
+// A stored file is checked under the name its alias in the shared folder links to.
+func TestSendManifestChecksLinkedName(t *testing.T) {
+	store := testStore(t)
+	shared := t.TempDir()
+	os.WriteFile(filepath.Join(shared, "secret.bin"), []byte("secret"), 0644)
+	os.Symlink("secret.bin", filepath.Join(shared, "alias.bin"))
+	peer := serveFolder(t, shared)
+	accessPolicy = &AccessPolicy{Files: map[string]FileRule{"secret.bin": {Visibility: Private}}}
+	for _, name := range []string{"alias.bin", "public.bin"} {
+		if err := store.StoreFile(name, []byte("contents of "+name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	aliasRoot, _ := store.ResolveName("alias.bin")
+	publicRoot, _ := store.ResolveName("public.bin")
+
+	var peerErr *PeerError
+	if _, err := fetchObject(peer, Message{Type: "get_manifest", Hash: aliasRoot}, "manifest"); !errors.As(err, &peerErr) || peerErr.Code != CodeUnauthenticated {
+		t.Errorf("manifest through an alias: got %v, want an %s error", err, CodeUnauthenticated)
+	}
+
+	// A resumable download of the same name keeps its partial file.
+	dest := filepath.Join(t.TempDir(), "public.bin")
+	os.WriteFile(dest+".partial", []byte("resume me"), 0644)
+	if _, err := store.DownloadByHash([]Peer{peer}, publicRoot, dest); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(dest); string(got) != "contents of public.bin" {
+		t.Errorf("downloaded %q", got)
+	}
+	if got, _ := os.ReadFile(dest + ".partial"); string(got) != "resume me" {
+		t.Errorf("partial file is now %q", got)
+	}
+}
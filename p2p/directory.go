@@ -0,0 +1,328 @@
+package p2p
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"FDS/audit"
+	"FDS/codec"
+)
+
+// DirTransfer summarizes a directory downloaded with DownloadDir.
+type DirTransfer struct {
+	Dirs    int      `json:"dirs"`
+	Files   int      `json:"files"`
+	Bytes   int64    `json:"bytes"`
+	Skipped []string `json:"skipped"` // files the peer could not send
+}
+
+// isRootDir reports whether a requested directory name means the whole shared folder.
+func isRootDir(dir string) bool {
+	return dir == "" || path.Clean(dir) == "."
+}
+
+// receiveDirRequest handles request_dir and records it in the audit log.
+func receiveDirRequest(conn net.Conn, c codec.Codec, request Message) {
+	peerID := remotePeerID(conn)
+	files, sent, err := sendDirectory(c, request.Filename, peerID)
+	audit.Record(audit.Event{
+		Type:     "dir_request",
+		PeerID:   peerID,
+		Remote:   conn.RemoteAddr().String(),
+		Filename: request.Filename,
+		Bytes:    sent,
+		Outcome:  deniedOutcome(err),
+		Detail:   fmt.Sprintf("%d files", files),
+		Err:      err,
+	})
+}
+
+// pendingDir is a subdirectory whose "dir_entry" is held back until something
+// in it is sent.
+type pendingDir struct {
+	name   string
+	info   os.FileInfo
+	denied bool // something under it may not be sent to the peer
+}
+
+// sendDirectory answers request_dir with the directory's tree: a "dir_entry"
+// for the directory itself and each subdirectory, and each file the peer may
+// fetch as sendFile sends it ("file_info", chunks, "end_of_file"), finished by
+// "end_of_dir". Names are slash-separated paths relative to the shared folder.
+// Every entry is checked with Resolve, so symlinks leading out of the folder
+// are skipped; symlinked directories are not followed at all. A subdirectory
+// is only sent once a file in it is, or if it is empty and the access policy
+// lets the peer see it, so the names of directories holding nothing the peer
+// may fetch are not revealed.
+func sendDirectory(c codec.Codec, dir, peerID string) (int, int64, error) {
+	dirPath := servedFolder.FolderPath
+	if isRootDir(dir) {
+		dir = "."
+	} else {
+		resolved, err := servedFolder.Resolve(dir)
+		if err != nil {
+			log.Printf("[WARN] Rejected request for directory %q: %v", dir, err)
+			return 0, 0, sendError(c, dir, CodeInvalidPath, "Invalid directory path")
+		}
+		dirPath = resolved
+		dir = path.Clean(filepath.ToSlash(dir))
+		if denied := checkSharedDir(dir, peerID); denied != nil {
+			return 0, 0, sendError(c, dir, denied.Code, denied.Message)
+		}
+	}
+	stat, err := os.Stat(dirPath)
+	if err != nil || !stat.IsDir() {
+		return 0, 0, sendError(c, dir, CodeNotFound, "Directory not found")
+	}
+	if err := writeDirEntry(c, dir, stat); err != nil {
+		return 0, 0, err
+	}
+
+	// pending holds the subdirectories being walked whose entries are not sent yet, outermost first.
+	var pending []pendingDir
+	flush := func() error {
+		for _, d := range pending {
+			if err := writeDirEntry(c, d.name, d.info); err != nil {
+				return err
+			}
+		}
+		pending = pending[:0]
+		return nil
+	}
+	// leave closes the pending directories that do not contain name, sending
+	// those that turned out empty and visible.
+	leave := func(name string) error {
+		for len(pending) > 0 {
+			last := pending[len(pending)-1]
+			if strings.HasPrefix(name, last.name+"/") {
+				return nil
+			}
+			if last.denied || checkSharedDir(last.name, peerID) != nil {
+				pending = pending[:len(pending)-1]
+				if len(pending) > 0 {
+					pending[len(pending)-1].denied = true
+				}
+				continue
+			}
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	files := 0
+	var sent int64
+	err = filepath.WalkDir(dirPath, func(filePath string, entry fs.DirEntry, err error) error {
+		if filePath == dirPath {
+			return nil
+		}
+		if err != nil {
+			log.Printf("[WARN] Skipping %s: %v", filePath, err)
+			return nil
+		}
+		rel, err := filepath.Rel(servedFolder.FolderPath, filePath)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if !tracked(name) {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if _, err := servedFolder.Resolve(name); err != nil {
+			log.Printf("[WARN] Not sending %s: %v", name, err)
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if err := leave(name); err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			info, err := entry.Info()
+			if err != nil {
+				return nil
+			}
+			pending = append(pending, pendingDir{name: name, info: info})
+			return nil
+		}
+		if checkShared(name, peerID) != nil {
+			for i := range pending {
+				pending[i].denied = true
+			}
+			return nil
+		}
+		if info, err := os.Stat(filePath); err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+		if err := flush(); err != nil {
+			return err
+		}
+		n, err := sendFile(c, Message{Filename: name}, peerID)
+		sent += n
+		var peerErr *PeerError
+		if errors.As(err, &peerErr) {
+			// Already reported to the peer, which skips the file.
+			return nil
+		}
+		if err == nil {
+			files++
+		}
+		return err
+	})
+	if err == nil {
+		err = leave("")
+	}
+	if err != nil {
+		log.Printf("[ERROR] Failed to send directory %s: %v", dir, err)
+		return files, sent, err
+	}
+
+	if err := c.WriteMessage(Message{Type: "end_of_dir", Filename: dir, Size: sent, Length: int64(files)}); err == nil {
+		err = c.Flush()
+	}
+	log.Printf("[DEBUG] Directory %s sent (%d files, %d bytes)", dir, files, sent)
+	return files, sent, err
+}
+
+func writeDirEntry(c codec.Codec, name string, info os.FileInfo) error {
+	return c.WriteMessage(Message{
+		Type:     "dir_entry",
+		Filename: name,
+		ModTime:  info.ModTime().UnixNano(),
+		Mode:     uint32(info.Mode().Perm()),
+	})
+}
+
+// DownloadDir requests a directory of peer's shared folder ("." for all of it)
+// and recreates it under destDir, with the permissions and modification times
+// the peer reports. Each file is verified chunk by chunk and in full, and only
+// appears under its final name once complete. Every name the peer sends must
+// lie inside the requested directory and, once mapped into destDir, inside
+// destDir; anything else aborts the transfer.
+func DownloadDir(peer Peer, dir, destDir string) (DirTransfer, error) {
+	var result DirTransfer
+	conn, c, err := dialPeer(peer)
+	if err != nil {
+		return result, fmt.Errorf("could not connect to peer %s: %w", peer.Address(), err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(transferIdleTimeout))
+	if err := c.WriteMessage(Message{Type: "request_dir", Filename: dir}); err == nil {
+		err = c.Flush()
+	}
+	if err != nil {
+		return result, fmt.Errorf("failed to send directory request: %w", err)
+	}
+	first, err := c.ReadMessage()
+	if err != nil {
+		return result, fmt.Errorf("failed to read directory response: %w", err)
+	}
+	if first.Type == "error" {
+		return result, &PeerError{Code: first.Code, Message: string(first.Content)}
+	}
+	if first.Type != "dir_entry" {
+		return result, fmt.Errorf("unexpected response type %q", first.Type)
+	}
+
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return result, fmt.Errorf("failed to create %s: %w", destDir, err)
+	}
+	dest := &SharedFolder{FolderPath: destDir}
+	prefix := ""
+	if !isRootDir(dir) {
+		prefix = path.Clean(filepath.ToSlash(dir)) + "/"
+	}
+	// localName maps a name from the peer into destDir, rejecting any that would leave it.
+	localName := func(name string) (string, string, error) {
+		rel, ok := strings.CutPrefix(name, prefix)
+		if !ok || rel == "" {
+			return "", "", fmt.Errorf("peer sent %q outside the requested directory", name)
+		}
+		localPath, err := dest.Resolve(rel)
+		if err != nil {
+			return "", "", fmt.Errorf("peer sent %q: %w", name, err)
+		}
+		return rel, localPath, nil
+	}
+
+	// Directory permissions are applied last, so a read-only directory can still be filled.
+	type dirMode struct {
+		path    string
+		mode    os.FileMode
+		modTime time.Time
+	}
+	dirs := []dirMode{{destDir, os.FileMode(first.Mode).Perm(), time.Unix(0, first.ModTime)}}
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(transferIdleTimeout))
+		msg, err := c.ReadMessage()
+		if err != nil {
+			return result, fmt.Errorf("directory transfer interrupted: %w", err)
+		}
+		switch msg.Type {
+		case "dir_entry":
+			_, localPath, err := localName(msg.Filename)
+			if err != nil {
+				return result, err
+			}
+			if err := os.MkdirAll(localPath, 0755); err != nil {
+				return result, fmt.Errorf("failed to create %s: %w", localPath, err)
+			}
+			dirs = append(dirs, dirMode{localPath, os.FileMode(msg.Mode).Perm(), time.Unix(0, msg.ModTime)})
+			result.Dirs++
+
+		case "file_info":
+			rel, localPath, err := localName(msg.Filename)
+			if err != nil {
+				return result, err
+			}
+			stream := &streamReader{conn: conn, c: c, filename: msg.Filename, remaining: msg.Size, digest: sha256.New()}
+			written, err := dest.AddFileFrom(rel, stream)
+			result.Bytes += written
+			if err != nil {
+				// The stream cannot be resynchronized after a failed file.
+				return result, err
+			}
+			if err := os.Chmod(localPath, os.FileMode(msg.Mode).Perm()); err != nil {
+				log.Printf("[WARN] Failed to set permissions of %s: %v", localPath, err)
+			}
+			modTime := time.Unix(0, msg.ModTime)
+			if err := os.Chtimes(localPath, modTime, modTime); err != nil {
+				log.Printf("[WARN] Failed to set modification time of %s: %v", localPath, err)
+			}
+			result.Files++
+
+		case "error":
+			log.Printf("[WARN] Peer could not send %s: %s", msg.Filename, msg.Content)
+			result.Skipped = append(result.Skipped, msg.Filename)
+
+		case "end_of_dir":
+			for i := len(dirs) - 1; i >= 0; i-- {
+				if err := os.Chmod(dirs[i].path, dirs[i].mode); err != nil {
+					log.Printf("[WARN] Failed to set permissions of %s: %v", dirs[i].path, err)
+				}
+				os.Chtimes(dirs[i].path, dirs[i].modTime, dirs[i].modTime)
+			}
+			return result, nil
+
+		default:
+			return result, fmt.Errorf("unexpected %q message during directory transfer", msg.Type)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package p2p
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// Directories holding nothing the peer may fetch are not revealed to it.
+func TestDownloadDirHidesDeniedDirs(t *testing.T) {
+	shared := t.TempDir()
+	for _, dir := range []string{"docs/papers", "private/deep", "reports", "empty", "secret/empty"} {
+		os.MkdirAll(filepath.Join(shared, dir), 0755)
+	}
+	for name, data := range map[string]string{
+		"docs/a.txt":          "a",
+		"docs/papers/p.pdf":   "p",
+		"private/deep/x.txt":  "x",
+		"private/readme.txt":  "r",
+		"reports/summary.pdf": "s",
+	} {
+		os.WriteFile(filepath.Join(shared, name), []byte(data), 0644)
+	}
+	peer := serveFolder(t, shared)
+	alice := FileRule{Visibility: Private, AllowedPeers: []string{"alice"}}
+	accessPolicy = &AccessPolicy{Files: map[string]FileRule{
+		"private/":           alice,
+		"private/readme.txt": {Visibility: Public},
+		"*.pdf":              alice,
+		"secret":             alice,
+	}}
+
+	dest := t.TempDir()
+	result, err := DownloadDir(peer, ".", dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	filepath.WalkDir(dest, func(p string, _ os.DirEntry, err error) error {
+		if rel, _ := filepath.Rel(dest, p); rel != "." {
+			got = append(got, filepath.ToSlash(rel))
+		}
+		return err
+	})
+	want := []string{"docs", "docs/a.txt", "empty", "private", "private/readme.txt"}
+	if !slices.Equal(got, want) {
+		t.Errorf("received %v, want %v", got, want)
+	}
+	if result.Dirs != 3 || result.Files != 2 {
+		t.Errorf("got %d dirs and %d files, want 3 and 2", result.Dirs, result.Files)
+	}
+
+	tests := []struct {
+		dir      string
+		wantCode string // "" if the directory must be sent
+	}{
+		{"docs", ""},
+		{"private/deep", CodeUnauthenticated},
+		{"secret/empty", CodeUnauthenticated},
+		{"missing", CodeNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.dir, func(t *testing.T) {
+			_, err := DownloadDir(peer, tt.dir, t.TempDir())
+			if tt.wantCode == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			var peerErr *PeerError
+			if !errors.As(err, &peerErr) || peerErr.Code != tt.wantCode {
+				t.Fatalf("got %v, want a %s error", err, tt.wantCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,238 @@
+package p2p
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// checkpointInterval is how many bytes are written to a .partial file between
+// state checkpoints. A crash loses at most this much progress.
+const checkpointInterval = 4 << 20
+
+// downloadState is the sidecar saved next to a .partial file so an interrupted
+// download can be resumed. Size and ModTime identify the version of the remote
+// file the partial data belongs to.
+type downloadState struct {
+	Filename string `json:"filename"`
+	Size     int64  `json:"size"`
+	ModTime  int64  `json:"mod_time"`
+	Offset   int64  `json:"offset"`
+}
+
+// DownloadFile requests a file from a peer and streams it into destPath+".partial".
+// Progress is recorded in destPath+".partial.state", so calling DownloadFile again
+// after a dropped connection resumes from the last verified byte instead of
+// starting over. The partial file is renamed to destPath only after the peer
+// signals "end_of_file" and, for a resumed download, the whole file has been
+// checked against the peer's digest, so a failed transfer never leaves a
+// truncated or corrupt file under the final name. Nothing is written before
+// the peer starts sending the file. It returns the number of bytes received
+// in this call.
+func DownloadFile(peer Peer, filename, destPath string) (int64, error) {
+	partialPath := destPath + ".partial"
+	statePath := partialPath + ".state"
+
+	state, err := loadDownloadState(statePath)
+	if err != nil || state.Filename != filename {
+		state = downloadState{Filename: filename}
+	}
+	// Bytes past the last checkpoint were never recorded as verified; drop them.
+	if stat, err := os.Stat(partialPath); err != nil || stat.Size() < state.Offset {
+		state = downloadState{Filename: filename}
+	}
+	if state.Offset > 0 {
+		log.Printf("[INFO] Resuming download of %s at byte %d", filename, state.Offset)
+	}
+
+	pw := &partialWriter{path: partialPath, statePath: statePath, state: state}
+	defer pw.close()
+	request := Message{
+		Type:     "request_file",
+		Filename: filename,
+		Offset:   state.Offset,
+		Size:     state.Size,
+		ModTime:  state.ModTime,
+	}
+	written, err := requestFile(peer, request, pw, pw.start, 0)
+	if err == nil {
+		err = pw.finish()
+	}
+	if err != nil {
+		if pw.file == nil {
+			// The peer refused before sending anything; keep any earlier progress as it was.
+			return written, err
+		}
+		var integrityErr *IntegrityError
+		if errors.As(err, &integrityErr) || errors.Is(err, ErrUnverified) {
+			// The partial data can't be trusted; start from scratch next time.
+			pw.close()
+			os.Remove(partialPath)
+			os.Remove(statePath)
+			return written, err
+		}
+		if cpErr := pw.checkpoint(); cpErr != nil {
+			log.Printf("[WARN] Failed to save download progress: %v", cpErr)
+		} else {
+			log.Printf("[INFO] Saved progress of %s at byte %d; rerun to resume", filename, pw.state.Offset)
+		}
+		return written, err
+	}
+
+	if err := pw.close(); err != nil {
+		return written, fmt.Errorf("[ERROR] Failed to close partial file: %w", err)
+	}
+	if err := os.Rename(partialPath, destPath); err != nil {
+		return written, fmt.Errorf("[ERROR] Failed to move file into place: %w", err)
+	}
+	os.Remove(statePath)
+	return written, nil
+}
+
+// partialWriter appends verified chunks to a .partial file and periodically
+// checkpoints how far it has got.
+type partialWriter struct {
+	path      string
+	file      *os.File // opened by start
+	writer    *bufio.Writer
+	statePath string
+	state     downloadState
+	unsynced  int64
+	fileHash  string // whole-file digest from file_info, for a resumed download
+}
+
+// start is called with the serving peer's file_info before any data arrives.
+// It opens the partial file, keeping the bytes already received if the peer
+// resumes where the last attempt stopped; if the peer restarted the transfer
+// from zero (the file changed, or it does not support ranges), the partial
+// data is discarded.
+func (pw *partialWriter) start(info Message) error {
+	file, err := os.OpenFile(pw.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("[ERROR] Failed to open partial file: %w", err)
+	}
+	pw.file = file
+	pw.writer = bufio.NewWriterSize(file, 64*1024)
+
+	if info.Offset != pw.state.Offset {
+		log.Printf("[INFO] Peer is sending %s from byte %d; discarding %d partial bytes", pw.state.Filename, info.Offset, pw.state.Offset)
+		if info.Offset != 0 {
+			return fmt.Errorf("[ERROR] Peer answered with unexpected offset %d", info.Offset)
+		}
+	}
+	if info.Offset > 0 {
+		if info.Hash == "" {
+			return fmt.Errorf("[ERROR] Cannot resume %s: %w", pw.state.Filename, ErrUnverified)
+		}
+		pw.fileHash = info.Hash
+	}
+	if err := file.Truncate(info.Offset); err != nil {
+		return fmt.Errorf("[ERROR] Failed to truncate partial file: %w", err)
+	}
+	if _, err := file.Seek(info.Offset, io.SeekStart); err != nil {
+		return fmt.Errorf("[ERROR] Failed to seek partial file: %w", err)
+	}
+	pw.state = downloadState{
+		Filename: pw.state.Filename,
+		Size:     info.Size,
+		ModTime:  info.ModTime,
+		Offset:   info.Offset,
+	}
+	return pw.checkpoint()
+}
+
+// finish makes the received data durable and, if the download was resumed,
+// checks the whole partial file against the digest the peer sent: the digest
+// in "end_of_file" only covered the bytes received in this call.
+func (pw *partialWriter) finish() error {
+	if err := pw.writer.Flush(); err != nil {
+		return fmt.Errorf("[ERROR] Failed to write partial file: %w", err)
+	}
+	if err := pw.file.Sync(); err != nil {
+		return fmt.Errorf("[ERROR] Failed to sync partial file: %w", err)
+	}
+	if pw.fileHash == "" {
+		return nil
+	}
+	if _, err := pw.file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("[ERROR] Failed to seek partial file: %w", err)
+	}
+	fileHash := sha256.New()
+	if _, err := io.Copy(fileHash, pw.file); err != nil {
+		return fmt.Errorf("[ERROR] Failed to read partial file: %w", err)
+	}
+	if actual := fmt.Sprintf("%x", fileHash.Sum(nil)); actual != pw.fileHash {
+		return fmt.Errorf("[ERROR] Rejected resumed file: %w", &IntegrityError{
+			Filename: pw.state.Filename,
+			Chunk:    -1,
+			Expected: pw.fileHash,
+			Actual:   actual,
+		})
+	}
+	return nil
+}
+
+// close closes the partial file, if start opened it.
+func (pw *partialWriter) close() error {
+	if pw.file == nil {
+		return nil
+	}
+	err := pw.file.Close()
+	pw.file = nil
+	return err
+}
+
+func (pw *partialWriter) Write(p []byte) (int, error) {
+	n, err := pw.writer.Write(p)
+	pw.state.Offset += int64(n)
+	pw.unsynced += int64(n)
+	if err != nil {
+		return n, err
+	}
+	if pw.unsynced >= checkpointInterval {
+		if err := pw.checkpoint(); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// checkpoint makes the partial data durable and then records its length, so the
+// state file never claims bytes that are not on disk.
+func (pw *partialWriter) checkpoint() error {
+	if err := pw.writer.Flush(); err != nil {
+		return err
+	}
+	if err := pw.file.Sync(); err != nil {
+		return err
+	}
+	pw.unsynced = 0
+	return saveDownloadState(pw.statePath, pw.state)
+}
+
+func loadDownloadState(path string) (downloadState, error) {
+	var state downloadState
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return state, err
+	}
+	err = json.Unmarshal(data, &state)
+	return state, err
+}
+
+func saveDownloadState(path string, state downloadState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
@@ -0,0 +1,109 @@
+package p2p
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDownloadFileResume(t *testing.T) {
+	data := bytes.Repeat([]byte("resumable download "), 3*chunkSize)
+	half := int64(len(data) / 2)
+
+	tests := []struct {
+		name      string
+		partial   []byte // nil for no earlier attempt
+		state     func(stat os.FileInfo) downloadState
+		wantErr   bool
+		wantBytes int64 // bytes received in this call
+	}{
+		{name: "fresh", wantBytes: int64(len(data))},
+		{name: "resumed",
+			partial: data[:half],
+			state: func(stat os.FileInfo) downloadState {
+				return downloadState{Filename: "big.txt", Size: stat.Size(), ModTime: stat.ModTime().UnixNano(), Offset: half}
+			},
+			wantBytes: int64(len(data)) - half},
+		{name: "corrupt partial data",
+			partial: append([]byte("X"), data[1:half]...),
+			state: func(stat os.FileInfo) downloadState {
+				return downloadState{Filename: "big.txt", Size: stat.Size(), ModTime: stat.ModTime().UnixNano(), Offset: half}
+			},
+			wantErr: true},
+		{name: "file changed since",
+			partial: data[:half],
+			state: func(stat os.FileInfo) downloadState {
+				return downloadState{Filename: "big.txt", Size: stat.Size() + 1, ModTime: stat.ModTime().UnixNano(), Offset: half}
+			},
+			wantBytes: int64(len(data))},
+		{name: "unrecorded bytes past the checkpoint",
+			partial: append(append([]byte{}, data[:half]...), "garbage"...),
+			state: func(stat os.FileInfo) downloadState {
+				return downloadState{Filename: "big.txt", Size: stat.Size(), ModTime: stat.ModTime().UnixNano(), Offset: half}
+			},
+			wantBytes: int64(len(data)) - half},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shared := t.TempDir()
+			if err := os.WriteFile(filepath.Join(shared, "big.txt"), data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			stat, _ := os.Stat(filepath.Join(shared, "big.txt"))
+			peer := serveFolder(t, shared)
+
+			destPath := filepath.Join(t.TempDir(), "received_big.txt")
+			if tt.partial != nil {
+				os.WriteFile(destPath+".partial", tt.partial, 0644)
+				if err := saveDownloadState(destPath+".partial.state", tt.state(stat)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			written, err := DownloadFile(peer, "big.txt", destPath)
+			if tt.wantErr {
+				var integrityErr *IntegrityError
+				if !errors.As(err, &integrityErr) {
+					t.Fatalf("got %v, want an IntegrityError", err)
+				}
+				for _, leftover := range []string{destPath, destPath + ".partial", destPath + ".partial.state"} {
+					if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+						t.Errorf("%s was left behind", filepath.Base(leftover))
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if written != tt.wantBytes {
+				t.Errorf("received %d bytes, want %d", written, tt.wantBytes)
+			}
+			got, _ := os.ReadFile(destPath)
+			if !bytes.Equal(got, data) {
+				t.Errorf("downloaded file differs from the original")
+			}
+			if _, err := os.Stat(destPath + ".partial.state"); !os.IsNotExist(err) {
+				t.Errorf("state file was left behind")
+			}
+		})
+	}
+}
+
+func TestDownloadFileNotFound(t *testing.T) {
+	peer := serveFolder(t, t.TempDir())
+	destPath := filepath.Join(t.TempDir(), "received_missing.txt")
+
+	_, err := DownloadFile(peer, "missing.txt", destPath)
+	var peerErr *PeerError
+	if !errors.As(err, &peerErr) || peerErr.Code != CodeNotFound {
+		t.Fatalf("got %v, want a not_found PeerError", err)
+	}
+	for _, leftover := range []string{destPath, destPath + ".partial", destPath + ".partial.state"} {
+		if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+			t.Errorf("%s was created", filepath.Base(leftover))
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+
+	"FDS/erasure"
+)
+
+// ErasureScheme records how a file stored with erasure coding was striped.
+// Data chunks are grouped in order into stripes of DataShards chunks; each
+// stripe gets ParityShards parity shards, listed per stripe in Parity. Shards
+// in a stripe are as long as its longest chunk, with shorter chunks (and the
+// missing chunks of a short final stripe) padded with zeros for coding.
+type ErasureScheme struct {
+	DataShards   int        `json:"data_shards"`
+	ParityShards int        `json:"parity_shards"`
+	ChunkSizes   []int      `json:"chunk_sizes"`
+	Parity       [][]string `json:"parity"`
+}
+
+// stripe returns the index of the first data chunk of stripe s, how many data
+// chunks it holds and its shard size.
+func (e *ErasureScheme) stripe(s int) (first, count, size int) {
+	first = s * e.DataShards
+	count = len(e.ChunkSizes) - first
+	if count > e.DataShards {
+		count = e.DataShards
+	}
+	for _, n := range e.ChunkSizes[first : first+count] {
+		if n > size {
+			size = n
+		}
+	}
+	return first, count, size
+}
+
+// stripeEncoder computes the parity shards of a stream of data chunks, one
+// stripe at a time, and builds the scheme describing them.
+type stripeEncoder struct {
+	coder   *erasure.Coder
+	scheme  *ErasureScheme
+	pending [][]byte // data chunks of the stripe being filled
+}
+
+func newStripeEncoder(dataShards, parityShards int) (*stripeEncoder, error) {
+	if parityShards < 1 {
+		// Without parity a stripe protects nothing, and placement ranks stripes by their first parity shard.
+		return nil, fmt.Errorf("invalid erasure scheme %d+%d: at least one parity shard is needed", dataShards, parityShards)
+	}
+	coder, err := erasure.New(dataShards, parityShards)
+	if err != nil {
+		return nil, err
+	}
+	scheme := &ErasureScheme{DataShards: dataShards, ParityShards: parityShards}
+	return &stripeEncoder{coder: coder, scheme: scheme}, nil
+}
+
+// add appends the next data chunk, passing the stripe's parity shards to
+// store once it is full.
+func (e *stripeEncoder) add(chunk []byte, store func(shard []byte, hash string) error) error {
+	e.scheme.ChunkSizes = append(e.scheme.ChunkSizes, len(chunk))
+	e.pending = append(e.pending, append([]byte(nil), chunk...))
+	if len(e.pending) < e.scheme.DataShards {
+		return nil
+	}
+	return e.flush(store)
+}
+
+// flush computes the parity of the current stripe, even if it is short, and
+// passes each parity shard to store.
+func (e *stripeEncoder) flush(store func(shard []byte, hash string) error) error {
+	if len(e.pending) == 0 {
+		return nil
+	}
+	_, _, size := e.scheme.stripe(len(e.scheme.Parity))
+	shards := make([][]byte, e.scheme.DataShards+e.scheme.ParityShards)
+	for i := 0; i < e.scheme.DataShards; i++ {
+		shards[i] = make([]byte, size)
+		if i < len(e.pending) {
+			copy(shards[i], e.pending[i])
+		}
+	}
+	if err := e.coder.Encode(shards); err != nil {
+		return err
+	}
+	var hashes []string
+	for _, shard := range shards[e.scheme.DataShards:] {
+		hash := hashChunk(shard)
+		if err := store(shard, hash); err != nil {
+			return err
+		}
+		hashes = append(hashes, hash)
+	}
+	e.scheme.Parity = append(e.scheme.Parity, hashes)
+	e.pending = e.pending[:0]
+	return nil
+}
+
+// stripeShards returns the hashes of the shards of stripe s: its data chunks
+// followed by its parity shards. Padding shards of a short stripe are "".
+func stripeShards(meta MetaData, s int) []string {
+	e := meta.Erasure
+	first, count, _ := e.stripe(s)
+	hashes := make([]string, e.DataShards, e.DataShards+e.ParityShards)
+	copy(hashes, meta.ChunkHashes[first:first+count])
+	return append(hashes, e.Parity[s]...)
+}
+
+// decodeStripe returns the data chunks of stripe s. Data chunks are read with
+// get; if any is missing or corrupt, parity shards are read until the stripe
+// can be reconstructed. Every shard is checked against its hash.
+func decodeStripe(meta MetaData, s int, get chunkGetter) ([][]byte, error) {
+	e := meta.Erasure
+	_, count, size := e.stripe(s)
+	hashes := stripeShards(meta, s)
+	shards := make([][]byte, len(hashes))
+	present := 0
+
+	read := func(i int) {
+		if hashes[i] == "" {
+			shards[i] = make([]byte, size)
+			present++
+			return
+		}
+		shard, err := get(hashes[i])
+		if err != nil || hashChunk(shard) != hashes[i] {
+			return
+		}
+		padded := make([]byte, size)
+		copy(padded, shard)
+		shards[i] = padded
+		present++
+	}
+	for i := 0; i < e.DataShards; i++ {
+		read(i)
+	}
+	if present < e.DataShards {
+		for i := e.DataShards; i < len(shards) && present < e.DataShards; i++ {
+			read(i)
+		}
+		coder, err := erasure.New(e.DataShards, e.ParityShards)
+		if err != nil {
+			return nil, err
+		}
+		if err := coder.Reconstruct(shards); err != nil {
+			return nil, fmt.Errorf("stripe %d: %w", s, err)
+		}
+	}
+
+	first, _, _ := e.stripe(s)
+	chunks := make([][]byte, count)
+	for i := range chunks {
+		chunks[i] = shards[i][:e.ChunkSizes[first+i]]
+		if actual := hashChunk(chunks[i]); actual != hashes[i] {
+			return nil, &IntegrityError{Filename: meta.Filename, Chunk: first + i, Expected: hashes[i], Actual: actual}
+		}
+	}
+	return chunks, nil
+}
+
+// rebuildShard recovers one data or parity shard of an erasure-coded file from
+// the other shards of its stripe.
+func rebuildShard(meta MetaData, hash string, get chunkGetter) ([]byte, error) {
+	e := meta.Erasure
+	if e == nil {
+		return nil, errors.New("file is not erasure coded")
+	}
+	for s := range e.Parity {
+		hashes := stripeShards(meta, s)
+		for i, h := range hashes {
+			if h != hash {
+				continue
+			}
+			// Decoding recovers the data chunks; parity is recomputed from them.
+			chunks, err := decodeStripe(meta, s, func(h string) ([]byte, error) {
+				if h == hash {
+					return nil, errors.New("shard being rebuilt")
+				}
+				return get(h)
+			})
+			if err != nil {
+				return nil, err
+			}
+			if i < len(chunks) {
+				return chunks[i], nil
+			}
+			_, _, size := e.stripe(s)
+			coder, err := erasure.New(e.DataShards, e.ParityShards)
+			if err != nil {
+				return nil, err
+			}
+			shards := make([][]byte, e.DataShards+e.ParityShards)
+			for j := 0; j < e.DataShards; j++ {
+				shards[j] = make([]byte, size)
+				if j < len(chunks) {
+					copy(shards[j], chunks[j])
+				}
+			}
+			if err := coder.Encode(shards); err != nil {
+				return nil, err
+			}
+			if actual := hashChunk(shards[i]); actual != hash {
+				return nil, &IntegrityError{Filename: meta.Filename, Chunk: -1, Expected: hash, Actual: actual}
+			}
+			return shards[i], nil
+		}
+	}
+	return nil, fmt.Errorf("shard %s is not part of %s", hash, meta.Filename)
+}
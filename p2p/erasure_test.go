@@ -0,0 +1,51 @@
+package p2p
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestNewStripeEncoder(t *testing.T) {
+	tests := []struct {
+		data, parity int
+		wantErr      bool
+	}{
+		{4, 2, false},
+		{1, 1, false},
+		{4, 0, true},
+		{4, -1, true},
+		{0, 2, true},
+		{200, 100, true},
+	}
+	for _, tt := range tests {
+		if _, err := newStripeEncoder(tt.data, tt.parity); (err != nil) != tt.wantErr {
+			t.Errorf("newStripeEncoder(%d, %d) = %v, want error %v", tt.data, tt.parity, err, tt.wantErr)
+		}
+	}
+}
+
+func TestErasureRoundTrip(t *testing.T) {
+	store := testStore(t)
+	data := make([]byte, 42000)
+	rand.New(rand.NewSource(1)).Read(data)
+	fixed := ChunkerConfig{Algorithm: ChunkerFixed, Max: 4096}
+	if err := store.StoreFileWith("f", data, StoreOptions{Chunker: &fixed, DataShards: 4, ParityShards: 2}); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := store.loadFileMeta("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Losing any two shards of a stripe is survivable.
+	store.chunks.Delete(meta.ChunkHashes[0])
+	store.chunks.Delete(meta.Erasure.Parity[0][1])
+	got, err := store.RetrieveFile("f")
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("RetrieveFile = %d bytes, %v; want the original %d", len(got), err, len(data))
+	}
+
+	if err := store.StoreFileWith("g", data, StoreOptions{DataShards: 4}); err == nil {
+		t.Error("stored with a 4+0 scheme")
+	}
+}
@@ -0,0 +1,212 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"FDS/audit"
+)
+
+// DefaultGCGracePeriod is how old an unreferenced chunk must be before it is collected.
+const DefaultGCGracePeriod = time.Hour
+
+// GCOptions tunes a garbage collection. Zero values select the defaults.
+type GCOptions struct {
+	DryRun      bool          // report what would be removed without removing it
+	GracePeriod time.Duration // unreferenced files younger than this are kept, default DefaultGCGracePeriod
+}
+
+// GCReport describes the outcome of a garbage collection.
+type GCReport struct {
+	Files        int      `json:"files"`         // stored files whose manifests were marked
+	LiveChunks   int      `json:"live_chunks"`   // chunks referenced by a manifest
+	Removed      []string `json:"removed"`       // chunk, manifest and temporary files removed (or, on a dry run, to be removed)
+	RemovedBytes int64    `json:"removed_bytes"` // their total size
+	Young        int      `json:"young"`         // unreferenced files kept because of the grace period
+}
+
+// DeleteFile removes a stored file's name record so that it is no longer
+// retrievable by name. Its manifest and chunks stay in the store until
+// CollectGarbage finds nothing else referencing them.
+func (s *Store) DeleteFile(filename string) (err error) {
+	defer func() {
+		audit.Record(audit.Event{Type: "delete_file", Filename: filename, Err: err})
+	}()
+
+	if filename == "" || strings.ContainsAny(filename, `/\`) {
+		return fmt.Errorf("invalid stored file name %q", filename)
+	}
+	key := filename + ".meta"
+	exists, err := s.chunks.Has(key)
+	if err != nil {
+		return fmt.Errorf("failed to delete %s: %w", filename, err)
+	}
+	if !exists {
+		return fmt.Errorf("failed to delete %s: %w", filename, ErrChunkNotFound)
+	}
+	if err := s.chunks.Delete(key); err != nil {
+		return fmt.Errorf("failed to delete %s: %w", filename, err)
+	}
+	log.Printf("[INFO] Deleted stored file %s", filename)
+	return nil
+}
+
+// CollectGarbage removes chunks and manifests that no stored file or version
+// references, by marking everything reachable from the name records and
+// version histories and then sweeping the rest. Values written within the
+// grace period are kept, since a StoreFile running concurrently writes its
+// chunks before the manifest that references them. Chunks held for other
+// peers are in a separate store and never collected. If any manifest cannot
+// be read, nothing is removed. The chunk store must be a TimedChunkStore.
+func (s *Store) CollectGarbage(opts GCOptions) (report GCReport, err error) {
+	defer func() {
+		if !opts.DryRun {
+			audit.Record(audit.Event{
+				Type:   "gc",
+				Bytes:  report.RemovedBytes,
+				Detail: fmt.Sprintf("%d files removed", len(report.Removed)),
+				Err:    err,
+			})
+		}
+	}()
+	if opts.GracePeriod <= 0 {
+		opts.GracePeriod = DefaultGCGracePeriod
+	}
+
+	timed, ok := s.chunks.(TimedChunkStore)
+	if !ok {
+		return report, errors.New("chunk store does not record modification times")
+	}
+
+	live, files, err := s.markLive()
+	if err != nil {
+		return report, fmt.Errorf("mark phase failed, nothing removed: %w", err)
+	}
+	report.Files = files
+	for name := range live {
+		if isHash(name) {
+			report.LiveChunks++
+		}
+	}
+
+	keys, err := s.chunks.List()
+	if err != nil {
+		return report, fmt.Errorf("failed to list chunk store: %w", err)
+	}
+	if files, ok := s.chunks.(*FileChunkStore); ok {
+		leftovers, err := files.leftovers()
+		if err != nil {
+			return report, fmt.Errorf("failed to list chunk store: %w", err)
+		}
+		keys = append(keys, leftovers...)
+	}
+	cutoff := time.Now().Add(-opts.GracePeriod)
+	for _, name := range keys {
+		if live[name] || !collectable(name) {
+			continue
+		}
+		info, err := timed.Stat(name)
+		if err != nil {
+			continue
+		}
+		if info.ModTime.After(cutoff) {
+			report.Young++
+			continue
+		}
+		if !opts.DryRun {
+			if err := s.chunks.Delete(name); err != nil {
+				log.Printf("[WARN] GC: failed to remove %s: %v", name, err)
+				continue
+			}
+		}
+		report.Removed = append(report.Removed, name)
+		report.RemovedBytes += info.Size
+	}
+
+	if opts.DryRun {
+		log.Printf("[INFO] GC dry run: would remove %d files (%d bytes); %d live chunks in %d stored files", len(report.Removed), report.RemovedBytes, report.LiveChunks, report.Files)
+	} else {
+		log.Printf("[INFO] GC removed %d files (%d bytes); %d live chunks in %d stored files", len(report.Removed), report.RemovedBytes, report.LiveChunks, report.Files)
+	}
+	return report, nil
+}
+
+// markLive returns the keys of every chunk and manifest reachable from a name
+// record or a version history, and the number of name records.
+func (s *Store) markLive() (map[string]bool, int, error) {
+	names, err := s.Names()
+	if err != nil {
+		return nil, 0, err
+	}
+	live := make(map[string]bool)
+	for _, name := range names {
+		record, err := s.readNameRecord(name)
+		if err != nil {
+			return nil, 0, err
+		}
+		if record.Manifest == "" {
+			for _, hash := range record.ChunkHashes {
+				live[hash] = true
+			}
+			continue
+		}
+		if err := s.markManifest(record.Manifest, live); err != nil {
+			return nil, 0, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	// Every version kept in a shared folder's history is live too.
+	versioned, err := s.VersionedNames()
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, name := range versioned {
+		record, err := s.readVersions(name)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, v := range record.Versions {
+			if v.Removed {
+				continue
+			}
+			if err := s.markManifest(v.Manifest, live); err != nil {
+				return nil, 0, fmt.Errorf("version %d of %s: %w", v.Version, name, err)
+			}
+		}
+	}
+	return live, len(names), nil
+}
+
+// markManifest marks the manifest with the given root hash, its parts and
+// every chunk it references.
+func (s *Store) markManifest(root string, live map[string]bool) error {
+	meta, err := s.loadManifest(root)
+	if err != nil {
+		return err
+	}
+	live[root+".manifest"] = true
+	for _, part := range meta.Parts {
+		live[part+".manifest"] = true
+	}
+	for _, hash := range meta.chunks() {
+		live[hash] = true
+	}
+	return nil
+}
+
+// collectable reports whether a chunk store key is one garbage collection
+// manages: a chunk, a manifest, or a leftover temporary file.
+func collectable(name string) bool {
+	switch {
+	case isHash(name):
+		return true
+	case strings.HasSuffix(name, ".manifest"):
+		return isHash(strings.TrimSuffix(name, ".manifest"))
+	case strings.HasSuffix(name, ".tmp"):
+		return true
+	}
+	return false
+}
@@ -0,0 +1,170 @@
+package p2p
+
+import (
+	"bytes"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ageStore makes every value in a memory store look d older.
+func ageStore(s *MemoryChunkStore, d time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for key, value := range s.values {
+		value.modTime = value.modTime.Add(-d)
+		s.values[key] = value
+	}
+}
+
+// gcFixture stores files whose chunks overlap and returns the store with the
+// chunks only the deleted file "gone" referenced.
+func gcFixture(t *testing.T) (*Store, []string) {
+	t.Helper()
+	store := testStore(t)
+	fixed := &ChunkerConfig{Algorithm: ChunkerFixed, Max: 1000}
+	shared := randomData(3000, 10)
+	kept := append(append([]byte(nil), shared...), randomData(1000, 11)...)
+	gone := append(append([]byte(nil), shared...), randomData(2000, 12)...)
+	for _, f := range []struct {
+		name string
+		data []byte
+		opts StoreOptions
+	}{
+		{"kept", kept, StoreOptions{Chunker: fixed}},
+		{"gone", gone, StoreOptions{Chunker: fixed}},
+		{"coded", randomData(5000, 13), StoreOptions{Chunker: fixed, DataShards: 2, ParityShards: 1}},
+	} {
+		if err := store.StoreFileWith(f.name, f.data, f.opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := store.AddVersion("versioned.txt", bytes.NewReader(randomData(1500, 14)), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	goneMeta, _ := store.loadFileMeta("gone")
+	goneRoot, _ := store.ResolveName("gone")
+	keptMeta, _ := store.loadFileMeta("kept")
+	var orphans []string
+	for _, hash := range goneMeta.ChunkHashes {
+		if !slices.Contains(keptMeta.ChunkHashes, hash) {
+			orphans = append(orphans, hash)
+		}
+	}
+	orphans = append(orphans, goneRoot+".manifest")
+	if err := store.DeleteFile("gone"); err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(orphans)
+	return store, orphans
+}
+
+func TestMarkLive(t *testing.T) {
+	store, orphans := gcFixture(t)
+	live, files, err := store.markLive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files != 2 {
+		t.Errorf("marked %d stored files, want kept and coded", files)
+	}
+	for _, orphan := range orphans {
+		if live[orphan] {
+			t.Errorf("%s of the deleted file is marked live", orphan)
+		}
+	}
+	for _, name := range []string{"kept", "coded"} {
+		root, _ := store.ResolveName(name)
+		meta, _ := store.loadManifest(root)
+		for _, hash := range append(meta.chunks(), root+".manifest") {
+			if !live[hash] {
+				t.Errorf("%s of %s is not marked live", hash, name)
+			}
+		}
+	}
+	versions, _ := store.Versions("versioned.txt")
+	if len(versions) != 1 || !live[versions[0].Manifest+".manifest"] {
+		t.Error("the kept version is not marked live")
+	}
+}
+
+func TestCollectGarbage(t *testing.T) {
+	tests := []struct {
+		name        string
+		age         time.Duration
+		opts        GCOptions
+		wantRemoved bool
+	}{
+		{"dry run", 2 * time.Hour, GCOptions{DryRun: true}, false},
+		{"within the grace period", 30 * time.Minute, GCOptions{}, false},
+		{"past the grace period", 2 * time.Hour, GCOptions{}, true},
+		{"shorter grace period", 30 * time.Minute, GCOptions{GracePeriod: 10 * time.Minute}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, orphans := gcFixture(t)
+			chunks := store.chunks.(*MemoryChunkStore)
+			chunks.Put("leftover.tmp", []byte("partial"))
+			store.held.Put(hashChunk([]byte("held")), []byte("held"))
+			ageStore(chunks, tt.age)
+			before, _ := chunks.List()
+
+			report, err := store.CollectGarbage(tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantReport := append(append([]string(nil), orphans...), "leftover.tmp")
+			slices.Sort(wantReport)
+			slices.Sort(report.Removed)
+			if tt.wantRemoved && !tt.opts.DryRun {
+				if !slices.Equal(report.Removed, wantReport) {
+					t.Errorf("removed %v, want %v", report.Removed, wantReport)
+				}
+			} else if tt.opts.DryRun {
+				if !slices.Equal(report.Removed, wantReport) {
+					t.Errorf("dry run reported %v, want %v", report.Removed, wantReport)
+				}
+			} else if len(report.Removed) != 0 || report.Young != len(wantReport) {
+				t.Errorf("removed %v and kept %d young, want nothing removed and %d young", report.Removed, report.Young, len(wantReport))
+			}
+
+			after, _ := chunks.List()
+			if removed := len(before) - len(after); (removed > 0) != tt.wantRemoved {
+				t.Errorf("%d values removed from the store", removed)
+			}
+			for _, key := range after {
+				if slices.Contains(orphans, key) && tt.wantRemoved {
+					t.Errorf("%s is still stored", key)
+				}
+			}
+			for _, name := range []string{"kept", "coded"} {
+				if _, err := store.RetrieveFile(name); err != nil {
+					t.Errorf("%s is damaged: %v", name, err)
+				}
+			}
+			if _, _, err := store.RetrieveVersion("versioned.txt", 1, &bytes.Buffer{}); err != nil {
+				t.Errorf("the version is damaged: %v", err)
+			}
+			if held, _ := store.held.List(); len(held) != 1 {
+				t.Error("held chunks were collected")
+			}
+		})
+	}
+}
+
+func TestCollectGarbageKeepsAllOnMarkFailure(t *testing.T) {
+	store, _ := gcFixture(t)
+	root, _ := store.ResolveName("kept")
+	store.chunks.Delete(root + ".manifest")
+	ageStore(store.chunks.(*MemoryChunkStore), 2*time.Hour)
+	before, _ := store.chunks.List()
+
+	if _, err := store.CollectGarbage(GCOptions{}); err == nil || !strings.Contains(err.Error(), "nothing removed") {
+		t.Fatalf("CollectGarbage = %v, want a mark phase failure", err)
+	}
+	if after, _ := store.chunks.List(); len(after) != len(before) {
+		t.Errorf("%d values removed after a failed mark", len(before)-len(after))
+	}
+}
@@ -0,0 +1,573 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"FDS/audit"
+	"FDS/codec"
+	"FDS/crypto"
+)
+
+// DefaultReplicas is how many peers DistributeFile places each chunk on.
+const DefaultReplicas = 3
+
+// maxPushedChunk bounds a chunk another peer asks this node to store. Sealed
+// chunks are larger than the largest chunk by the wrapped key, nonce and tag.
+const maxPushedChunk = maxChunkLimit + 4096
+
+// DefaultHeldQuota is how many bytes of chunks each peer may keep on this node
+// with put_chunk unless UseHeldQuota says otherwise.
+const DefaultHeldQuota = 1 << 30
+
+// heldQuota bounds the bytes of pushed chunks kept for each peer; 0 means no limit.
+var heldQuota int64 = DefaultHeldQuota
+
+// UseHeldQuota sets how many bytes of chunks each peer may keep on this node;
+// 0 means no limit.
+func UseHeldQuota(bytes int64) {
+	heldQuota = bytes
+}
+
+// rankPeers orders peers for a chunk by rendezvous (highest random weight)
+// hashing: every peer gets a score from the hash of its ID and the chunk hash,
+// highest first. The first N peers are the chunk's placement, and a peer
+// joining or leaving only moves the chunks it ranks first for.
+func rankPeers(key string, peers []Peer) []Peer {
+	type scored struct {
+		peer  Peer
+		score uint64
+	}
+	ranked := make([]scored, len(peers))
+	for i, peer := range peers {
+		sum := sha256.Sum256([]byte(peer.ID + "\x00" + key))
+		ranked[i] = scored{peer, binary.BigEndian.Uint64(sum[:8])}
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].score != ranked[j].score {
+			return ranked[i].score > ranked[j].score
+		}
+		return ranked[i].peer.ID < ranked[j].peer.ID
+	})
+	result := make([]Peer, len(ranked))
+	for i, r := range ranked {
+		result[i] = r.peer
+	}
+	return result
+}
+
+// storedChunk is a chunk as kept on disk: named by the hash of its plaintext,
+// and sealed for the owner's storage key pair.
+type storedChunk struct {
+	hash string
+	blob []byte
+}
+
+// DistributeFile splits data into chunks, encrypts each for this node's storage
+// key pair and pushes it to the replicas highest-ranked peers for that chunk.
+// A peer that fails is replaced by the next one in the chunk's ranking. The
+// manifest, including where every chunk was placed, is stored locally under
+// filename and its root hash is returned. Chunks that could not be placed
+// on enough peers are logged; it is an error only if one was placed nowhere.
+//
+// With erasure coding selected in opts, each data and parity shard is placed
+// on a single peer instead, and the shards of a stripe go to different peers
+// where there are enough of them.
+func (s *Store) DistributeFile(peers []Peer, filename string, data []byte, replicas int, opts StoreOptions) (string, error) {
+	return s.DistributeReader(peers, filename, bytes.NewReader(data), replicas, opts)
+}
+
+// DistributeReader distributes a file read from r like DistributeFile. Chunks
+// are pushed a batch at a time as they are read, and the manifest of a large
+// file is written a part at a time, so only a few chunks and the placement of
+// one part are held in memory however large the file is.
+func (s *Store) DistributeReader(peers []Peer, filename string, r io.Reader, replicas int, opts StoreOptions) (root string, err error) {
+	var size int64
+	defer func() {
+		audit.Record(audit.Event{Type: "distribute_file", Filename: filename, Bytes: size, Detail: root, Err: err})
+	}()
+
+	if s.keys == nil {
+		return "", fmt.Errorf("storage encryption keys not configured")
+	}
+	if len(peers) == 0 {
+		return "", errors.New("no peers to distribute to")
+	}
+	if replicas <= 0 {
+		replicas = DefaultReplicas
+	}
+	placer := &chunkPlacer{keys: s.keys, peers: peers, replicas: replicas}
+	if opts.DataShards > 0 {
+		placer.shards = [2]int{opts.DataShards, opts.ParityShards}
+		placer.replicas = 1
+		if n := opts.DataShards + opts.ParityShards; len(peers) < n {
+			log.Printf("[WARN] Only %d peers for stripes of %d shards; some peers will hold several shards of a stripe", len(peers), n)
+		}
+	} else if replicas > len(peers) {
+		log.Printf("[WARN] Only %d peers available for a replication factor of %d", len(peers), replicas)
+		placer.replicas = len(peers)
+	}
+
+	meta, size, err := splitStream(filename, r, opts, placer.add, func(part MetaData) (string, error) {
+		placement, err := placer.flush()
+		if err != nil {
+			return "", err
+		}
+		part.Placement = placement
+		return s.writeManifest(part)
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(meta.Parts) == 0 {
+		if meta.Placement, err = placer.flush(); err != nil {
+			return "", err
+		}
+	}
+	if root, err = s.writeManifest(meta); err != nil {
+		return "", err
+	}
+	if err := s.writeNameRecord(filename, root); err != nil {
+		return "", err
+	}
+	log.Printf("[INFO] Distributed %s: %d bytes on %d peers (manifest %s)", filename, size, len(peers), root)
+	return root, nil
+}
+
+// distributeBatch is how many chunks DistributeReader gathers before pushing
+// them to peers.
+const distributeBatch = 64
+
+// chunkPlacer seals the chunks of a file as they are split and places them
+// on peers a batch at a time, keeping the placement of the chunks placed
+// since the last flush.
+type chunkPlacer struct {
+	keys     *crypto.KeyPair
+	peers    []Peer
+	replicas int
+	shards   [2]int // data and parity shards per stripe, zero without erasure coding
+
+	stripe    []string            // shards of the stripe being split, data chunks first
+	blobs     map[string][]byte   // sealed chunks not placed yet
+	rankings  map[string][]Peer   // ranking of each chunk in blobs, once known
+	placement map[string][]string // peers holding each chunk placed since the last flush
+}
+
+// add takes the next chunk from splitStream. The shards of a stripe arrive as
+// its data chunks followed by its parity shards.
+func (p *chunkPlacer) add(chunk []byte, hash string) error {
+	if p.blobs == nil {
+		p.blobs = make(map[string][]byte)
+		p.rankings = make(map[string][]Peer)
+		p.placement = make(map[string][]string)
+	}
+	if p.shards[0] > 0 {
+		p.stripe = append(p.stripe, hash)
+		if len(p.stripe) == p.shards[0]+p.shards[1] {
+			p.rankStripe()
+		}
+	} else if _, ranked := p.rankings[hash]; !ranked {
+		p.rankings[hash] = rankPeers(hash, p.peers)
+	}
+	if _, placed := p.placement[hash]; !placed && p.blobs[hash] == nil {
+		sealed, err := crypto.Seal(p.keys.Public, chunk, []byte(hash))
+		if err != nil {
+			return fmt.Errorf("failed to encrypt chunk %s: %w", hash, err)
+		}
+		p.blobs[hash] = sealed
+	}
+	if len(p.blobs) >= distributeBatch && len(p.stripe) == 0 {
+		return p.place()
+	}
+	return nil
+}
+
+// rankStripe ranks the shards of the stripe collected in p.stripe like
+// stripeRankings does for a whole file: by one ranking for the stripe, with
+// each shard starting at its position in a full stripe.
+func (p *chunkPlacer) rankStripe() {
+	data := len(p.stripe) - p.shards[1]
+	ranking := rankPeers(p.stripe[data]+p.stripe[0], p.peers)
+	for i, hash := range p.stripe {
+		if _, done := p.rankings[hash]; done {
+			continue
+		}
+		position := i
+		if i >= data {
+			position = p.shards[0] + i - data
+		}
+		offset := position % len(ranking)
+		p.rankings[hash] = append(append([]Peer(nil), ranking[offset:]...), ranking[:offset]...)
+	}
+	p.stripe = p.stripe[:0]
+}
+
+// place pushes the chunks gathered so far.
+func (p *chunkPlacer) place() error {
+	if len(p.blobs) == 0 {
+		return nil
+	}
+	rankings := make(map[string][]Peer, len(p.blobs))
+	for hash := range p.blobs {
+		rankings[hash] = p.rankings[hash]
+	}
+	placement, err := placeChunks(rankings, p.blobs, p.replicas)
+	if err != nil {
+		return err
+	}
+	for hash, holders := range placement {
+		p.placement[hash] = holders
+	}
+	p.blobs = make(map[string][]byte)
+	p.rankings = make(map[string][]Peer)
+	return nil
+}
+
+// flush places every chunk still gathered, including a short last stripe,
+// and returns the placement of the chunks placed since the last flush.
+func (p *chunkPlacer) flush() (map[string][]string, error) {
+	if len(p.stripe) > 0 {
+		p.rankStripe()
+	}
+	if err := p.place(); err != nil {
+		return nil, err
+	}
+	placement := p.placement
+	p.placement = make(map[string][]string)
+	return placement, nil
+}
+
+// stripeRankings ranks peers for every shard of an erasure-coded file. The
+// shards of a stripe share one rendezvous ranking, each starting at a
+// different position in it, so their first choices are distinct peers.
+func stripeRankings(meta MetaData, peers []Peer) map[string][]Peer {
+	rankings := make(map[string][]Peer)
+	for s := range meta.Erasure.Parity {
+		shards := stripeShards(meta, s)
+		ranking := rankPeers(meta.Erasure.Parity[s][0]+shards[0], peers)
+		for i, hash := range shards {
+			if _, done := rankings[hash]; hash == "" || done {
+				continue
+			}
+			offset := i % len(ranking)
+			rankings[hash] = append(append([]Peer(nil), ranking[offset:]...), ranking[:offset]...)
+		}
+	}
+	return rankings
+}
+
+// placeChunks pushes every chunk to replicas peers in its ranking, moving down
+// the ranking past peers that fail, and returns the peers now holding each chunk.
+func placeChunks(rankings map[string][]Peer, blobs map[string][]byte, replicas int) (map[string][]string, error) {
+	placement := make(map[string][]string, len(blobs))
+	tried := make(map[string]int, len(blobs))
+	var lastErr error // why the last failing peer refused, reported if a chunk is left unplaced
+
+	for {
+		// Give each chunk that is short of replicas to the next peers in its ranking.
+		batches := make(map[string][]storedChunk)
+		byID := make(map[string]Peer)
+		for hash, ranking := range rankings {
+			for need := replicas - len(placement[hash]); need > 0 && tried[hash] < len(ranking); need-- {
+				peer := ranking[tried[hash]]
+				tried[hash]++
+				batches[peer.ID] = append(batches[peer.ID], storedChunk{hash, blobs[hash]})
+				byID[peer.ID] = peer
+			}
+		}
+		if len(batches) == 0 {
+			break
+		}
+
+		var mutex sync.Mutex
+		var wg sync.WaitGroup
+		for id, batch := range batches {
+			wg.Add(1)
+			go func(peer Peer, batch []storedChunk) {
+				defer wg.Done()
+				stored, err := pushChunks(peer, batch)
+				if err != nil {
+					log.Printf("[WARN] Peer %s stored %d of %d chunks: %v", peer.ID, len(stored), len(batch), err)
+				}
+				mutex.Lock()
+				if err != nil {
+					lastErr = err
+				}
+				for _, hash := range stored {
+					placement[hash] = append(placement[hash], peer.ID)
+				}
+				mutex.Unlock()
+			}(byID[id], batch)
+		}
+		wg.Wait()
+	}
+
+	for hash := range blobs {
+		switch n := len(placement[hash]); {
+		case n == 0 && lastErr != nil:
+			return nil, fmt.Errorf("no peer accepted chunk %s: %w", hash, lastErr)
+		case n == 0:
+			return nil, fmt.Errorf("no peer accepted chunk %s", hash)
+		case n < replicas:
+			log.Printf("[WARN] Chunk %s is on %d of %d peers", hash, n, replicas)
+		}
+		sort.Strings(placement[hash])
+	}
+	return placement, nil
+}
+
+// pushChunks sends chunks to a peer for it to store, over a single connection,
+// and returns the hashes of the chunks the peer confirmed before any failure.
+func pushChunks(peer Peer, chunks []storedChunk) ([]string, error) {
+	conn, c, err := dialPeer(peer)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to peer %s: %w", peer.Address(), err)
+	}
+	defer conn.Close()
+
+	var stored []string
+	for _, chunk := range chunks {
+		conn.SetDeadline(time.Now().Add(transferIdleTimeout))
+		if err := c.WriteMessage(Message{Type: "put_chunk", Hash: chunk.hash, Content: chunk.blob}); err == nil {
+			err = c.Flush()
+		}
+		if err != nil {
+			return stored, fmt.Errorf("failed to send chunk %s: %w", chunk.hash, err)
+		}
+		response, err := c.ReadMessage()
+		if err != nil {
+			return stored, fmt.Errorf("failed to read acknowledgement for chunk %s: %w", chunk.hash, err)
+		}
+		if response.Type == "error" {
+			return stored, &PeerError{Code: response.Code, Message: string(response.Content)}
+		}
+		if response.Type != "chunk_stored" || response.Hash != chunk.hash {
+			return stored, fmt.Errorf("unexpected response %q to put_chunk", response.Type)
+		}
+		stored = append(stored, chunk.hash)
+	}
+	return stored, nil
+}
+
+// receiveChunks stores chunks pushed by another peer. A peer may push several
+// chunks over one connection; each is acknowledged before the next is read.
+func receiveChunks(conn net.Conn, c codec.Codec, request Message) {
+	peerID := remotePeerID(conn)
+	var count, total int64
+	var err error
+	for request.Type == "put_chunk" {
+		if err = localStore.storePushedChunk(peerID, request.Hash, request.Content); err != nil {
+			var peerErr *PeerError
+			if errors.As(err, &peerErr) {
+				sendError(c, request.Hash, peerErr.Code, peerErr.Message)
+			}
+			break
+		}
+		count++
+		total += int64(len(request.Content))
+		if err = c.WriteMessage(Message{Type: "chunk_stored", Hash: request.Hash}); err == nil {
+			err = c.Flush()
+		}
+		if err != nil {
+			break
+		}
+
+		conn.SetReadDeadline(time.Now().Add(transferIdleTimeout))
+		if request, err = c.ReadMessage(); err != nil {
+			// The pushing peer closes the connection once it is done.
+			err = nil
+			break
+		}
+	}
+	log.Printf("[INFO] Stored %d chunks (%d bytes) pushed by %s", count, total, conn.RemoteAddr())
+	audit.Record(audit.Event{
+		Type:   "put_chunk",
+		PeerID: peerID,
+		Remote: conn.RemoteAddr().String(),
+		Bytes:  total,
+		Detail: fmt.Sprintf("%d chunks", count),
+		Err:    err,
+	})
+}
+
+// storePushedChunk keeps a chunk pushed by another peer in the held chunk
+// store, apart from this node's own chunks, which garbage collection sweeps
+// using only this node's manifests. Chunks are kept per owner, the pushing
+// peer's verified ID, so one peer can neither replace nor claim another's
+// chunk, and each owner may keep up to heldQuota bytes. Plaintext chunks are
+// checked against their hash; sealed chunks can only be checked for their
+// layout here, and fully by the owner, which does so when it fetches them.
+func (s *Store) storePushedChunk(owner, hash string, blob []byte) error {
+	if owner == "" {
+		return &PeerError{Code: CodeUnauthenticated, Message: "Storing chunks requires an authenticated peer"}
+	}
+	if !isHash(hash) {
+		return &PeerError{Code: CodeInvalidPath, Message: "Invalid chunk hash"}
+	}
+	if len(blob) > maxPushedChunk {
+		return &PeerError{Code: CodeTooLarge, Message: fmt.Sprintf("Chunk exceeds %d bytes", maxPushedChunk)}
+	}
+	if crypto.IsSealed(blob) {
+		if err := crypto.CheckSealed(blob); err != nil {
+			return &PeerError{Code: CodeIntegrity, Message: "Malformed encrypted chunk"}
+		}
+	} else if hashChunk(blob) != hash {
+		return &PeerError{Code: CodeIntegrity, Message: "Chunk does not match its hash"}
+	}
+
+	s.heldMutex.Lock()
+	defer s.heldMutex.Unlock()
+	usage, err := s.heldUsage()
+	if err != nil {
+		log.Printf("[ERROR] Failed to measure held chunks: %v", err)
+		return &PeerError{Code: CodeStoreFailed, Message: "Chunk could not be stored"}
+	}
+	key := heldKey(owner, hash)
+	var previous int64
+	if existing, err := s.held.Get(key); err == nil {
+		previous = int64(len(existing))
+	}
+	if heldQuota > 0 && usage[owner]-previous+int64(len(blob)) > heldQuota {
+		return &PeerError{Code: CodeQuotaExceeded, Message: fmt.Sprintf("Chunks would exceed the %d byte quota", heldQuota)}
+	}
+	if err := s.held.Put(key, blob); err != nil {
+		log.Printf("[ERROR] Failed to store chunk %s: %v", hash, err)
+		return &PeerError{Code: CodeStoreFailed, Message: "Chunk could not be stored"}
+	}
+	usage[owner] += int64(len(blob)) - previous
+	return nil
+}
+
+// heldUsage returns the bytes of held chunks kept for each owner, measuring
+// the held store the first time. heldMutex must be held.
+func (s *Store) heldUsage() (map[string]int64, error) {
+	if s.heldBytes != nil {
+		return s.heldBytes, nil
+	}
+	keys, err := s.held.List()
+	if err != nil {
+		return nil, err
+	}
+	usage := make(map[string]int64)
+	timed, _ := s.held.(TimedChunkStore)
+	for _, key := range keys {
+		owner, _, ok := parseHeldKey(key)
+		if !ok || owner == "" {
+			continue
+		}
+		if timed != nil {
+			if info, err := timed.Stat(key); err == nil {
+				usage[owner] += info.Size
+			}
+		} else if data, err := s.held.Get(key); err == nil {
+			usage[owner] += int64(len(data))
+		}
+	}
+	s.heldBytes = usage
+	return usage, nil
+}
+
+// readHeldChunk returns a chunk owner pushed to this node, as stored. Chunks
+// pushed before they were kept per owner are found under their bare hash.
+func (s *Store) readHeldChunk(owner, hash string) ([]byte, error) {
+	if owner != "" {
+		chunk, err := s.held.Get(heldKey(owner, hash))
+		if !errors.Is(err, ErrChunkNotFound) {
+			return chunk, err
+		}
+	}
+	return s.held.Get(hash)
+}
+
+// heldKey is the held store key of a chunk pushed by owner: the owner's ID in
+// hex, which keeps it a valid key whatever the ID holds, a dot, and the hash.
+func heldKey(owner, hash string) string {
+	return hex.EncodeToString([]byte(owner)) + "." + hash
+}
+
+// parseHeldKey splits a held store key into owner and chunk hash. Keys of
+// chunks pushed before they were kept per owner are a bare hash and have no owner.
+func parseHeldKey(key string) (owner, hash string, ok bool) {
+	if isHash(key) {
+		return "", key, true
+	}
+	encoded, hash, found := strings.Cut(key, ".")
+	if !found || !isHash(hash) {
+		return "", "", false
+	}
+	id, err := hex.DecodeString(encoded)
+	if err != nil || len(id) == 0 {
+		return "", "", false
+	}
+	return string(id), hash, true
+}
+
+// RetrieveFromPeers reconstructs a stored file whose chunks may live on other
+// peers. Each chunk is read locally if present, and otherwise fetched from the
+// peers its manifest places it on; every chunk is verified against its hash.
+// Missing shards of an erasure-coded file are rebuilt from the rest of their stripe.
+func (s *Store) RetrieveFromPeers(peers []Peer, filename string) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := s.RetrieveFromPeersTo(peers, filename, &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// RetrieveFromPeersTo writes a file reconstructed like RetrieveFromPeers to w,
+// one chunk at a time (a stripe at a time for erasure-coded files), and
+// returns the number of bytes written.
+func (s *Store) RetrieveFromPeersTo(peers []Peer, filename string, w io.Writer) (written int64, err error) {
+	defer func() {
+		audit.Record(audit.Event{Type: "retrieve_file", Filename: filename, Bytes: written, Err: err})
+	}()
+
+	meta, err := s.loadFileMeta(filename)
+	if err != nil {
+		return 0, err
+	}
+	byID := make(map[string]Peer, len(peers))
+	for _, peer := range peers {
+		byID[peer.ID] = peer
+	}
+
+	written, err = assembleTo(w, meta, func(hash string) ([]byte, error) {
+		chunk, err := s.readChunk(hash)
+		if err != nil {
+			chunk, err = s.fetchPlacedChunk(byID, meta.Placement[hash], hash)
+		}
+		return chunk, err
+	})
+	if err != nil {
+		return written, fmt.Errorf("failed to reassemble %s: %w", filename, err)
+	}
+	return written, nil
+}
+
+// fetchPlacedChunk fetches a chunk from the first of its holders that is online and has it.
+func (s *Store) fetchPlacedChunk(online map[string]Peer, holders []string, hash string) ([]byte, error) {
+	err := errors.New("no holder is online")
+	for _, id := range holders {
+		peer, ok := online[id]
+		if !ok {
+			continue
+		}
+		var chunk []byte
+		if chunk, err = s.FetchChunk(peer, "", hash); err == nil {
+			return chunk, nil
+		}
+		log.Printf("[DEBUG] Chunk %s not available from %s: %v", hash, id, err)
+	}
+	return nil, fmt.Errorf("chunk %s unavailable: %w", hash, err)
+}
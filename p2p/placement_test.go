@@ -0,0 +1,182 @@
+package p2p
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"testing"
+
+	"FDS/crypto"
+)
+
+func TestStorePushedChunk(t *testing.T) {
+	store := testStore(t)
+	previous := heldQuota
+	t.Cleanup(func() { heldQuota = previous })
+	heldQuota = 3000
+
+	plain := bytes.Repeat([]byte("p"), 1000)
+	hash := hashChunk(plain)
+	sealed, err := crypto.Seal(store.keys.Public, plain, []byte(hash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := bytes.Repeat([]byte("o"), 1000)
+
+	// The steps run in order against the same store.
+	steps := []struct {
+		name     string
+		owner    string
+		hash     string
+		blob     []byte
+		wantCode string
+	}{
+		{"unauthenticated", "", hash, plain, CodeUnauthenticated},
+		{"invalid hash", "alice", "../x", plain, CodeInvalidPath},
+		{"too large", "alice", hash, make([]byte, maxPushedChunk+1), CodeTooLarge},
+		{"plaintext not matching its hash", "alice", hash, other, CodeIntegrity},
+		{"sealed header only", "alice", hash, []byte("FDSE garbage"), CodeIntegrity},
+		{"plaintext", "alice", hash, plain, ""},
+		{"same hash from another owner", "mallory", hash, sealed, ""},
+		{"sealed", "alice", hashChunk(other), sealed, ""},
+		{"over quota", "alice", hashChunk([]byte("x")), append(append([]byte(nil), sealed...), bytes.Repeat([]byte("x"), 1500)...), CodeQuotaExceeded},
+		{"replacing within quota", "alice", hash, sealed, ""},
+	}
+	for _, step := range steps {
+		err := store.storePushedChunk(step.owner, step.hash, step.blob)
+		if step.wantCode == "" {
+			if err != nil {
+				t.Fatalf("%s: %v", step.name, err)
+			}
+			continue
+		}
+		var peerErr *PeerError
+		if !errors.As(err, &peerErr) || peerErr.Code != step.wantCode {
+			t.Fatalf("%s: got %v, want a %s error", step.name, err, step.wantCode)
+		}
+	}
+
+	if got, _ := store.readHeldChunk("alice", hash); !bytes.Equal(got, sealed) {
+		t.Error("alice's replaced chunk was not kept")
+	}
+	if got, _ := store.readHeldChunk("mallory", hash); !bytes.Equal(got, sealed) {
+		t.Error("mallory's chunk was not kept apart from alice's")
+	}
+	if _, err := store.readHeldChunk("bob", hash); !errors.Is(err, ErrChunkNotFound) {
+		t.Errorf("bob read a chunk he never pushed: %v", err)
+	}
+	if usage, _ := store.heldUsage(); usage["alice"] != 2*int64(len(sealed)) || usage["mallory"] != int64(len(sealed)) {
+		t.Errorf("usage = %v", usage)
+	}
+}
+
+func TestParseHeldKey(t *testing.T) {
+	hash := hashChunk([]byte("x"))
+	tests := []struct {
+		key       string
+		wantOwner string
+		wantOK    bool
+	}{
+		{heldKey("alice", hash), "alice", true},
+		{heldKey("CN=a/b.c", hash), "CN=a/b.c", true},
+		{hash, "", true},
+		{"zz." + hash, "", false},
+		{"." + hash, "", false},
+		{heldKey("alice", "short"), "", false},
+		{hash + ".tmp", "", false},
+	}
+	for _, tt := range tests {
+		owner, got, ok := parseHeldKey(tt.key)
+		if ok != tt.wantOK || owner != tt.wantOwner || ok && got != hash {
+			t.Errorf("parseHeldKey(%q) = %q, %q, %v", tt.key, owner, got, ok)
+		}
+	}
+}
+
+// Without mutual TLS peers refuse pushes, and the upload says why.
+func TestDistributeFileReportsRefusal(t *testing.T) {
+	store := testStore(t)
+	peer := serveFolder(t, t.TempDir())
+	_, err := store.DistributeFile([]Peer{peer}, "a.bin", []byte("contents"), 1, StoreOptions{})
+	var peerErr *PeerError
+	if !errors.As(err, &peerErr) || peerErr.Code != CodeUnauthenticated {
+		t.Fatalf("got %v, want an %s error", err, CodeUnauthenticated)
+	}
+}
+
+// DistributeReader places each chunk where DistributeFile's rankings would,
+// and records its placement in the part manifest that lists it.
+func TestDistributeReader(t *testing.T) {
+	limit := manifestPartChunks
+	t.Cleanup(func() { manifestPartChunks = limit })
+	manifestPartChunks = 4
+	fixed := &ChunkerConfig{Algorithm: ChunkerFixed, Max: 100}
+
+	tests := []struct {
+		name      string
+		data      []byte
+		replicas  int
+		opts      StoreOptions
+		wantParts int
+	}{
+		{"small file", randomData(250, 1), 2, StoreOptions{Chunker: fixed}, 0},
+		{"replicated parts", randomData(1050, 2), 2, StoreOptions{Chunker: fixed}, 3},
+		{"repeated chunks", bytes.Repeat(randomData(200, 3), 6), 3, StoreOptions{Chunker: fixed}, 3},
+		{"erasure coded parts", randomData(1050, 4), 1, StoreOptions{Chunker: fixed, DataShards: 2, ParityShards: 1}, 3},
+		{"short last stripe", randomData(1050, 5), 1, StoreOptions{Chunker: fixed, DataShards: 3, ParityShards: 2}, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := testStore(t)
+			holders := holdingPeers(t, "owner", "a", "b", "c", "d", "e")
+			var peers []Peer
+			for _, id := range []string{"a", "b", "c", "d", "e"} {
+				peers = append(peers, holders[id].Peer)
+			}
+			root, err := store.DistributeReader(peers, "big.bin", bytes.NewReader(tt.data), tt.replicas, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			outline, err := store.loadManifestPart(root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(outline.Parts) != tt.wantParts {
+				t.Fatalf("stored %d parts, want %d", len(outline.Parts), tt.wantParts)
+			}
+
+			meta, err := store.loadManifest(root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rankings := make(map[string][]Peer)
+			if meta.Erasure != nil {
+				rankings = stripeRankings(meta, peers)
+			}
+			for _, hash := range meta.chunks() {
+				want := rankings[hash]
+				if want == nil {
+					want = rankPeers(hash, peers)
+				}
+				var wantIDs []string
+				for _, peer := range want[:tt.replicas] {
+					wantIDs = append(wantIDs, peer.ID)
+				}
+				slices.Sort(wantIDs)
+				if !slices.Equal(meta.Placement[hash], wantIDs) {
+					t.Errorf("chunk %s placed on %v, want %v", hash, meta.Placement[hash], wantIDs)
+				}
+				for _, id := range meta.Placement[hash] {
+					if !holders[id].holds("owner", hash) {
+						t.Errorf("chunk %s placed on %s, which does not hold it", hash, id)
+					}
+				}
+			}
+
+			var buf bytes.Buffer
+			if _, err := store.RetrieveFromPeersTo(peers, "big.bin", &buf); err != nil || !bytes.Equal(buf.Bytes(), tt.data) {
+				t.Errorf("RetrieveFromPeersTo = %v, want the distributed data", err)
+			}
+		})
+	}
+}
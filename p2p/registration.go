@@ -3,21 +3,25 @@ package p2p
 import (
 	"encoding/json"
 	"fmt"
-	"net"
 	"time"
 )
 
 // BootstrapPeerInfo represents peer information received from the bootstrap server.
+// LastSeen is the peer's last heartbeat in this node's clock, worked out from
+// how long ago the bootstrap server saw it, so the two clocks need not agree.
+// From bootstraps that only report the time in their own clock it is that
+// time, and it is zero from bootstraps that report neither.
 type BootstrapPeerInfo struct {
-	ID   string `json:"id"`
-	Addr string `json:"addr"`
+	ID       string    `json:"id"`
+	Addr     string    `json:"addr"`
+	LastSeen time.Time `json:"last_seen"`
 }
 
 // RegisterWithBootstrap registers the local peer with the bootstrap server.
 // It sends a JSON message with type "register", the peer's ID and address,
 // then reads the server's response.
 func RegisterWithBootstrap(localPeer Peer, bootstrapAddr string) error {
-	conn, err := net.DialTimeout("tcp", bootstrapAddr, 10*time.Second)
+	conn, err := dialTCP(bootstrapAddr, "")
 	if err != nil {
 		return fmt.Errorf("failed to connect to bootstrap server: %w", err)
 	}
@@ -54,7 +58,7 @@ func RegisterWithBootstrap(localPeer Peer, bootstrapAddr string) error {
 // GetPeersFromBootstrap queries the bootstrap server for active peers.
 // It sends a message with type "get_peers" and decodes the returned peer list.
 func GetPeersFromBootstrap(localPeer Peer, bootstrapAddr string) ([]BootstrapPeerInfo, error) {
-	conn, err := net.DialTimeout("tcp", bootstrapAddr, 10*time.Second)
+	conn, err := dialTCP(bootstrapAddr, "")
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to bootstrap server: %w", err)
 	}
@@ -75,18 +79,29 @@ func GetPeersFromBootstrap(localPeer Peer, bootstrapAddr string) ([]BootstrapPee
 		return nil, fmt.Errorf("failed to send get_peers request: %w", err)
 	}
 
-	var peers []BootstrapPeerInfo
-	if err := decoder.Decode(&peers); err != nil {
+	var reply []struct {
+		BootstrapPeerInfo
+		SeenAgo *time.Duration `json:"seen_ago"`
+	}
+	if err := decoder.Decode(&reply); err != nil {
 		return nil, fmt.Errorf("failed to decode peers list: %w", err)
 	}
-
+	received := time.Now()
+
+	peers := make([]BootstrapPeerInfo, len(reply))
+	for i, p := range reply {
+		peers[i] = p.BootstrapPeerInfo
+		if p.SeenAgo != nil {
+			peers[i].LastSeen = received.Add(-*p.SeenAgo)
+		}
+	}
 	return peers, nil
 }
 
 // SendHeartbeatToBootstrap notifies the bootstrap server that the peer is still active.
 // It sends a JSON message with type "heartbeat" and the peer's ID.
 func SendHeartbeatToBootstrap(localPeer Peer, bootstrapAddr string) error {
-	conn, err := net.DialTimeout("tcp", bootstrapAddr, 10*time.Second)
+	conn, err := dialTCP(bootstrapAddr, "")
 	if err != nil {
 		return fmt.Errorf("failed to connect to bootstrap server: %w", err)
 	}
@@ -0,0 +1,60 @@
+package p2p
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+// serveBootstrap answers one get_peers request per connection with reply.
+func serveBootstrap(t *testing.T, reply string) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			var request map[string]string
+			json.NewDecoder(conn).Decode(&request)
+			conn.Write([]byte(reply + "\n"))
+			conn.Close()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestGetPeersFromBootstrapUsesLocalClock(t *testing.T) {
+	// The bootstrap's clock is a day ahead; only how long ago it saw each peer counts.
+	skewed := time.Now().Add(24 * time.Hour).Format(time.RFC3339Nano)
+	tests := []struct {
+		name    string
+		reply   string
+		wantAge time.Duration
+	}{
+		{"seen_ago reported", `[{"id":"a","addr":"h:1","last_seen":"` + skewed + `","seen_ago":5000000000}]`, 5 * time.Second},
+		{"seen just now", `[{"id":"a","addr":"h:1","last_seen":"` + skewed + `","seen_ago":0}]`, 0},
+		{"older bootstrap", `[{"id":"a","addr":"h:1","last_seen":"` + skewed + `"}]`, -24 * time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := serveBootstrap(t, tt.reply)
+			peers, err := GetPeersFromBootstrap(Peer{ID: "me"}, addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(peers) != 1 {
+				t.Fatalf("got %d peers", len(peers))
+			}
+			if age := time.Since(peers[0].LastSeen); age < tt.wantAge-time.Second || age > tt.wantAge+time.Second {
+				t.Errorf("peer last seen %v ago, want about %v", age, tt.wantAge)
+			}
+		})
+	}
+}
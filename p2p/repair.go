@@ -0,0 +1,353 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"FDS/audit"
+	"FDS/crypto"
+)
+
+// RepairOptions tunes re-replication. Zero values select the defaults.
+type RepairOptions struct {
+	Replicas         int           // target live copies of every chunk, default DefaultReplicas
+	Interval         time.Duration // time between repair passes, default 1 minute
+	HeartbeatTimeout time.Duration // a peer not heard from for longer is offline, default 30s
+}
+
+func (o RepairOptions) withDefaults() RepairOptions {
+	if o.Replicas <= 0 {
+		o.Replicas = DefaultReplicas
+	}
+	if o.Interval <= 0 {
+		o.Interval = time.Minute
+	}
+	if o.HeartbeatTimeout <= 0 {
+		o.HeartbeatTimeout = 30 * time.Second
+	}
+	return o
+}
+
+// RepairStatus reports the progress of the current or last repair pass.
+type RepairStatus struct {
+	Running         bool      `json:"running"`
+	Started         time.Time `json:"started"`
+	Finished        time.Time `json:"finished,omitempty"`
+	File            string    `json:"file,omitempty"` // file being checked while running
+	Files           int       `json:"files"`
+	Chunks          int       `json:"chunks"`
+	UnderReplicated int       `json:"under_replicated"`
+	Copied          int       `json:"copied"` // new replicas created
+	Failed          int       `json:"failed"` // chunks still short of replicas
+}
+
+// Repairer keeps the chunks of files distributed by this node at their target
+// replica count. Each pass looks up the live holders of every chunk in the
+// manifests' placement, using the heartbeat times reported by the bootstrap
+// server, copies chunks that have fallen short from a surviving holder to the
+// next peers in their rendezvous ranking, and records the new placement.
+type Repairer struct {
+	store *Store
+	opts  RepairOptions
+	peers func() []BootstrapPeerInfo
+
+	mutex  sync.Mutex
+	status RepairStatus
+}
+
+// NewRepairer creates a Repairer for the files in store that gets the current
+// peer list from peers.
+func NewRepairer(store *Store, opts RepairOptions, peers func() []BootstrapPeerInfo) *Repairer {
+	return &Repairer{store: store, opts: opts.withDefaults(), peers: peers}
+}
+
+// Status returns the progress of the current or last repair pass.
+func (r *Repairer) Status() RepairStatus {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.status
+}
+
+func (r *Repairer) update(fn func(s *RepairStatus)) {
+	r.mutex.Lock()
+	fn(&r.status)
+	r.mutex.Unlock()
+}
+
+// Run repairs every opts.Interval until quit is closed.
+func (r *Repairer) Run(quit <-chan struct{}) {
+	ticker := time.NewTicker(r.opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			status := r.RepairOnce()
+			if status.UnderReplicated > 0 {
+				log.Printf("[INFO] Repair pass: %d chunks in %d files, %d under-replicated, %d copies made, %d still short",
+					status.Chunks, status.Files, status.UnderReplicated, status.Copied, status.Failed)
+			} else {
+				log.Printf("[DEBUG] Repair pass: %d chunks in %d files, all replicated", status.Chunks, status.Files)
+			}
+		case <-quit:
+			return
+		}
+	}
+}
+
+// RepairOnce runs a single repair pass over every distributed file.
+func (r *Repairer) RepairOnce() (status RepairStatus) {
+	r.update(func(s *RepairStatus) { *s = RepairStatus{Running: true, Started: time.Now()} })
+	defer func() {
+		r.update(func(s *RepairStatus) {
+			s.Running = false
+			s.File = ""
+			s.Finished = time.Now()
+		})
+		status = r.Status()
+	}()
+
+	live := livePeers(r.peers(), r.opts.HeartbeatTimeout)
+	if len(live) == 0 {
+		// Without a peer list every chunk would look lost; wait for one.
+		log.Printf("[DEBUG] Repair: no live peers known, skipping pass")
+		return
+	}
+	names, err := r.store.Names()
+	if err != nil {
+		log.Printf("[ERROR] Repair: %v", err)
+		return
+	}
+	for _, name := range names {
+		record, err := r.store.readNameRecord(name)
+		if err != nil || record.Manifest == "" {
+			continue
+		}
+		meta, err := r.store.loadManifest(record.Manifest)
+		if err != nil {
+			log.Printf("[WARN] Repair: skipping %s: %v", name, err)
+			continue
+		}
+		if len(meta.Placement) == 0 {
+			continue
+		}
+		r.update(func(s *RepairStatus) {
+			s.File = name
+			s.Files++
+		})
+		if err := r.repairFile(name, meta, live); err != nil {
+			log.Printf("[ERROR] Repair: %s: %v", name, err)
+		}
+	}
+	return
+}
+
+// livePeers returns the peers whose last heartbeat is within timeout, by ID.
+func livePeers(infos []BootstrapPeerInfo, timeout time.Duration) map[string]Peer {
+	live := make(map[string]Peer)
+	for _, info := range infos {
+		if !info.LastSeen.IsZero() && time.Since(info.LastSeen) > timeout {
+			continue
+		}
+		host, port, err := net.SplitHostPort(info.Addr)
+		if err != nil {
+			continue
+		}
+		live[info.ID] = Peer{ID: info.ID, IP: host, Port: port}
+	}
+	return live
+}
+
+// repairFile restores the replica count of each chunk of one file and stores
+// a manifest with the new placement if anything moved.
+func (r *Repairer) repairFile(name string, meta MetaData, live map[string]Peer) error {
+	target := r.opts.Replicas
+	if meta.Erasure != nil {
+		// Parity provides the redundancy of erasure-coded files; each shard is kept once.
+		target = 1
+	}
+	if target > len(live) {
+		target = len(live)
+	}
+	var candidates []Peer
+	for _, peer := range live {
+		candidates = append(candidates, peer)
+	}
+
+	placement := make(map[string][]string, len(meta.Placement))
+	changed := false
+	for hash, holders := range meta.Placement {
+		placement[hash] = holders
+		r.update(func(s *RepairStatus) { s.Chunks++ })
+
+		var alive []string
+		for _, id := range holders {
+			if _, ok := live[id]; ok {
+				alive = append(alive, id)
+			}
+		}
+		if len(alive) >= target && target > 0 {
+			continue
+		}
+		r.update(func(s *RepairStatus) { s.UnderReplicated++ })
+
+		copied, err := r.repairChunk(meta, hash, alive, live, candidates, target)
+		if len(copied) > 0 {
+			changed = true
+			placement[hash] = append(alive, copied...)
+			if len(placement[hash]) < target {
+				// Still short: keep the offline holders in case they come back.
+				placement[hash] = mergeHolders(placement[hash], holders)
+			}
+			sort.Strings(placement[hash])
+		}
+		if err != nil || len(alive)+len(copied) < target {
+			r.update(func(s *RepairStatus) { s.Failed++ })
+			if err != nil {
+				log.Printf("[WARN] Repair: chunk %s of %s has %d live copies: %v", hash, name, len(alive)+len(copied), err)
+			}
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	meta.Placement = placement
+	root, err := r.store.writeManifest(meta)
+	if err != nil {
+		return err
+	}
+	if err := r.store.writeNameRecord(name, root); err != nil {
+		return err
+	}
+	log.Printf("[INFO] Repair: updated placement of %s (manifest %s)", name, root)
+	return nil
+}
+
+// repairChunk copies a chunk from one of its live holders, or the local store,
+// to peers that do not hold it until it has target live copies. A shard of an
+// erasure-coded file with no copy left is rebuilt from the rest of its stripe.
+// It returns the IDs of the peers that received a copy.
+func (r *Repairer) repairChunk(meta MetaData, hash string, alive []string, live map[string]Peer, candidates []Peer, target int) ([]string, error) {
+	name := meta.Filename
+	blob, source, err := r.fetchReplica(hash, alive, live)
+	if err != nil && meta.Erasure != nil {
+		blob, source, err = r.rebuildReplica(meta, hash, live)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	holding := make(map[string]bool, len(alive))
+	for _, id := range alive {
+		holding[id] = true
+	}
+	var copied []string
+	for _, peer := range rankPeers(hash, candidates) {
+		if len(alive)+len(copied) >= target {
+			break
+		}
+		if holding[peer.ID] {
+			continue
+		}
+		if _, err := pushChunks(peer, []storedChunk{{hash, blob}}); err != nil {
+			log.Printf("[WARN] Repair: could not copy chunk %s to %s: %v", hash, peer.ID, err)
+			continue
+		}
+		copied = append(copied, peer.ID)
+		log.Printf("[INFO] Repair: copied chunk %s of %s from %s to %s", hash, name, source, peer.ID)
+		audit.Record(audit.Event{
+			Type:     "repair_chunk",
+			PeerID:   peer.ID,
+			Filename: name,
+			Bytes:    int64(len(blob)),
+			Detail:   fmt.Sprintf("chunk %s copied from %s", hash, source),
+		})
+		r.update(func(s *RepairStatus) { s.Copied++ })
+	}
+	if len(alive)+len(copied) < target {
+		return copied, errors.New("not enough peers accepted a copy")
+	}
+	return copied, nil
+}
+
+// fetchReplica returns a chunk sealed for this node's storage keys, taken from
+// the local store or a live holder, after checking that it decrypts to the
+// content its hash names. It also returns where the chunk came from.
+func (r *Repairer) fetchReplica(hash string, alive []string, live map[string]Peer) ([]byte, string, error) {
+	if r.store.keys == nil {
+		return nil, "", fmt.Errorf("storage encryption keys not configured")
+	}
+	if blob, err := r.store.readStoredChunk(hash); err == nil {
+		if blob, err = r.store.verifyReplica(hash, blob); err == nil {
+			return blob, "local store", nil
+		}
+	}
+
+	err := errors.New("no live holder")
+	for _, id := range alive {
+		var blob []byte
+		blob, err = fetchObject(live[id], Message{Type: "get_chunk", Hash: hash}, "chunk_data")
+		if err == nil {
+			if blob, err = r.store.verifyReplica(hash, blob); err == nil {
+				return blob, id, nil
+			}
+		}
+		log.Printf("[DEBUG] Repair: chunk %s not available from %s: %v", hash, id, err)
+	}
+	return nil, "", fmt.Errorf("no readable copy: %w", err)
+}
+
+// rebuildReplica reconstructs a lost shard of an erasure-coded file from the
+// other shards of its stripe and returns it sealed for this node's storage keys.
+func (r *Repairer) rebuildReplica(meta MetaData, hash string, live map[string]Peer) ([]byte, string, error) {
+	shard, err := rebuildShard(meta, hash, func(h string) ([]byte, error) {
+		chunk, err := r.store.readChunk(h)
+		if err != nil {
+			chunk, err = r.store.fetchPlacedChunk(live, meta.Placement[h], h)
+		}
+		return chunk, err
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("could not rebuild from parity: %w", err)
+	}
+	sealed, err := crypto.Seal(r.store.keys.Public, shard, []byte(hash))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to encrypt chunk %s: %w", hash, err)
+	}
+	return sealed, "parity", nil
+}
+
+// verifyReplica checks a chunk against its hash and returns it sealed for the store's keys.
+func (s *Store) verifyReplica(hash string, blob []byte) ([]byte, error) {
+	plaintext, err := s.openChunk(hash, blob)
+	if err != nil {
+		return nil, err
+	}
+	if actual := hashChunk(plaintext); actual != hash {
+		return nil, &IntegrityError{Filename: hash, Chunk: -1, Expected: hash, Actual: actual}
+	}
+	if crypto.IsSealed(blob) {
+		return blob, nil
+	}
+	return crypto.Seal(s.keys.Public, plaintext, []byte(hash))
+}
+
+// mergeHolders appends the IDs in extra that are not already in holders.
+func mergeHolders(holders, extra []string) []string {
+	seen := make(map[string]bool, len(holders))
+	for _, id := range holders {
+		seen[id] = true
+	}
+	for _, id := range extra {
+		if !seen[id] {
+			holders = append(holders, id)
+			seen[id] = true
+		}
+	}
+	return holders
+}
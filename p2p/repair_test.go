@@ -0,0 +1,234 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"FDS/codec"
+	"FDS/crypto"
+)
+
+func TestLivePeers(t *testing.T) {
+	now := time.Now()
+	infos := []BootstrapPeerInfo{
+		{ID: "fresh", Addr: "10.0.0.1:1", LastSeen: now.Add(-time.Second)},
+		{ID: "stale", Addr: "10.0.0.2:1", LastSeen: now.Add(-time.Minute)},
+		{ID: "unreported", Addr: "10.0.0.3:1"},
+		{ID: "bad address", Addr: "nowhere", LastSeen: now},
+	}
+	live := livePeers(infos, 30*time.Second)
+	for id, want := range map[string]bool{"fresh": true, "stale": false, "unreported": true, "bad address": false} {
+		if _, ok := live[id]; ok != want {
+			t.Errorf("%s live = %v, want %v", id, ok, want)
+		}
+	}
+	if peer := live["fresh"]; peer.IP != "10.0.0.1" || peer.Port != "1" {
+		t.Errorf("fresh peer = %+v", peer)
+	}
+}
+
+func TestRepairStatusWithoutPeers(t *testing.T) {
+	r := NewRepairer(testStore(t), RepairOptions{}, func() []BootstrapPeerInfo { return nil })
+	status := r.RepairOnce()
+	if status.Running || status.Started.IsZero() || status.Finished.Before(status.Started) {
+		t.Errorf("status after a skipped pass = %+v", status)
+	}
+	if r.Status() != status {
+		t.Error("Status does not report the last pass")
+	}
+}
+
+// holdingPeer is an in-process peer reached over mutual TLS that keeps the
+// chunks pushed to it in its own held store.
+type holdingPeer struct {
+	Peer
+	store    *Store
+	listener net.Listener
+}
+
+// holdingPeers starts a peer for each ID and makes this process dial them as
+// owner, each with a certificate the others trust.
+func holdingPeers(t *testing.T, owner string, ids ...string) map[string]*holdingPeer {
+	t.Helper()
+	dir := t.TempDir()
+	trustDir := filepath.Join(dir, "trust")
+	identities := make(map[string]*crypto.TLSIdentity)
+	for _, id := range append([]string{owner}, ids...) {
+		keys, err := crypto.GenerateKeyPair(1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyDir := filepath.Join(dir, id)
+		if err := crypto.SaveKeyPair(keyDir, keys); err != nil {
+			t.Fatal(err)
+		}
+		if err := crypto.GenerateSelfSignedCertificate(id, keys, filepath.Join(trustDir, id+".pem")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, id := range append([]string{owner}, ids...) {
+		identity, err := crypto.LoadTLSIdentity(filepath.Join(trustDir, id+".pem"), filepath.Join(dir, id, "private.pem"), trustDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		identities[id] = identity
+	}
+	previous := tlsIdentity
+	t.Cleanup(func() { tlsIdentity = previous })
+	tlsIdentity = identities[owner]
+
+	peers := make(map[string]*holdingPeer)
+	for _, id := range ids {
+		listener, err := tls.Listen("tcp", "127.0.0.1:0", identities[id].ServerConfig())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { listener.Close() })
+		host, port, _ := net.SplitHostPort(listener.Addr().String())
+		peer := &holdingPeer{
+			Peer:     Peer{ID: id, IP: host, Port: port},
+			store:    NewStore(NewMemoryChunkStore(), NewMemoryChunkStore(), nil),
+			listener: listener,
+		}
+		go peer.serve()
+		peers[id] = peer
+	}
+	return peers
+}
+
+// serve answers put_chunk and get_chunk like a peer's connection handler, from its own store.
+func (p *holdingPeer) serve() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			c, request, err := codec.ServerHandshake(conn)
+			if err != nil {
+				return
+			}
+			owner := remotePeerID(conn)
+			for err == nil {
+				switch request.Type {
+				case "put_chunk":
+					if err := p.store.storePushedChunk(owner, request.Hash, request.Content); err != nil {
+						sendError(c, request.Hash, CodeStoreFailed, err.Error())
+						return
+					}
+					c.WriteMessage(Message{Type: "chunk_stored", Hash: request.Hash})
+				case "get_chunk":
+					chunk, err := p.store.readHeldChunk(owner, request.Hash)
+					if err != nil {
+						sendError(c, request.Hash, CodeNotFound, "Chunk not found")
+						return
+					}
+					c.WriteMessage(Message{Type: "chunk_data", Hash: request.Hash, Content: chunk})
+				}
+				c.Flush()
+				request, err = c.ReadMessage()
+			}
+		}()
+	}
+}
+
+func (p *holdingPeer) holds(owner, hash string) bool {
+	_, err := p.store.held.Get(heldKey(owner, hash))
+	return err == nil
+}
+
+// A chunk whose holder goes offline is copied to a live peer, or rebuilt from
+// parity if it has no other copy, and the manifest records where it went.
+func TestRepairReplacesOfflineHolder(t *testing.T) {
+	tests := []struct {
+		name     string
+		replicas int
+		opts     StoreOptions
+	}{
+		{"replicated", 2, StoreOptions{}},
+		{"erasure coded", 1, StoreOptions{DataShards: 2, ParityShards: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := testStore(t)
+			peers := holdingPeers(t, "owner", "a", "b", "c", "d")
+			var all []Peer
+			for _, id := range []string{"a", "b", "c", "d"} {
+				all = append(all, peers[id].Peer)
+			}
+			data := randomData(20000, 7)
+			opts := tt.opts
+			opts.Chunker = &ChunkerConfig{Algorithm: ChunkerFixed, Max: 4096}
+			if _, err := store.DistributeFile(all, "a.bin", data, tt.replicas, opts); err != nil {
+				t.Fatal(err)
+			}
+			before, err := store.loadFileMeta("a.bin")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Take the peer holding the most chunks offline.
+			counts := make(map[string]int)
+			for _, holders := range before.Placement {
+				for _, id := range holders {
+					counts[id]++
+				}
+			}
+			offline := "a"
+			for id, n := range counts {
+				if n > counts[offline] || n == counts[offline] && id < offline {
+					offline = id
+				}
+			}
+			peers[offline].listener.Close()
+			infos := func() []BootstrapPeerInfo {
+				var infos []BootstrapPeerInfo
+				for id, peer := range peers {
+					info := BootstrapPeerInfo{ID: id, Addr: peer.Address(), LastSeen: time.Now()}
+					if id == offline {
+						info.LastSeen = time.Now().Add(-time.Hour)
+					}
+					infos = append(infos, info)
+				}
+				return infos
+			}
+
+			status := NewRepairer(store, RepairOptions{Replicas: tt.replicas}, infos).RepairOnce()
+			if status.UnderReplicated != counts[offline] || status.Copied != counts[offline] || status.Failed != 0 {
+				t.Fatalf("status = %+v, want %d chunks copied", status, counts[offline])
+			}
+			after, err := store.loadFileMeta("a.bin")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for hash, holders := range after.Placement {
+				if len(holders) != tt.replicas {
+					t.Errorf("chunk %s is on %v, want %d peers", hash, holders, tt.replicas)
+				}
+				for _, id := range holders {
+					if id == offline {
+						t.Errorf("chunk %s still placed on offline peer %s", hash, id)
+					} else if !peers[id].holds("owner", hash) {
+						t.Errorf("chunk %s placed on %s, which does not hold it", hash, id)
+					}
+				}
+			}
+
+			var live []Peer
+			for _, peer := range all {
+				if peer.ID != offline {
+					live = append(live, peer)
+				}
+			}
+			got, err := store.RetrieveFromPeers(live, "a.bin")
+			if err != nil || !bytes.Equal(got, data) {
+				t.Errorf("RetrieveFromPeers after repair = %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,357 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"FDS/audit"
+	"FDS/crypto"
+)
+
+// quarantineSuffix is appended to the key of a value that failed verification.
+// Quarantined values are kept for inspection; garbage collection leaves them alone.
+const quarantineSuffix = ".corrupt"
+
+// errUnverifiable marks a chunk sealed for keys this store does not have,
+// including a chunk whose data key was wrapped for another key pair.
+var errUnverifiable = errors.New("chunk is sealed for another key pair")
+
+// ScrubOptions tunes integrity scrubbing. Zero values select the defaults.
+type ScrubOptions struct {
+	Interval         time.Duration // time between scrub passes, default 1 hour
+	HeartbeatTimeout time.Duration // a peer not heard from for longer is offline, default 30s
+}
+
+func (o ScrubOptions) withDefaults() ScrubOptions {
+	if o.Interval <= 0 {
+		o.Interval = time.Hour
+	}
+	if o.HeartbeatTimeout <= 0 {
+		o.HeartbeatTimeout = 30 * time.Second
+	}
+	return o
+}
+
+// ScrubReport describes one scrub pass.
+type ScrubReport struct {
+	Started      time.Time `json:"started"`
+	Finished     time.Time `json:"finished"`
+	Scanned      int       `json:"scanned"`      // chunks and manifests read and verified
+	Bytes        int64     `json:"bytes"`        // their total size
+	Corrupt      []string  `json:"corrupt"`      // keys that failed verification and were quarantined
+	Repaired     int       `json:"repaired"`     // corrupt values, found now or earlier, replaced by a healthy copy
+	Unverifiable int       `json:"unverifiable"` // sealed chunks the store has no keys for, such as held chunks
+}
+
+// ScrubStats accumulates bit-rot statistics over every pass of a Scrubber.
+type ScrubStats struct {
+	Passes   int         `json:"passes"`
+	Scanned  int         `json:"scanned"`
+	Bytes    int64       `json:"bytes"`
+	Corrupt  int         `json:"corrupt"`
+	Repaired int         `json:"repaired"`
+	Last     ScrubReport `json:"last"`
+}
+
+// Scrubber periodically re-reads every chunk and manifest in a store and checks
+// it against its hash. A value that fails is moved aside under
+// <key>.corrupt and, where possible, replaced by a healthy copy fetched from a
+// peer or, for shards of erasure-coded files, rebuilt from the rest of the stripe.
+type Scrubber struct {
+	store *Store
+	opts  ScrubOptions
+	peers func() []BootstrapPeerInfo
+
+	mutex sync.Mutex
+	stats ScrubStats
+}
+
+// NewScrubber creates a Scrubber for store that gets the current peer list
+// from peers. peers may be nil, in which case nothing is re-fetched.
+func NewScrubber(store *Store, opts ScrubOptions, peers func() []BootstrapPeerInfo) *Scrubber {
+	return &Scrubber{store: store, opts: opts.withDefaults(), peers: peers}
+}
+
+// Stats returns the statistics of every pass so far.
+func (sc *Scrubber) Stats() ScrubStats {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	return sc.stats
+}
+
+// Run scrubs every opts.Interval until quit is closed.
+func (sc *Scrubber) Run(quit <-chan struct{}) {
+	ticker := time.NewTicker(sc.opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			sc.ScrubOnce()
+		case <-quit:
+			return
+		}
+	}
+}
+
+// ScrubOnce runs a single pass over the store.
+func (sc *Scrubber) ScrubOnce() ScrubReport {
+	report := ScrubReport{Started: time.Now()}
+	s := sc.store
+
+	shards, holders := sc.references()
+	var live map[string]Peer
+	repair := func(key string) (string, error) {
+		if live == nil && sc.peers != nil {
+			live = livePeers(sc.peers(), sc.opts.HeartbeatTimeout)
+		}
+		if root, ok := strings.CutSuffix(key, ".manifest"); ok {
+			return sc.refetchManifest(root, live)
+		}
+		return sc.restoreChunk(key, holders[key], shards[key], live)
+	}
+
+	keys, err := s.chunks.List()
+	if err != nil {
+		log.Printf("[ERROR] Scrub: %v", err)
+	}
+	for _, key := range keys {
+		if original, ok := strings.CutSuffix(key, quarantineSuffix); ok {
+			// Retry values no healthy copy could be found for in earlier passes.
+			if exists, err := s.chunks.Has(original); err == nil && !exists {
+				source, err := repair(original)
+				if err == nil {
+					report.Repaired++
+					sc.record(original, source, nil)
+				}
+			}
+			continue
+		}
+		if !isHash(key) && !isHash(strings.TrimSuffix(key, ".manifest")) {
+			continue
+		}
+		data, err := s.chunks.Get(key)
+		if err != nil {
+			// Removed since it was listed, most likely by garbage collection.
+			continue
+		}
+		report.Scanned++
+		report.Bytes += int64(len(data))
+		err = s.verifyStored(key, data)
+		if errors.Is(err, errUnverifiable) {
+			report.Unverifiable++
+		}
+		if err == nil || errors.Is(err, errUnverifiable) {
+			continue
+		}
+		log.Printf("[WARN] Scrub: %s is corrupt: %v", key, err)
+		report.Corrupt = append(report.Corrupt, key)
+		if sc.quarantine(s.chunks, key, data) != nil {
+			continue
+		}
+		source, err := repair(key)
+		if err == nil {
+			report.Repaired++
+		}
+		sc.record(key, source, err)
+	}
+
+	// Chunks held for other peers can only be checked if they are plaintext;
+	// their owners keep track of where else they are.
+	held, err := s.held.List()
+	if err != nil {
+		log.Printf("[ERROR] Scrub: %v", err)
+	}
+	for _, key := range held {
+		_, hash, ok := parseHeldKey(key)
+		if !ok {
+			continue
+		}
+		data, err := s.held.Get(key)
+		if err != nil {
+			continue
+		}
+		report.Scanned++
+		report.Bytes += int64(len(data))
+		if crypto.IsSealed(data) {
+			report.Unverifiable++
+			continue
+		}
+		if actual := hashChunk(data); actual != hash {
+			log.Printf("[WARN] Scrub: held chunk %s is corrupt: digest %s", key, actual)
+			report.Corrupt = append(report.Corrupt, key)
+			if sc.quarantine(s.held, key, data) == nil {
+				sc.record(key, "", errors.New("held chunk, not repaired"))
+			}
+		}
+	}
+
+	report.Finished = time.Now()
+	sc.mutex.Lock()
+	sc.stats.Passes++
+	sc.stats.Scanned += report.Scanned
+	sc.stats.Bytes += report.Bytes
+	sc.stats.Corrupt += len(report.Corrupt)
+	sc.stats.Repaired += report.Repaired
+	sc.stats.Last = report
+	stats := sc.stats
+	sc.mutex.Unlock()
+
+	if len(report.Corrupt) > 0 {
+		log.Printf("[WARN] Scrub pass: %d of %d values corrupt (%d repaired); %d corrupt in %d passes",
+			len(report.Corrupt), report.Scanned, report.Repaired, stats.Corrupt, stats.Passes)
+	} else {
+		log.Printf("[DEBUG] Scrub pass: %d values (%d bytes) verified", report.Scanned, report.Bytes)
+	}
+	return report
+}
+
+// references returns, for every chunk of a stored file, the erasure-coded
+// manifests it is a shard of and the peers the manifests place it on.
+func (sc *Scrubber) references() (map[string][]MetaData, map[string][]string) {
+	shards := make(map[string][]MetaData)
+	holders := make(map[string][]string)
+	names, err := sc.store.Names()
+	if err != nil {
+		return shards, holders
+	}
+	for _, name := range names {
+		meta, err := sc.store.loadFileMeta(name)
+		if err != nil {
+			// A corrupt manifest is found and reported by the pass itself.
+			continue
+		}
+		for hash, ids := range meta.Placement {
+			holders[hash] = mergeHolders(holders[hash], ids)
+		}
+		if meta.Erasure == nil {
+			continue
+		}
+		hashes := append([]string(nil), meta.ChunkHashes...)
+		for _, stripe := range meta.Erasure.Parity {
+			hashes = append(hashes, stripe...)
+		}
+		for _, hash := range hashes {
+			shards[hash] = append(shards[hash], meta)
+		}
+	}
+	return shards, holders
+}
+
+// verifyStored checks a chunk or manifest from the store against the hash it is kept under.
+func (s *Store) verifyStored(key string, data []byte) error {
+	if root, ok := strings.CutSuffix(key, ".manifest"); ok {
+		if actual := hashChunk(data); actual != root {
+			return &IntegrityError{Filename: key, Chunk: -1, Expected: root, Actual: actual}
+		}
+		return nil
+	}
+	if crypto.IsSealed(data) && s.keys == nil {
+		return errUnverifiable
+	}
+	plaintext, err := s.openChunk(key, data)
+	if errors.Is(err, crypto.ErrWrongKey) {
+		// Sealed under an earlier key pair, or pushed here by a peer: not
+		// readable, but no evidence of damage either.
+		return errUnverifiable
+	}
+	if err != nil {
+		return err
+	}
+	if actual := hashChunk(plaintext); actual != key {
+		return &IntegrityError{Filename: key, Chunk: -1, Expected: key, Actual: actual}
+	}
+	return nil
+}
+
+// quarantine moves a value that failed verification to <key>.corrupt.
+func (sc *Scrubber) quarantine(cs ChunkStore, key string, data []byte) error {
+	if err := cs.Put(key+quarantineSuffix, data); err != nil {
+		log.Printf("[ERROR] Scrub: failed to quarantine %s: %v", key, err)
+		return err
+	}
+	if err := cs.Delete(key); err != nil {
+		log.Printf("[ERROR] Scrub: failed to remove corrupt %s: %v", key, err)
+		return err
+	}
+	return nil
+}
+
+// restoreChunk replaces a quarantined chunk with a verified copy from one of
+// its holders or any other live peer, or rebuilds it from parity.
+func (sc *Scrubber) restoreChunk(hash string, holders []string, metas []MetaData, live map[string]Peer) (string, error) {
+	s := sc.store
+	if s.keys == nil {
+		return "", fmt.Errorf("storage encryption keys not configured")
+	}
+
+	order := append([]string(nil), holders...)
+	for id := range live {
+		order = mergeHolders(order, []string{id})
+	}
+	err := errors.New("no live peer")
+	for _, id := range order {
+		peer, ok := live[id]
+		if !ok {
+			continue
+		}
+		var blob []byte
+		blob, err = fetchObject(peer, Message{Type: "get_chunk", Hash: hash}, "chunk_data")
+		if err == nil {
+			if blob, err = s.verifyReplica(hash, blob); err == nil {
+				if err = s.chunks.Put(hash, blob); err == nil {
+					return id, nil
+				}
+			}
+		}
+		log.Printf("[DEBUG] Scrub: chunk %s not available from %s: %v", hash, id, err)
+	}
+
+	for _, meta := range metas {
+		shard, rerr := rebuildShard(meta, hash, s.readChunk)
+		if rerr != nil {
+			err = rerr
+			continue
+		}
+		sealed, rerr := crypto.Seal(s.keys.Public, shard, []byte(hash))
+		if rerr != nil {
+			return "", fmt.Errorf("failed to encrypt chunk %s: %w", hash, rerr)
+		}
+		if err = s.chunks.Put(hash, sealed); err == nil {
+			return "parity", nil
+		}
+	}
+	return "", fmt.Errorf("no healthy copy: %w", err)
+}
+
+// refetchManifest replaces a quarantined manifest with a verified copy from a live peer.
+func (sc *Scrubber) refetchManifest(root string, live map[string]Peer) (string, error) {
+	err := errors.New("no live peer")
+	for id, peer := range live {
+		var data []byte
+		data, err = fetchObject(peer, Message{Type: "get_manifest", Hash: root}, "manifest")
+		if err == nil {
+			if actual := hashChunk(data); actual != root {
+				err = &IntegrityError{Filename: root + ".manifest", Chunk: -1, Expected: root, Actual: actual}
+			} else if err = sc.store.chunks.Put(root+".manifest", data); err == nil {
+				return id, nil
+			}
+		}
+		log.Printf("[DEBUG] Scrub: manifest %s not available from %s: %v", root, id, err)
+	}
+	return "", fmt.Errorf("no healthy copy: %w", err)
+}
+
+// record logs and audits the outcome of a corrupt value found by the scrubber.
+func (sc *Scrubber) record(key, source string, err error) {
+	if err != nil {
+		log.Printf("[WARN] Scrub: %s quarantined, not repaired: %v", key, err)
+		audit.Record(audit.Event{Type: "scrub_chunk", Filename: key, Detail: "quarantined: " + err.Error(), Err: err})
+		return
+	}
+	log.Printf("[INFO] Scrub: %s quarantined and restored from %s", key, source)
+	audit.Record(audit.Event{Type: "scrub_chunk", Filename: key, Detail: "quarantined, restored from " + source})
+}
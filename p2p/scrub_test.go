@@ -0,0 +1,65 @@
+package p2p
+
+import (
+	"testing"
+
+	"FDS/crypto"
+)
+
+func TestScrubOnce(t *testing.T) {
+	store := testStore(t)
+	other, err := crypto.GenerateKeyPair(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("chunk contents")
+	hash := hashChunk(data)
+	seal := func(keys *crypto.KeyPair) []byte {
+		sealed, err := crypto.Seal(keys.Public, data, []byte(hash))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sealed
+	}
+	tampered := seal(testKeys)
+	tampered[len(tampered)-1] ^= 1
+	manifest := []byte(`{"filename":"a"}`)
+
+	tests := []struct {
+		name             string
+		key              string
+		value            []byte
+		wantCorrupt      bool
+		wantUnverifiable bool
+	}{
+		{"intact plaintext chunk", hash, data, false, false},
+		{"intact sealed chunk", hash, seal(testKeys), false, false},
+		{"damaged plaintext chunk", hash, []byte("chunk c0ntents"), true, false},
+		{"sealed chunk failing authentication", hash, tampered, true, false},
+		{"chunk sealed for another key", hash, seal(other), false, true},
+		{"intact manifest", hashChunk(manifest) + ".manifest", manifest, false, false},
+		{"damaged manifest", hashChunk(manifest) + ".manifest", []byte(`{"filename":"b"}`), true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store.chunks = NewMemoryChunkStore()
+			store.chunks.Put(tt.key, tt.value)
+
+			report := NewScrubber(store, ScrubOptions{}, nil).ScrubOnce()
+			if report.Scanned != 1 {
+				t.Fatalf("scanned %d values, want 1", report.Scanned)
+			}
+			if corrupt := len(report.Corrupt) == 1; corrupt != tt.wantCorrupt {
+				t.Errorf("corrupt = %v, want %v", report.Corrupt, tt.wantCorrupt)
+			}
+			if unverifiable := report.Unverifiable == 1; unverifiable != tt.wantUnverifiable {
+				t.Errorf("unverifiable = %d, want %v", report.Unverifiable, tt.wantUnverifiable)
+			}
+			kept, _ := store.chunks.Has(tt.key)
+			quarantined, _ := store.chunks.Has(tt.key + quarantineSuffix)
+			if kept == tt.wantCorrupt || quarantined != tt.wantCorrupt {
+				t.Errorf("kept = %v, quarantined = %v", kept, quarantined)
+			}
+		})
+	}
+}
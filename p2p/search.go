@@ -0,0 +1,62 @@
+package p2p
+
+import (
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// SearchResult is a file matching a search, together with the peer sharing it.
+type SearchResult struct {
+	PeerID string `json:"peer"`
+	RemoteFileInfo
+}
+
+// MatchFilename reports whether a shared file name matches a search pattern.
+// Patterns containing glob characters (*, ? or [) are matched with path.Match
+// against the whole name; anything else is a case-insensitive substring match.
+func MatchFilename(pattern, name string) bool {
+	if strings.ContainsAny(pattern, "*?[") {
+		matched, err := path.Match(pattern, name)
+		return err == nil && matched
+	}
+	return strings.Contains(strings.ToLower(name), strings.ToLower(pattern))
+}
+
+// SearchPeers sends a search query to every peer in parallel and collects the
+// matching files, sorted by name and then peer. Peers that cannot be reached
+// or do not support search are skipped.
+func SearchPeers(peers []Peer, pattern string) []SearchResult {
+	var (
+		mutex   sync.Mutex
+		results []SearchResult
+		wg      sync.WaitGroup
+	)
+	for _, peer := range peers {
+		wg.Add(1)
+		go func(peer Peer) {
+			defer wg.Done()
+			files, err := queryFileList(peer, Message{Type: "search", Filename: pattern})
+			if err != nil {
+				log.Printf("[WARN] Search on peer %s failed: %v", peer.ID, err)
+				return
+			}
+			mutex.Lock()
+			for _, f := range files {
+				results = append(results, SearchResult{PeerID: peer.ID, RemoteFileInfo: f})
+			}
+			mutex.Unlock()
+		}(peer)
+	}
+	wg.Wait()
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Name != results[j].Name {
+			return results[i].Name < results[j].Name
+		}
+		return results[i].PeerID < results[j].PeerID
+	})
+	return results
+}
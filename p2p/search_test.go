@@ -0,0 +1,57 @@
+package p2p
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMatchFilename(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"report", "docs/Annual-Report.pdf", true},
+		{"REPORT", "report.pdf", true},
+		{"notes", "report.pdf", false},
+		{"", "anything", true},
+		{"*.pdf", "report.pdf", true},
+		{"*.pdf", "docs/report.pdf", false},
+		{"docs/*.pdf", "docs/report.pdf", true},
+		{"*.PDF", "report.pdf", false},
+		{"report.???", "report.pdf", true},
+		{"[rs]*", "report.pdf", true},
+		{"[", "report.pdf", false},
+	}
+	for _, tt := range tests {
+		if got := MatchFilename(tt.pattern, tt.name); got != tt.want {
+			t.Errorf("MatchFilename(%q, %q) = %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSearchPeers(t *testing.T) {
+	shared := t.TempDir()
+	for _, name := range []string{"b-report.txt", "a-report.txt", "notes.txt"} {
+		os.WriteFile(filepath.Join(shared, name), []byte(name), 0644)
+	}
+	first := serveFolder(t, shared)
+	second := serveFolder(t, shared)
+	first.ID, second.ID = "first", "second"
+	unreachable := Peer{ID: "gone", IP: "127.0.0.1", Port: "1"}
+
+	results := SearchPeers([]Peer{second, unreachable, first}, "report")
+	want := []struct{ name, peer string }{
+		{"a-report.txt", "first"}, {"a-report.txt", "second"},
+		{"b-report.txt", "first"}, {"b-report.txt", "second"},
+	}
+	if len(results) != len(want) {
+		t.Fatalf("got %d results, want %d: %+v", len(results), len(want), results)
+	}
+	for i, w := range want {
+		if results[i].Name != w.name || results[i].PeerID != w.peer {
+			t.Errorf("result %d = %s on %s, want %s on %s", i, results[i].Name, results[i].PeerID, w.name, w.peer)
+		}
+	}
+}
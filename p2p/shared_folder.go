@@ -1,16 +1,26 @@
 package p2p
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
+	"io/fs"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
+
+	"FDS/audit"
 )
 
 // SharedFolder represents the folder where shared files are stored.
 type SharedFolder struct {
 	FolderPath string
+
+	// History, if set, keeps every version of the files written and removed
+	// through the folder in a chunk store; see AddVersion.
+	History *Store
 }
 
 // NewSharedFolder creates a new instance of SharedFolder and ensures the folder exists.
@@ -27,18 +37,163 @@ func NewSharedFolder(folderPath string) *SharedFolder {
 	return &SharedFolder{FolderPath: folderPath}
 }
 
-// ListFiles returns the list of filenames in the shared folder.
-func (s *SharedFolder) ListFiles() ([]string, error) {
-	files, err := ioutil.ReadDir(s.FolderPath)
+// ErrPathEscape is returned by Resolve for names that would leave the shared folder.
+var ErrPathEscape = errors.New("path escapes the shared folder")
+
+// Resolve maps a peer-supplied name to a path inside the shared folder.
+// Absolute names, ".." components and symlinks pointing outside the folder
+// are rejected with ErrPathEscape. The named file does not have to exist.
+func (s *SharedFolder) Resolve(name string) (string, error) {
+	if name == "" || strings.ContainsRune(name, 0) {
+		return "", ErrPathEscape
+	}
+	clean := filepath.Clean(filepath.FromSlash(name))
+	if filepath.IsAbs(clean) || filepath.VolumeName(clean) != "" || clean == "." ||
+		clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", ErrPathEscape
+	}
+	fullPath := filepath.Join(s.FolderPath, clean)
+
+	root, err := filepath.EvalSymlinks(s.FolderPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to list files: %v", err)
+		return "", fmt.Errorf("failed to resolve shared folder: %v", err)
+	}
+	// Follow symlinks through the longest existing prefix of the path, so a file
+	// or directory about to be created is checked through its nearest existing
+	// ancestor. A dangling symlink counts as existing and is rejected.
+	existing := fullPath
+	for {
+		if _, err := os.Lstat(existing); err == nil || !os.IsNotExist(err) {
+			break
+		}
+		existing = filepath.Dir(existing)
+	}
+	real, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", ErrPathEscape
+		}
+		return "", fmt.Errorf("failed to resolve %s: %v", name, err)
+	}
+	if rel, err := filepath.Rel(root, real); err != nil || rel == ".." ||
+		strings.HasPrefix(rel, ".."+string(filepath.Separator)) || filepath.IsAbs(rel) {
+		return "", ErrPathEscape
+	}
+	return fullPath, nil
+}
+
+// linkedName returns the slash-separated path, relative to the folder, of the
+// file name refers to once symlinks are resolved.
+func (s *SharedFolder) linkedName(name string) (string, error) {
+	_, rel, err := s.realPath(name)
+	return rel, err
+}
+
+// canonicalName is linkedName with each element spelled as it is stored on
+// disk, so on a case-insensitive filesystem "Report.PDF" names report.pdf.
+// It names the file the access policy applies to, whatever name it was
+// requested by. It reads every directory on the way, so it is meant for
+// names peers ask for, not for names taken from a walk of the folder.
+func (s *SharedFolder) canonicalName(name string) (string, error) {
+	root, rel, err := s.realPath(name)
+	if err != nil || rel == "." {
+		return rel, err
+	}
+	dir := root
+	elements := strings.Split(rel, "/")
+	for i, element := range elements {
+		names, err := readDirNames(dir)
+		if err != nil {
+			return "", err
+		}
+		elements[i] = storedName(names, element)
+		dir = filepath.Join(dir, elements[i])
+	}
+	return strings.Join(elements, "/"), nil
+}
+
+func (s *SharedFolder) realPath(name string) (string, string, error) {
+	filePath, err := s.Resolve(name)
+	if err != nil {
+		return "", "", err
+	}
+	real, err := filepath.EvalSymlinks(filePath)
+	if err != nil {
+		return "", "", err
+	}
+	root, err := filepath.EvalSymlinks(s.FolderPath)
+	if err != nil {
+		return "", "", err
 	}
+	rel, err := filepath.Rel(root, real)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", "", ErrPathEscape
+	}
+	return root, filepath.ToSlash(rel), nil
+}
+
+func readDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdirnames(-1)
+}
 
+// storedName returns the entry of names that element refers to: itself if
+// present, else the entry equal to it under case folding.
+func storedName(names []string, element string) string {
+	folded := ""
+	for _, name := range names {
+		if name == element {
+			return name
+		}
+		if folded == "" && strings.EqualFold(name, element) {
+			folded = name
+		}
+	}
+	if folded != "" {
+		return folded
+	}
+	return element
+}
+
+// ListFiles returns the names of the files in the shared folder and its
+// subdirectories, as slash-separated paths relative to the folder. Symlinked
+// directories are not followed. Hidden files and directories, such as uploads
+// in progress, and partial downloads are left out.
+func (s *SharedFolder) ListFiles() ([]string, error) {
 	var fileNames []string
-	for _, file := range files {
-		if !file.IsDir() {
-			fileNames = append(fileNames, file.Name())
+	err := filepath.WalkDir(s.FolderPath, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if filePath == s.FolderPath {
+				return err
+			}
+			log.Printf("[WARN] Skipping %s: %v", filePath, err)
+			return nil
+		}
+		if filePath == s.FolderPath {
+			return nil
 		}
+		rel, err := filepath.Rel(s.FolderPath, filePath)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if !tracked(rel) {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !entry.IsDir() {
+			fileNames = append(fileNames, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files: %v", err)
 	}
 
 	return fileNames, nil
@@ -46,19 +201,74 @@ func (s *SharedFolder) ListFiles() ([]string, error) {
 
 // AddFile adds a new file to the shared folder.
 func (s *SharedFolder) AddFile(filename string, data []byte) error {
-	filePath := filepath.Join(s.FolderPath, filename)
-	err := ioutil.WriteFile(filePath, data, os.ModePerm)
+	_, err := s.AddFileFrom(filename, bytes.NewReader(data))
+	return err
+}
+
+// AddFileFrom adds a file to the shared folder with the contents of r and
+// returns its size. The data is written to a temporary file that only replaces
+// filename once r has been read to the end, so a failed read leaves any
+// existing file untouched.
+func (s *SharedFolder) AddFileFrom(filename string, r io.Reader) (written int64, err error) {
+	filePath, err := s.Resolve(filename)
 	if err != nil {
-		return fmt.Errorf("failed to write file %s: %v", filename, err)
+		audit.Record(audit.Event{Type: "add_file", Filename: filename, Outcome: audit.OutcomeDenied, Err: err})
+		return 0, fmt.Errorf("failed to write file %s: %w", filename, err)
+	}
+	defer func() {
+		audit.Record(audit.Event{Type: "add_file", Filename: filename, Bytes: written, Err: err})
+	}()
+
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return 0, fmt.Errorf("failed to write file %s: %w", filename, err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(filePath), "."+filepath.Base(filePath)+".*.tmp")
+	if err != nil {
+		return 0, fmt.Errorf("failed to write file %s: %w", filename, err)
+	}
+	defer os.Remove(tmp.Name())
+	written, err = io.Copy(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filePath)
+	}
+	if err != nil {
+		return written, fmt.Errorf("failed to write file %s: %w", filename, err)
 	}
 	log.Printf("File added: %s", filename)
-	return nil
+	if s.History != nil {
+		if err := s.recordVersion(filename); err != nil {
+			log.Printf("[WARN] Failed to record version of %s: %v", filename, err)
+		}
+	}
+	return written, nil
 }
 
 // RemoveFile removes a file from the shared folder.
 func (s *SharedFolder) RemoveFile(filename string) error {
-	filePath := filepath.Join(s.FolderPath, filename)
-	err := os.Remove(filePath)
+	filePath, err := s.Resolve(filename)
+	if err != nil {
+		audit.Record(audit.Event{Type: "remove_file", Filename: filename, Outcome: audit.OutcomeDenied, Err: err})
+		return fmt.Errorf("failed to remove file %s: %w", filename, err)
+	}
+	if s.History != nil {
+		// Keep what is being removed if it was never recorded, e.g. copied in by hand.
+		if err := s.recordVersion(filename); err != nil && !os.IsNotExist(err) {
+			log.Printf("[WARN] Failed to record version of %s: %v", filename, err)
+		}
+	}
+	err = os.Remove(filePath)
+	if err == nil && s.History != nil {
+		if err := s.History.addRemoval(filename); err != nil {
+			log.Printf("[WARN] Failed to record removal of %s: %v", filename, err)
+		}
+	}
+	audit.Record(audit.Event{Type: "remove_file", Filename: filename, Err: err})
 	if err != nil {
 		return fmt.Errorf("failed to remove file %s: %v", filename, err)
 	}
@@ -0,0 +1,142 @@
+package p2p
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "docs"), 0755)
+	os.WriteFile(filepath.Join(root, "docs", "a.txt"), []byte("a"), 0644)
+	os.WriteFile(filepath.Join(outside, "secret"), []byte("s"), 0644)
+	os.Symlink(filepath.Join(outside, "secret"), filepath.Join(root, "escape"))
+	os.Symlink(outside, filepath.Join(root, "escapedir"))
+	os.Symlink(filepath.Join(root, "docs", "a.txt"), filepath.Join(root, "inside"))
+	os.Symlink(filepath.Join(root, "missing"), filepath.Join(root, "dangling"))
+	folder := &SharedFolder{FolderPath: root}
+
+	tests := []struct {
+		name string
+		want string // "" if the name must be rejected
+	}{
+		{"docs/a.txt", filepath.Join(root, "docs", "a.txt")},
+		{"docs/../docs/a.txt", filepath.Join(root, "docs", "a.txt")},
+		{"new/file.txt", filepath.Join(root, "new", "file.txt")},
+		{"inside", filepath.Join(root, "inside")},
+		{"", ""},
+		{".", ""},
+		{"..", ""},
+		{"../x", ""},
+		{"docs/../../x", ""},
+		{"/etc/passwd", ""},
+		{"a\x00b", ""},
+		{"escape", ""},
+		{"escapedir/secret", ""},
+		{"escapedir/new.txt", ""},
+		{"dangling", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := folder.Resolve(tt.name)
+			if tt.want == "" {
+				if !errors.Is(err, ErrPathEscape) {
+					t.Fatalf("Resolve = %q, %v; want ErrPathEscape", got, err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("Resolve = %q, %v; want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+// Temporary files of uploads in progress and partial downloads are neither
+// listed nor served.
+func TestListFilesSkipsUntracked(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "docs", ".cache"), 0755)
+	for _, name := range []string{
+		"a.txt",
+		".a.txt.123.tmp",
+		"movie.mkv.partial",
+		"movie.mkv.partial.state",
+		"docs/b.txt",
+		"docs/.b.txt.456.tmp",
+		"docs/.cache/c.txt",
+	} {
+		os.WriteFile(filepath.Join(root, name), []byte(name), 0644)
+	}
+
+	names, err := (&SharedFolder{FolderPath: root}).ListFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a.txt", "docs/b.txt"}; !slices.Equal(names, want) {
+		t.Errorf("ListFiles = %v, want %v", names, want)
+	}
+
+	peer := serveFolder(t, root)
+	for _, name := range []string{".a.txt.123.tmp", "movie.mkv.partial", "docs/.cache/c.txt"} {
+		_, _, err := StatFile(peer, name)
+		var peerErr *PeerError
+		if !errors.As(err, &peerErr) || peerErr.Code != CodeNotFound {
+			t.Errorf("stat %s: got %v, want a not_found error", name, err)
+		}
+	}
+	if _, _, err := StatFile(peer, "docs/b.txt"); err != nil {
+		t.Errorf("stat docs/b.txt: %v", err)
+	}
+}
+
+func TestCanonicalName(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "Private"), 0755)
+	os.WriteFile(filepath.Join(root, "Private", "Secret.txt"), []byte("s"), 0644)
+	os.Symlink(filepath.Join("Private", "Secret.txt"), filepath.Join(root, "public.txt"))
+	os.Symlink("Private", filepath.Join(root, "open"))
+	folder := &SharedFolder{FolderPath: root}
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"Private/Secret.txt", "Private/Secret.txt"},
+		{"public.txt", "Private/Secret.txt"},
+		{"open/Secret.txt", "Private/Secret.txt"},
+		{"./Private//Secret.txt", "Private/Secret.txt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := folder.canonicalName(tt.name)
+			if err != nil || got != tt.want {
+				t.Errorf("canonicalName = %q, %v; want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+// storedName is what spells a differently-cased request the way the policy
+// knows it on case-insensitive filesystems, where both names open the file.
+func TestStoredName(t *testing.T) {
+	tests := []struct {
+		names   []string
+		element string
+		want    string
+	}{
+		{[]string{"report.pdf", "notes"}, "report.pdf", "report.pdf"},
+		{[]string{"report.pdf", "notes"}, "Report.PDF", "report.pdf"},
+		{[]string{"README", "readme"}, "readme", "readme"},
+		{[]string{"notes"}, "other", "other"},
+	}
+	for _, tt := range tests {
+		if got := storedName(tt.names, tt.element); got != tt.want {
+			t.Errorf("storedName(%q, %q) = %q, want %q", tt.names, tt.element, got, tt.want)
+		}
+	}
+}
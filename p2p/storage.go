@@ -1,90 +1,711 @@
 package p2p
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/json"
 	"fmt"
-	"os"
+	"io"
 	"path/filepath"
+	"strings"
+	"sync"
+
+	"FDS/audit"
+	"FDS/crypto"
 )
 
-// Define the fixed size for each chunk.
+// Define the fixed size for each chunk. Files are transferred in chunks of this
+// size, and stored files were split into them before content-defined chunking.
 const chunkSize = 4096
 
+// Store holds this node's stored files: their chunks, manifests and name
+// records in one ChunkStore, and the chunks other peers pushed to this node
+// in another. Chunks are encrypted at rest for the store's key pair.
+type Store struct {
+	chunks ChunkStore
+	held   ChunkStore
+	keys   *crypto.KeyPair
+	closer io.Closer
+
+	versionMutex sync.Mutex // serializes changes to version histories
+
+	heldMutex sync.Mutex       // serializes pushes into held
+	heldBytes map[string]int64 // bytes held per owner, measured on the first push
+}
+
+// NewStore returns a store over the given chunk stores. keys is the key pair
+// chunks are encrypted for and decrypted with; it is required to store files.
+func NewStore(chunks, held ChunkStore, keys *crypto.KeyPair) *Store {
+	return &Store{chunks: chunks, held: held, keys: keys}
+}
+
+// Storage backends accepted by OpenStore.
+const (
+	BackendFS     = "fs"
+	BackendBolt   = "bolt"
+	BackendMemory = "memory"
+)
+
+// OpenStore opens a store with one of the built-in backends. "fs" keeps a file
+// per key in the directory path, and chunks held for other peers in path/held.
+// "bolt" keeps both in buckets of the bbolt database file at path. "memory"
+// keeps everything in memory and ignores path.
+func OpenStore(backend, path string, keys *crypto.KeyPair) (*Store, error) {
+	switch backend {
+	case BackendFS:
+		return NewStore(NewFileChunkStore(path), NewFileChunkStore(filepath.Join(path, "held")), keys), nil
+	case BackendMemory:
+		return NewStore(NewMemoryChunkStore(), NewMemoryChunkStore(), keys), nil
+	case BackendBolt:
+		db, err := OpenBoltDB(path)
+		if err != nil {
+			return nil, err
+		}
+		chunks, err := NewBoltChunkStore(db, "chunks")
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		held, err := NewBoltChunkStore(db, "held")
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		store := NewStore(chunks, held, keys)
+		store.closer = db
+		return store, nil
+	}
+	return nil, fmt.Errorf("unknown storage backend %q", backend)
+}
+
+// Close releases the store's backend.
+func (s *Store) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
+
+// localStore is the store this node serves chunks from and keeps chunks pushed
+// to it in; see UseStore. By default it is the chunks/ directory without keys.
+var localStore = NewStore(NewFileChunkStore("chunks"), NewFileChunkStore(filepath.Join("chunks", "held")), nil)
+
+// UseStore sets the store the TCP server serves and accepts chunks with.
+// It must be called before the server is started.
+func UseStore(s *Store) {
+	localStore = s
+}
+
+// Compile-time checks that the built-in backends support garbage collection.
+var (
+	_ TimedChunkStore = (*FileChunkStore)(nil)
+	_ TimedChunkStore = (*MemoryChunkStore)(nil)
+	_ TimedChunkStore = (*BoltChunkStore)(nil)
+)
+
 // MetaData holds metadata that maps a filename to a list of chunk hashes.
+// Stored manifests are content-addressed: a file is identified by the SHA-256
+// of its encoded manifest (its root hash), kept under the key <root>.manifest.
+// Files distributed with DistributeFile also record which peers hold each chunk,
+// and files stored with erasure coding record the scheme and parity shards.
+// Chunker is nil in manifests written before content-defined chunking, whose
+// chunks are fixed 4096-byte pieces.
+//
+// A file of more than manifestPartChunks chunks gets a manifest of manifests:
+// Parts lists the root hashes of part manifests, each a manifest of the same
+// file for the next run of its chunks (whole stripes of them, if erasure
+// coded), and the manifest itself lists no chunks. loadManifest and
+// FetchManifest join the parts, so a loaded manifest lists every chunk.
 type MetaData struct {
-	Filename    string   `json:"filename"`
-	ChunkHashes []string `json:"chunk_hashes"`
+	Filename    string              `json:"filename"`
+	ChunkHashes []string            `json:"chunk_hashes"`
+	Chunker     *ChunkerConfig      `json:"chunker,omitempty"`
+	Placement   map[string][]string `json:"placement,omitempty"`
+	Erasure     *ErasureScheme      `json:"erasure,omitempty"`
+	Parts       []string            `json:"parts,omitempty"`
 }
 
-// StoreFile breaks the file data into chunks, computes a SHA-256 hash for each chunk,
-// stores each chunk on disk, and saves corresponding metadata.
-func StoreFile(filename string, data []byte) error {
-	chunks, hashes := chunkData(data, chunkSize)
+// manifestPartChunks is how many chunks a manifest lists before its chunk list
+// is split into part manifests. Storing a file then holds one part of the list
+// in memory at a time, and no manifest grows with the size of the file.
+var manifestPartChunks = 4096
 
-	// Ensure that the "chunks" directory exists.
-	if err := os.MkdirAll("chunks", 0755); err != nil {
-		return fmt.Errorf("failed to create chunks directory: %w", err)
+// partChunks returns how many chunks each part manifest of a file lists:
+// manifestPartChunks, rounded down to whole stripes for erasure-coded files.
+func partChunks(e *ErasureScheme) int {
+	n := manifestPartChunks
+	if e != nil {
+		n -= n % e.DataShards
+		if n == 0 {
+			n = e.DataShards
+		}
 	}
+	return n
+}
 
-	// Write each chunk to a separate file, named by its hash.
-	for i, chunk := range chunks {
-		chunkFilename := filepath.Join("chunks", hashes[i])
+// outline returns a manifest of manifests for meta's file, without any parts yet.
+func (meta MetaData) outline() MetaData {
+	outline := MetaData{Filename: meta.Filename, Chunker: meta.Chunker}
+	if meta.Erasure != nil {
+		outline.Erasure = &ErasureScheme{DataShards: meta.Erasure.DataShards, ParityShards: meta.Erasure.ParityShards}
+	}
+	return outline
+}
 
-		// Skip writing if the chunk already exists.
-		if _, err := os.Stat(chunkFilename); os.IsNotExist(err) {
-			if err := os.WriteFile(chunkFilename, chunk, 0644); err != nil {
-				return fmt.Errorf("failed to write chunk %s: %w", hashes[i], err)
+// part returns the manifest of data chunks first to end of a joined manifest,
+// with the parity shards and placement of those chunks. first must start a stripe.
+func (meta MetaData) part(first, end int) MetaData {
+	part := meta.outline()
+	part.ChunkHashes = meta.ChunkHashes[first:end]
+	if e := meta.Erasure; e != nil {
+		part.Erasure.ChunkSizes = e.ChunkSizes[first:end]
+		part.Erasure.Parity = e.Parity[first/e.DataShards : (end+e.DataShards-1)/e.DataShards]
+	}
+	if meta.Placement != nil {
+		part.Placement = make(map[string][]string)
+		for _, hash := range part.chunks() {
+			if ids, ok := meta.Placement[hash]; ok {
+				part.Placement[hash] = ids
+			}
+		}
+	}
+	return part
+}
+
+// joinParts returns a manifest of manifests with the chunks, parity shards and
+// placement of its parts, read with load, filled in. Parts is kept so the part
+// manifests can still be found. Other manifests are returned as they are.
+func joinParts(meta MetaData, load func(root string) (MetaData, error)) (MetaData, error) {
+	if len(meta.Parts) == 0 {
+		return meta, nil
+	}
+	joined := meta.outline()
+	joined.Parts = meta.Parts
+	for _, root := range meta.Parts {
+		part, err := load(root)
+		if err != nil {
+			return MetaData{}, err
+		}
+		if len(part.Parts) > 0 || part.Filename != meta.Filename || (part.Erasure == nil) != (meta.Erasure == nil) {
+			return MetaData{}, fmt.Errorf("manifest part %s does not belong to %s", root, meta.Filename)
+		}
+		if e := joined.Erasure; e != nil && len(e.ChunkSizes)%e.DataShards != 0 {
+			return MetaData{}, fmt.Errorf("manifest part %s of %s follows a short stripe", root, meta.Filename)
+		}
+		joined.ChunkHashes = append(joined.ChunkHashes, part.ChunkHashes...)
+		if e := joined.Erasure; e != nil {
+			e.ChunkSizes = append(e.ChunkSizes, part.Erasure.ChunkSizes...)
+			e.Parity = append(e.Parity, part.Erasure.Parity...)
+		}
+		for hash, ids := range part.Placement {
+			if joined.Placement == nil {
+				joined.Placement = make(map[string][]string)
 			}
+			joined.Placement[hash] = ids
 		}
-		fmt.Printf("Stored chunk %s for file %s (%d bytes)\n", hashes[i], filename, len(chunk))
 	}
+	return joined, nil
+}
 
-	// Create metadata for the file and save it.
-	meta := MetaData{
-		Filename:    filename,
-		ChunkHashes: hashes,
+// chunks returns the hashes of every chunk a manifest references: its data
+// chunks followed by any parity shards.
+func (meta MetaData) chunks() []string {
+	hashes := meta.ChunkHashes
+	if meta.Erasure != nil {
+		hashes = append([]string(nil), hashes...)
+		for _, stripe := range meta.Erasure.Parity {
+			hashes = append(hashes, stripe...)
+		}
 	}
+	return hashes
+}
+
+// references reports whether hash is one of the chunks of a manifest.
+func (meta MetaData) references(hash string) bool {
+	for _, h := range meta.chunks() {
+		if h == hash {
+			return true
+		}
+	}
+	return false
+}
+
+// nameRecord is what <filename>.meta holds: a mutable pointer from a
+// name to the root hash of the file's current manifest. Older stores kept the
+// manifest itself in the .meta file; those are still readable.
+type nameRecord struct {
+	Filename    string   `json:"filename"`
+	Manifest    string   `json:"manifest,omitempty"`
+	ChunkHashes []string `json:"chunk_hashes,omitempty"`
+}
+
+// StoreOptions selects how a file is stored. The zero value stores plain
+// chunks cut by DefaultChunker.
+type StoreOptions struct {
+	// Chunker selects how data is split into chunks; nil means DefaultChunker.
+	Chunker *ChunkerConfig
+
+	// DataShards and ParityShards enable Reed-Solomon erasure coding: every
+	// DataShards chunks get ParityShards parity shards, and any DataShards of
+	// them recover the rest. Distributed files are then stored as one copy
+	// of each shard, spread so that the shards of a stripe land on different peers.
+	DataShards   int
+	ParityShards int
+}
 
-	metaData, err := json.Marshal(meta)
+// StoreFile breaks the file data into content-defined chunks, computes a SHA-256 hash for each chunk,
+// stores each chunk encrypted for the store's key pair, and saves corresponding metadata.
+// Chunks are still named by the hash of their plaintext so identical chunks are stored once.
+func (s *Store) StoreFile(filename string, data []byte) error {
+	return s.StoreFileWith(filename, data, StoreOptions{})
+}
+
+// StoreFileWith stores a file like StoreFile using the given storage mode.
+func (s *Store) StoreFileWith(filename string, data []byte, opts StoreOptions) error {
+	return s.StoreReaderWith(filename, bytes.NewReader(data), opts)
+}
+
+// StoreReader stores a file read from r like StoreFile. The data is chunked,
+// hashed and stored as it is read, so only a few chunks are held in memory at
+// a time however large the file is.
+func (s *Store) StoreReader(filename string, r io.Reader) error {
+	return s.StoreReaderWith(filename, r, StoreOptions{})
+}
+
+// StoreReaderWith stores a file read from r like StoreReader using the given storage mode.
+func (s *Store) StoreReaderWith(filename string, r io.Reader, opts StoreOptions) (err error) {
+	var size int64
+	defer func() {
+		audit.Record(audit.Event{Type: "store_file", Filename: filename, Bytes: size, Err: err})
+	}()
+
+	if s.keys == nil {
+		return fmt.Errorf("storage encryption keys not configured")
+	}
+	meta, size, err := splitStream(filename, r, opts, func(chunk []byte, hash string) error {
+		if err := s.putChunk(hash, chunk); err != nil {
+			return err
+		}
+		fmt.Printf("Stored chunk %s for file %s (%d bytes)\n", hash, filename, len(chunk))
+		return nil
+	}, s.writeManifest)
 	if err != nil {
-		return fmt.Errorf("failed to marshal metadata: %w", err)
+		return err
 	}
 
-	metaFilename := filepath.Join("chunks", filename+".meta")
-	if err := os.WriteFile(metaFilename, metaData, 0644); err != nil {
-		return fmt.Errorf("failed to write metadata file: %w", err)
+	// Store the metadata under its hash and point the name at it.
+	root, err := s.writeManifest(meta)
+	if err != nil {
+		return err
+	}
+	if err := s.writeNameRecord(filename, root); err != nil {
+		return err
 	}
 
-	fmt.Printf("Stored metadata for file %s\n", filename)
+	fmt.Printf("Stored metadata for file %s (manifest %s)\n", filename, root)
 	return nil
 }
 
-// RetrieveFile reconstructs a file from its chunks using stored metadata.
-func RetrieveFile(filename string) ([]byte, error) {
-	metaFilename := filepath.Join("chunks", filename+".meta")
-	metaData, err := os.ReadFile(metaFilename)
+// putChunk stores a chunk under its hash, encrypted for the store's key pair.
+func (s *Store) putChunk(hash string, chunk []byte) error {
+	// Skip writing if the chunk already exists, but refresh its time so a
+	// concurrent garbage collection treats it as new and leaves it alone.
+	exists, err := s.chunks.Has(hash)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read metadata file: %w", err)
+		return fmt.Errorf("failed to look up chunk %s: %w", hash, err)
+	}
+	if exists {
+		if timed, ok := s.chunks.(TimedChunkStore); ok {
+			if err := timed.Touch(hash); err != nil {
+				return fmt.Errorf("failed to refresh chunk %s: %w", hash, err)
+			}
+		}
+		return nil
 	}
+	sealed, err := crypto.Seal(s.keys.Public, chunk, []byte(hash))
+	if err != nil {
+		return fmt.Errorf("failed to encrypt chunk %s: %w", hash, err)
+	}
+	if err := s.chunks.Put(hash, sealed); err != nil {
+		return fmt.Errorf("failed to write chunk %s: %w", hash, err)
+	}
+	return nil
+}
 
-	var meta MetaData
-	if err := json.Unmarshal(metaData, &meta); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal metadata: %w", err)
+// splitStream reads r and splits it into chunks for the given storage mode,
+// passing each to store as soon as it is cut: data chunks in order and, with
+// erasure coding, each stripe's parity shards after its data chunks. Chunks
+// are only valid during the call. It returns the file's manifest and size.
+// If writePart is not nil, the chunk list is passed to it a part at a time
+// once it grows past manifestPartChunks, and the manifest returned for a
+// large file is a manifest of the parts; otherwise it lists every chunk.
+func splitStream(filename string, r io.Reader, opts StoreOptions, store func(chunk []byte, hash string) error, writePart func(part MetaData) (string, error)) (MetaData, int64, error) {
+	chunker := DefaultChunker
+	if opts.Chunker != nil {
+		chunker = *opts.Chunker
+	}
+	if err := chunker.Validate(); err != nil {
+		return MetaData{}, 0, err
+	}
+	meta := MetaData{Filename: filename, Chunker: &chunker}
+	var stripes *stripeEncoder
+	if opts.DataShards > 0 {
+		var err error
+		if stripes, err = newStripeEncoder(opts.DataShards, opts.ParityShards); err != nil {
+			return MetaData{}, 0, err
+		}
+		meta.Erasure = stripes.scheme
+	}
+
+	outline := meta.outline()
+	limit := partChunks(meta.Erasure)
+	// flushPart passes the chunks listed so far to writePart as the next part.
+	flushPart := func() error {
+		part := meta
+		if stripes != nil {
+			scheme := *stripes.scheme
+			part.Erasure = &scheme
+			stripes.scheme.ChunkSizes, stripes.scheme.Parity = nil, nil
+		}
+		root, err := writePart(part)
+		if err != nil {
+			return err
+		}
+		outline.Parts = append(outline.Parts, root)
+		meta.ChunkHashes = nil
+		return nil
+	}
+
+	var size int64
+	chunks := chunker.newChunkReader(r)
+	for {
+		chunk, err := chunks.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return MetaData{}, size, fmt.Errorf("failed to read %s: %w", filename, err)
+		}
+		if writePart != nil && len(meta.ChunkHashes) >= limit && (stripes == nil || len(stripes.pending) == 0) {
+			if err := flushPart(); err != nil {
+				return MetaData{}, size, err
+			}
+		}
+		hash := hashChunk(chunk)
+		size += int64(len(chunk))
+		meta.ChunkHashes = append(meta.ChunkHashes, hash)
+		if err := store(chunk, hash); err != nil {
+			return MetaData{}, size, err
+		}
+		if stripes != nil {
+			if err := stripes.add(chunk, store); err != nil {
+				return MetaData{}, size, err
+			}
+		}
+	}
+	if stripes != nil {
+		if err := stripes.flush(store); err != nil {
+			return MetaData{}, size, err
+		}
+	}
+	if len(outline.Parts) == 0 {
+		return meta, size, nil
+	}
+	if len(meta.ChunkHashes) > 0 {
+		if err := flushPart(); err != nil {
+			return MetaData{}, size, err
+		}
+	}
+	return outline, size, nil
+}
+
+// prepareChunks splits data into chunks for the given storage mode and returns
+// the file's manifest along with every chunk to store (data chunks and any
+// parity shards) and its hash.
+func prepareChunks(filename string, data []byte, opts StoreOptions) (MetaData, [][]byte, []string, error) {
+	var chunks [][]byte
+	var hashes []string
+	meta, _, err := splitStream(filename, bytes.NewReader(data), opts, func(chunk []byte, hash string) error {
+		chunks = append(chunks, append([]byte(nil), chunk...))
+		hashes = append(hashes, hash)
+		return nil
+	}, nil)
+	if err != nil {
+		return MetaData{}, nil, nil, err
+	}
+	return meta, chunks, hashes, nil
+}
+
+// RetrieveFile reconstructs a file from its chunks using stored metadata,
+// decrypting each chunk with the store's key pair and verifying it against its
+// hash. Chunks stored before encryption was introduced are read as plaintext.
+// Erasure-coded files are rebuilt from parity if data chunks are missing or damaged.
+func (s *Store) RetrieveFile(filename string) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := s.RetrieveTo(filename, &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// RetrieveTo writes a stored file to w like RetrieveFile, one chunk at a time
+// (a stripe at a time for erasure-coded files), and returns the number of
+// bytes written.
+func (s *Store) RetrieveTo(filename string, w io.Writer) (written int64, err error) {
+	defer func() {
+		audit.Record(audit.Event{Type: "retrieve_file", Filename: filename, Bytes: written, Err: err})
+	}()
+
+	meta, err := s.loadFileMeta(filename)
+	if err != nil {
+		return 0, err
+	}
+	if written, err = assembleTo(w, meta, s.readChunk); err != nil {
+		return written, err
+	}
+
+	fmt.Printf("Reconstructed file %s from %d chunks (%d bytes)\n", filename, len(meta.ChunkHashes), written)
+	return written, nil
+}
+
+// RetrieveByHash reconstructs a file from the manifest with the given root hash.
+func (s *Store) RetrieveByHash(root string) ([]byte, error) {
+	meta, err := s.loadManifest(root)
+	if err != nil {
+		return nil, err
 	}
+	var buf bytes.Buffer
+	if _, err := assembleTo(&buf, meta, s.readChunk); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// chunkGetter returns the plaintext of a chunk by hash, from wherever it is kept.
+type chunkGetter func(hash string) ([]byte, error)
 
-	var fileData []byte
-	for _, hash := range meta.ChunkHashes {
-		chunkFilename := filepath.Join("chunks", hash)
-		chunk, err := os.ReadFile(chunkFilename)
+// assembleTo writes the file described by meta to w, reading chunks with get.
+func assembleTo(w io.Writer, meta MetaData, get chunkGetter) (int64, error) {
+	var written int64
+	if meta.Erasure == nil {
+		for _, hash := range meta.ChunkHashes {
+			chunk, err := get(hash)
+			if err != nil {
+				return written, err
+			}
+			n, err := w.Write(chunk)
+			written += int64(n)
+			if err != nil {
+				return written, fmt.Errorf("failed to write chunk: %w", err)
+			}
+		}
+		return written, nil
+	}
+
+	for s := range meta.Erasure.Parity {
+		chunks, err := decodeStripe(meta, s, get)
 		if err != nil {
-			return nil, fmt.Errorf("failed to read chunk file %s: %w", hash, err)
+			return written, err
+		}
+		for _, chunk := range chunks {
+			n, err := w.Write(chunk)
+			written += int64(n)
+			if err != nil {
+				return written, fmt.Errorf("failed to write chunk: %w", err)
+			}
+		}
+	}
+	return written, nil
+}
+
+// ResolveName returns the root hash of the manifest a stored filename points to.
+func (s *Store) ResolveName(filename string) (string, error) {
+	record, err := s.readNameRecord(filename)
+	if err != nil {
+		return "", err
+	}
+	if record.Manifest == "" {
+		// A pre-content-addressing store; give the manifest a hash now.
+		return s.writeManifest(MetaData{Filename: record.Filename, ChunkHashes: record.ChunkHashes})
+	}
+	return record.Manifest, nil
+}
+
+// Names returns the names of the stored files.
+func (s *Store) Names() ([]string, error) {
+	keys, err := s.chunks.List()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, key := range keys {
+		if name, ok := strings.CutSuffix(key, ".meta"); ok {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// readNameRecord reads <filename>.meta.
+func (s *Store) readNameRecord(filename string) (nameRecord, error) {
+	var record nameRecord
+	metaData, err := s.chunks.Get(filename + ".meta")
+	if err != nil {
+		return record, fmt.Errorf("failed to read metadata file: %w", err)
+	}
+	if err := json.Unmarshal(metaData, &record); err != nil {
+		return record, fmt.Errorf("failed to unmarshal metadata: %w", err)
+	}
+	return record, nil
+}
+
+// writeNameRecord points <filename>.meta at the manifest with the given root hash.
+func (s *Store) writeNameRecord(filename, root string) error {
+	metaData, err := json.Marshal(nameRecord{Filename: filename, Manifest: root})
+	if err != nil {
+		return fmt.Errorf("failed to marshal metadata: %w", err)
+	}
+	if err := s.chunks.Put(filename+".meta", metaData); err != nil {
+		return fmt.Errorf("failed to write metadata file: %w", err)
+	}
+	return nil
+}
+
+// loadFileMeta returns the manifest a stored filename currently points to.
+func (s *Store) loadFileMeta(filename string) (MetaData, error) {
+	record, err := s.readNameRecord(filename)
+	if err != nil {
+		return MetaData{}, err
+	}
+	if record.Manifest == "" {
+		return MetaData{Filename: record.Filename, ChunkHashes: record.ChunkHashes}, nil
+	}
+	return s.loadManifest(record.Manifest)
+}
+
+// writeManifest stores a manifest under the hash of its encoding and returns
+// that root hash. A manifest listing more than manifestPartChunks chunks is
+// stored as part manifests and a manifest of them.
+func (s *Store) writeManifest(meta MetaData) (string, error) {
+	if len(meta.ChunkHashes) > 0 {
+		// A joined manifest of manifests is split afresh.
+		meta.Parts = nil
+	}
+	if limit := partChunks(meta.Erasure); len(meta.ChunkHashes) > limit {
+		outline := meta.outline()
+		for first := 0; first < len(meta.ChunkHashes); first += limit {
+			root, err := s.writeManifest(meta.part(first, min(first+limit, len(meta.ChunkHashes))))
+			if err != nil {
+				return "", err
+			}
+			outline.Parts = append(outline.Parts, root)
 		}
-		fileData = append(fileData, chunk...)
+		meta = outline
+	}
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal manifest: %w", err)
+	}
+	root := hashChunk(data)
+	if err := s.chunks.Put(root+".manifest", data); err != nil {
+		return "", fmt.Errorf("failed to write manifest %s: %w", root, err)
+	}
+	return root, nil
+}
+
+// readManifestBytes returns the encoded manifest with the given root hash, verified against it.
+func (s *Store) readManifestBytes(root string) ([]byte, error) {
+	if !isHash(root) {
+		return nil, fmt.Errorf("invalid manifest hash %q", root)
+	}
+	data, err := s.chunks.Get(root + ".manifest")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest %s: %w", root, err)
+	}
+	if actual := hashChunk(data); actual != root {
+		return nil, &IntegrityError{Filename: root + ".manifest", Chunk: -1, Expected: root, Actual: actual}
+	}
+	return data, nil
+}
+
+// loadManifest reads and decodes the manifest with the given root hash,
+// joining the parts of a manifest of manifests.
+func (s *Store) loadManifest(root string) (MetaData, error) {
+	meta, err := s.loadManifestPart(root)
+	if err != nil {
+		return MetaData{}, err
+	}
+	return joinParts(meta, s.loadManifestPart)
+}
+
+// loadManifestPart reads and decodes the manifest with the given root hash as it is stored.
+func (s *Store) loadManifestPart(root string) (MetaData, error) {
+	data, err := s.readManifestBytes(root)
+	if err != nil {
+		return MetaData{}, err
+	}
+	var meta MetaData
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return MetaData{}, fmt.Errorf("failed to unmarshal manifest %s: %w", root, err)
+	}
+	return meta, nil
+}
+
+// readStoredChunk returns one of this node's own chunks as stored, which may be encrypted.
+func (s *Store) readStoredChunk(hash string) ([]byte, error) {
+	if !isHash(hash) {
+		return nil, fmt.Errorf("invalid chunk hash %q", hash)
+	}
+	chunk, err := s.chunks.Get(hash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chunk file %s: %w", hash, err)
+	}
+	return chunk, nil
+}
+
+// openChunk decrypts a stored chunk with the store's key pair; chunks stored
+// before encryption was introduced are returned as they are.
+func (s *Store) openChunk(hash string, chunk []byte) ([]byte, error) {
+	if !crypto.IsSealed(chunk) {
+		return chunk, nil
+	}
+	if s.keys == nil {
+		return nil, fmt.Errorf("storage encryption keys not configured")
+	}
+	plaintext, err := crypto.Open(s.keys.Private, chunk, []byte(hash))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt chunk %s: %w", hash, err)
 	}
+	return plaintext, nil
+}
 
-	fmt.Printf("Reconstructed file %s from %d chunks (%d bytes)\n", filename, len(meta.ChunkHashes), len(fileData))
-	return fileData, nil
+// readChunk reads and decrypts a chunk from the store and checks it against
+// its hash, so damaged chunks are never returned as file data.
+func (s *Store) readChunk(hash string) ([]byte, error) {
+	chunk, err := s.readStoredChunk(hash)
+	if err != nil {
+		return nil, err
+	}
+	if chunk, err = s.openChunk(hash, chunk); err != nil {
+		return nil, err
+	}
+	if actual := hashChunk(chunk); actual != hash {
+		return nil, &IntegrityError{Filename: hash, Chunk: -1, Expected: hash, Actual: actual}
+	}
+	return chunk, nil
+}
+
+// isHash reports whether s is a hex-encoded SHA-256, and so safe to use as a file name.
+func isHash(s string) bool {
+	if len(s) != sha256.Size*2 {
+		return false
+	}
+	for _, r := range s {
+		if !(r >= '0' && r <= '9' || r >= 'a' && r <= 'f') {
+			return false
+		}
+	}
+	return true
 }
 
 // chunkData splits data into fixed-size chunks and computes SHA-256 hashes for each.
@@ -98,11 +719,15 @@ func chunkData(data []byte, size int) ([][]byte, []string) {
 			end = len(data)
 		}
 		chunk := data[i:end]
-		hashVal := sha256.Sum256(chunk)
-		hashStr := fmt.Sprintf("%x", hashVal)
 		chunks = append(chunks, chunk)
-		hashes = append(hashes, hashStr)
+		hashes = append(hashes, hashChunk(chunk))
 	}
 
 	return chunks, hashes
 }
+
+// hashChunk returns the hex-encoded SHA-256 of a chunk, the name it is stored and verified under.
+func hashChunk(chunk []byte) string {
+	hashVal := sha256.Sum256(chunk)
+	return fmt.Sprintf("%x", hashVal)
+}
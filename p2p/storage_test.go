@@ -0,0 +1,132 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestManifestParts(t *testing.T) {
+	limit := manifestPartChunks
+	t.Cleanup(func() { manifestPartChunks = limit })
+	manifestPartChunks = 4
+	fixed := &ChunkerConfig{Algorithm: ChunkerFixed, Max: 100}
+
+	tests := []struct {
+		name      string
+		size      int
+		opts      StoreOptions
+		wantParts int
+	}{
+		{"fits in one manifest", 400, StoreOptions{Chunker: fixed}, 0},
+		{"plain chunks", 1050, StoreOptions{Chunker: fixed}, 3},
+		{"whole stripes per part", 1050, StoreOptions{Chunker: fixed, DataShards: 2, ParityShards: 1}, 3},
+		{"parts rounded down to stripes", 1050, StoreOptions{Chunker: fixed, DataShards: 3, ParityShards: 2}, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := testStore(t)
+			peer := serveFolder(t, t.TempDir())
+			data := randomData(tt.size, 20)
+			if err := store.StoreFileWith("big.bin", data, tt.opts); err != nil {
+				t.Fatal(err)
+			}
+			want, _, _, err := prepareChunks("big.bin", data, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			root, _ := store.ResolveName("big.bin")
+			stored, err := store.loadManifestPart(root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(stored.Parts) != tt.wantParts {
+				t.Fatalf("stored %d parts, want %d", len(stored.Parts), tt.wantParts)
+			}
+			if tt.wantParts > 0 && len(stored.ChunkHashes) > 0 {
+				t.Error("the manifest of manifests lists chunks")
+			}
+			for _, part := range stored.Parts {
+				meta, err := store.loadManifestPart(part)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(meta.ChunkHashes) > manifestPartChunks {
+					t.Errorf("part %s lists %d chunks", part, len(meta.ChunkHashes))
+				}
+			}
+
+			joined, err := store.loadManifest(root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(joined.chunks(), want.chunks()) || !reflect.DeepEqual(joined.Erasure, want.Erasure) {
+				t.Errorf("joined manifest lists %v, want %v", joined.chunks(), want.chunks())
+			}
+			last := want.ChunkHashes[len(want.ChunkHashes)-1]
+			if !joined.references(last) {
+				t.Error("the last chunk is not referenced")
+			}
+			// Writing the joined manifest again splits it the same way.
+			if again, err := store.writeManifest(joined); err != nil || again != root {
+				t.Errorf("rewritten as %s, %v; want %s", again, err, root)
+			}
+
+			if got, err := store.RetrieveFile("big.bin"); err != nil || !bytes.Equal(got, data) {
+				t.Errorf("RetrieveFile = %v, want the stored data", err)
+			}
+			var buf bytes.Buffer
+			if _, err := store.FetchByHash([]Peer{peer}, root, &buf); err != nil || !bytes.Equal(buf.Bytes(), data) {
+				t.Errorf("FetchByHash = %v, want the stored data", err)
+			}
+			live, _, err := store.markLive()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, part := range stored.Parts {
+				if !live[part+".manifest"] {
+					t.Errorf("part %s is not marked live", part)
+				}
+			}
+		})
+	}
+}
+
+func TestJoinPartsRejectsForeignParts(t *testing.T) {
+	store := testStore(t)
+	erasure := &ErasureScheme{DataShards: 2, ParityShards: 1}
+	write := func(meta MetaData) string {
+		data, _ := json.Marshal(meta)
+		root := hashChunk(data)
+		store.chunks.Put(root+".manifest", data)
+		return root
+	}
+	a := write(MetaData{Filename: "a", ChunkHashes: []string{hashChunk([]byte("1"))}})
+	b := write(MetaData{Filename: "b", ChunkHashes: []string{hashChunk([]byte("2"))}})
+	nested := write(MetaData{Filename: "a", Parts: []string{a}})
+	short := write(MetaData{Filename: "a", ChunkHashes: []string{a}, Erasure: &ErasureScheme{DataShards: 2, ParityShards: 1, ChunkSizes: []int{1}, Parity: [][]string{{b}}}})
+
+	tests := []struct {
+		name    string
+		meta    MetaData
+		wantErr bool
+	}{
+		{"own part", MetaData{Filename: "a", Parts: []string{a}}, false},
+		{"another file's part", MetaData{Filename: "a", Parts: []string{a, b}}, true},
+		{"nested parts", MetaData{Filename: "a", Parts: []string{nested}}, true},
+		{"plain part of an erasure-coded file", MetaData{Filename: "a", Erasure: erasure, Parts: []string{a}}, true},
+		{"part after a short stripe", MetaData{Filename: "a", Erasure: erasure, Parts: []string{short, short}}, true},
+		{"missing part", MetaData{Filename: "a", Parts: []string{hashChunk([]byte("none"))}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := store.loadManifest(write(tt.meta))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("loadManifest = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,317 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// SwarmOptions tunes a multi-source download. Zero values select the defaults.
+type SwarmOptions struct {
+	Workers      int           // concurrent range requests, default 4
+	PieceChunks  int           // chunks fetched per range request, default 256 (1 MiB)
+	StallTimeout time.Duration // how long a silent peer is waited on, default 30s
+	MaxFailures  int           // failures before a peer is dropped from the swarm, default 3
+}
+
+func (o SwarmOptions) withDefaults() SwarmOptions {
+	if o.Workers <= 0 {
+		o.Workers = 4
+	}
+	if o.PieceChunks <= 0 {
+		o.PieceChunks = 256
+	}
+	if o.StallTimeout <= 0 {
+		o.StallTimeout = transferIdleTimeout
+	}
+	if o.MaxFailures <= 0 {
+		o.MaxFailures = 3
+	}
+	return o
+}
+
+// piece is a run of consecutive chunks fetched with a single range request.
+type piece struct {
+	index      int
+	firstChunk int
+	offset     int64
+	length     int64
+}
+
+// swarmPeer tracks how a source peer is doing during a download.
+type swarmPeer struct {
+	peer     Peer
+	active   int
+	failures int
+}
+
+// swarm hands out pieces to workers and picks the least busy healthy peer for each.
+type swarm struct {
+	mutex   sync.Mutex
+	peers   []*swarmPeer
+	pending []piece
+	left    int
+	failed  error
+	wake    *sync.Cond
+	opts    SwarmOptions
+}
+
+// FindFileHolders asks every peer whether it shares filename and groups the
+// holders by the file's digest. It returns the holders of the most widely held
+// version along with that version's info and manifest.
+func FindFileHolders(peers []Peer, filename string) ([]Peer, RemoteFileInfo, MetaData, error) {
+	type result struct {
+		peer     Peer
+		info     RemoteFileInfo
+		manifest MetaData
+		err      error
+	}
+	results := make(chan result, len(peers))
+	for _, peer := range peers {
+		go func(peer Peer) {
+			info, manifest, err := StatFile(peer, filename)
+			results <- result{peer, info, manifest, err}
+		}(peer)
+	}
+
+	versions := make(map[string][]result)
+	best := ""
+	for range peers {
+		r := <-results
+		if r.err != nil {
+			log.Printf("[DEBUG] Peer %s does not have %s: %v", r.peer.ID, filename, r.err)
+			continue
+		}
+		versions[r.info.Hash] = append(versions[r.info.Hash], r)
+		if best == "" || len(versions[r.info.Hash]) > len(versions[best]) {
+			best = r.info.Hash
+		}
+	}
+	if best == "" {
+		return nil, RemoteFileInfo{}, MetaData{}, fmt.Errorf("no peer has file %s", filename)
+	}
+	if len(versions) > 1 {
+		log.Printf("[WARN] Peers hold %d different versions of %s; using the one held by %d peers", len(versions), filename, len(versions[best]))
+	}
+
+	var holders []Peer
+	for _, r := range versions[best] {
+		holders = append(holders, r.peer)
+	}
+	return holders, versions[best][0].info, versions[best][0].manifest, nil
+}
+
+// SwarmDownload fetches filename from every peer that has it, requesting
+// different byte ranges from different peers in parallel. Every chunk is
+// checked against the manifest agreed on by the holders before it is written.
+// A peer that fails or stalls has its piece handed to another peer, and is
+// dropped after opts.MaxFailures failures. The file is assembled in
+// destPath+".partial" and renamed to destPath once complete and its digest
+// matches the one the holders reported.
+func SwarmDownload(peers []Peer, filename, destPath string, opts SwarmOptions) (int64, error) {
+	opts = opts.withDefaults()
+
+	holders, info, manifest, err := FindFileHolders(peers, filename)
+	if err != nil {
+		return 0, err
+	}
+	expectedChunks := int((info.Size + chunkSize - 1) / chunkSize)
+	if len(manifest.ChunkHashes) != expectedChunks {
+		return 0, fmt.Errorf("manifest for %s lists %d chunks, expected %d", filename, len(manifest.ChunkHashes), expectedChunks)
+	}
+	log.Printf("[INFO] Downloading %s (%d bytes) from %d peers with %d workers", filename, info.Size, len(holders), opts.Workers)
+
+	partialPath := destPath + ".partial"
+	file, err := os.OpenFile(partialPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create partial file: %w", err)
+	}
+	defer file.Close()
+	if err := file.Truncate(info.Size); err != nil {
+		return 0, fmt.Errorf("failed to size partial file: %w", err)
+	}
+
+	s := &swarm{opts: opts}
+	s.wake = sync.NewCond(&s.mutex)
+	for _, peer := range holders {
+		s.peers = append(s.peers, &swarmPeer{peer: peer})
+	}
+	for first := 0; first < expectedChunks; first += opts.PieceChunks {
+		last := first + opts.PieceChunks
+		if last > expectedChunks {
+			last = expectedChunks
+		}
+		offset := int64(first) * chunkSize
+		end := int64(last) * chunkSize
+		if end > info.Size {
+			end = info.Size
+		}
+		s.pending = append(s.pending, piece{index: len(s.pending), firstChunk: first, offset: offset, length: end - offset})
+	}
+	s.left = len(s.pending)
+
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.work(file, filename, manifest)
+		}()
+	}
+	wg.Wait()
+
+	if s.failed != nil {
+		file.Close()
+		os.Remove(partialPath)
+		return 0, s.failed
+	}
+	if err := file.Sync(); err != nil {
+		return 0, fmt.Errorf("failed to sync partial file: %w", err)
+	}
+	// The pieces matched the manifest; make sure the manifest described the file the holders agreed on.
+	if err := verifyFile(file, filename, info.Hash); err != nil {
+		file.Close()
+		os.Remove(partialPath)
+		return 0, err
+	}
+	if err := file.Close(); err != nil {
+		return 0, fmt.Errorf("failed to close partial file: %w", err)
+	}
+	if err := os.Rename(partialPath, destPath); err != nil {
+		return 0, fmt.Errorf("failed to move file into place: %w", err)
+	}
+	return info.Size, nil
+}
+
+// work fetches pieces until none are left or the download has failed.
+func (s *swarm) work(file *os.File, filename string, manifest MetaData) {
+	for {
+		p, source, ok := s.next()
+		if !ok {
+			return
+		}
+
+		var buf bytes.Buffer
+		buf.Grow(int(p.length))
+		request := Message{
+			Type:     "request_file",
+			Filename: filename,
+			Offset:   p.offset,
+			Length:   p.length,
+		}
+		_, err := requestFile(source.peer, request, &buf, func(info Message) error {
+			if info.Offset != p.offset {
+				return errors.New("peer does not support byte-range requests")
+			}
+			return nil
+		}, s.opts.StallTimeout)
+		if err == nil {
+			err = verifyPiece(buf.Bytes(), p, manifest)
+		}
+		if err == nil {
+			_, err = file.WriteAt(buf.Bytes(), p.offset)
+			if err != nil {
+				s.fail(fmt.Errorf("failed to write partial file: %w", err))
+				return
+			}
+		}
+		s.finish(p, source, err)
+	}
+}
+
+// next blocks until a piece and a peer to fetch it from are available.
+func (s *swarm) next() (piece, *swarmPeer, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for {
+		if s.failed != nil || s.left == 0 {
+			return piece{}, nil, false
+		}
+		if len(s.pending) > 0 {
+			var source *swarmPeer
+			for _, sp := range s.peers {
+				if sp.failures < s.opts.MaxFailures && (source == nil || sp.active < source.active) {
+					source = sp
+				}
+			}
+			if source == nil {
+				s.failed = errors.New("all peers failed")
+				s.wake.Broadcast()
+				return piece{}, nil, false
+			}
+			p := s.pending[0]
+			s.pending = s.pending[1:]
+			source.active++
+			return p, source, true
+		}
+		// Other workers still hold pieces that may need to be retried.
+		s.wake.Wait()
+	}
+}
+
+// finish records the outcome of a piece, queueing it again if it failed.
+func (s *swarm) finish(p piece, source *swarmPeer, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	source.active--
+	if err != nil {
+		source.failures++
+		log.Printf("[WARN] Piece %d from peer %s failed (%d/%d): %v", p.index, source.peer.ID, source.failures, s.opts.MaxFailures, err)
+		s.pending = append(s.pending, p)
+	} else {
+		s.left--
+	}
+	s.wake.Broadcast()
+}
+
+func (s *swarm) fail(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.failed == nil {
+		s.failed = err
+	}
+	s.wake.Broadcast()
+}
+
+// verifyPiece checks every chunk of a downloaded piece against the manifest.
+func verifyPiece(data []byte, p piece, manifest MetaData) error {
+	if int64(len(data)) != p.length {
+		return fmt.Errorf("received %d of %d bytes", len(data), p.length)
+	}
+	for i, chunk := 0, p.firstChunk; i < len(data); i, chunk = i+chunkSize, chunk+1 {
+		end := i + chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		if actual := hashChunk(data[i:end]); actual != manifest.ChunkHashes[chunk] {
+			return &IntegrityError{
+				Filename: manifest.Filename,
+				Chunk:    chunk,
+				Expected: manifest.ChunkHashes[chunk],
+				Actual:   actual,
+			}
+		}
+	}
+	return nil
+}
+
+// verifyFile checks the whole of file against its expected SHA-256 digest.
+func verifyFile(file *os.File, filename, expected string) error {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to read partial file: %w", err)
+	}
+	fileHash := sha256.New()
+	if _, err := io.Copy(fileHash, file); err != nil {
+		return fmt.Errorf("failed to read partial file: %w", err)
+	}
+	if actual := fmt.Sprintf("%x", fileHash.Sum(nil)); actual != expected {
+		return &IntegrityError{Filename: filename, Chunk: -1, Expected: expected, Actual: actual}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"FDS/codec"
+)
+
+func TestSwarmDownload(t *testing.T) {
+	data := bytes.Repeat([]byte("swarm "), 5*chunkSize)
+	shared := t.TempDir()
+	if err := os.WriteFile(filepath.Join(shared, "file.bin"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	peers := []Peer{serveFolder(t, shared), serveFolder(t, shared), serveFolder(t, shared)}
+
+	destPath := filepath.Join(t.TempDir(), "file.bin")
+	written, err := SwarmDownload(peers, "file.bin", destPath, SwarmOptions{Workers: 3, PieceChunks: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := os.ReadFile(destPath)
+	if written != int64(len(data)) || !bytes.Equal(got, data) {
+		t.Errorf("got %d bytes, want the original %d", written, len(data))
+	}
+}
+
+// A holder whose manifest matches the data it serves but whose reported
+// digest does not must not get the file accepted.
+func TestSwarmDownloadChecksFileDigest(t *testing.T) {
+	data := bytes.Repeat([]byte("liar "), 3*chunkSize)
+	shared := t.TempDir()
+	if err := os.WriteFile(filepath.Join(shared, "file.bin"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	serveFolder(t, shared)
+	peer := servePeer(t, func(conn net.Conn, c codec.Codec, request Message) {
+		if request.Type != "stat_file" {
+			sendFile(c, request, "")
+			return
+		}
+		stat, _ := os.Stat(filepath.Join(shared, "file.bin"))
+		_, manifest, _ := fileManifest(filepath.Join(shared, "file.bin"), "file.bin", stat)
+		content, _ := json.Marshal(manifest)
+		c.WriteMessage(Message{Type: "file_info", Filename: "file.bin", Content: content, Hash: digest([]byte("something else")), Size: stat.Size()})
+	})
+
+	destPath := filepath.Join(t.TempDir(), "file.bin")
+	_, err := SwarmDownload([]Peer{peer}, "file.bin", destPath, SwarmOptions{})
+	var integrityErr *IntegrityError
+	if !errors.As(err, &integrityErr) || integrityErr.Chunk != -1 {
+		t.Fatalf("got %v, want a whole-file IntegrityError", err)
+	}
+	for _, leftover := range []string{destPath, destPath + ".partial"} {
+		if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+			t.Errorf("%s was left behind", filepath.Base(leftover))
+		}
+	}
+}
+
+func TestVerifyPiece(t *testing.T) {
+	data := bytes.Repeat([]byte("p"), 2*chunkSize+10)
+	manifest := MetaData{Filename: "f", ChunkHashes: []string{
+		hashChunk(data[:chunkSize]), hashChunk(data[chunkSize : 2*chunkSize]), hashChunk(data[2*chunkSize:]),
+	}}
+	tests := []struct {
+		name    string
+		data    []byte
+		piece   piece
+		wantErr bool
+	}{
+		{"whole file", data, piece{firstChunk: 0, length: int64(len(data))}, false},
+		{"last chunk", data[2*chunkSize:], piece{firstChunk: 2, offset: 2 * chunkSize, length: 10}, false},
+		{"short", data[:chunkSize], piece{firstChunk: 0, length: 2 * chunkSize}, true},
+		{"wrong chunk", data[:chunkSize], piece{firstChunk: 2, length: chunkSize}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := verifyPiece(tt.data, tt.piece, manifest); (err != nil) != tt.wantErr {
+				t.Errorf("verifyPiece: %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
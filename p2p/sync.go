@@ -0,0 +1,428 @@
+package p2p
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"FDS/audit"
+)
+
+// conflictMarker goes between the name and extension of the copy kept of the
+// losing side of a conflict: report.sync-conflict-1a2b3c4d.pdf.
+const conflictMarker = ".sync-conflict-"
+
+// SyncOptions configures folder synchronization. Zero values select the defaults.
+type SyncOptions struct {
+	Peers            []string      // IDs of the peers whose shared folders are kept in sync with this one
+	Interval         time.Duration // time between sync rounds, default 30s
+	StatePath        string        // where the last synced version of each file is kept, default "sync_state.json"
+	HeartbeatTimeout time.Duration // a peer not heard from for longer is offline, default 30s
+}
+
+func (o SyncOptions) withDefaults() SyncOptions {
+	if o.Interval <= 0 {
+		o.Interval = 30 * time.Second
+	}
+	if o.StatePath == "" {
+		o.StatePath = "sync_state.json"
+	}
+	if o.HeartbeatTimeout <= 0 {
+		o.HeartbeatTimeout = 30 * time.Second
+	}
+	return o
+}
+
+// SyncReport describes one sync round with a peer.
+type SyncReport struct {
+	Peer      string   `json:"peer"`
+	Pulled    []string `json:"pulled"`    // files fetched because they are new or changed on the peer
+	Removed   []string `json:"removed"`   // files deleted because the peer deleted them
+	Conflicts []string `json:"conflicts"` // files changed on both sides
+	Failed    []string `json:"failed"`    // files left for the next round after an error
+}
+
+// syncState is the version of each file both sides last agreed on, per peer.
+// Comparing each side against it tells which side changed a file.
+type syncState struct {
+	Peers map[string]map[string]string `json:"peers"` // peer ID -> file name -> SHA-256
+}
+
+// Syncer keeps a shared folder in sync with the shared folders of other peers.
+// Every round it compares the file list of each peer (name, size, modification
+// time and digest) with the local folder and the state of the last round, and
+// pulls the files the peer added or changed and removes those it deleted.
+// Changes made here are picked up by the peers' own Syncers, so every peer
+// taking part runs one. A file changed on both sides is a conflict: the newer
+// version keeps the name and the other is kept as name.sync-conflict-<hash>.ext
+// on both peers.
+type Syncer struct {
+	folder *SharedFolder
+	opts   SyncOptions
+	peers  func() []BootstrapPeerInfo
+
+	mutex sync.Mutex
+	state syncState
+}
+
+// NewSyncer creates a Syncer for folder that gets the current peer list from peers.
+func NewSyncer(folder *SharedFolder, opts SyncOptions, peers func() []BootstrapPeerInfo) *Syncer {
+	s := &Syncer{folder: folder, opts: opts.withDefaults(), peers: peers}
+	state, err := loadSyncState(s.opts.StatePath)
+	if err != nil {
+		// Without a state every difference is treated as a conflict and nothing is deleted.
+		log.Printf("[WARN] Sync: %v; starting without sync state", err)
+	}
+	s.state = state
+	return s
+}
+
+// Run syncs with every peer every opts.Interval until quit is closed.
+func (s *Syncer) Run(quit <-chan struct{}) {
+	ticker := time.NewTicker(s.opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.SyncOnce()
+		case <-quit:
+			return
+		}
+	}
+}
+
+// SyncOnce runs a single round with every configured peer that is online.
+func (s *Syncer) SyncOnce() []SyncReport {
+	live := livePeers(s.peers(), s.opts.HeartbeatTimeout)
+	var reports []SyncReport
+	for _, id := range s.opts.Peers {
+		peer, ok := live[id]
+		if !ok {
+			log.Printf("[DEBUG] Sync: peer %s is offline, skipping", id)
+			continue
+		}
+		report, err := s.SyncPeer(peer)
+		if err != nil {
+			log.Printf("[WARN] Sync with %s failed: %v", id, err)
+			continue
+		}
+		if len(report.Pulled)+len(report.Removed)+len(report.Conflicts)+len(report.Failed) > 0 {
+			log.Printf("[INFO] Sync with %s: %d pulled, %d removed, %d conflicts, %d failed",
+				id, len(report.Pulled), len(report.Removed), len(report.Conflicts), len(report.Failed))
+		}
+		reports = append(reports, report)
+	}
+	return reports
+}
+
+// SyncPeer brings the local folder up to date with the changes made on peer
+// since the last round.
+func (s *Syncer) SyncPeer(peer Peer) (SyncReport, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	report := SyncReport{Peer: peer.ID}
+
+	listed, err := ListRemoteFiles(peer)
+	if err != nil {
+		return report, err
+	}
+	remote := make(map[string]RemoteFileInfo)
+	for _, info := range listed {
+		if tracked(info.Name) {
+			remote[info.Name] = info
+		}
+	}
+	local, err := s.localFiles()
+	if err != nil {
+		return report, err
+	}
+	if s.state.Peers == nil {
+		s.state.Peers = make(map[string]map[string]string)
+	}
+	base := s.state.Peers[peer.ID]
+	if base == nil {
+		base = make(map[string]string)
+		s.state.Peers[peer.ID] = base
+	}
+
+	names := make(map[string]bool)
+	for _, m := range []map[string]RemoteFileInfo{local, remote} {
+		for name := range m {
+			names[name] = true
+		}
+	}
+	for name := range base {
+		names[name] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	for _, name := range sorted {
+		l, hasLocal := local[name]
+		r, hasRemote := remote[name]
+		agreed, hasBase := base[name]
+
+		var err error
+		switch {
+		case !hasLocal && !hasRemote:
+			delete(base, name)
+
+		case hasLocal && hasRemote && l.Hash == r.Hash:
+			base[name] = l.Hash
+
+		case !hasLocal:
+			if hasBase && agreed == r.Hash {
+				// Deleted here; the peer removes its copy when it syncs with us.
+				continue
+			}
+			if err = s.pull(peer, r, name); err == nil {
+				base[name] = r.Hash
+				report.Pulled = append(report.Pulled, name)
+			}
+
+		case !hasRemote:
+			if !hasBase {
+				// New here; the peer pulls it when it syncs with us.
+				continue
+			}
+			var removed bool
+			if removed, err = removedOnPeer(peer, name); err != nil || !removed {
+				break
+			}
+			if agreed == l.Hash {
+				if err = s.folder.RemoveFile(name); err == nil {
+					report.Removed = append(report.Removed, name)
+				}
+			}
+			if err == nil {
+				// A file changed here after the peer deleted it is kept and pulled back by the peer.
+				delete(base, name)
+			}
+
+		case hasBase && agreed == l.Hash:
+			if err = s.pull(peer, r, name); err == nil {
+				base[name] = r.Hash
+				report.Pulled = append(report.Pulled, name)
+			}
+
+		case hasBase && agreed == r.Hash:
+			// Changed only here; the peer pulls it when it syncs with us.
+
+		default:
+			if err = s.resolveConflict(peer, l, r); err == nil {
+				base[name] = r.Hash
+				report.Conflicts = append(report.Conflicts, name)
+			}
+		}
+		if err != nil {
+			log.Printf("[WARN] Sync: %s with %s: %v", name, peer.ID, err)
+			report.Failed = append(report.Failed, name)
+		}
+	}
+
+	if err := saveSyncState(s.opts.StatePath, s.state); err != nil {
+		log.Printf("[ERROR] Sync: %v", err)
+	}
+	return report, nil
+}
+
+// removedOnPeer asks peer about a file its list left out, and reports whether
+// the peer says it no longer has it. A list also leaves out files the peer
+// failed to hash or that its access policy hides from us, so only that answer
+// counts as the file being deleted.
+func removedOnPeer(peer Peer, name string) (bool, error) {
+	_, _, err := StatFile(peer, name)
+	var peerErr *PeerError
+	switch {
+	case err == nil:
+		log.Printf("[DEBUG] Sync: %s is missing from the list of %s but still shared", name, peer.ID)
+		return false, nil
+	case errors.As(err, &peerErr) && peerErr.Code == CodeNotFound:
+		return true, nil
+	case errors.As(err, &peerErr):
+		log.Printf("[DEBUG] Sync: %s is missing from the list of %s: %s", name, peer.ID, peerErr.Code)
+		return false, nil
+	}
+	return false, err
+}
+
+// resolveConflict handles a file changed both here and on peer. The version
+// with the later modification time (or, if equal, the greater digest) keeps the
+// name; the other is saved under conflictName. Both peers reach the same result.
+func (s *Syncer) resolveConflict(peer Peer, local, remote RemoteFileInfo) error {
+	name := local.Name
+	remoteWins := remote.ModTime.After(local.ModTime) ||
+		(remote.ModTime.Equal(local.ModTime) && remote.Hash > local.Hash)
+
+	var kept string
+	if remoteWins {
+		kept = conflictName(name, local.Hash)
+		from, err := s.folder.Resolve(name)
+		if err != nil {
+			return err
+		}
+		to, err := s.folder.Resolve(kept)
+		if err != nil {
+			return err
+		}
+		if err := os.Rename(from, to); err != nil {
+			return fmt.Errorf("failed to keep conflicting version: %w", err)
+		}
+		if err := s.pull(peer, remote, name); err != nil {
+			return err
+		}
+	} else {
+		kept = conflictName(name, remote.Hash)
+		if err := s.pull(peer, remote, kept); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("[WARN] Sync: %s changed here and on %s; other version kept as %s", name, peer.ID, kept)
+	audit.Record(audit.Event{
+		Type:     "sync_conflict",
+		PeerID:   peer.ID,
+		Remote:   peer.Address(),
+		Filename: name,
+		Detail:   "other version kept as " + kept,
+	})
+	return nil
+}
+
+// pull fetches the peer's file described by info into the folder as name. The
+// file only replaces an existing one if it still matches info.Hash, so a file
+// that changes on the peer mid-transfer is left for the next round.
+func (s *Syncer) pull(peer Peer, info RemoteFileInfo, name string) error {
+	reader, writer := io.Pipe()
+	go func() {
+		_, err := RequestFileTo(peer, info.Name, writer)
+		writer.CloseWithError(err)
+	}()
+	_, err := s.folder.AddFileFrom(name, &digestReader{r: reader, digest: sha256.New(), want: info.Hash})
+	reader.CloseWithError(io.ErrClosedPipe)
+	if err != nil {
+		return err
+	}
+
+	filePath, err := s.folder.Resolve(name)
+	if err != nil {
+		return err
+	}
+	// Keep the peer's modification time so both sides order later conflicts alike.
+	if err := os.Chtimes(filePath, info.ModTime, info.ModTime); err != nil {
+		log.Printf("[WARN] Failed to set modification time of %s: %v", name, err)
+	}
+	manifestCache.Delete(filePath)
+	return nil
+}
+
+// localFiles describes the syncable files of the folder like a peer's file list.
+func (s *Syncer) localFiles() (map[string]RemoteFileInfo, error) {
+	names, err := s.folder.ListFiles()
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]RemoteFileInfo)
+	for _, name := range names {
+		filePath, err := s.folder.Resolve(name)
+		if err != nil {
+			continue
+		}
+		stat, err := os.Stat(filePath)
+		if err != nil || !stat.Mode().IsRegular() {
+			continue
+		}
+		hash, _, err := fileManifest(filePath, name, stat)
+		if err != nil {
+			return nil, fmt.Errorf("failed to hash %s: %w", name, err)
+		}
+		files[name] = RemoteFileInfo{Name: name, Size: stat.Size(), ModTime: stat.ModTime(), Hash: hash}
+	}
+	return files, nil
+}
+
+// tracked reports whether a file takes part in sync and change announcements.
+// Hidden files and directories, such as uploads in progress, and partial
+// downloads do not.
+func tracked(name string) bool {
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") {
+			return false
+		}
+	}
+	return !strings.HasSuffix(name, ".partial") && !strings.HasSuffix(name, ".partial.state")
+}
+
+// conflictName is the name the losing version with digest hash of a conflict
+// on name is kept under.
+func conflictName(name, hash string) string {
+	if len(hash) > 8 {
+		hash = hash[:8]
+	}
+	dir, base := path.Split(name)
+	ext := path.Ext(base)
+	return dir + strings.TrimSuffix(base, ext) + conflictMarker + hash + ext
+}
+
+// digestReader fails at the end of r if what was read does not match want.
+type digestReader struct {
+	r      io.Reader
+	digest hash.Hash
+	want   string
+}
+
+func (d *digestReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	d.digest.Write(p[:n])
+	if err == io.EOF {
+		if actual := fmt.Sprintf("%x", d.digest.Sum(nil)); actual != d.want {
+			return n, fmt.Errorf("file changed during transfer: digest %s, listed %s", actual, d.want)
+		}
+	}
+	return n, err
+}
+
+func loadSyncState(path string) (syncState, error) {
+	var state syncState
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, fmt.Errorf("failed to read sync state: %w", err)
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return syncState{}, fmt.Errorf("failed to decode sync state %s: %w", path, err)
+	}
+	return state, nil
+}
+
+// saveSyncState writes the state to a temporary file first so a crash never
+// leaves a truncated one behind.
+func saveSyncState(path string, state syncState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode sync state: %w", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write sync state: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write sync state: %w", err)
+	}
+	return nil
+}
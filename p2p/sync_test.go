@@ -0,0 +1,204 @@
+package p2p
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"FDS/codec"
+)
+
+func TestSyncPeer(t *testing.T) {
+	const name = "notes.txt"
+	// Contents of the file in the last agreed state, here and on the peer; "" if absent.
+	tests := []struct {
+		name          string
+		base          string
+		local         string
+		remote        string
+		localIsNewer  bool
+		wantLocal     string
+		wantBase      string
+		wantOutcome   string // "pulled", "removed", "conflict" or "" for no change here
+		wantConflicts string // contents kept under the conflict name
+	}{
+		{"same on both sides", "", "a", "a", false, "a", "a", "", ""},
+		{"new on the peer", "", "", "a", false, "a", "a", "pulled", ""},
+		{"new here", "", "a", "", false, "a", "", "", ""},
+		{"changed on the peer", "a", "a", "b", false, "b", "b", "pulled", ""},
+		{"changed here", "a", "b", "a", false, "b", "a", "", ""},
+		{"deleted on the peer", "a", "a", "", false, "", "", "removed", ""},
+		{"deleted here", "a", "", "a", false, "", "a", "", ""},
+		{"changed here, deleted on the peer", "a", "b", "", false, "b", "", "", ""},
+		{"changed on both sides, peer's newer", "a", "b", "c", false, "c", "c", "conflict", "b"},
+		{"changed on both sides, local newer", "a", "b", "c", true, "b", "c", "conflict", "c"},
+		{"different without a base", "", "b", "c", false, "c", "c", "conflict", "b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			localDir, remoteDir := t.TempDir(), t.TempDir()
+			peer := serveFolder(t, remoteDir)
+			modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+			write := func(dir, contents string, modTime time.Time) {
+				if contents == "" {
+					return
+				}
+				filePath := filepath.Join(dir, name)
+				os.WriteFile(filePath, []byte(contents), 0644)
+				os.Chtimes(filePath, modTime, modTime)
+			}
+			localTime := modTime.Add(-time.Minute)
+			if tt.localIsNewer {
+				localTime = modTime.Add(time.Minute)
+			}
+			write(localDir, tt.local, localTime)
+			write(remoteDir, tt.remote, modTime)
+
+			syncer := NewSyncer(&SharedFolder{FolderPath: localDir}, SyncOptions{StatePath: filepath.Join(t.TempDir(), "state.json")}, nil)
+			base := map[string]string{}
+			if tt.base != "" {
+				base[name] = digest([]byte(tt.base))
+			}
+			syncer.state.Peers = map[string]map[string]string{peer.ID: base}
+
+			report, err := syncer.SyncPeer(peer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			outcomes := map[string][]string{"pulled": report.Pulled, "removed": report.Removed, "conflict": report.Conflicts, "failed": report.Failed}
+			for outcome, names := range outcomes {
+				var want []string
+				if outcome == tt.wantOutcome {
+					want = []string{name}
+				}
+				if !slices.Equal(names, want) {
+					t.Errorf("%s = %v, want %v", outcome, names, want)
+				}
+			}
+
+			got, err := os.ReadFile(filepath.Join(localDir, name))
+			if tt.wantLocal == "" {
+				if !os.IsNotExist(err) {
+					t.Errorf("local file is %q, want it removed", got)
+				}
+			} else if string(got) != tt.wantLocal {
+				t.Errorf("local file is %q, %v; want %q", got, err, tt.wantLocal)
+			}
+			wantBase := ""
+			if tt.wantBase != "" {
+				wantBase = digest([]byte(tt.wantBase))
+			}
+			if base[name] != wantBase {
+				t.Errorf("agreed on %q, want the digest of %q", base[name], tt.wantBase)
+			}
+			if tt.wantConflicts != "" {
+				kept := conflictName(name, digest([]byte(tt.wantConflicts)))
+				if got, err := os.ReadFile(filepath.Join(localDir, kept)); err != nil || string(got) != tt.wantConflicts {
+					t.Errorf("%s is %q, %v; want %q", kept, got, err, tt.wantConflicts)
+				}
+			}
+
+			// The state is saved, so a new Syncer continues where this one stopped.
+			reloaded := NewSyncer(syncer.folder, syncer.opts, nil)
+			if reloaded.state.Peers[peer.ID][name] != base[name] {
+				t.Error("sync state was not saved")
+			}
+		})
+	}
+}
+
+func TestConflictName(t *testing.T) {
+	tests := []struct {
+		name string
+		hash string
+		want string
+	}{
+		{"report.pdf", "1a2b3c4d5e6f", "report.sync-conflict-1a2b3c4d.pdf"},
+		{"docs/report.pdf", "1a2b3c4d5e6f", "docs/report.sync-conflict-1a2b3c4d.pdf"},
+		{"Makefile", "1a2b", "Makefile.sync-conflict-1a2b"},
+		{"archive.tar.gz", "1a2b3c4d5e6f", "archive.tar.sync-conflict-1a2b3c4d.gz"},
+	}
+	for _, tt := range tests {
+		if got := conflictName(tt.name, tt.hash); got != tt.want {
+			t.Errorf("conflictName(%q, %q) = %q, want %q", tt.name, tt.hash, got, tt.want)
+		}
+	}
+}
+
+func TestTracked(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"notes.txt", true},
+		{"docs/notes.txt", true},
+		{".hidden", false},
+		{"docs/.upload-123", false},
+		{".git/config", false},
+		{"movie.mkv.partial", false},
+		{"movie.mkv.partial.state", false},
+	}
+	for _, tt := range tests {
+		if got := tracked(tt.name); got != tt.want {
+			t.Errorf("tracked(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// A file left out of the peer's list is only removed here when the peer says
+// it no longer has it, not when it is hidden from us or the peer failed to hash it.
+func TestSyncPeerConfirmsRemoval(t *testing.T) {
+	const name = "notes.txt"
+	tests := []struct {
+		name        string
+		stat        func(c codec.Codec, request Message)
+		wantRemoved bool
+	}{
+		{"still shared", func(c codec.Codec, request Message) {
+			c.WriteMessage(Message{Type: "file_info", Filename: request.Filename, Content: []byte(`{}`), Hash: digest([]byte("a")), Size: 1})
+		}, false},
+		{"hidden by the peer's policy", func(c codec.Codec, request Message) {
+			sendError(c, request.Filename, CodeAccessDenied, "Access denied")
+		}, false},
+		{"unreadable on the peer", func(c codec.Codec, request Message) {
+			sendError(c, request.Filename, CodeUnreadable, "File not readable")
+		}, false},
+		{"deleted on the peer", func(c codec.Codec, request Message) {
+			sendError(c, request.Filename, CodeNotFound, "File not found")
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			peer := servePeer(t, func(conn net.Conn, c codec.Codec, request Message) {
+				if request.Type == "stat_file" {
+					tt.stat(c, request)
+					return
+				}
+				c.WriteMessage(Message{Type: "file_list", Content: []byte(`[]`)})
+			})
+			localDir := t.TempDir()
+			os.WriteFile(filepath.Join(localDir, name), []byte("a"), 0644)
+			syncer := NewSyncer(&SharedFolder{FolderPath: localDir}, SyncOptions{StatePath: filepath.Join(t.TempDir(), "state.json")}, nil)
+			base := map[string]string{name: digest([]byte("a"))}
+			syncer.state.Peers = map[string]map[string]string{peer.ID: base}
+
+			report, err := syncer.SyncPeer(peer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, statErr := os.Stat(filepath.Join(localDir, name))
+			if removed := os.IsNotExist(statErr); removed != tt.wantRemoved {
+				t.Errorf("local file removed: %v, want %v", removed, tt.wantRemoved)
+			}
+			if removed := len(report.Removed) == 1; removed != tt.wantRemoved || len(report.Failed) != 0 {
+				t.Errorf("removed %v and failed %v", report.Removed, report.Failed)
+			}
+			if _, kept := base[name]; kept == tt.wantRemoved {
+				t.Errorf("agreed state kept: %v, want %v", kept, !tt.wantRemoved)
+			}
+		})
+	}
+}
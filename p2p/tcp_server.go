@@ -1,19 +1,35 @@
 package p2p
 
 import (
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"net"
 	"os"
-	"path/filepath"
+	"sync"
+	"time"
+
+	"FDS/audit"
+	"FDS/codec"
 )
 
 // Message struct for handling different request types.
-type Message struct {
-	Type     string `json:"type"`
-	Filename string `json:"filename,omitempty"`
-	Content  []byte `json:"content,omitempty"`
+// It lives in the codec package so both wire formats share one definition.
+type Message = codec.Message
+
+// DefaultSharedFolder is the folder whose files are served to other peers.
+const DefaultSharedFolder = "shared_folder"
+
+// servedFolder is the folder whose files are served to other peers.
+var servedFolder = &SharedFolder{FolderPath: DefaultSharedFolder}
+
+// UseSharedFolder makes the TCP server serve, and accept uploads into, folder.
+func UseSharedFolder(folder *SharedFolder) {
+	servedFolder = folder
 }
 
 // StartTCPServerWithListener starts the TCP server and listens for file requests.
@@ -40,77 +56,505 @@ func StartTCPServerWithListener(localPeer *Peer, msgChan chan<- string, listener
 // handleConnection processes incoming TCP messages safely.
 func handleConnection(conn net.Conn, msgChan chan<- string) {
 	defer conn.Close()
-	decoder := json.NewDecoder(conn)
-	var request Message
 
-	if err := decoder.Decode(&request); err != nil {
+	c, request, err := codec.ServerHandshake(conn)
+	if err != nil {
 		log.Printf("[ERROR] Failed to parse incoming request: %v", err)
 		return
 	}
 
-	log.Printf("[DEBUG] Received request type: %s, filename: %s", request.Type, request.Filename)
+	if id := remotePeerID(conn); id != "" {
+		log.Printf("[DEBUG] Received request type: %s, filename: %s, from peer: %s", request.Type, request.Filename, id)
+	} else {
+		log.Printf("[DEBUG] Received request type: %s, filename: %s", request.Type, request.Filename)
+	}
 
-	// Handle file request
-	if request.Type == "request_file" {
+	switch request.Type {
+	case "request_file":
 		log.Printf("[DEBUG] File request received, calling sendFile() for %s", request.Filename)
-		sendFile(conn, request.Filename)
+		sent, err := sendFile(c, request, remotePeerID(conn))
 		log.Printf("[DEBUG] Finished executing sendFile() for %s", request.Filename)
+		audit.Record(audit.Event{
+			Type:     "file_request",
+			PeerID:   remotePeerID(conn),
+			Remote:   conn.RemoteAddr().String(),
+			Filename: request.Filename,
+			Bytes:    sent,
+			Outcome:  deniedOutcome(err),
+			Err:      err,
+		})
+
+	case "stat_file":
+		sendFileInfo(c, request.Filename, remotePeerID(conn))
+
+	case "list_files":
+		sendFileList(c, remotePeerID(conn), request.Length, nil)
+
+	case "search":
+		pattern := request.Filename
+		sendFileList(c, remotePeerID(conn), request.Length, func(name string) bool {
+			return MatchFilename(pattern, name)
+		})
+
+	case "get_chunk":
+		sendChunk(c, request, remotePeerID(conn))
+
+	case "get_manifest":
+		sendManifest(c, request.Hash, remotePeerID(conn))
+
+	case "put_chunk":
+		receiveChunks(conn, c, request)
+
+	case "put_file":
+		receiveFile(conn, c, request)
+
+	case "watch_folder":
+		streamChanges(conn, c, remotePeerID(conn), request.Length)
+
+	case "list_versions":
+		sendVersions(c, request.Filename, remotePeerID(conn))
+
+	case "request_dir":
+		receiveDirRequest(conn, c, request)
 	}
 }
 
-// sendFile streams the requested file in chunks, ensuring integrity.
-func sendFile(conn net.Conn, filename string) {
-	filePath := filepath.Join("shared_folder", filename)
+// manifestCacheEntry is a computed manifest, valid while the file's size and modification time are unchanged.
+type manifestCacheEntry struct {
+	size     int64
+	modTime  int64
+	hash     string
+	manifest MetaData
+}
+
+// manifestCache avoids rehashing unchanged shared files on every stat_file.
+var manifestCache sync.Map // file path -> manifestCacheEntry
+
+// fileManifest returns the whole-file SHA-256 and chunk hashes of a shared file.
+func fileManifest(filePath, filename string, stat os.FileInfo) (string, MetaData, error) {
+	if hash, manifest, ok := cachedManifest(filePath, stat); ok {
+		return hash, manifest, nil
+	}
 	file, err := os.Open(filePath)
 	if err != nil {
-		log.Printf("[ERROR] File not found: %s", filename)
-		response := Message{
-			Type:     "error",
-			Filename: filename,
-			Content:  []byte("File not found"),
-		}
-		json.NewEncoder(conn).Encode(response)
-		return
+		return "", MetaData{}, err
 	}
 	defer file.Close()
+	return fileManifestFrom(file, filename, stat)
+}
 
-	buffer := make([]byte, 4096) // 4KB chunks
-	encoder := json.NewEncoder(conn)
+func cachedManifest(filePath string, stat os.FileInfo) (string, MetaData, bool) {
+	if cached, ok := manifestCache.Load(filePath); ok {
+		entry := cached.(manifestCacheEntry)
+		if entry.size == stat.Size() && entry.modTime == stat.ModTime().UnixNano() {
+			return entry.hash, entry.manifest, true
+		}
+	}
+	return "", MetaData{}, false
+}
+
+// fileManifestFrom is fileManifest for a file that is already open, such as
+// one whose access was checked; file's read offset is left untouched.
+func fileManifestFrom(file *os.File, filename string, stat os.FileInfo) (string, MetaData, error) {
+	filePath := file.Name()
+	if hash, manifest, ok := cachedManifest(filePath, stat); ok {
+		return hash, manifest, nil
+	}
 
+	reader := io.NewSectionReader(file, 0, stat.Size())
+	manifest := MetaData{Filename: filename}
+	fileHash := sha256.New()
+	buffer := make([]byte, chunkSize)
 	for {
-		n, err := file.Read(buffer)
+		n, err := io.ReadFull(reader, buffer)
+		if n > 0 {
+			manifest.ChunkHashes = append(manifest.ChunkHashes, hashChunk(buffer[:n]))
+			fileHash.Write(buffer[:n])
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
 		if err != nil {
-			if err == io.EOF {
-				break
+			return "", MetaData{}, err
+		}
+	}
+
+	hash := fmt.Sprintf("%x", fileHash.Sum(nil))
+	manifestCache.Store(filePath, manifestCacheEntry{
+		size:     stat.Size(),
+		modTime:  stat.ModTime().UnixNano(),
+		hash:     hash,
+		manifest: manifest,
+	})
+	return hash, manifest, nil
+}
+
+// fileListKeepalive is how often a streamed file list is sent on while files
+// are still being hashed, so the requester's idle deadline does not expire.
+const fileListKeepalive = transferIdleTimeout / 3
+
+// sendFileList answers list_files, search and watch_folder with the shared
+// files that match and that peerID may fetch. A requester that sets batch
+// (the request's Length) gets them as they are hashed, in "file_list_part"
+// messages of at most batch entries, the last batch in a closing "file_list";
+// an empty part is sent whenever hashing takes longer than fileListKeepalive.
+// Other requesters get the whole list in a single "file_list".
+func sendFileList(c codec.Codec, peerID string, batch int64, match func(name string) bool) {
+	names, err := servedFolder.ListFiles()
+	if err != nil {
+		log.Printf("[ERROR] %v", err)
+		sendError(c, "", CodeUnreadable, "Shared folder not readable")
+		return
+	}
+
+	entries := make(chan RemoteFileInfo)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(entries)
+		for _, name := range names {
+			if match != nil && !match(name) {
+				continue
 			}
-			log.Printf("[ERROR] Error reading file: %s", filename)
+			info, ok := listEntry(name, peerID)
+			if !ok {
+				continue
+			}
+			select {
+			case entries <- info:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	send := func(msgType string, files []RemoteFileInfo) error {
+		content, err := json.Marshal(files)
+		if err != nil {
+			return err
+		}
+		if err := c.WriteMessage(Message{Type: msgType, Content: content}); err != nil {
+			return err
+		}
+		return c.Flush()
+	}
+
+	files := []RemoteFileInfo{}
+	keepalive := time.NewTicker(fileListKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case info, ok := <-entries:
+			if !ok {
+				if err := send("file_list", files); err != nil {
+					log.Printf("[DEBUG] Failed to send file list: %v", err)
+				}
+				return
+			}
+			files = append(files, info)
+			if batch <= 0 || int64(len(files)) < batch {
+				continue
+			}
+		case <-keepalive.C:
+			if batch <= 0 {
+				continue
+			}
+		}
+		if err := send("file_list_part", files); err != nil {
+			log.Printf("[DEBUG] Failed to send file list: %v", err)
 			return
 		}
+		files = files[:0]
+		keepalive.Reset(fileListKeepalive)
+	}
+}
+
+// listEntry describes a shared file for a file list, if peerID may see it.
+func listEntry(name, peerID string) (RemoteFileInfo, bool) {
+	if checkShared(name, peerID) != nil {
+		return RemoteFileInfo{}, false
+	}
+	filePath, err := servedFolder.Resolve(name)
+	if err != nil {
+		return RemoteFileInfo{}, false
+	}
+	stat, err := os.Stat(filePath)
+	if err != nil || !stat.Mode().IsRegular() {
+		return RemoteFileInfo{}, false
+	}
+	hash, _, err := fileManifest(filePath, name, stat)
+	if err != nil {
+		log.Printf("[WARN] Failed to hash file %s: %v", name, err)
+		return RemoteFileInfo{}, false
+	}
+	return RemoteFileInfo{
+		Name:    name,
+		Size:    stat.Size(),
+		ModTime: stat.ModTime(),
+		Hash:    hash,
+	}, true
+}
+
+// sendFileInfo answers stat_file with a "file_info" message carrying the file's
+// size, modification time and whole-file digest, and its chunk manifest as JSON content.
+func sendFileInfo(c codec.Codec, filename, peerID string) {
+	file, stat, denied := openShared(c, filename, peerID)
+	if denied != nil {
+		return
+	}
+	defer file.Close()
+
+	hash, manifest, err := fileManifestFrom(file, filename, stat)
+	if err != nil {
+		log.Printf("[ERROR] Failed to hash file %s: %v", filename, err)
+		sendError(c, filename, CodeUnreadable, "File not readable")
+		return
+	}
+	content, err := json.Marshal(manifest)
+	if err != nil {
+		sendError(c, filename, CodeUnreadable, "File not readable")
+		return
+	}
+
+	info := Message{
+		Type:     "file_info",
+		Filename: filename,
+		Content:  content,
+		Hash:     hash,
+		Size:     stat.Size(),
+		ModTime:  stat.ModTime().UnixNano(),
+	}
+	if err := c.WriteMessage(info); err == nil {
+		c.Flush()
+	}
+}
+
+// sendError reports a failed request to the remote peer and returns it as an error.
+func sendError(c codec.Codec, filename, code, text string) *PeerError {
+	response := Message{
+		Type:     "error",
+		Filename: filename,
+		Content:  []byte(text),
+		Code:     code,
+	}
+	if err := c.WriteMessage(response); err == nil {
+		c.Flush()
+	}
+	return &PeerError{Code: code, Message: text}
+}
+
+// openShared resolves a requested name inside the served folder, checks the
+// access policy for the requesting peer and opens the file. The policy is
+// checked for the requested name and for the path of the file actually
+// opened, so a symlink cannot serve a file under a name with a laxer rule.
+// Callers must only read the returned descriptor, never reopen the file by
+// name. Failures have already been reported to the peer when the *PeerError
+// is returned.
+func openShared(c codec.Codec, filename, peerID string) (*os.File, os.FileInfo, *PeerError) {
+	filePath, err := servedFolder.Resolve(filename)
+	if err != nil {
+		log.Printf("[WARN] Rejected request for %q: %v", filename, err)
+		return nil, nil, sendError(c, filename, CodeInvalidPath, "Invalid file path")
+	}
+	// Checked before opening, so a denied peer cannot tell whether the file exists.
+	if denied := accessPolicy.Check(filename, peerID); denied != nil {
+		log.Printf("[WARN] Denied %s to peer %q: %s", filename, peerID, denied.Code)
+		return nil, nil, sendError(c, filename, denied.Code, denied.Message)
+	}
+
+	file, err := os.Open(filePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Printf("[ERROR] File not found: %s", filename)
+		return nil, nil, sendError(c, filename, CodeNotFound, "File not found")
+	}
+	if err != nil {
+		// Reported apart from a missing file, which a syncing peer takes as a deletion.
+		log.Printf("[ERROR] Failed to open %s: %v", filename, err)
+		return nil, nil, sendError(c, filename, CodeUnreadable, "File not readable")
+	}
+	stat, err := file.Stat()
+	if err != nil || !stat.Mode().IsRegular() {
+		file.Close()
+		return nil, nil, sendError(c, filename, CodeNotFound, "File not found")
+	}
+
+	canonical, err := openedName(filename, stat)
+	if err != nil {
+		file.Close()
+		log.Printf("[WARN] Rejected request for %q: %v", filename, err)
+		return nil, nil, sendError(c, filename, CodeInvalidPath, "Invalid file path")
+	}
+	if !tracked(canonical) {
+		// Uploads and downloads in progress are not shared, as ListFiles leaves them out.
+		file.Close()
+		return nil, nil, sendError(c, filename, CodeNotFound, "File not found")
+	}
+	if canonical != filename {
+		if denied := accessPolicy.Check(canonical, peerID); denied != nil {
+			file.Close()
+			log.Printf("[WARN] Denied %s (%s) to peer %q: %s", filename, canonical, peerID, denied.Code)
+			return nil, nil, sendError(c, filename, denied.Code, denied.Message)
+		}
+	}
+	return file, stat, nil
+}
 
-		log.Printf("[DEBUG] Read file chunk (%d bytes)", n)
+// openedName returns the canonical name of the file opened as filename, making
+// sure it is still the file with stat, not one swapped in after it was opened.
+func openedName(filename string, stat os.FileInfo) (string, error) {
+	canonical, err := servedFolder.canonicalName(filename)
+	if err != nil {
+		return "", err
+	}
+	canonicalPath, err := servedFolder.Resolve(canonical)
+	if err != nil {
+		return "", err
+	}
+	current, err := os.Stat(canonicalPath)
+	if err != nil || !os.SameFile(current, stat) {
+		return "", errors.New("file was replaced while being opened")
+	}
+	return canonical, nil
+}
+
+// checkShared decides whether peerID may see filename, by its own name and by
+// the name of the file it refers to once symlinks are resolved. filename is
+// taken as spelled on disk; requests by name go through openShared instead.
+func checkShared(filename, peerID string) *PeerError {
+	if denied := accessPolicy.Check(filename, peerID); denied != nil {
+		return denied
+	}
+	canonical, err := servedFolder.linkedName(filename)
+	if err != nil || canonical == filename {
+		// A file that no longer exists, such as one just removed, is known only by its name.
+		return nil
+	}
+	return accessPolicy.Check(canonical, peerID)
+}
 
-		response := Message{
-			Type:    "send_file_chunk",
-			Content: buffer[:n],
+// checkSharedDir is checkShared for a directory of the served folder.
+func checkSharedDir(dir, peerID string) *PeerError {
+	if denied := accessPolicy.CheckDir(dir, peerID); denied != nil {
+		return denied
+	}
+	canonical, err := servedFolder.linkedName(dir)
+	if err != nil || canonical == dir {
+		return nil
+	}
+	return accessPolicy.CheckDir(canonical, peerID)
+}
+
+// deniedOutcome classifies policy rejections as denials in the audit log.
+func deniedOutcome(err error) string {
+	var peerErr *PeerError
+	if errors.As(err, &peerErr) {
+		switch peerErr.Code {
+		case CodeAccessDenied, CodeUnauthenticated, CodeInvalidPath:
+			return audit.OutcomeDenied
 		}
+	}
+	return ""
+}
 
-		if err := encoder.Encode(response); err != nil {
-			log.Printf("[ERROR] Failed to send file chunk: %s", filename)
-			return
+// sendFile streams the requested byte range of a file in chunks, ensuring integrity.
+//
+// The response starts with a "file_info" message describing the file and the
+// range actually served. A request that resumes at a non-zero offset may carry
+// the Size and ModTime it saw earlier; if the file has changed since, the whole
+// file is served from offset 0 instead so the client can start over.
+func sendFile(c codec.Codec, request Message, peerID string) (int64, error) {
+	filename := request.Filename
+	file, stat, denied := openShared(c, filename, peerID)
+	if denied != nil {
+		return 0, denied
+	}
+	defer file.Close()
+
+	offset, length := request.Offset, request.Length
+	if offset > 0 && (request.Size != 0 || request.ModTime != 0) &&
+		(request.Size != stat.Size() || request.ModTime != stat.ModTime().UnixNano()) {
+		log.Printf("[DEBUG] File %s changed since the range was requested, sending it in full", filename)
+		offset, length = 0, 0
+	}
+	if offset < 0 || length < 0 || offset > stat.Size() {
+		return 0, sendError(c, filename, CodeInvalidRange, "Invalid range")
+	}
+	if length == 0 || offset+length > stat.Size() {
+		length = stat.Size() - offset
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		log.Printf("[ERROR] Failed to seek in file %s: %v", filename, err)
+		return 0, sendError(c, filename, CodeUnreadable, "File not readable")
+	}
+
+	info := Message{
+		Type:     "file_info",
+		Filename: filename,
+		Size:     stat.Size(),
+		ModTime:  stat.ModTime().UnixNano(),
+		Offset:   offset,
+		Length:   length,
+		Mode:     uint32(stat.Mode().Perm()),
+	}
+	if length != stat.Size() {
+		// The digest in "end_of_file" only covers the range; also send the whole
+		// file's, so a resumed download can verify the bytes it already has.
+		if hash, _, err := fileManifestFrom(file, filename, stat); err == nil {
+			info.Hash = hash
 		}
+	}
+	if err := c.WriteMessage(info); err != nil {
+		log.Printf("[ERROR] Failed to send file info: %s: %v", filename, err)
+		return 0, err
+	}
 
-		log.Printf("[DEBUG] Sent file chunk (%d bytes)", n)
+	reader := io.LimitReader(file, length)
+	buffer := make([]byte, chunkSize)
+	rangeHash := sha256.New()
+	var sent int64
+
+	for {
+		n, err := io.ReadFull(reader, buffer)
+		if n > 0 {
+			response := Message{
+				Type:    "send_file_chunk",
+				Content: buffer[:n],
+				Hash:    hashChunk(buffer[:n]),
+			}
+			if err := c.WriteMessage(response); err != nil {
+				log.Printf("[ERROR] Failed to send file chunk: %s: %v", filename, err)
+				return sent, err
+			}
+			rangeHash.Write(buffer[:n])
+			sent += int64(n)
+		}
+		if err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			log.Printf("[ERROR] Error reading file %s: %v", filename, err)
+			return sent, err
+		}
 	}
 
-	// Send explicit "end_of_file" signal
+	// Send explicit "end_of_file" signal carrying the digest of the served range
 	endMessage := Message{
 		Type:     "end_of_file",
 		Filename: filename,
+		Hash:     fmt.Sprintf("%x", rangeHash.Sum(nil)),
+		Size:     stat.Size(),
+		Offset:   offset,
+		Length:   sent,
 	}
-	if err := encoder.Encode(endMessage); err != nil {
+	if err := c.WriteMessage(endMessage); err != nil {
 		log.Printf("[ERROR] Failed to send end-of-file signal: %s", filename)
-		return
+		return sent, err
+	}
+	if err := c.Flush(); err != nil {
+		log.Printf("[ERROR] Failed to flush file %s: %v", filename, err)
+		return sent, err
 	}
 
-	log.Printf("[DEBUG] File %s sent successfully.", filename)
+	log.Printf("[DEBUG] File %s sent successfully (%d bytes from offset %d).", filename, sent, offset)
+	return sent, nil
 }
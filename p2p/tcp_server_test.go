@@ -0,0 +1,131 @@
+package p2p
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"FDS/codec"
+)
+
+// A symlink must not serve a private file under a name the policy leaves public.
+func TestServeChecksLinkedFile(t *testing.T) {
+	shared := t.TempDir()
+	os.MkdirAll(filepath.Join(shared, "private"), 0755)
+	os.WriteFile(filepath.Join(shared, "private", "secret.txt"), []byte("secret"), 0644)
+	os.WriteFile(filepath.Join(shared, "notes.txt"), []byte("notes"), 0644)
+	os.Symlink(filepath.Join("private", "secret.txt"), filepath.Join(shared, "public.txt"))
+	os.Symlink("private", filepath.Join(shared, "open"))
+	peer := serveFolder(t, shared)
+	accessPolicy = &AccessPolicy{Files: map[string]FileRule{
+		"private/*": {Visibility: Private, AllowedPeers: []string{"alice"}},
+	}}
+
+	tests := []struct {
+		name     string
+		wantCode string // "" if the file must be served
+	}{
+		{"notes.txt", ""},
+		{"private/secret.txt", CodeUnauthenticated},
+		{"public.txt", CodeUnauthenticated},
+		{"open/secret.txt", CodeUnauthenticated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := RequestFileTo(peer, tt.name, io.Discard)
+			if tt.wantCode == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			var peerErr *PeerError
+			if !errors.As(err, &peerErr) || peerErr.Code != tt.wantCode {
+				t.Fatalf("got %v, want a %s error", err, tt.wantCode)
+			}
+		})
+	}
+
+	files, err := ListRemoteFiles(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name != "notes.txt" {
+		t.Errorf("listed %+v, want only notes.txt", files)
+	}
+}
+
+func TestFileListBatches(t *testing.T) {
+	shared := t.TempDir()
+	for i := 0; i < 5; i++ {
+		os.WriteFile(filepath.Join(shared, fmt.Sprintf("f%d.txt", i)), []byte{byte(i)}, 0644)
+	}
+	peer := serveFolder(t, shared)
+
+	tests := []struct {
+		name      string
+		batch     int64
+		wantTypes []string
+	}{
+		{"whole list", 0, []string{"file_list"}},
+		{"batches of two", 2, []string{"file_list_part", "file_list_part", "file_list"}},
+		{"one batch", 10, []string{"file_list"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, c, err := dialPeer(peer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			c.WriteMessage(Message{Type: "list_files", Length: tt.batch})
+			c.Flush()
+
+			var types []string
+			names := map[string]bool{}
+			for len(types) == 0 || types[len(types)-1] != "file_list" {
+				msg, err := c.ReadMessage()
+				if err != nil {
+					t.Fatal(err)
+				}
+				var part []RemoteFileInfo
+				json.Unmarshal(msg.Content, &part)
+				if tt.batch > 0 && int64(len(part)) > tt.batch {
+					t.Errorf("%s held %d entries", msg.Type, len(part))
+				}
+				for _, info := range part {
+					names[info.Name] = true
+				}
+				types = append(types, msg.Type)
+			}
+			if !slices.Equal(types, tt.wantTypes) || len(names) != 5 {
+				t.Errorf("got %v with %d files, want %v with 5", types, len(names), tt.wantTypes)
+			}
+		})
+	}
+}
+
+func TestReadFileListParts(t *testing.T) {
+	peer := servePeer(t, func(conn net.Conn, c codec.Codec, request Message) {
+		if request.Length != fileListBatch {
+			sendError(c, "", CodeInvalidRange, "no batch size")
+			return
+		}
+		c.WriteMessage(Message{Type: "file_list_part", Content: []byte(`[{"name":"a"}]`)})
+		c.WriteMessage(Message{Type: "file_list_part", Content: []byte(`[]`)})
+		c.WriteMessage(Message{Type: "file_list", Content: []byte(`[{"name":"b"}]`)})
+	})
+	files, err := ListRemoteFiles(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || files[0].Name != "a" || files[1].Name != "b" {
+		t.Errorf("got %+v, want a and b", files)
+	}
+}
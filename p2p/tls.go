@@ -0,0 +1,39 @@
+package p2p
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+
+	"FDS/crypto"
+)
+
+// tlsIdentity enables mutual TLS on every peer and bootstrap connection; see UseTLS.
+var tlsIdentity *crypto.TLSIdentity
+
+// UseTLS makes listeners and outgoing connections use mutual TLS with the
+// given identity. It must be called before CreateTCPListener and before
+// contacting the bootstrap server. All nodes in a network must agree on it.
+func UseTLS(identity *crypto.TLSIdentity) {
+	tlsIdentity = identity
+}
+
+// dialTCP connects to addr, over mutual TLS when enabled. peerID is the ID the
+// remote certificate must carry; "" accepts any trusted certificate.
+func dialTCP(addr, peerID string) (net.Conn, error) {
+	if tlsIdentity == nil {
+		return net.DialTimeout("tcp", addr, 10*time.Second)
+	}
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	return tls.DialWithDialer(dialer, "tcp", addr, tlsIdentity.ClientConfig(peerID))
+}
+
+// remotePeerID returns the certificate-verified ID of the peer on the other end
+// of conn, or "" if the connection is not authenticated.
+func remotePeerID(conn net.Conn) string {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	return crypto.PeerIDFromConnState(tlsConn.ConnectionState())
+}
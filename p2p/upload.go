@@ -0,0 +1,337 @@
+package p2p
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"FDS/audit"
+	"FDS/codec"
+)
+
+// DefaultMaxUpload is the largest file accepted with put_file unless UploadOptions say otherwise.
+const DefaultMaxUpload = 1 << 30
+
+// UploadOptions limits the files other peers may upload into the served folder.
+type UploadOptions struct {
+	MaxFileSize int64 // largest file accepted, default DefaultMaxUpload
+	Quota       int64 // most bytes the served folder may hold after an upload; 0 means no limit
+}
+
+// uploadOptions is nil until UseUploads is called; uploads are refused until then.
+var uploadOptions *UploadOptions
+
+// UseUploads makes the TCP server accept put_file uploads within opts. Who may
+// upload which files is decided by the access policy, so nothing is accepted
+// without one; see AccessPolicy.CheckWrite.
+func UseUploads(opts UploadOptions) {
+	if opts.MaxFileSize <= 0 {
+		opts.MaxFileSize = DefaultMaxUpload
+	}
+	uploadOptions = &opts
+}
+
+var (
+	uploadMutex    sync.Mutex
+	uploadReserved int64 // bytes of uploads in progress, counted against the quota
+)
+
+// reserveUpload checks that size more bytes fit in the quota, counting uploads
+// in progress but not the file at filePath, which the upload replaces. The
+// reservation must be released with releaseUpload.
+func reserveUpload(filePath string, size, quota int64) *PeerError {
+	uploadMutex.Lock()
+	defer uploadMutex.Unlock()
+	if quota > 0 {
+		used, err := folderUsage(filePath)
+		if err != nil {
+			log.Printf("[ERROR] %v", err)
+			return &PeerError{Code: CodeUnreadable, Message: "Shared folder not readable"}
+		}
+		if used+uploadReserved+size > quota {
+			return &PeerError{Code: CodeQuotaExceeded, Message: fmt.Sprintf("Upload would exceed the %d byte quota", quota)}
+		}
+	}
+	uploadReserved += size
+	return nil
+}
+
+func releaseUpload(size int64) {
+	uploadMutex.Lock()
+	uploadReserved -= size
+	uploadMutex.Unlock()
+}
+
+// folderUsage returns the total size of the files in the served folder other than exclude.
+func folderUsage(exclude string) (int64, error) {
+	names, err := servedFolder.ListFiles()
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, name := range names {
+		filePath, err := servedFolder.Resolve(name)
+		if err != nil || filePath == exclude {
+			continue
+		}
+		if stat, err := os.Stat(filePath); err == nil && stat.Mode().IsRegular() {
+			total += stat.Size()
+		}
+	}
+	return total, nil
+}
+
+// receiveFile handles a put_file request: it checks the upload against the
+// size limit, quota and access policy, answers "put_ready", and writes the
+// streamed chunks into the served folder with AddFileFrom. The file only
+// replaces an existing one once every chunk and the whole-file digest match.
+func receiveFile(conn net.Conn, c codec.Codec, request Message) {
+	peerID := remotePeerID(conn)
+	written, err := acceptUpload(conn, c, request, peerID)
+	if err != nil {
+		log.Printf("[WARN] Rejected upload of %s from %s: %v", request.Filename, conn.RemoteAddr(), err)
+	}
+	audit.Record(audit.Event{
+		Type:     "put_file",
+		PeerID:   peerID,
+		Remote:   conn.RemoteAddr().String(),
+		Filename: request.Filename,
+		Bytes:    written,
+		Outcome:  deniedOutcome(err),
+		Err:      err,
+	})
+}
+
+// uploadAccess decides whether peerID may upload filename to filePath: it must
+// be one of the file's writers and, if the upload replaces a file, allowed to
+// read that file under its name and the name it links to.
+func uploadAccess(filename, filePath, peerID string) *PeerError {
+	if denied := accessPolicy.CheckWrite(filename, peerID); denied != nil {
+		return denied
+	}
+	if _, err := os.Lstat(filePath); err != nil {
+		return nil
+	}
+	return checkShared(filename, peerID)
+}
+
+func acceptUpload(conn net.Conn, c codec.Codec, request Message, peerID string) (int64, error) {
+	filename := request.Filename
+	opts := uploadOptions
+	if opts == nil {
+		return 0, sendError(c, filename, CodeAccessDenied, "Uploads not accepted")
+	}
+	filePath, err := servedFolder.Resolve(filename)
+	if err != nil {
+		return 0, sendError(c, filename, CodeInvalidPath, "Invalid file path")
+	}
+	if denied := uploadAccess(filename, filePath, peerID); denied != nil {
+		return 0, sendError(c, filename, denied.Code, denied.Message)
+	}
+	if request.Size < 0 {
+		return 0, sendError(c, filename, CodeInvalidRange, "Invalid file size")
+	}
+	if request.Size > opts.MaxFileSize {
+		return 0, sendError(c, filename, CodeTooLarge, fmt.Sprintf("File exceeds %d bytes", opts.MaxFileSize))
+	}
+	if denied := reserveUpload(filePath, request.Size, opts.Quota); denied != nil {
+		return 0, sendError(c, filename, denied.Code, denied.Message)
+	}
+	defer releaseUpload(request.Size)
+
+	err = c.WriteMessage(Message{Type: "put_ready", Filename: filename})
+	if err == nil {
+		err = c.Flush()
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	upload := &streamReader{conn: conn, c: c, filename: filename, remaining: request.Size, digest: sha256.New()}
+	written, err := servedFolder.AddFileFrom(filename, upload)
+	if err != nil {
+		var peerErr *PeerError
+		if errors.As(err, &peerErr) {
+			sendError(c, filename, peerErr.Code, peerErr.Message)
+		} else {
+			sendError(c, filename, CodeStoreFailed, "File could not be stored")
+		}
+		return written, err
+	}
+	if request.ModTime != 0 {
+		modTime := time.Unix(0, request.ModTime)
+		if err := os.Chtimes(filePath, modTime, modTime); err != nil {
+			log.Printf("[WARN] Failed to set modification time of %s: %v", filename, err)
+		}
+	}
+
+	stored := Message{Type: "file_stored", Filename: filename, Size: written, Hash: fmt.Sprintf("%x", upload.digest.Sum(nil))}
+	if err := c.WriteMessage(stored); err == nil {
+		c.Flush()
+	}
+	log.Printf("[INFO] Stored %s (%d bytes) uploaded by %s", filename, written, conn.RemoteAddr())
+	return written, nil
+}
+
+// streamReader reads a file streamed as "send_file_chunk" messages up to
+// "end_of_file", such as an upload after "put_ready" or a file of a directory
+// transfer, verifying each chunk and, at the end, the length and digest of the
+// whole file. Failures are *PeerErrors to send back.
+type streamReader struct {
+	conn      net.Conn
+	c         codec.Codec
+	filename  string
+	remaining int64 // bytes announced not yet received
+	digest    hash.Hash
+	pending   []byte
+	chunk     int
+}
+
+func (u *streamReader) Read(p []byte) (int, error) {
+	for len(u.pending) == 0 {
+		u.conn.SetReadDeadline(time.Now().Add(transferIdleTimeout))
+		msg, err := u.c.ReadMessage()
+		if err != nil {
+			return 0, fmt.Errorf("transfer interrupted: %w", err)
+		}
+		switch msg.Type {
+		case "send_file_chunk":
+			if actual := hashChunk(msg.Content); actual != msg.Hash {
+				log.Printf("[WARN] %v", &IntegrityError{Filename: u.filename, Chunk: u.chunk, Expected: msg.Hash, Actual: actual})
+				return 0, &PeerError{Code: CodeIntegrity, Message: fmt.Sprintf("Chunk %d does not match its hash", u.chunk)}
+			}
+			if int64(len(msg.Content)) > u.remaining {
+				return 0, &PeerError{Code: CodeTooLarge, Message: "File is larger than announced"}
+			}
+			u.chunk++
+			u.remaining -= int64(len(msg.Content))
+			u.digest.Write(msg.Content)
+			u.pending = msg.Content
+
+		case "end_of_file":
+			if u.remaining != 0 {
+				return 0, &PeerError{Code: CodeIntegrity, Message: "File is shorter than announced"}
+			}
+			if actual := fmt.Sprintf("%x", u.digest.Sum(nil)); actual != msg.Hash {
+				return 0, &PeerError{Code: CodeIntegrity, Message: "File does not match its digest"}
+			}
+			return 0, io.EOF
+
+		default:
+			return 0, fmt.Errorf("unexpected %q message during transfer", msg.Type)
+		}
+	}
+	n := copy(p, u.pending)
+	u.pending = u.pending[n:]
+	return n, nil
+}
+
+// PutFile uploads the local file at localPath to peer, which stores it in its
+// shared folder as name, and returns the number of bytes sent. The peer checks
+// the upload against its size limit, quota and access policy before any data
+// is sent; a rejection is returned as a *PeerError whose Code gives the reason.
+func PutFile(peer Peer, localPath, name string) (sent int64, err error) {
+	defer func() {
+		audit.Record(audit.Event{Type: "put_file", PeerID: peer.ID, Remote: peer.Address(), Filename: name, Bytes: sent, Err: err})
+	}()
+
+	file, err := os.Open(localPath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open %s: %w", localPath, err)
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat %s: %w", localPath, err)
+	}
+
+	conn, c, err := dialPeer(peer)
+	if err != nil {
+		return 0, fmt.Errorf("could not connect to peer %s: %w", peer.Address(), err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(transferIdleTimeout))
+	request := Message{Type: "put_file", Filename: name, Size: stat.Size(), ModTime: stat.ModTime().UnixNano()}
+	if err := c.WriteMessage(request); err == nil {
+		err = c.Flush()
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to send put_file request: %w", err)
+	}
+	if _, err := readUploadResponse(c, "put_ready"); err != nil {
+		return 0, err
+	}
+
+	digest := sha256.New()
+	buffer := make([]byte, chunkSize)
+	for {
+		n, err := io.ReadFull(file, buffer)
+		if n > 0 {
+			conn.SetDeadline(time.Now().Add(transferIdleTimeout))
+			chunk := Message{Type: "send_file_chunk", Content: buffer[:n], Hash: hashChunk(buffer[:n])}
+			if werr := c.WriteMessage(chunk); werr != nil {
+				return sent, uploadFailure(conn, c, werr)
+			}
+			digest.Write(buffer[:n])
+			sent += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return sent, fmt.Errorf("failed to read %s: %w", localPath, err)
+		}
+	}
+
+	conn.SetDeadline(time.Now().Add(transferIdleTimeout))
+	end := Message{Type: "end_of_file", Filename: name, Hash: fmt.Sprintf("%x", digest.Sum(nil)), Length: sent}
+	if err := c.WriteMessage(end); err == nil {
+		err = c.Flush()
+	}
+	if err != nil {
+		return sent, uploadFailure(conn, c, err)
+	}
+	stored, err := readUploadResponse(c, "file_stored")
+	if err != nil {
+		return sent, err
+	}
+	if stored.Size != sent {
+		return sent, fmt.Errorf("peer stored %d of %d bytes", stored.Size, sent)
+	}
+	return sent, nil
+}
+
+// readUploadResponse reads the peer's answer during an upload, returning an
+// "error" message as a *PeerError.
+func readUploadResponse(c codec.Codec, want string) (Message, error) {
+	response, err := c.ReadMessage()
+	if err != nil {
+		return response, fmt.Errorf("failed to read %s response: %w", want, err)
+	}
+	if response.Type == "error" {
+		return response, &PeerError{Code: response.Code, Message: string(response.Content)}
+	}
+	if response.Type != want {
+		return response, fmt.Errorf("unexpected response %q to put_file", response.Type)
+	}
+	return response, nil
+}
+
+// uploadFailure explains a failed write during an upload: a peer that rejects
+// a chunk sends an error and closes the connection, so the error is read if it
+// arrived, and the write error returned otherwise.
+func uploadFailure(conn net.Conn, c codec.Codec, err error) error {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if response, rerr := c.ReadMessage(); rerr == nil && response.Type == "error" {
+		return &PeerError{Code: response.Code, Message: string(response.Content)}
+	}
+	return fmt.Errorf("upload interrupted: %w", err)
+}
@@ -0,0 +1,78 @@
+package p2p
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUploadAccess(t *testing.T) {
+	shared := t.TempDir()
+	os.MkdirAll(filepath.Join(shared, "private"), 0755)
+	os.WriteFile(filepath.Join(shared, "private", "secret.txt"), []byte("secret"), 0644)
+	os.WriteFile(filepath.Join(shared, "notes.txt"), []byte("notes"), 0644)
+	os.Symlink(filepath.Join("private", "secret.txt"), filepath.Join(shared, "public.txt"))
+	serveFolder(t, shared)
+	policy := &AccessPolicy{Files: map[string]FileRule{
+		"notes.txt":          {Visibility: Public, Writers: []string{"alice", "bob"}},
+		"new.txt":            {Visibility: Public, Writers: []string{"alice"}},
+		"public.txt":         {Visibility: Public, Writers: []string{"bob"}},
+		"private/secret.txt": {Visibility: Private, AllowedPeers: []string{"alice"}, Writers: []string{"alice", "bob"}},
+	}}
+
+	tests := []struct {
+		name     string
+		policy   *AccessPolicy
+		filename string
+		peerID   string
+		wantCode string // "" if the upload is allowed
+	}{
+		{"no policy", nil, "notes.txt", "alice", CodeAccessDenied},
+		{"unauthenticated", policy, "notes.txt", "", CodeUnauthenticated},
+		{"writer", policy, "notes.txt", "bob", ""},
+		{"not a writer", policy, "new.txt", "bob", CodeAccessDenied},
+		{"new file", policy, "new.txt", "alice", ""},
+		{"replacing a readable private file", policy, "private/secret.txt", "alice", ""},
+		{"replacing an unreadable private file", policy, "private/secret.txt", "bob", CodeAccessDenied},
+		{"replacing a link to an unreadable file", policy, "public.txt", "bob", CodeAccessDenied},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			accessPolicy = tt.policy
+			filePath, err := servedFolder.Resolve(tt.filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			denied := uploadAccess(tt.filename, filePath, tt.peerID)
+			if tt.wantCode == "" {
+				if denied != nil {
+					t.Fatalf("denied: %v", denied)
+				}
+				return
+			}
+			if denied == nil || denied.Code != tt.wantCode {
+				t.Fatalf("got %v, want a %s error", denied, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestPutFileRequiresPolicy(t *testing.T) {
+	shared := t.TempDir()
+	peer := serveFolder(t, shared)
+	previous := uploadOptions
+	t.Cleanup(func() { uploadOptions = previous })
+	UseUploads(UploadOptions{})
+
+	local := filepath.Join(t.TempDir(), "notes.txt")
+	os.WriteFile(local, []byte("notes"), 0644)
+	_, err := PutFile(peer, local, "notes.txt")
+	var peerErr *PeerError
+	if !errors.As(err, &peerErr) || peerErr.Code != CodeAccessDenied {
+		t.Fatalf("got %v, want an access_denied error", err)
+	}
+	if _, err := os.Stat(filepath.Join(shared, "notes.txt")); !os.IsNotExist(err) {
+		t.Error("the upload was stored")
+	}
+}
@@ -0,0 +1,422 @@
+package p2p
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"FDS/audit"
+	"FDS/codec"
+)
+
+// FileVersion is one version of a shared file kept in a store's history.
+type FileVersion struct {
+	Version  int       `json:"version"`            // 1 for the oldest version kept, counting up; never reused
+	Manifest string    `json:"manifest,omitempty"` // root hash of the version's manifest
+	Size     int64     `json:"size"`
+	Hash     string    `json:"hash,omitempty"` // SHA-256 of the whole file
+	ModTime  time.Time `json:"mod_time"`
+	Created  time.Time `json:"created"`           // when the version was recorded
+	Removed  bool      `json:"removed,omitempty"` // the file was removed; there is no content
+}
+
+// versionRecord is the history of one file, kept under versionKey.
+type versionRecord struct {
+	Filename string        `json:"filename"`
+	Versions []FileVersion `json:"versions"`
+}
+
+// PruneOptions selects the versions PruneVersions removes. The current version
+// of a file is always kept; zero values keep everything.
+type PruneOptions struct {
+	Keep   int           // versions to keep per file, newest first
+	MaxAge time.Duration // remove versions recorded longer ago than this
+}
+
+// versionKey is the chunk store key of a file's history. Names are hashed so
+// any file name makes a valid key.
+func versionKey(filename string) string {
+	return hashChunk([]byte(filename)) + ".versions"
+}
+
+// AddVersion stores the contents of r as a new version of filename, modified
+// at modTime. Its chunks are stored like StoreReader's, so chunks shared with
+// earlier versions or other files are stored once. If the contents are those
+// of the current version, no version is added and the current one is returned.
+func (s *Store) AddVersion(filename string, r io.Reader, modTime time.Time) (FileVersion, error) {
+	if s.keys == nil {
+		return FileVersion{}, fmt.Errorf("storage encryption keys not configured")
+	}
+	digest := sha256.New()
+	meta, size, err := splitStream(filename, io.TeeReader(r, digest), StoreOptions{}, func(chunk []byte, hash string) error {
+		return s.putChunk(hash, chunk)
+	}, s.writeManifest)
+	if err != nil {
+		return FileVersion{}, err
+	}
+	root, err := s.writeManifest(meta)
+	if err != nil {
+		return FileVersion{}, err
+	}
+	hash := fmt.Sprintf("%x", digest.Sum(nil))
+
+	s.versionMutex.Lock()
+	defer s.versionMutex.Unlock()
+	record, err := s.readVersions(filename)
+	if err != nil {
+		return FileVersion{}, err
+	}
+	if n := len(record.Versions); n > 0 && !record.Versions[n-1].Removed && record.Versions[n-1].Hash == hash {
+		current := &record.Versions[n-1]
+		if !current.ModTime.Equal(modTime) {
+			current.ModTime = modTime
+			if err := s.writeVersions(record); err != nil {
+				return FileVersion{}, err
+			}
+		}
+		return *current, nil
+	}
+
+	version := FileVersion{
+		Version:  record.next(),
+		Manifest: root,
+		Size:     size,
+		Hash:     hash,
+		ModTime:  modTime,
+		Created:  time.Now(),
+	}
+	record.Versions = append(record.Versions, version)
+	if err := s.writeVersions(record); err != nil {
+		return FileVersion{}, err
+	}
+	log.Printf("[INFO] Recorded version %d of %s (%d bytes)", version.Version, filename, size)
+	audit.Record(audit.Event{Type: "add_version", Filename: filename, Bytes: size, Detail: fmt.Sprintf("version %d", version.Version)})
+	return version, nil
+}
+
+// addRemoval records that filename was removed, so its history shows when.
+func (s *Store) addRemoval(filename string) error {
+	s.versionMutex.Lock()
+	defer s.versionMutex.Unlock()
+	record, err := s.readVersions(filename)
+	if err != nil {
+		return err
+	}
+	if n := len(record.Versions); n == 0 || record.Versions[n-1].Removed {
+		return nil
+	}
+	now := time.Now()
+	record.Versions = append(record.Versions, FileVersion{Version: record.next(), ModTime: now, Created: now, Removed: true})
+	return s.writeVersions(record)
+}
+
+// Versions returns the recorded versions of filename, oldest first.
+func (s *Store) Versions(filename string) ([]FileVersion, error) {
+	record, err := s.readVersions(filename)
+	if err != nil {
+		return nil, err
+	}
+	if len(record.Versions) == 0 {
+		return nil, fmt.Errorf("no versions of %s: %w", filename, ErrChunkNotFound)
+	}
+	return record.Versions, nil
+}
+
+// Version returns the given version of filename.
+func (s *Store) Version(filename string, version int) (FileVersion, error) {
+	versions, err := s.Versions(filename)
+	if err != nil {
+		return FileVersion{}, err
+	}
+	return findVersion(filename, versions, version)
+}
+
+// RetrieveVersion writes the given version of filename to w and returns the
+// number of bytes written.
+func (s *Store) RetrieveVersion(filename string, version int, w io.Writer) (FileVersion, int64, error) {
+	v, err := s.Version(filename, version)
+	if err != nil {
+		return v, 0, err
+	}
+	meta, err := s.loadManifest(v.Manifest)
+	if err != nil {
+		return v, 0, err
+	}
+	written, err := assembleTo(w, meta, s.readChunk)
+	return v, written, err
+}
+
+// VersionedNames returns the names of the files with a history.
+func (s *Store) VersionedNames() ([]string, error) {
+	keys, err := s.chunks.List()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, key := range keys {
+		if !strings.HasSuffix(key, ".versions") {
+			continue
+		}
+		data, err := s.chunks.Get(key)
+		if err != nil {
+			continue
+		}
+		var record versionRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return nil, fmt.Errorf("failed to decode version history %s: %w", key, err)
+		}
+		names = append(names, record.Filename)
+	}
+	return names, nil
+}
+
+// PruneVersions removes old versions of every file with a history and returns
+// how many were removed. Their chunks are reclaimed by CollectGarbage. The
+// history of a removed file disappears once only its removal is left.
+func (s *Store) PruneVersions(opts PruneOptions) (int, error) {
+	names, err := s.VersionedNames()
+	if err != nil {
+		return 0, err
+	}
+	pruned := 0
+	for _, name := range names {
+		n, err := s.pruneFile(name, opts)
+		pruned += n
+		if err != nil {
+			return pruned, err
+		}
+	}
+	return pruned, nil
+}
+
+func (s *Store) pruneFile(filename string, opts PruneOptions) (int, error) {
+	s.versionMutex.Lock()
+	defer s.versionMutex.Unlock()
+	record, err := s.readVersions(filename)
+	if err != nil {
+		return 0, err
+	}
+
+	last := len(record.Versions) - 1
+	var kept []FileVersion
+	for i, v := range record.Versions {
+		tooMany := opts.Keep > 0 && last-i >= opts.Keep
+		tooOld := opts.MaxAge > 0 && time.Since(v.Created) > opts.MaxAge
+		if i == last || !(tooMany || tooOld) {
+			kept = append(kept, v)
+		}
+	}
+	pruned := len(record.Versions) - len(kept)
+	if pruned == 0 {
+		return 0, nil
+	}
+
+	if len(kept) == 1 && kept[0].Removed {
+		err = s.chunks.Delete(versionKey(filename))
+	} else {
+		record.Versions = kept
+		err = s.writeVersions(record)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune versions of %s: %w", filename, err)
+	}
+	log.Printf("[INFO] Pruned %d versions of %s", pruned, filename)
+	audit.Record(audit.Event{Type: "prune_versions", Filename: filename, Detail: fmt.Sprintf("%d versions", pruned)})
+	return pruned, nil
+}
+
+// readVersions returns the history of filename, which is empty if it has none.
+func (s *Store) readVersions(filename string) (versionRecord, error) {
+	record := versionRecord{Filename: filename}
+	data, err := s.chunks.Get(versionKey(filename))
+	if errors.Is(err, ErrChunkNotFound) {
+		return record, nil
+	}
+	if err != nil {
+		return record, fmt.Errorf("failed to read version history of %s: %w", filename, err)
+	}
+	if err := json.Unmarshal(data, &record); err != nil {
+		return record, fmt.Errorf("failed to decode version history of %s: %w", filename, err)
+	}
+	return record, nil
+}
+
+func (s *Store) writeVersions(record versionRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to encode version history: %w", err)
+	}
+	if err := s.chunks.Put(versionKey(record.Filename), data); err != nil {
+		return fmt.Errorf("failed to write version history of %s: %w", record.Filename, err)
+	}
+	return nil
+}
+
+// next returns the number of the next version.
+func (r versionRecord) next() int {
+	if len(r.Versions) == 0 {
+		return 1
+	}
+	return r.Versions[len(r.Versions)-1].Version + 1
+}
+
+// findVersion picks a version out of a history; version 0 means the newest
+// version that has content.
+func findVersion(filename string, versions []FileVersion, version int) (FileVersion, error) {
+	for i := len(versions) - 1; i >= 0; i-- {
+		v := versions[i]
+		if (version == 0 && !v.Removed) || (version != 0 && v.Version == version) {
+			if v.Removed {
+				return v, fmt.Errorf("version %d of %s records its removal and has no content", version, filename)
+			}
+			return v, nil
+		}
+	}
+	return FileVersion{}, fmt.Errorf("version %d of %s: %w", version, filename, ErrChunkNotFound)
+}
+
+// recordVersion adds the current contents of a file in the folder to its
+// history, unless its size and modification time show it is already there.
+func (s *SharedFolder) recordVersion(filename string) error {
+	filePath, err := s.Resolve(filename)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if versions, err := s.History.Versions(filename); err == nil {
+		if current := versions[len(versions)-1]; !current.Removed &&
+			current.Size == stat.Size() && current.ModTime.Equal(stat.ModTime()) {
+			return nil
+		}
+	}
+	_, err = s.History.AddVersion(filename, file, stat.ModTime())
+	return err
+}
+
+// Versions returns the recorded versions of a file in the folder, oldest first.
+func (s *SharedFolder) Versions(filename string) ([]FileVersion, error) {
+	if s.History == nil {
+		return nil, errors.New("shared folder keeps no history")
+	}
+	return s.History.Versions(filename)
+}
+
+// RestoreVersion makes the given version of a file its current contents again,
+// recording the restored contents as a new version.
+func (s *SharedFolder) RestoreVersion(filename string, version int) (FileVersion, error) {
+	if s.History == nil {
+		return FileVersion{}, errors.New("shared folder keeps no history")
+	}
+	v, err := s.History.Version(filename, version)
+	if err != nil {
+		return v, err
+	}
+	reader, writer := io.Pipe()
+	go func() {
+		_, _, err := s.History.RetrieveVersion(filename, v.Version, writer)
+		writer.CloseWithError(err)
+	}()
+	_, err = s.AddFileFrom(filename, &digestReader{r: reader, digest: sha256.New(), want: v.Hash})
+	reader.CloseWithError(io.ErrClosedPipe)
+	if err != nil {
+		return v, fmt.Errorf("failed to restore version %d of %s: %w", v.Version, filename, err)
+	}
+	log.Printf("[INFO] Restored version %d of %s", v.Version, filename)
+	return v, nil
+}
+
+// TrackVersions records the changes reported by a FolderWatcher in the
+// folder's history, so files written directly into the folder are versioned too.
+func (s *SharedFolder) TrackVersions(events <-chan FileEvent) {
+	for event := range events {
+		var err error
+		switch event.Type {
+		case FileAdded, FileModified:
+			err = s.recordVersion(event.Name)
+		case FileRenamed:
+			if err = s.recordVersion(event.Name); err == nil {
+				err = s.History.addRemoval(event.OldName)
+			}
+		case FileRemoved:
+			err = s.History.addRemoval(event.Name)
+		}
+		if err != nil {
+			log.Printf("[WARN] Failed to record version of %s: %v", event.Name, err)
+		}
+	}
+}
+
+// sendVersions answers list_versions with a "version_list" message whose
+// content is the JSON history of a shared file, subject to the access policy.
+func sendVersions(c codec.Codec, filename, peerID string) {
+	if _, err := servedFolder.Resolve(filename); err != nil {
+		sendError(c, filename, CodeInvalidPath, "Invalid file path")
+		return
+	}
+	if denied := checkShared(filename, peerID); denied != nil {
+		sendError(c, filename, denied.Code, denied.Message)
+		return
+	}
+	versions, err := servedFolder.Versions(filename)
+	if err != nil {
+		sendError(c, filename, CodeNotFound, "No versions found")
+		return
+	}
+	content, err := json.Marshal(versions)
+	if err != nil {
+		sendError(c, filename, CodeUnreadable, "Versions not readable")
+		return
+	}
+	if err := c.WriteMessage(Message{Type: "version_list", Filename: filename, Content: content}); err == nil {
+		c.Flush()
+	}
+}
+
+// ListVersions asks a peer for the versions of a file in its shared folder.
+func ListVersions(peer Peer, filename string) ([]FileVersion, error) {
+	data, err := fetchObject(peer, Message{Type: "list_versions", Filename: filename}, "version_list")
+	if err != nil {
+		return nil, err
+	}
+	var versions []FileVersion
+	if err := json.Unmarshal(data, &versions); err != nil {
+		return nil, fmt.Errorf("failed to decode versions: %w", err)
+	}
+	return versions, nil
+}
+
+// FetchVersion fetches the given version of a file in peer's shared folder
+// (0 for the newest) and writes it to w. The manifest and every chunk are
+// verified, and so is the whole file against the version's digest.
+func (s *Store) FetchVersion(peer Peer, filename string, version int, w io.Writer) (FileVersion, error) {
+	versions, err := ListVersions(peer, filename)
+	if err != nil {
+		return FileVersion{}, err
+	}
+	v, err := findVersion(filename, versions, version)
+	if err != nil {
+		return v, err
+	}
+	digest := sha256.New()
+	if _, err := s.FetchByHash([]Peer{peer}, v.Manifest, io.MultiWriter(w, digest)); err != nil {
+		return v, err
+	}
+	if actual := fmt.Sprintf("%x", digest.Sum(nil)); actual != v.Hash {
+		return v, &IntegrityError{Filename: filename, Chunk: -1, Expected: v.Hash, Actual: actual}
+	}
+	return v, nil
+}
@@ -0,0 +1,218 @@
+package p2p
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestAddVersion(t *testing.T) {
+	store := testStore(t)
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	steps := []struct {
+		name        string
+		contents    string // "" records a removal
+		wantVersion int
+	}{
+		{"first version", "one", 1},
+		{"same contents", "one", 1},
+		{"changed", "two", 2},
+		{"removed", "", 3},
+		{"removed again", "", 3},
+		{"recreated", "three", 4},
+	}
+	for _, step := range steps {
+		if step.contents == "" {
+			if err := store.addRemoval("a.txt"); err != nil {
+				t.Fatalf("%s: %v", step.name, err)
+			}
+		} else if _, err := store.AddVersion("a.txt", bytes.NewReader([]byte(step.contents)), modTime); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		versions, _ := store.Versions("a.txt")
+		if got := versions[len(versions)-1].Version; got != step.wantVersion {
+			t.Errorf("%s: newest version %d, want %d", step.name, got, step.wantVersion)
+		}
+	}
+
+	tests := []struct {
+		version int
+		want    string // "" if the version has no content
+	}{
+		{0, "three"},
+		{1, "one"},
+		{2, "two"},
+		{3, ""},
+		{4, "three"},
+		{5, ""},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		v, n, err := store.RetrieveVersion("a.txt", tt.version, &buf)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("version %d: retrieved %q", tt.version, buf.String())
+			}
+			continue
+		}
+		if err != nil || buf.String() != tt.want || n != int64(len(tt.want)) {
+			t.Errorf("version %d = %q, %v; want %q", tt.version, buf.String(), err, tt.want)
+		}
+		if v.Hash != digest([]byte(tt.want)) || !v.ModTime.Equal(modTime) {
+			t.Errorf("version %d recorded as %+v", tt.version, v)
+		}
+	}
+	if _, err := store.Versions("other.txt"); !errors.Is(err, ErrChunkNotFound) {
+		t.Errorf("Versions of a file without history = %v, want ErrChunkNotFound", err)
+	}
+}
+
+func TestPruneVersions(t *testing.T) {
+	tests := []struct {
+		name        string
+		opts        PruneOptions
+		removed     bool // the file's removal is its newest version
+		wantPruned  int
+		wantKept    []int
+		wantHistory bool
+	}{
+		{"keep everything", PruneOptions{}, false, 0, []int{1, 2, 3, 4}, true},
+		{"keep two", PruneOptions{Keep: 2}, false, 2, []int{3, 4}, true},
+		{"keep one", PruneOptions{Keep: 1}, false, 3, []int{4}, true},
+		{"older than a day", PruneOptions{MaxAge: 24 * time.Hour}, false, 2, []int{3, 4}, true},
+		{"current version is always kept", PruneOptions{MaxAge: time.Minute}, false, 3, []int{4}, true},
+		{"history of a removed file", PruneOptions{Keep: 1}, true, 3, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := testStore(t)
+			for i, contents := range []string{"1", "2", "3", "4"} {
+				if i == 3 && tt.removed {
+					store.addRemoval("a.txt")
+					continue
+				}
+				store.AddVersion("a.txt", bytes.NewReader([]byte(contents)), time.Now())
+			}
+			// Versions 1 and 2 were recorded two days ago, the rest an hour ago.
+			record, _ := store.readVersions("a.txt")
+			for i := range record.Versions {
+				age := time.Hour
+				if i < 2 {
+					age = 48 * time.Hour
+				}
+				record.Versions[i].Created = time.Now().Add(-age)
+			}
+			store.writeVersions(record)
+
+			pruned, err := store.PruneVersions(tt.opts)
+			if err != nil || pruned != tt.wantPruned {
+				t.Fatalf("PruneVersions = %d, %v; want %d", pruned, err, tt.wantPruned)
+			}
+			names, _ := store.VersionedNames()
+			if hasHistory := slices.Contains(names, "a.txt"); hasHistory != tt.wantHistory {
+				t.Fatalf("history kept = %v, want %v", hasHistory, tt.wantHistory)
+			}
+			record, _ = store.readVersions("a.txt")
+			var kept []int
+			for _, v := range record.Versions {
+				kept = append(kept, v.Version)
+			}
+			if !slices.Equal(kept, tt.wantKept) {
+				t.Errorf("kept versions %v, want %v", kept, tt.wantKept)
+			}
+		})
+	}
+}
+
+func TestSharedFolderHistory(t *testing.T) {
+	store := testStore(t)
+	dir := t.TempDir()
+	folder := &SharedFolder{FolderPath: dir, History: store}
+
+	folder.AddFile("a.txt", []byte("one"))
+	folder.AddFile("a.txt", []byte("two"))
+	// A file copied in by hand is recorded before it is removed.
+	os.WriteFile(filepath.Join(dir, "b.txt"), []byte("by hand"), 0644)
+	folder.RemoveFile("b.txt")
+	if _, err := folder.RestoreVersion("a.txt", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		filename string
+		want     []string // contents of each version; "" for a removal
+	}{
+		{"a.txt", []string{"one", "two", "one"}},
+		{"b.txt", []string{"by hand", ""}},
+	}
+	for _, tt := range tests {
+		versions, err := folder.Versions(tt.filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, v := range versions {
+			var buf bytes.Buffer
+			if !v.Removed {
+				store.RetrieveVersion(tt.filename, v.Version, &buf)
+			}
+			got = append(got, buf.String())
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("versions of %s are %q, want %q", tt.filename, got, tt.want)
+		}
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "a.txt")); string(data) != "one" {
+		t.Errorf("restored a.txt holds %q", data)
+	}
+	if _, err := (&SharedFolder{FolderPath: dir}).Versions("a.txt"); err == nil {
+		t.Error("a folder without history listed versions")
+	}
+}
+
+func TestFetchVersion(t *testing.T) {
+	store := testStore(t)
+	shared := t.TempDir()
+	peer := serveFolder(t, shared)
+	servedFolder.History = store
+	servedFolder.AddFile("notes.txt", []byte("first"))
+	servedFolder.AddFile("notes.txt", []byte("second"))
+	servedFolder.AddFile("private/secret.txt", []byte("secret"))
+	accessPolicy = &AccessPolicy{Files: map[string]FileRule{
+		"private/*": {Visibility: Private, AllowedPeers: []string{"alice"}},
+	}}
+
+	tests := []struct {
+		name     string
+		filename string
+		version  int
+		want     string
+		wantCode string
+	}{
+		{"newest version", "notes.txt", 0, "second", ""},
+		{"older version", "notes.txt", 1, "first", ""},
+		{"private file", "private/secret.txt", 0, "", CodeUnauthenticated},
+		{"file without history", "other.txt", 0, "", CodeNotFound},
+		{"path outside the folder", "../notes.txt", 0, "", CodeInvalidPath},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			_, err := store.FetchVersion(peer, tt.filename, tt.version, &buf)
+			if tt.wantCode != "" {
+				var peerErr *PeerError
+				if !errors.As(err, &peerErr) || peerErr.Code != tt.wantCode {
+					t.Fatalf("got %v, want a %s error", err, tt.wantCode)
+				}
+				return
+			}
+			if err != nil || buf.String() != tt.want {
+				t.Errorf("FetchVersion = %q, %v; want %q", buf.String(), err, tt.want)
+			}
+		})
+	}
+}
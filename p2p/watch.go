@@ -0,0 +1,389 @@
+package p2p
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"FDS/codec"
+)
+
+// FileEvent types.
+const (
+	FileAdded    = "added"
+	FileModified = "modified"
+	FileRemoved  = "removed"
+	FileRenamed  = "renamed"
+)
+
+// watchBuffer is how many events a subscriber may fall behind before it is dropped.
+const watchBuffer = 256
+
+// FileEvent is a change to a file in a shared folder. Size, ModTime and Hash
+// describe the file after the change, or before it for FileRemoved.
+type FileEvent struct {
+	Type    string    `json:"type"`
+	Name    string    `json:"name"`
+	OldName string    `json:"old_name,omitempty"` // previous name of a renamed file
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	Hash    string    `json:"hash"`
+}
+
+// WatchOptions configures a FolderWatcher. Zero values select the defaults.
+type WatchOptions struct {
+	PollInterval time.Duration // time between scans when polling, default 2s
+	Poll         bool          // always poll instead of using inotify
+}
+
+func (o WatchOptions) withDefaults() WatchOptions {
+	if o.PollInterval <= 0 {
+		o.PollInterval = 2 * time.Second
+	}
+	return o
+}
+
+// FolderWatcher reports files added, modified, removed and renamed in a shared
+// folder. On Linux it is driven by inotify; elsewhere, or if inotify cannot be
+// used, it rescans the folder every opts.PollInterval. Either way a changed
+// file is compared by size and modification time and then by digest, so only
+// real content changes are reported as modified, and a file that disappears
+// under one name and appears under another with the same digest is reported
+// as renamed.
+type FolderWatcher struct {
+	folder *SharedFolder
+	opts   WatchOptions
+
+	files map[string]RemoteFileInfo // last seen state; only used by Run's goroutine
+
+	mutex       sync.Mutex
+	subscribers map[chan FileEvent]bool
+	stopped     bool
+}
+
+// NewFolderWatcher creates a FolderWatcher for folder. It reports nothing until Run.
+func NewFolderWatcher(folder *SharedFolder, opts WatchOptions) *FolderWatcher {
+	return &FolderWatcher{
+		folder:      folder,
+		opts:        opts.withDefaults(),
+		files:       make(map[string]RemoteFileInfo),
+		subscribers: make(map[chan FileEvent]bool),
+	}
+}
+
+// Subscribe returns a channel receiving every event from now on and a function
+// that cancels the subscription. The channel is closed when the watcher stops,
+// and also if the subscriber falls more than watchBuffer events behind, after
+// which it has to list the folder again to catch up.
+func (w *FolderWatcher) Subscribe() (<-chan FileEvent, func()) {
+	events := make(chan FileEvent, watchBuffer)
+	w.mutex.Lock()
+	if w.stopped {
+		close(events)
+	} else {
+		w.subscribers[events] = true
+	}
+	w.mutex.Unlock()
+	return events, func() {
+		w.mutex.Lock()
+		defer w.mutex.Unlock()
+		if w.subscribers[events] {
+			delete(w.subscribers, events)
+			close(events)
+		}
+	}
+}
+
+// Run watches the folder until quit is closed.
+func (w *FolderWatcher) Run(quit <-chan struct{}) {
+	defer w.stop()
+	w.scan(nil, false)
+
+	if !w.opts.Poll {
+		err := w.watchNative(quit)
+		if err == nil {
+			return
+		}
+		log.Printf("[WARN] Watch: %v; polling %s every %s", err, w.folder.FolderPath, w.opts.PollInterval)
+	}
+
+	ticker := time.NewTicker(w.opts.PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.scan(nil, true)
+		case <-quit:
+			return
+		}
+	}
+}
+
+// scan compares the named files, or every file if names is nil, with their
+// last seen state and publishes the differences if publish is set.
+func (w *FolderWatcher) scan(names []string, publish bool) {
+	if names == nil {
+		listed, err := w.folder.ListFiles()
+		if err != nil {
+			log.Printf("[ERROR] Watch: %v", err)
+			return
+		}
+		names = listed
+		seen := make(map[string]bool, len(listed))
+		for _, name := range listed {
+			seen[name] = true
+		}
+		for name := range w.files {
+			if !seen[name] {
+				names = append(names, name)
+			}
+		}
+	}
+
+	var modified, added, removed []FileEvent
+	for _, name := range names {
+		if !tracked(name) {
+			continue
+		}
+		old, known := w.files[name]
+		info, exists := w.stat(name)
+		switch {
+		case !exists && known:
+			delete(w.files, name)
+			removed = append(removed, FileEvent{Type: FileRemoved, Name: name, Size: old.Size, ModTime: old.ModTime, Hash: old.Hash})
+		case !exists:
+		case !known:
+			w.files[name] = info
+			added = append(added, FileEvent{Type: FileAdded, Name: name, Size: info.Size, ModTime: info.ModTime, Hash: info.Hash})
+		case info.Hash != old.Hash:
+			w.files[name] = info
+			modified = append(modified, FileEvent{Type: FileModified, Name: name, Size: info.Size, ModTime: info.ModTime, Hash: info.Hash})
+		default:
+			w.files[name] = info
+		}
+	}
+	if !publish {
+		return
+	}
+
+	for _, event := range modified {
+		w.publish(event)
+	}
+	// A name that went away while another with the same content appeared was renamed.
+	for _, gone := range removed {
+		renamed := false
+		for i, event := range added {
+			if event.Type == FileAdded && event.Hash == gone.Hash && event.Size == gone.Size {
+				added[i].Type = FileRenamed
+				added[i].OldName = gone.Name
+				renamed = true
+				break
+			}
+		}
+		if !renamed {
+			w.publish(gone)
+		}
+	}
+	for _, event := range added {
+		w.publish(event)
+	}
+}
+
+// stat describes a file of the folder, reusing the last digest if its size and
+// modification time are unchanged.
+func (w *FolderWatcher) stat(name string) (RemoteFileInfo, bool) {
+	filePath, err := w.folder.Resolve(name)
+	if err != nil {
+		return RemoteFileInfo{}, false
+	}
+	stat, err := os.Stat(filePath)
+	if err != nil || !stat.Mode().IsRegular() {
+		return RemoteFileInfo{}, false
+	}
+	if old, ok := w.files[name]; ok && old.Size == stat.Size() && old.ModTime.Equal(stat.ModTime()) {
+		return old, true
+	}
+	hash, _, err := fileManifest(filePath, name, stat)
+	if err != nil {
+		// Most likely removed or replaced while being read; the next event or scan catches up.
+		log.Printf("[DEBUG] Watch: failed to hash %s: %v", name, err)
+		return RemoteFileInfo{}, false
+	}
+	return RemoteFileInfo{Name: name, Size: stat.Size(), ModTime: stat.ModTime(), Hash: hash}, true
+}
+
+// publish hands an event to every subscriber, dropping those that are full.
+func (w *FolderWatcher) publish(event FileEvent) {
+	if event.Type == FileRenamed {
+		log.Printf("[DEBUG] Watch: %s renamed to %s", event.OldName, event.Name)
+	} else {
+		log.Printf("[DEBUG] Watch: %s %s", event.Name, event.Type)
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for events := range w.subscribers {
+		select {
+		case events <- event:
+		default:
+			log.Printf("[WARN] Watch: subscriber fell behind, dropping it")
+			delete(w.subscribers, events)
+			close(events)
+		}
+	}
+}
+
+// stop closes every subscription.
+func (w *FolderWatcher) stop() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.stopped = true
+	for events := range w.subscribers {
+		delete(w.subscribers, events)
+		close(events)
+	}
+}
+
+// changeWatcher is nil until UseWatcher is called; watch_folder requests are refused until then.
+var changeWatcher *FolderWatcher
+
+// UseWatcher makes the TCP server announce the changes w reports to peers that
+// send watch_folder. Each peer only hears about files the access policy lets it fetch.
+func UseWatcher(w *FolderWatcher) {
+	changeWatcher = w
+}
+
+// streamChanges answers watch_folder with the current file list, sent as
+// sendFileList does, followed by a "file_changed" message for every change,
+// until either side goes away.
+func streamChanges(conn net.Conn, c codec.Codec, peerID string, batch int64) {
+	w := changeWatcher
+	if w == nil {
+		sendError(c, "", CodeAccessDenied, "Change announcements not enabled")
+		return
+	}
+	// Subscribe before listing so no change falls between the two.
+	events, cancel := w.Subscribe()
+	defer cancel()
+	sendFileList(c, peerID, batch, nil)
+
+	// The subscriber sends nothing more; a read returning means it hung up.
+	closed := make(chan struct{})
+	go func() {
+		c.ReadMessage()
+		close(closed)
+	}()
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			event, visible := visibleEvent(event, peerID)
+			if !visible {
+				continue
+			}
+			content, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			conn.SetWriteDeadline(time.Now().Add(transferIdleTimeout))
+			err = c.WriteMessage(Message{Type: "file_changed", Filename: event.Name, Content: content})
+			if err == nil {
+				err = c.Flush()
+			}
+			if err != nil {
+				log.Printf("[DEBUG] Stopped announcing changes to %s: %v", conn.RemoteAddr(), err)
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
+
+// visibleEvent adjusts an event to what peerID may see: a file renamed from or
+// to a name it may not fetch is announced as added or removed, and changes to
+// files it may not fetch are not announced at all.
+func visibleEvent(event FileEvent, peerID string) (FileEvent, bool) {
+	visible := checkShared(event.Name, peerID) == nil
+	if event.Type != FileRenamed {
+		return event, visible
+	}
+	wasVisible := checkShared(event.OldName, peerID) == nil
+	switch {
+	case visible && wasVisible:
+		return event, true
+	case visible:
+		event.Type, event.OldName = FileAdded, ""
+		return event, true
+	case wasVisible:
+		event.Type, event.Name, event.OldName = FileRemoved, event.OldName, ""
+		return event, true
+	}
+	return event, false
+}
+
+// WatchPeer subscribes to the changes in peer's shared folder. It returns the
+// files the peer shares now and a channel receiving every later change, which
+// is closed when quit is closed or the connection is lost.
+func WatchPeer(peer Peer, quit <-chan struct{}) ([]RemoteFileInfo, <-chan FileEvent, error) {
+	conn, c, err := dialPeer(peer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not connect to peer %s: %w", peer.Address(), err)
+	}
+	conn.SetDeadline(time.Now().Add(transferIdleTimeout))
+	if err := c.WriteMessage(Message{Type: "watch_folder", Length: fileListBatch}); err == nil {
+		err = c.Flush()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("failed to send watch request: %w", err)
+	}
+
+	files, err := readFileList(conn, c)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	events := make(chan FileEvent, watchBuffer)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-quit:
+			conn.Close()
+		case <-done:
+		}
+	}()
+	go func() {
+		defer close(events)
+		defer close(done)
+		defer conn.Close()
+		for {
+			msg, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			if msg.Type != "file_changed" {
+				continue
+			}
+			var event FileEvent
+			if err := json.Unmarshal(msg.Content, &event); err != nil {
+				log.Printf("[WARN] Bad change announcement from %s: %v", peer.ID, err)
+				continue
+			}
+			select {
+			case events <- event:
+			case <-quit:
+				return
+			}
+		}
+	}()
+	return files, events, nil
+}
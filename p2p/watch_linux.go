@@ -0,0 +1,165 @@
+//go:build linux
+
+package p2p
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+// inotifyMask selects the inotify events that can change what a file holds or
+// which files exist. Files are picked up once closed after writing, so a file
+// still being written is not announced half-way; IN_CREATE is only used to
+// notice new subdirectories.
+const inotifyMask = syscall.IN_CLOSE_WRITE | syscall.IN_ATTRIB | syscall.IN_CREATE | syscall.IN_DELETE |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF
+
+// watchNative follows the folder and its subdirectories with inotify until
+// quit is closed, and returns an error if inotify cannot be used or stops working.
+func (w *FolderWatcher) watchNative(quit <-chan struct{}) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_NONBLOCK | syscall.IN_CLOEXEC)
+	if err != nil {
+		return fmt.Errorf("inotify unavailable: %w", err)
+	}
+	// A non-blocking descriptor is read through the runtime poller, so closing it ends a pending read.
+	file := os.NewFile(uintptr(fd), "inotify")
+	defer file.Close()
+	root, err := syscall.InotifyAddWatch(fd, w.folder.FolderPath, inotifyMask)
+	if err != nil {
+		return fmt.Errorf("failed to watch %s: %w", w.folder.FolderPath, err)
+	}
+	dirs := map[int32]string{int32(root): ""}
+	watchDirs(fd, w.folder.FolderPath, dirs)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-quit:
+			file.Close()
+		case <-done:
+		}
+	}()
+
+	// Catch up with anything that changed before the watch was in place.
+	w.scan(nil, true)
+
+	buffer := make([]byte, 64*1024)
+	for {
+		n, err := file.Read(buffer)
+		if err != nil {
+			select {
+			case <-quit:
+				return nil
+			default:
+				return fmt.Errorf("inotify read failed: %w", err)
+			}
+		}
+		names, rescan, gone := parseInotify(buffer[:n], int32(root), dirs)
+		if gone {
+			return errors.New("shared folder was moved or removed")
+		}
+		if rescan {
+			// Events were lost or a directory came, went or moved; only a full scan
+			// can tell which files that affected.
+			watchDirs(fd, w.folder.FolderPath, dirs)
+			w.scan(nil, true)
+		} else if len(names) > 0 {
+			w.scan(names, true)
+		}
+	}
+}
+
+// watchDirs adds a watch for every tracked subdirectory of folder, records in
+// dirs which one each watch descriptor stands for, and drops watches on
+// directories that no longer exist there. Symlinked directories are not followed.
+func watchDirs(fd int, folder string, dirs map[int32]string) {
+	seen := make(map[int32]bool)
+	for wd, dir := range dirs {
+		if dir == "" {
+			seen[wd] = true
+		}
+	}
+	filepath.WalkDir(folder, func(dirPath string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.IsDir() || dirPath == folder {
+			return nil
+		}
+		rel, err := filepath.Rel(folder, dirPath)
+		if err != nil {
+			return nil
+		}
+		name := filepath.ToSlash(rel)
+		if !tracked(name) {
+			return filepath.SkipDir
+		}
+		wd, err := syscall.InotifyAddWatch(fd, dirPath, inotifyMask)
+		if err != nil {
+			// Most likely removed meanwhile; the event for that triggers another pass.
+			log.Printf("[DEBUG] Watch: failed to watch %s: %v", name, err)
+			return filepath.SkipDir
+		}
+		dirs[int32(wd)] = name
+		seen[int32(wd)] = true
+		return nil
+	})
+	for wd := range dirs {
+		if !seen[wd] {
+			syscall.InotifyRmWatch(fd, uint32(wd))
+			delete(dirs, wd)
+		}
+	}
+}
+
+// parseInotify returns the folder-relative names of the files touched by a
+// buffer of inotify events, whether the folder has to be rescanned because the
+// kernel queue overflowed or a directory changed, and whether the watched
+// folder itself went away. dirs maps watch descriptors to their directories.
+func parseInotify(buffer []byte, root int32, dirs map[int32]string) (names []string, rescan, gone bool) {
+	seen := make(map[string]bool)
+	for offset := 0; offset+syscall.SizeofInotifyEvent <= len(buffer); {
+		event := (*syscall.InotifyEvent)(unsafe.Pointer(&buffer[offset]))
+		start := offset + syscall.SizeofInotifyEvent
+		end := start + int(event.Len)
+		if end > len(buffer) {
+			break
+		}
+		offset = end
+
+		switch {
+		case event.Mask&syscall.IN_Q_OVERFLOW != 0:
+			rescan = true
+		case event.Mask&(syscall.IN_DELETE_SELF|syscall.IN_MOVE_SELF|syscall.IN_IGNORED) != 0:
+			if event.Wd == root {
+				gone = true
+			} else {
+				rescan = true
+			}
+		case event.Mask&syscall.IN_ISDIR != 0:
+			if event.Mask&syscall.IN_ATTRIB == 0 {
+				rescan = true
+			}
+		case event.Mask&syscall.IN_CREATE != 0:
+			// Files are picked up by IN_CLOSE_WRITE once written.
+		default:
+			dir, ok := dirs[event.Wd]
+			name := string(bytes.TrimRight(buffer[start:end], "\x00"))
+			if !ok || name == "" {
+				continue
+			}
+			name = path.Join(dir, name)
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	return names, rescan, gone
+}
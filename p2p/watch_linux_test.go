@@ -0,0 +1,64 @@
+package p2p
+
+import (
+	"reflect"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+// inotifyEvent encodes an inotify event as the kernel does, with the name
+// padded with NULs.
+func inotifyEvent(wd int32, mask uint32, name string) []byte {
+	size := 0
+	if name != "" {
+		size = (len(name)/16 + 1) * 16
+	}
+	buffer := make([]byte, syscall.SizeofInotifyEvent+size)
+	event := (*syscall.InotifyEvent)(unsafe.Pointer(&buffer[0]))
+	event.Wd, event.Mask, event.Len = wd, mask, uint32(size)
+	copy(buffer[syscall.SizeofInotifyEvent:], name)
+	return buffer
+}
+
+func TestParseInotify(t *testing.T) {
+	dirs := map[int32]string{1: "", 2: "docs"}
+	tests := []struct {
+		name       string
+		events     [][]byte
+		wantNames  []string
+		wantRescan bool
+		wantGone   bool
+	}{
+		{"written file", [][]byte{inotifyEvent(1, syscall.IN_CLOSE_WRITE, "a.txt")}, []string{"a.txt"}, false, false},
+		{"file in a subdirectory", [][]byte{inotifyEvent(2, syscall.IN_DELETE, "b.txt")}, []string{"docs/b.txt"}, false, false},
+		{"rename", [][]byte{
+			inotifyEvent(1, syscall.IN_MOVED_FROM, "a.txt"),
+			inotifyEvent(2, syscall.IN_MOVED_TO, "a.txt"),
+		}, []string{"a.txt", "docs/a.txt"}, false, false},
+		{"repeated events", [][]byte{
+			inotifyEvent(1, syscall.IN_CLOSE_WRITE, "a.txt"),
+			inotifyEvent(1, syscall.IN_ATTRIB, "a.txt"),
+		}, []string{"a.txt"}, false, false},
+		{"created file", [][]byte{inotifyEvent(1, syscall.IN_CREATE, "a.txt")}, nil, false, false},
+		{"new directory", [][]byte{inotifyEvent(1, syscall.IN_CREATE|syscall.IN_ISDIR, "new")}, nil, true, false},
+		{"directory attributes", [][]byte{inotifyEvent(1, syscall.IN_ATTRIB|syscall.IN_ISDIR, "docs")}, nil, false, false},
+		{"queue overflow", [][]byte{inotifyEvent(-1, syscall.IN_Q_OVERFLOW, "")}, nil, true, false},
+		{"subdirectory removed", [][]byte{inotifyEvent(2, syscall.IN_DELETE_SELF, "")}, nil, true, false},
+		{"folder removed", [][]byte{inotifyEvent(1, syscall.IN_DELETE_SELF, "")}, nil, false, true},
+		{"unknown watch", [][]byte{inotifyEvent(7, syscall.IN_CLOSE_WRITE, "a.txt")}, nil, false, false},
+		{"truncated event", [][]byte{inotifyEvent(1, syscall.IN_CLOSE_WRITE, "a.txt")[:syscall.SizeofInotifyEvent+4]}, nil, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buffer []byte
+			for _, event := range tt.events {
+				buffer = append(buffer, event...)
+			}
+			names, rescan, gone := parseInotify(buffer, 1, dirs)
+			if !reflect.DeepEqual(names, tt.wantNames) || rescan != tt.wantRescan || gone != tt.wantGone {
+				t.Errorf("got %v, rescan %v, gone %v; want %v, %v, %v", names, rescan, gone, tt.wantNames, tt.wantRescan, tt.wantGone)
+			}
+		})
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package p2p
+
+import "errors"
+
+// watchNative is only implemented with inotify on Linux; other platforms poll.
+func (w *FolderWatcher) watchNative(quit <-chan struct{}) error {
+	return errors.New("inotify not available on this platform")
+}
@@ -0,0 +1,210 @@
+package p2p
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// drain returns the events already delivered to a subscription.
+func drain(events <-chan FileEvent) []FileEvent {
+	var got []FileEvent
+	for {
+		select {
+		case event := <-events:
+			got = append(got, event)
+		default:
+			return got
+		}
+	}
+}
+
+// eventKinds reduces events to "type name" or "type old->name" for comparison.
+func eventKinds(events []FileEvent) []string {
+	var kinds []string
+	for _, event := range events {
+		kind := event.Type + " " + event.Name
+		if event.OldName != "" {
+			kind = event.Type + " " + event.OldName + "->" + event.Name
+		}
+		kinds = append(kinds, kind)
+	}
+	return kinds
+}
+
+func TestFolderWatcherScan(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(dir string)
+		want   []string
+	}{
+		{"nothing changed", func(dir string) {}, nil},
+		{"added", func(dir string) {
+			os.WriteFile(filepath.Join(dir, "new.txt"), []byte("new"), 0644)
+		}, []string{"added new.txt"}},
+		{"added in a subdirectory", func(dir string) {
+			os.MkdirAll(filepath.Join(dir, "docs"), 0755)
+			os.WriteFile(filepath.Join(dir, "docs", "new.txt"), []byte("new"), 0644)
+		}, []string{"added docs/new.txt"}},
+		{"modified", func(dir string) {
+			os.WriteFile(filepath.Join(dir, "a.txt"), []byte("changed"), 0644)
+		}, []string{"modified a.txt"}},
+		{"touched without a change", func(dir string) {
+			later := time.Now().Add(time.Minute)
+			os.Chtimes(filepath.Join(dir, "a.txt"), later, later)
+		}, nil},
+		{"removed", func(dir string) {
+			os.Remove(filepath.Join(dir, "a.txt"))
+		}, []string{"removed a.txt"}},
+		{"renamed", func(dir string) {
+			os.Rename(filepath.Join(dir, "a.txt"), filepath.Join(dir, "c.txt"))
+		}, []string{"renamed a.txt->c.txt"}},
+		{"removed and another added", func(dir string) {
+			os.Remove(filepath.Join(dir, "a.txt"))
+			os.WriteFile(filepath.Join(dir, "c.txt"), []byte("other"), 0644)
+		}, []string{"removed a.txt", "added c.txt"}},
+		{"hidden and partial files", func(dir string) {
+			os.WriteFile(filepath.Join(dir, ".upload"), []byte("x"), 0644)
+			os.WriteFile(filepath.Join(dir, "b.txt.partial"), []byte("x"), 0644)
+		}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			os.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0644)
+			os.WriteFile(filepath.Join(dir, "b.txt"), []byte("b"), 0644)
+			w := NewFolderWatcher(&SharedFolder{FolderPath: dir}, WatchOptions{})
+			w.scan(nil, false)
+			events, cancel := w.Subscribe()
+			defer cancel()
+
+			tt.change(dir)
+			w.scan(nil, true)
+			if got := eventKinds(drain(events)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("events %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVisibleEvent(t *testing.T) {
+	serveFolder(t, t.TempDir())
+	accessPolicy = &AccessPolicy{Files: map[string]FileRule{
+		"private/*": {Visibility: Private, AllowedPeers: []string{"alice"}},
+	}}
+
+	tests := []struct {
+		name        string
+		event       FileEvent
+		peerID      string
+		want        FileEvent
+		wantVisible bool
+	}{
+		{"public change", FileEvent{Type: FileModified, Name: "a.txt"}, "", FileEvent{Type: FileModified, Name: "a.txt"}, true},
+		{"private change", FileEvent{Type: FileAdded, Name: "private/a.txt"}, "", FileEvent{}, false},
+		{"private change to an allowed peer", FileEvent{Type: FileAdded, Name: "private/a.txt"}, "alice", FileEvent{Type: FileAdded, Name: "private/a.txt"}, true},
+		{"renamed into private", FileEvent{Type: FileRenamed, Name: "private/a.txt", OldName: "a.txt"}, "", FileEvent{Type: FileRemoved, Name: "a.txt"}, true},
+		{"renamed out of private", FileEvent{Type: FileRenamed, Name: "a.txt", OldName: "private/a.txt"}, "", FileEvent{Type: FileAdded, Name: "a.txt"}, true},
+		{"renamed within private", FileEvent{Type: FileRenamed, Name: "private/b.txt", OldName: "private/a.txt"}, "", FileEvent{}, false},
+		{"renamed within private for an allowed peer", FileEvent{Type: FileRenamed, Name: "private/b.txt", OldName: "private/a.txt"}, "alice", FileEvent{Type: FileRenamed, Name: "private/b.txt", OldName: "private/a.txt"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, visible := visibleEvent(tt.event, tt.peerID)
+			if visible != tt.wantVisible {
+				t.Fatalf("visible = %v, want %v", visible, tt.wantVisible)
+			}
+			if visible && got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSubscriberFallingBehind(t *testing.T) {
+	w := NewFolderWatcher(&SharedFolder{FolderPath: t.TempDir()}, WatchOptions{})
+	slow, cancelSlow := w.Subscribe()
+	defer cancelSlow()
+	for i := 0; i <= watchBuffer; i++ {
+		w.publish(FileEvent{Type: FileAdded, Name: "a.txt"})
+	}
+	received := 0
+	for range slow {
+		received++
+	}
+	if received != watchBuffer {
+		t.Errorf("received %d events before the subscription closed, want %d", received, watchBuffer)
+	}
+
+	events, cancel := w.Subscribe()
+	defer cancel()
+	w.stop()
+	if _, ok := <-events; ok {
+		t.Error("subscription still open after the watcher stopped")
+	}
+	if late, _ := w.Subscribe(); late != nil {
+		if _, ok := <-late; ok {
+			t.Error("subscribed to a stopped watcher")
+		}
+	}
+}
+
+func TestWatchPeer(t *testing.T) {
+	for _, poll := range []bool{true, false} {
+		name := "inotify"
+		if poll {
+			name = "polling"
+		}
+		t.Run(name, func(t *testing.T) {
+			shared := t.TempDir()
+			peer := serveFolder(t, shared)
+			w := NewFolderWatcher(servedFolder, WatchOptions{Poll: poll, PollInterval: 20 * time.Millisecond})
+			quit := make(chan struct{})
+			stopped := make(chan struct{})
+			go func() {
+				w.Run(quit)
+				close(stopped)
+			}()
+			previous := changeWatcher
+			UseWatcher(w)
+			t.Cleanup(func() {
+				close(quit)
+				<-stopped
+				changeWatcher = previous
+			})
+
+			// Changes made before the watcher's first scan are not announced,
+			// so wait until it reports one.
+			local, cancel := w.Subscribe()
+			for i := 0; ; i++ {
+				os.WriteFile(filepath.Join(shared, "a.txt"), []byte{byte(i)}, 0644)
+				select {
+				case <-local:
+				case <-time.After(50 * time.Millisecond):
+					continue
+				}
+				break
+			}
+			cancel()
+
+			files, events, err := WatchPeer(peer, quit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(files) != 1 || files[0].Name != "a.txt" {
+				t.Fatalf("listed %+v, want a.txt", files)
+			}
+			os.WriteFile(filepath.Join(shared, "b.txt"), []byte("b"), 0644)
+			select {
+			case event := <-events:
+				if event.Type != FileAdded || event.Name != "b.txt" || event.Hash != digest([]byte("b")) {
+					t.Errorf("got %+v, want b.txt added", event)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("no change announced")
+			}
+		})
+	}
+}